@@ -0,0 +1,466 @@
+// Command thermomatic-ctl administers a thermomatic server through its http
+// API, for operators who live in terminals.
+//
+// Usage:
+//
+//	thermomatic-ctl [flags] <command> [arguments]
+//
+// The commands are:
+//
+//	devices [-online=true|false]  list the devices that have connected
+//	status <imei>                 show the presence of a device
+//	reading <imei>                show the last reading of a device
+//	kick <imei>                   disconnect a device
+//	erase <imei>                  erase the data kept of a disconnected
+//	                              device
+//	quarantine                    list the quarantined devices
+//	quarantine clear <imei>       lift the quarantine of a device
+//	drain                         drain the server
+//	drain status                  show whether the server is draining
+//	tail [imei]                   print readings as they are received
+//	import <imei> <file>          backfill a device's history from a CSV or
+//	                              JSON lines file
+//	top [-interval=duration]      show a live dashboard of the devices
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/server"
+)
+
+// addr is the base URL of the thermomatic http server.
+var addr = flag.String("addr", env("THERMOMATIC_ADDR", "http://localhost:1338"), "base URL of the thermomatic http server; defaults to $THERMOMATIC_ADDR")
+
+// token is the bearer token of requests. Empty sends none.
+var token = flag.String("token", os.Getenv("THERMOMATIC_TOKEN"), "bearer token of requests; defaults to $THERMOMATIC_TOKEN")
+
+// errUsage indicates a command was invoked with invalid arguments.
+var errUsage = errors.New("invalid usage")
+
+// command is a thermomatic-ctl command, run with its arguments.
+type command func(args []string) error
+
+var commands = map[string]command{
+	"devices":    devices,
+	"status":     status,
+	"reading":    reading,
+	"kick":       kick,
+	"erase":      erase,
+	"quarantine": quarantine,
+	"drain":      drain,
+	"tail":       tail,
+	"import":     importReadings,
+	"top":        top,
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "thermomatic-ctl: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd(flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "thermomatic-ctl: %s\n", err)
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: thermomatic-ctl [flags] <command> [arguments]
+
+Commands:
+  devices [-online=true|false]  list the devices that have connected
+  status <imei>                 show the presence of a device
+  reading <imei>                show the last reading of a device
+  kick <imei>                   disconnect a device
+  erase <imei>                  erase the data kept of a disconnected
+                                device
+  quarantine                    list the quarantined devices
+  quarantine clear <imei>       lift the quarantine of a device
+  drain                         drain the server
+  drain status                  show whether the server is draining
+  tail [imei]                   print readings as they are received
+  import <imei> <file>          backfill a device's history from a CSV or
+                                JSON lines file
+  top [-interval=duration]      show a live dashboard of the devices
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+// env retrieves the environment variable key, or fallback if it is unset.
+func env(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+// devices lists the devices that have connected.
+func devices(args []string) error {
+	fs := flag.NewFlagSet("devices", flag.ContinueOnError)
+	online := fs.String("online", "", "only list devices that are online (true) or offline (false)")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w, err = %s", errUsage, err)
+	}
+	query := url.Values{}
+	if *online != "" {
+		query.Set("online", *online)
+	}
+
+	var response struct {
+		Devices []server.Presence
+	}
+	if err := do(http.MethodGet, "/v1/devices?"+query.Encode(), http.StatusOK, &response); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IMEI\tONLINE\tTENANT\tLAST SEEN\tPLACE")
+	for _, d := range response.Devices {
+		fmt.Fprintf(w, "%d\t%t\t%s\t%s\t%s\n", d.IMEI, d.Online, d.Tenant, d.LastSeen.Format(time.RFC3339), d.Place)
+	}
+	return w.Flush()
+}
+
+// status shows the presence of a device.
+func status(args []string) error {
+	imei, err := imeiArg(args)
+	if err != nil {
+		return err
+	}
+	var response json.RawMessage
+	if err := do(http.MethodGet, "/status/"+imei, http.StatusOK, &response); err != nil {
+		return err
+	}
+	return printJSON(response)
+}
+
+// reading shows the last reading of a device.
+func reading(args []string) error {
+	imei, err := imeiArg(args)
+	if err != nil {
+		return err
+	}
+	var response json.RawMessage
+	if err := do(http.MethodGet, "/readings/"+imei, http.StatusOK, &response); err != nil {
+		return err
+	}
+	return printJSON(response)
+}
+
+// kick disconnects a device.
+func kick(args []string) error {
+	imei, err := imeiArg(args)
+	if err != nil {
+		return err
+	}
+	if err := do(http.MethodDelete, "/devices/"+imei, http.StatusNoContent, nil); err != nil {
+		return err
+	}
+	fmt.Printf("kicked %s\n", imei)
+	return nil
+}
+
+// erase erases the data kept of a disconnected device, and prints the
+// records erased from each backend.
+func erase(args []string) error {
+	imei, err := imeiArg(args)
+	if err != nil {
+		return err
+	}
+	var receipt server.ErasureReceipt
+	if err := do(http.MethodDelete, "/v1/devices/"+imei+"/data", http.StatusOK, &receipt); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKEND\tRECORDS")
+	for _, backend := range receipt.Backends {
+		records := strconv.Itoa(backend.Records)
+		if backend.Unsupported {
+			records = "unsupported"
+		}
+		fmt.Fprintf(w, "%s\t%s\n", backend.Name, records)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("erased %s at %s\n", imei, receipt.ErasedAt.Format(time.RFC3339))
+	return nil
+}
+
+// quarantine lists the quarantined devices, or lifts the quarantine of one.
+func quarantine(args []string) error {
+	switch {
+	case len(args) == 0:
+		var response struct {
+			Quarantined []server.Quarantined
+		}
+		if err := do(http.MethodGet, "/admin/quarantine", http.StatusOK, &response); err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "IMEI\tUNTIL")
+		for _, q := range response.Quarantined {
+			fmt.Fprintf(w, "%d\t%s\n", q.IMEI, q.Until.Format(time.RFC3339))
+		}
+		return w.Flush()
+
+	case args[0] == "clear":
+		imei, err := imeiArg(args[1:])
+		if err != nil {
+			return err
+		}
+		if err := do(http.MethodDelete, "/admin/quarantine/"+imei, http.StatusNoContent, nil); err != nil {
+			return err
+		}
+		fmt.Printf("cleared quarantine of %s\n", imei)
+		return nil
+
+	default:
+		return fmt.Errorf("%w, quarantine [clear <imei>]", errUsage)
+	}
+}
+
+// drain drains the server, or shows whether it is draining.
+func drain(args []string) error {
+	switch {
+	case len(args) == 0:
+		if err := do(http.MethodPost, "/admin/drain", http.StatusAccepted, nil); err != nil {
+			return err
+		}
+		fmt.Println("draining")
+		return nil
+
+	case len(args) == 1 && args[0] == "status":
+		var response struct {
+			Draining bool
+		}
+		if err := do(http.MethodGet, "/admin/drain", http.StatusOK, &response); err != nil {
+			return err
+		}
+		fmt.Printf("draining: %t\n", response.Draining)
+		return nil
+
+	default:
+		return fmt.Errorf("%w, drain [status]", errUsage)
+	}
+}
+
+// tail prints readings, of every device or the one specified, as they are
+// received, until interrupted.
+func tail(args []string) error {
+	path := "/v1/readings/stream"
+	switch len(args) {
+	case 0:
+	case 1:
+		imei, err := imeiArg(args)
+		if err != nil {
+			return err
+		}
+		path += "?imei=" + imei
+	default:
+		return fmt.Errorf("%w, tail [imei]", errUsage)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return stream(ctx, path, func(live server.LiveReading) {
+		printReading(live.ReceivedAt, live.IMEI, live.Reading)
+	})
+}
+
+// stream calls fn with each reading streamed from the server's path, until
+// the stream ends or ctx is done.
+func stream(ctx context.Context, path string, fn func(server.LiveReading)) error {
+	req, err := request(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to stream/Do\terr = %w", err)
+	}
+	defer resp.Body.Close()
+	if err := check(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var live server.LiveReading
+		if err := json.Unmarshal([]byte(data), &live); err != nil {
+			return fmt.Errorf("failed to stream/Unmarshal\terr = %w", err)
+		}
+		fn(live)
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("failed to stream/Scan\terr = %w", err)
+	}
+	return nil
+}
+
+// importReadings backfills the history of a device with the readings of a
+// file, CSV if its extension is .csv and JSON lines otherwise. If any row is
+// invalid, nothing is imported, and the invalid rows are printed.
+func importReadings(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("%w, import <imei> <file>", errUsage)
+	}
+	imei, err := imeiArg(args[:1])
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(args[1])
+	if err != nil {
+		return fmt.Errorf("failed to importReadings/Open\terr = %w", err)
+	}
+	defer f.Close()
+
+	req, err := request(http.MethodPost, "/v1/import?imei="+imei, f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if strings.EqualFold(filepath.Ext(args[1]), ".csv") {
+		req.Header.Set("Content-Type", "text/csv")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to importReadings/Do\terr = %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest && resp.Header.Get("Content-Type") == "application/json" {
+		var response struct {
+			Errors []server.ImportError
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return fmt.Errorf("failed to importReadings/Decode\terr = %w", err)
+		}
+		for _, invalid := range response.Errors {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", args[1], invalid.Line, invalid.Error)
+		}
+		return fmt.Errorf("nothing imported, %d invalid rows reported", len(response.Errors))
+	}
+	if err := check(resp, http.StatusOK); err != nil {
+		return err
+	}
+	var response struct {
+		Imported int
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("failed to importReadings/Decode\terr = %w", err)
+	}
+	fmt.Printf("imported %d readings of %s\n", response.Imported, imei)
+	return nil
+}
+
+// printReading prints reading, received from imei at receivedAt, as a line.
+func printReading(receivedAt time.Time, imei uint64, r client.Reading) {
+	fmt.Printf(
+		"%s %d temperature=%g altitude=%g latitude=%g longitude=%g battery=%g\n",
+		receivedAt.Format(time.RFC3339Nano), imei, r.Temperature, r.Altitude, r.Latitude, r.Longitude, r.BatteryLevel)
+}
+
+// imeiArg retrieves the IMEI that is the only argument of args.
+func imeiArg(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("%w, expected an imei", errUsage)
+	}
+	if _, err := strconv.ParseUint(args[0], 10, 64); err != nil || len(args[0]) != 15 {
+		return "", fmt.Errorf("%w, invalid imei %q", errUsage, args[0])
+	}
+	return args[0], nil
+}
+
+// request initializes a request of the server's path with method and body.
+func request(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, strings.TrimSuffix(*addr, "/")+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request/NewRequest\terr = %w", err)
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	return req, nil
+}
+
+// do requests the server's path with method, failing unless it responds with
+// expected. The response body is decoded into v, unless v is nil.
+func do(method, path string, expected int, v interface{}) error {
+	req, err := request(method, path, nil)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to do/Do\terr = %w", err)
+	}
+	defer resp.Body.Close()
+	if err := check(resp, expected); err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to do/Decode\terr = %w", err)
+	}
+	return nil
+}
+
+// check fails unless resp has status expected, describing the response
+// otherwise.
+func check(resp *http.Response, expected int) error {
+	if resp.StatusCode == expected {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("%s %s: %s %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// printJSON prints the JSON b, indented.
+func printJSON(b json.RawMessage) error {
+	var out strings.Builder
+	enc := json.NewEncoder(&out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(b); err != nil {
+		return fmt.Errorf("failed to printJSON/Encode\terr = %w", err)
+	}
+	fmt.Print(out.String())
+	return nil
+}
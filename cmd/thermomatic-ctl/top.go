@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/server"
+)
+
+// maxDisconnects is the number of recent disconnects shown by top.
+const maxDisconnects = 5
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\x1b[H\x1b[2J"
+
+// top redraws a dashboard of each device's last reading, the rate readings
+// are received at, and recent disconnects every interval, until interrupted.
+func top(args []string) error {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	interval := fs.Duration("interval", 2*time.Second, "interval the dashboard is redrawn at")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w, err = %s", errUsage, err)
+	}
+	if *interval <= 0 || fs.NArg() != 0 {
+		return fmt.Errorf("%w, top [-interval=duration]", errUsage)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	d := newDashboard(time.Now())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- stream(ctx, "/v1/readings/stream", d.add)
+	}()
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		d.poll()
+		if _, err := os.Stdout.Write(d.render(time.Now())); err != nil {
+			return fmt.Errorf("failed to top/Write\terr = %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err == nil {
+				err = errors.New("stream of readings ended")
+			}
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// dashboard is the state drawn by top: the devices, their readings streamed
+// since top started, and their disconnects observed since.
+type dashboard struct {
+	mu      sync.Mutex
+	devices map[uint64]*dashboardDevice
+
+	// readings is the number of readings received since top started, and
+	// window the number received since windowStart, when the dashboard was
+	// last drawn.
+	readings    int
+	window      int
+	windowStart time.Time
+
+	// disconnects are the most recent disconnects, newest first, and
+	// disconnected their number.
+	disconnects  []disconnect
+	disconnected int
+
+	// err is the error of the last poll of the devices, if any.
+	err error
+}
+
+// dashboardDevice is a device drawn by top.
+type dashboardDevice struct {
+	presence server.Presence
+	polled   bool
+
+	// last is the device's last reading, if readings is non-zero.
+	last     server.LiveReading
+	readings int
+}
+
+// disconnect is a device going offline.
+type disconnect struct {
+	IMEI   uint64
+	At     time.Time
+	Reason client.CloseReason
+}
+
+func newDashboard(now time.Time) *dashboard {
+	return &dashboard{
+		devices:     make(map[uint64]*dashboardDevice),
+		windowStart: now,
+	}
+}
+
+// device retrieves the device of imei, adding it if missing. d.mu must be
+// held.
+func (d *dashboard) device(imei uint64) *dashboardDevice {
+	device, ok := d.devices[imei]
+	if !ok {
+		device = &dashboardDevice{presence: server.Presence{IMEI: imei, Online: true}}
+		d.devices[imei] = device
+	}
+	return device
+}
+
+// add records a streamed reading.
+func (d *dashboard) add(live server.LiveReading) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	device := d.device(live.IMEI)
+	device.last = live
+	device.readings++
+	d.readings++
+	d.window++
+}
+
+// poll retrieves the presence of the devices, recording those that went
+// offline since the last poll as disconnects.
+func (d *dashboard) poll() {
+	var response struct {
+		Devices []server.Presence
+	}
+	err := do(http.MethodGet, "/v1/devices", http.StatusOK, &response)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.err = err
+	if err != nil {
+		return
+	}
+	for _, presence := range response.Devices {
+		device := d.device(presence.IMEI)
+		if device.polled && device.presence.Online && !presence.Online {
+			at := time.Now()
+			if presence.OfflineSince != nil {
+				at = *presence.OfflineSince
+			}
+			d.disconnected++
+			d.disconnects = append([]disconnect{{IMEI: presence.IMEI, At: at, Reason: presence.CloseReason}}, d.disconnects...)
+			if len(d.disconnects) > maxDisconnects {
+				d.disconnects = d.disconnects[:maxDisconnects]
+			}
+		}
+		device.presence, device.polled = presence, true
+	}
+}
+
+// render draws the dashboard at now, starting a new window of the ingest
+// rate.
+func (d *dashboard) render(now time.Time) []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var rate float64
+	if elapsed := now.Sub(d.windowStart).Seconds(); elapsed > 0 {
+		rate = float64(d.window) / elapsed
+	}
+	d.window, d.windowStart = 0, now
+
+	imeis := make([]uint64, 0, len(d.devices))
+	online := 0
+	for imei, device := range d.devices {
+		imeis = append(imeis, imei)
+		if device.presence.Online {
+			online++
+		}
+	}
+	sort.Slice(imeis, func(i, j int) bool { return imeis[i] < imeis[j] })
+
+	var b bytes.Buffer
+	b.WriteString(clearScreen)
+	fmt.Fprintf(&b, "thermomatic-ctl top  %s  %s\n", *addr, now.Format(time.RFC3339))
+	fmt.Fprintf(
+		&b, "devices: %d online, %d total  ingest: %.1f readings/s  readings: %d  disconnects: %d\n",
+		online, len(d.devices), rate, d.readings, d.disconnected)
+	if d.err != nil {
+		fmt.Fprintf(&b, "error: %s\n", d.err)
+	}
+	b.WriteString("\n")
+
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IMEI\tONLINE\tTEMPERATURE\tBATTERY\tREADINGS\tLAST READING")
+	for _, imei := range imeis {
+		device := d.devices[imei]
+		if device.readings == 0 {
+			fmt.Fprintf(w, "%d\t%t\t-\t-\t0\t-\n", imei, device.presence.Online)
+			continue
+		}
+		fmt.Fprintf(
+			w, "%d\t%t\t%.2f\t%.0f%%\t%d\t%s ago\n",
+			imei, device.presence.Online, device.last.Reading.Temperature, device.last.Reading.BatteryLevel,
+			device.readings, now.Sub(device.last.ReceivedAt).Round(time.Second))
+	}
+	w.Flush()
+
+	if len(d.disconnects) > 0 {
+		b.WriteString("\nRecent disconnects:\n")
+		w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+		for _, dc := range d.disconnects {
+			fmt.Fprintf(w, "  %d\t%s\t%s\n", dc.IMEI, dc.At.Format(time.TimeOnly), dc.Reason)
+		}
+		w.Flush()
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"errors"
+)
+
+// ErrUnknownFrame indicates a frame's type is not recognized.
+var ErrUnknownFrame = errors.New("unknown frame type")
+
+// NackCode identifies why an uplink frame was rejected in acknowledged mode.
+type NackCode byte
+
+const (
+	// NackInternal rejects a frame the server failed to process for a reason
+	// not described by another NackCode.
+	NackInternal NackCode = 0x00
+
+	// NackShortFrame rejects a frame whose payload is too short for its type.
+	NackShortFrame NackCode = 0x01
+
+	// NackUnknownFrame rejects a frame of unknown type.
+	NackUnknownFrame NackCode = 0x02
+
+	// NackNoBaseReading rejects a delta frame received before any reading on
+	// the connection. The device should send a full reading.
+	NackNoBaseReading NackCode = 0x03
+
+	// NackInvalidDelta rejects a delta frame whose payload does not match its
+	// field mask.
+	NackInvalidDelta NackCode = 0x04
+
+	// NackLongFrame rejects a frame whose payload is too long for its type.
+	NackLongFrame NackCode = 0x05
+
+	// NackInvalidTemperature through NackInvalidBatteryLevel reject a reading
+	// whose field is out of range, or NaN.
+	NackInvalidTemperature  NackCode = 0x10
+	NackInvalidAltitude     NackCode = 0x11
+	NackInvalidLatitude     NackCode = 0x12
+	NackInvalidLongitude    NackCode = 0x13
+	NackInvalidBatteryLevel NackCode = 0x14
+
+	// NackQuotaExceeded rejects a reading as the tenant of the device exceeded
+	// its reading rate limit. The device should back off before resending.
+	NackQuotaExceeded NackCode = 0x20
+)
+
+// nackRanges maps the Reading fields of ErrInvalidRange to their NackCode.
+var nackRanges = map[string]NackCode{
+	"Temperature":  NackInvalidTemperature,
+	"Altitude":     NackInvalidAltitude,
+	"Latitude":     NackInvalidLatitude,
+	"Longitude":    NackInvalidLongitude,
+	"BatteryLevel": NackInvalidBatteryLevel,
+}
+
+// Nack retrieves the NackCode describing err.
+func Nack(err error) NackCode {
+	var invalid ErrInvalidRange
+	switch {
+	case errors.Is(err, ErrShortFrame):
+		return NackShortFrame
+	case errors.Is(err, ErrLongFrame):
+		return NackLongFrame
+	case errors.Is(err, ErrUnknownFrame):
+		return NackUnknownFrame
+	case errors.Is(err, ErrNoBaseReading):
+		return NackNoBaseReading
+	case errors.Is(err, ErrInvalidDelta):
+		return NackInvalidDelta
+	case errors.Is(err, ErrQuotaExceeded):
+		return NackQuotaExceeded
+	case errors.As(err, &invalid):
+		if code, ok := nackRanges[invalid.Field]; ok {
+			return code
+		}
+	}
+	return NackInternal
+}
+
+// acknowledge answers the frame most recently processed, where err is the
+// result of processing it, if the Client is in acknowledged mode.
+func (c Client) acknowledge(err error) error {
+	if !c.acknowledged {
+		return nil
+	}
+	if err == nil {
+		return c.writeFrame(FrameReadingAck, nil)
+	}
+	return c.writeFrame(FrameNack, []byte{byte(Nack(err))})
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestNack(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Err      error
+		Expected NackCode
+	}{
+		{
+			Name:     "short frame",
+			Err:      fmt.Errorf("%w, length = %d", ErrShortFrame, 3),
+			Expected: NackShortFrame,
+		},
+		{
+			Name:     "long frame",
+			Err:      fmt.Errorf("%w, length = %d", ErrLongFrame, 41),
+			Expected: NackLongFrame,
+		},
+		{
+			Name:     "unknown frame",
+			Err:      ErrUnknownFrame,
+			Expected: NackUnknownFrame,
+		},
+		{
+			Name:     "invalid latitude",
+			Err:      ErrInvalidRange{Field: "Latitude", Value: 91},
+			Expected: NackInvalidLatitude,
+		},
+		{
+			Name:     "quota exceeded",
+			Err:      ErrQuotaExceeded,
+			Expected: NackQuotaExceeded,
+		},
+		{
+			Name:     "unrecognized error",
+			Err:      errors.New("disk full"),
+			Expected: NackInternal,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if actual := Nack(test.Err); actual != test.Expected {
+				t.Errorf("expected %#x, actual = %#x", test.Expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/common"
+	"github.com/tjper/thermomatic/internal/metrics"
+)
+
+// asyncBatchSize is the maximum number of readings written to the output of an
+// AsyncReadingLogger in a single write.
+const asyncBatchSize = 256
+
+// record is a reading queued by an AsyncReadingLogger.
+type record struct {
+	receivedAt int64
+	imei       uint64
+	reading    Reading
+}
+
+// AsyncReadingLogger logs readings on its own goroutine, decoupling the
+// reading hot path from slow log sinks. Readings are queued in a bounded
+// buffer and written in batches; readings received while the buffer is full
+// are dropped and counted.
+type AsyncReadingLogger struct {
+	out     io.Writer
+	queue   chan record
+	dropped *metrics.Counter
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewAsyncReadingLogger initializes an AsyncReadingLogger writing to out, with
+// a buffer of size readings. Dropped readings are counted by dropped. Run must
+// be called to begin writing.
+func NewAsyncReadingLogger(out io.Writer, size int, dropped *metrics.Counter) *AsyncReadingLogger {
+	return &AsyncReadingLogger{
+		out:     out,
+		queue:   make(chan record, size),
+		dropped: dropped,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// LogReading queues the reading with the UnixNano time it was received, and
+// the reading device's IMEI. It satisfies the function signature accepted by
+// WithLogReading, and only queues the reading if logger is enabled.
+func (l *AsyncReadingLogger) LogReading(logger *common.LevelLogger, imei uint64, receivedAt time.Time, reading Reading) {
+	if !logger.Enabled() {
+		return
+	}
+	select {
+	case l.queue <- record{receivedAt: receivedAt.UnixNano(), imei: imei, reading: reading}:
+	default:
+		l.dropped.Inc()
+	}
+}
+
+// Len retrieves the number of readings queued.
+func (l *AsyncReadingLogger) Len() int {
+	return len(l.queue)
+}
+
+// Run writes queued readings in batches until Close is called.
+func (l *AsyncReadingLogger) Run() {
+	defer close(l.done)
+
+	var buf bytes.Buffer
+	for {
+		select {
+		case <-l.stop:
+			for {
+				if l.batch(&buf) == 0 {
+					return
+				}
+			}
+		case r := <-l.queue:
+			buf.Reset()
+			write(&buf, r)
+			l.drain(&buf, asyncBatchSize-1)
+			_, _ = l.out.Write(buf.Bytes())
+		}
+	}
+}
+
+// Close stops Run after writing all queued readings.
+func (l *AsyncReadingLogger) Close() {
+	close(l.stop)
+	<-l.done
+}
+
+// batch writes up to asyncBatchSize queued readings, and returns the number
+// written.
+func (l *AsyncReadingLogger) batch(buf *bytes.Buffer) int {
+	buf.Reset()
+	n := l.drain(buf, asyncBatchSize)
+	if n > 0 {
+		_, _ = l.out.Write(buf.Bytes())
+	}
+	return n
+}
+
+// drain formats up to max queued readings into buf without blocking, and
+// returns the number formatted.
+func (l *AsyncReadingLogger) drain(buf *bytes.Buffer, max int) int {
+	for i := 0; i < max; i++ {
+		select {
+		case r := <-l.queue:
+			write(buf, r)
+		default:
+			return i
+		}
+	}
+	return max
+}
+
+func write(buf *bytes.Buffer, r record) {
+	fmt.Fprintf(buf, "%d,%d,%s\n", r.receivedAt, r.imei, r.reading)
+}
@@ -0,0 +1,80 @@
+package client_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/common"
+	"github.com/tjper/thermomatic/internal/metrics"
+)
+
+func TestAsyncReadingLogger(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Size     int
+		Readings int
+		Level    common.Level
+		Logged   int
+		Dropped  int64
+	}{
+		{
+			Name:     "all logged",
+			Size:     10,
+			Readings: 10,
+			Level:    common.LevelDebug,
+			Logged:   10,
+		},
+		{
+			Name:     "buffer full",
+			Size:     4,
+			Readings: 10,
+			Level:    common.LevelDebug,
+			Logged:   4,
+			Dropped:  6,
+		},
+		{
+			Name:     "level disabled",
+			Size:     10,
+			Readings: 10,
+			Level:    common.LevelInfo,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var (
+				out     bytes.Buffer
+				dropped metrics.Counter
+			)
+			l := client.NewAsyncReadingLogger(&out, test.Size, &dropped)
+			logger := common.NewLevelLogger(
+				common.NewStdLogger(&out, "", 0),
+				common.LevelDebug,
+				common.NewLevelVar(test.Level))
+
+			// Readings are queued before Run is called, so the buffer fills
+			// deterministically.
+			for i := 0; i < test.Readings; i++ {
+				l.LogReading(logger, 490154203237518, time.Unix(1, int64(i)), client.Reading{Temperature: float64(i)})
+			}
+			if queued := l.Len(); queued != test.Logged {
+				t.Errorf("expected %d readings queued, actual = %d", test.Logged, queued)
+			}
+			go l.Run()
+			l.Close()
+
+			if lines := strings.Count(out.String(), "\n"); lines != test.Logged {
+				t.Errorf("expected %d readings logged, actual = %d", test.Logged, lines)
+			}
+			if test.Logged > 0 && !strings.HasPrefix(out.String(), "1000000000,490154203237518,0,") {
+				t.Errorf("expected the first reading logged with its receive time, actual = %q", out.String())
+			}
+			if dropped.Value() != test.Dropped {
+				t.Errorf("expected %d readings dropped, actual = %d", test.Dropped, dropped.Value())
+			}
+		})
+	}
+}
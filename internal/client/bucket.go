@@ -0,0 +1,40 @@
+package client
+
+import "time"
+
+// bucket is a token bucket rate limiter. Tokens are refilled lazily as they
+// are reserved, so a bucket requires no goroutine. A bucket is not concurrent
+// safe.
+type bucket struct {
+	interval time.Duration
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// newBucket initializes a full bucket holding up to capacity tokens, refilled
+// at a rate of one token per interval.
+func newBucket(interval time.Duration, capacity int) *bucket {
+	return &bucket{
+		interval: interval,
+		capacity: float64(capacity),
+		tokens:   float64(capacity),
+		last:     time.Now(),
+	}
+}
+
+// take takes a token from the bucket at time now, and reports whether one was
+// available.
+func (b *bucket) take(now time.Time) bool {
+	b.tokens += float64(now.Sub(b.last)) / float64(b.interval)
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,32 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketTake(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		Name     string
+		At       time.Duration
+		Expected bool
+	}{
+		{Name: "full bucket", At: 0, Expected: true},
+		{Name: "last token", At: 0, Expected: true},
+		{Name: "empty bucket", At: 0, Expected: false},
+		{Name: "partially refilled", At: 50 * time.Millisecond, Expected: false},
+		{Name: "refilled token", At: 100 * time.Millisecond, Expected: true},
+		{Name: "refilled to capacity", At: time.Second, Expected: true},
+	}
+
+	b := newBucket(100*time.Millisecond, 2)
+	b.last = start
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if actual := b.take(start.Add(test.At)); actual != test.Expected {
+				t.Fatalf("expected = %t, actual = %t", test.Expected, actual)
+			}
+		})
+	}
+}
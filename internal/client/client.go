@@ -11,10 +11,13 @@ import (
 	"log"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/tjper/thermomatic/internal/common"
 	"github.com/tjper/thermomatic/internal/imei"
+	"github.com/tjper/thermomatic/internal/metrics"
+	"github.com/tjper/thermomatic/internal/trace"
 )
 
 var (
@@ -26,89 +29,169 @@ var (
 
 	// ErrClientClose indicates the client was closed.
 	ErrClientClose = errors.New("client closed")
-)
 
-const (
-	login = "login"
+	// ErrClientQuarantined indicates the client was closed after sending too
+	// many consecutive readings that failed to decode.
+	ErrClientQuarantined = errors.New("client quarantined")
 )
 
 // Client is a thermomatic client.
 type Client struct {
 	net.Conn
 
-	imei        common.Uint64Holder
-	createdAt   common.TimeHolder
-	lastReadAt  common.TimeHolder
-	lastReading ReadingHolder
+	imei        common.Holder[uint64]
+	remoteAddr  string
+	listener    string
+	tls         *TLSState
+	tenant      string
+	createdAt   common.Holder[time.Time]
+	lastReadAt  common.Holder[time.Time]
+	lastReading common.Holder[Reading]
 	logReading  logReadingFunc
-
-	logInfo  *log.Logger
-	logError *log.Logger
-
-	toShutdown chan struct{}
-	done       chan struct{}
+	metrics     *metrics.Metrics
+	stats       *stats
+	meta        *meta
+	stream      *decompressingConn
+	downlink    *downlink
+	config      *configState
+	transfers   *Transfers
+	workers     *WorkerPool
+	tunables    *Tunables
+	resumptions *Resumptions
+	resumption  common.Holder[*suspended]
+
+	decodeFailureLimit int
+	acknowledged       bool
+	tracer             *trace.Tracer
+	readingStores      []ReadingStore
+	allowsProtocol     func(Protocol) bool
+	validateReading    ReadingValidator
+
+	tenantOf       TenantResolver
+	tenantLoggers  map[string]*common.LevelLogger
+	tenantReadings *metrics.Counter
+	tenantLimits   map[string]*RateLimit
+	readingLimit   *RateLimit
+
+	closeReason common.Holder[CloseReason]
+	closeOnce   *sync.Once
+
+	logDebug *common.LevelLogger
+	logInfo  *common.LevelLogger
+	logWarn  *common.LevelLogger
+	logError *common.LevelLogger
+
+	done chan struct{}
 }
 
 // New initializes a Client object with the passed net.Conn. On success, the
 // a Client reference, and a nil error is returned. On failure a nil Client
 // reference, and an error is returned.
 func New(ctx context.Context, conn net.Conn, options ...ClientOption) (*Client, error) {
+	raw := conn
+	conn = injectFaults(conn)
 	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
-		return nil, fmt.Errorf("failed to client.New/SetReadDeadline\terr = %s", err)
+		return nil, fmt.Errorf("failed to client.New/SetReadDeadline\terr = %w", err)
 	}
 
 	b := make([]byte, 15)
-	if _, err := io.ReadFull(conn, b); err != nil {
-		return nil, fmt.Errorf("failed to client.New/ReadFull\tb = \"%s\" err = %s", b, err)
+	n, err := io.ReadFull(conn, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to client.New/ReadFull\tb = \"%s\" err = %w", b, err)
 	}
 	imei, err := imei.Decode(b)
 	if err != nil {
-		return nil, fmt.Errorf("failed to client.New/Decode\tb = \"%s\" err = %s", b, err)
+		return nil, fmt.Errorf("failed to client.New/Decode\tb = \"%s\" err = %w", b, err)
 	}
 
+	c := newClient(conn, imei, tlsStateOf(raw), options)
+	c.stats.bytesRead.Add(int64(n))
+	c.metrics.BytesRead.Add(int64(n))
+
+	c.logInfo.Printf("[IMEI %d] Connection Established\n", c.IMEI())
+	return c, nil
+}
+
+// newClient initializes a Client for the device imei connected via conn,
+// applying options.
+func newClient(conn net.Conn, imei uint64, tls *TLSState, options []ClientOption) *Client {
+	level := common.NewLevelVar(common.LevelInfo)
 	c := &Client{
 		Conn:        conn,
-		imei:        common.NewUint64Holder(imei),
-		createdAt:   common.NewTimeHolder(time.Now()),
-		lastReadAt:  common.NewTimeHolder(time.Now()),
-		lastReading: NewReadingHolder(Reading{}),
+		imei:        common.NewHolder(imei),
+		remoteAddr:  conn.RemoteAddr().String(),
+		tls:         tls,
+		createdAt:   common.NewHolder(time.Now()),
+		lastReadAt:  common.NewHolder(time.Now()),
+		lastReading: common.NewHolder(Reading{}),
 		logReading:  LogReadingWithUnixNano,
-
-		logInfo:  log.New(os.Stdout, "", log.LstdFlags),
-		logError: log.New(os.Stderr, "", log.LstdFlags),
-
-		toShutdown: make(chan struct{}, 7),
-		done:       make(chan struct{}),
+		metrics:     metrics.New(),
+		stats:       newStats(),
+		meta:        new(meta),
+		downlink:    newDownlink(),
+		config:      new(configState),
+		transfers:   NewTransfers(),
+		tunables:    NewTunables(),
+		resumption:  common.NewHolder[*suspended](nil),
+
+		logDebug: common.NewLevelLogger(common.NewStdLogger(os.Stdout, "", log.LstdFlags), common.LevelDebug, level),
+		logInfo:  common.NewLevelLogger(common.NewStdLogger(os.Stdout, "", log.LstdFlags), common.LevelInfo, level),
+		logWarn:  common.NewLevelLogger(common.NewStdLogger(os.Stderr, "", log.LstdFlags), common.LevelWarn, level),
+		logError: common.NewLevelLogger(common.NewStdLogger(os.Stderr, "", log.LstdFlags), common.LevelError, level),
+
+		closeReason: common.NewHolder(CloseNone),
+		closeOnce:   new(sync.Once),
+		done:        make(chan struct{}),
 	}
 
 	for _, option := range options {
 		option(c)
 	}
-	go c.moderator()
-
-	c.logInfo.Printf("[IMEI %d] Connection Established\n", c.IMEI())
-	return c, nil
-}
-
-func (c Client) moderator() {
-	<-c.toShutdown
-	close(c.done)
+	if c.tenantOf != nil {
+		c.tenant = c.tenantOf(imei, c.tls)
+	}
+	if c.tenant != "" {
+		c.tenantReadings = c.metrics.TenantReadings.Counter(c.tenant)
+		c.readingLimit = c.tenantLimits[c.tenant]
+	}
+	c.stream = &decompressingConn{Conn: &countingConn{Conn: conn, stats: c.stats, metrics: c.metrics}}
+	c.Conn = c.stream
+	return c
 }
 
 // LogReading logs the reading with the reading device's IMEI.
-func LogReading(logger *log.Logger, imei uint64, reading Reading) {
+func LogReading(logger *common.LevelLogger, imei uint64, _ time.Time, reading Reading) {
 	logger.Printf("%d,%s\n", imei, reading)
 }
 
-// LogReadingWithUnixNano logs the reading with the current UnixNano time, and
-// the reading device's IMEI.
-func LogReadingWithUnixNano(logger *log.Logger, imei uint64, reading Reading) {
-	logger.Printf("%d,%d,%s\n", time.Now().UnixNano(), imei, reading)
+// LogReadingWithUnixNano logs the reading with the UnixNano time it was
+// received, and the reading device's IMEI.
+func LogReadingWithUnixNano(logger *common.LevelLogger, imei uint64, receivedAt time.Time, reading Reading) {
+	logger.Printf("%d,%d,%s\n", receivedAt.UnixNano(), imei, reading)
 }
 
-// toClose releases all Client sub-processes and resources.
-func (c Client) shutdown() {
-	c.toShutdown <- struct{}{}
+// interruptReads closes the Client with CloseServerShutdown once ctx is done,
+// interrupting any read in progress. The returned func stops the interruption
+// from happening.
+func (c Client) interruptReads(ctx context.Context) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		c.Close(CloseServerShutdown)
+	})
+}
+
+// closed reports whether ctx is done or the Client has been closed, in which
+// case a failed read was interrupted. If ctx is done, the Client is closed
+// with CloseServerShutdown.
+func (c Client) closed(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		c.Close(CloseServerShutdown)
+		return true
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
 }
 
 // IMEI is a getter for the client's IMEI.
@@ -116,108 +199,483 @@ func (c Client) IMEI() uint64 {
 	return c.imei.Get()
 }
 
+// LastReadingAt retrieves when the Client's last reading was received. The
+// zero Time is returned if it has not sent one.
+func (c Client) LastReadingAt() time.Time {
+	if !c.hasReading() {
+		return time.Time{}
+	}
+	return c.lastReadAt.Get()
+}
+
+// LastSeen retrieves when the Client last sent a reading, or connected if it
+// has not sent one.
+func (c Client) LastSeen() time.Time {
+	return c.lastReadAt.Get()
+}
+
 // LastReading is a getter for the Client's most recent reading.
 func (c Client) LastReading() Reading {
 	return c.lastReading.Get()
 }
 
+// Protocol retrieves the protocol version negotiated at login. Zero is
+// returned if the Client has not logged in.
+func (c Client) Protocol() Protocol {
+	return c.meta.getProtocol()
+}
+
+// Compression retrieves the stream compression negotiated at login.
+func (c Client) Compression() Compression {
+	return c.meta.getCompression()
+}
+
+// Firmware retrieves the firmware version reported at login. An empty string
+// is returned if the device did not report one.
+func (c Client) Firmware() string {
+	return c.meta.getFirmware()
+}
+
+// Stats retrieves a snapshot of the Client's statistics. Byte rates are
+// averaged over the lifetime of the connection.
+func (c Client) Stats() Stats {
+	connectedAt := c.createdAt.Get()
+	elapsed := time.Since(connectedAt).Seconds()
+	bytesRead := c.stats.bytesRead.Value()
+	bytesWritten := c.stats.bytesWritten.Value()
+	return Stats{
+		ConnectedAt:           connectedAt,
+		BytesRead:             bytesRead,
+		BytesWritten:          bytesWritten,
+		BytesReadPerSecond:    float64(bytesRead) / elapsed,
+		BytesWrittenPerSecond: float64(bytesWritten) / elapsed,
+		Readings:              c.stats.readings.Value(),
+		DecodeErrors:          c.stats.decodeErrors.Value(),
+		RateLimitStalls:       c.stats.rateLimitStalls.Value(),
+		ReadingIntervals:      c.stats.intervals.Snapshot(),
+		Alarms:                c.stats.alarms.Value(),
+		QuotaRejections:       c.stats.quotaRejections.Value(),
+	}
+}
+
 // ProcessLogin authorizes the Client connection by ensuring TCP message
-// following IMEI message, has a "login" payload. On success, a nil error is
+// following IMEI message, has a "login" payload, or a "logv2" payload for
+// protocol v2 devices. On success, a nil error is
 // returned. On failure, a non-nil error is returned.
-func (c Client) ProcessLogin(ctx context.Context) error {
+func (c Client) ProcessLogin(ctx context.Context) (err error) {
+	_, span := c.tracer.Start(ctx, "login", trace.KindInternal)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	stop := c.interruptReads(ctx)
+	defer stop()
+
 	b := make([]byte, 5)
 	for {
-		select {
-		case <-ctx.Done():
-			return ErrClientClose
-		case <-c.done:
+		_, err := io.ReadFull(c.Conn, b)
+		if err != nil && err != io.EOF && c.closed(ctx) {
 			return ErrClientClose
-		default:
-			_, err := io.ReadFull(c.Conn, b)
-			if err, ok := err.(net.Error); ok && err.Timeout() {
-				c.logError.Printf("[IMEI %d] Login Window Expired\n", c.IMEI())
-				c.shutdown()
-				return ErrClientLoginWindowExpired
-			}
-			if err == io.EOF {
-				continue
-			}
-			if err != nil {
-				c.shutdown()
-				return fmt.Errorf("[IMEI %d] failed to client.ProcessLogin/ReadFull\tb = % x, err = %s", c.IMEI(), b, err)
-			}
-			if err := c.Conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
-				c.shutdown()
-				return fmt.Errorf("[IMEI %d] failed to client.ProcessLogin/SetReadDeadline\terr = %s", c.IMEI(), err)
+		}
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			c.logWarn.Printf("[IMEI %d] Login Window Expired\n", c.IMEI())
+			c.Close(CloseLoginExpired)
+			return ErrClientLoginWindowExpired
+		}
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			c.Close(closeReasonOf(err))
+			return fmt.Errorf("[IMEI %d] failed to client.ProcessLogin/ReadFull\tb = % x, err = %w", c.IMEI(), b, err)
+		}
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.tunables.ReadingTimeout())); err != nil {
+			if c.closed(ctx) {
+				return ErrClientClose
 			}
+			c.Close(CloseError)
+			return fmt.Errorf("[IMEI %d] failed to client.ProcessLogin/SetReadDeadline\terr = %w", c.IMEI(), err)
+		}
+		break
+	}
 
-			if !bytes.Equal([]byte(login), b) {
-				c.shutdown()
-				return ErrClientUnauthorized
+	switch {
+	case bytes.Equal([]byte(loginV1), b):
+		c.meta.setProtocol(ProtocolV1)
+	case bytes.Equal([]byte(loginV2), b):
+		c.meta.setProtocol(ProtocolV2)
+	case bytes.Equal([]byte(loginV2Firmware), b):
+		c.meta.setProtocol(ProtocolV2)
+		if err := c.readFirmware(); err != nil {
+			c.Close(closeReasonOf(err))
+			return err
+		}
+	case bytes.Equal([]byte(loginV2Compress), b):
+		c.meta.setProtocol(ProtocolV2)
+		if err := c.readCompression(); err != nil {
+			if errors.Is(err, ErrUnsupportedCompression) {
+				c.Close(CloseUnauthorized)
+			} else {
+				c.Close(closeReasonOf(err))
 			}
-			c.logInfo.Printf("[IMEI %d] Logged-In\n", c.IMEI())
-			return nil
+			return err
 		}
+	default:
+		c.Close(CloseUnauthorized)
+		return ErrClientUnauthorized
+	}
+	if c.allowsProtocol != nil && !c.allowsProtocol(c.Protocol()) {
+		c.Close(CloseUnauthorized)
+		return fmt.Errorf("[IMEI %d] failed to client.ProcessLogin\tprotocol = %d, err = %w", c.IMEI(), c.Protocol(), ErrClientUnauthorized)
+	}
+	c.logInfo.Printf("[IMEI %d] Logged-In\n", c.IMEI())
+	return nil
+}
+
+// readFirmware reads the length-prefixed firmware version following a
+// "logfw" login.
+func (c Client) readFirmware() error {
+	var size [1]byte
+	if _, err := io.ReadFull(c.Conn, size[:]); err != nil {
+		return fmt.Errorf("[IMEI %d] failed to client.readFirmware/ReadFull\terr = %w", c.IMEI(), err)
+	}
+	firmware := make([]byte, size[0])
+	if _, err := io.ReadFull(c.Conn, firmware); err != nil {
+		return fmt.Errorf("[IMEI %d] failed to client.readFirmware/ReadFull\terr = %w", c.IMEI(), err)
+	}
+	c.meta.setFirmware(string(firmware))
+	c.logInfo.Printf("[IMEI %d] Firmware %q\n", c.IMEI(), firmware)
+	return nil
+}
+
+// readCompression reads the Compression following a "logcz" login, and
+// decompresses the Client's subsequent reads per it.
+func (c Client) readCompression() error {
+	var compression [1]byte
+	if _, err := io.ReadFull(c.Conn, compression[:]); err != nil {
+		return fmt.Errorf("[IMEI %d] failed to client.readCompression/ReadFull\terr = %w", c.IMEI(), err)
+	}
+	if err := c.stream.decompress(Compression(compression[0])); err != nil {
+		return fmt.Errorf("[IMEI %d] failed to client.readCompression/decompress\terr = %w", c.IMEI(), err)
 	}
+	c.meta.setCompression(Compression(compression[0]))
+	c.logInfo.Printf("[IMEI %d] Compression %s\n", c.IMEI(), Compression(compression[0]))
+	return nil
 }
 
 // ProcessReadings process incoming "Reading" TCP messages for the Client.
+// Protocol v2 clients send readings within frames.
 func (c Client) ProcessReadings(ctx context.Context) error {
-	read := time.NewTicker(time.Duration(25 * time.Millisecond))
-	defer read.Stop()
+	if c.Protocol() == ProtocolV2 {
+		return c.processFrames(ctx)
+	}
 
-	b := make([]byte, 40)
-	var reading Reading
+	stop := c.interruptReads(ctx)
+	defer stop()
+
+	s := NewSession()
+	scratch := readingBufPool.Get().(*[readingSize]byte)
+	defer readingBufPool.Put(scratch)
 	for {
-		select {
-		case <-c.done:
-			return ErrClientClose
-		default:
+		if finished, err := c.nextReading(ctx, s, c.Conn, scratch[:]); finished {
+			return err
 		}
-		select {
-		case <-ctx.Done():
-			return ErrClientClose
-		default:
+	}
+}
+
+// processFrames processes incoming protocol v2 frames for the Client.
+func (c Client) processFrames(ctx context.Context) error {
+	stop := c.interruptReads(ctx)
+	defer stop()
+
+	s := NewSession()
+	scratch := frameBufPool.Get().(*[frameHeaderSize + maxFramePayload]byte)
+	defer frameBufPool.Put(scratch)
+	if err := c.resumeTransfer(); err != nil {
+		c.Close(closeReasonOf(err))
+		return err
+	}
+	if err := c.resendCommands(); err != nil {
+		c.Close(closeReasonOf(err))
+		return err
+	}
+	for {
+		if finished, err := c.nextFrame(ctx, s, c.Conn, scratch[:frameHeaderSize], scratch[frameHeaderSize:]); finished {
+			return err
 		}
+	}
+}
 
-		select {
-		case <-ctx.Done():
-			return ErrClientClose
-		case <-c.done:
-			return ErrClientClose
-		case <-read.C:
-			_, err := io.ReadFull(c.Conn, b)
-			if err, ok := err.(net.Error); ok && err.Timeout() {
-				c.logError.Printf("[IMEI %d] No Readings for 2 seconds, Closing Client\n", c.IMEI())
-				c.shutdown()
-				return nil
-			}
-			if err == io.EOF {
-				continue
-			}
-			if err != nil {
-				c.shutdown()
-				return fmt.Errorf("[IMEI %d] failed to client.ProcessReadings/ReadFull\tb = % x, err = %s", c.IMEI(), b, err)
-			}
-			if err := c.Conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
-				c.shutdown()
-				return fmt.Errorf("[IMEI %d] failed to client.ProcessReadings/SetReadDeadline\terr = %s", c.IMEI(), err)
-			}
+// nextReading reads a single protocol v1 reading from r into b, and processes
+// it. It reports whether the Client is finished, along with the error
+// finishing it. If the connection had nothing to read, io.EOF is returned,
+// and if it had part of a reading, errPartialRead is returned; in either case
+// the Client is not finished.
+func (c Client) nextReading(ctx context.Context, s *Session, r io.Reader, b []byte) (bool, error) {
+	// A reading resumed from its held part already waited on the read ticker.
+	if len(s.partial) == 0 {
+		if err := c.wait(ctx, s); err != nil {
+			return true, err
+		}
+	}
+	_, err := io.ReadFull(r, b)
+	if err != nil && err != io.EOF && c.closed(ctx) {
+		return true, ErrClientClose
+	}
+	if err == errPartialRead {
+		return false, err
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		c.logWarn.Printf("[IMEI %d] No Readings for %g seconds, Closing Client\n", c.IMEI(), c.tunables.ReadingTimeout().Seconds())
+		c.Close(CloseInactive)
+		return true, nil
+	}
+	if err == io.EOF {
+		return false, err
+	}
+	if err != nil {
+		c.Close(closeReasonOf(err))
+		return true, fmt.Errorf("[IMEI %d] failed to client.ProcessReadings/ReadFull\tb = % x, err = %w", c.IMEI(), b, err)
+	}
+	if err := c.extendDeadline(s); err != nil {
+		if c.closed(ctx) {
+			return true, ErrClientClose
+		}
+		c.Close(CloseError)
+		return true, fmt.Errorf("[IMEI %d] failed to client.ProcessReadings/SetReadDeadline\terr = %w", c.IMEI(), err)
+	}
+	if !c.allowReading() {
+		return false, nil
+	}
 
-			if err := reading.Decode(b); err != nil {
-				c.logError.Printf(
-					"[IMEI %d] Failed to Client.ProcessReadings/decode\t b = %x, err = %s\n",
-					c.imei.Get(),
-					b,
-					err)
-				continue
+	err = c.processReading(ctx, b, &s.reading)
+	if err := c.checkDecodeFailures(err, &s.decodeFailures); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// nextFrame reads a single protocol v2 frame from r, using header and buf as
+// scratch space, and processes it. It reports whether the Client is finished,
+// along with the error finishing it. If the connection had nothing to read,
+// io.EOF is returned, and if it had part of a frame, errPartialRead is
+// returned; in either case the Client is not finished.
+func (c Client) nextFrame(ctx context.Context, s *Session, r io.Reader, header, buf []byte) (bool, error) {
+	t, payload, err := readFrame(r, header, buf)
+	if err != nil && err != io.EOF && c.closed(ctx) {
+		return true, ErrClientClose
+	}
+	if err == errPartialRead {
+		return false, err
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		c.logWarn.Printf("[IMEI %d] No Readings for %g seconds, Closing Client\n", c.IMEI(), c.tunables.ReadingTimeout().Seconds())
+		c.Close(CloseInactive)
+		return true, nil
+	}
+	if err == io.EOF {
+		return false, err
+	}
+	if err != nil {
+		c.Close(closeReasonOf(err))
+		return true, fmt.Errorf("[IMEI %d] failed to client.processFrames/readFrame\theader = % x, err = %w", c.IMEI(), header, err)
+	}
+	if err := c.extendDeadline(s); err != nil {
+		if c.closed(ctx) {
+			return true, ErrClientClose
+		}
+		c.Close(CloseError)
+		return true, fmt.Errorf("[IMEI %d] failed to client.processFrames/SetReadDeadline\terr = %w", c.IMEI(), err)
+	}
+
+	switch t {
+	case FrameReading, FrameDelta:
+		if err := c.wait(ctx, s); err != nil {
+			return true, err
+		}
+		if !c.allowReading() {
+			if err := c.acknowledge(ErrQuotaExceeded); err != nil {
+				c.Close(closeReasonOf(err))
+				return true, err
 			}
+			return false, nil
+		}
+	case FrameAck:
+		c.processAck(payload)
+		return false, nil
+	case FrameConfigAck:
+		c.processConfigAck(payload)
+		return false, nil
+	case FrameFirmwareAck:
+		if err := c.processTransferAck(payload); err != nil {
+			c.Close(closeReasonOf(err))
+			return true, err
+		}
+		return false, nil
+	case FrameAlarm:
+		c.stats.alarms.Inc()
+		c.metrics.Alarms.Inc()
+		c.logWarn.Printf("[IMEI %d] Alarm Received\n", c.IMEI())
+	default:
+		c.logWarn.Printf("[IMEI %d] Unknown Frame Type %#x, Skipping\n", c.IMEI(), byte(t))
+		if err := c.acknowledge(ErrUnknownFrame); err != nil {
+			c.Close(closeReasonOf(err))
+			return true, err
+		}
+		return false, nil
+	}
 
-			c.logReading(c.logError, c.imei.Get(), reading)
-			c.lastReadAt.Set(time.Now())
-			c.lastReading.Set(reading)
+	s.reading.Alarm = t == FrameAlarm
+	switch {
+	case t == FrameDelta:
+		err = c.processDelta(ctx, payload, &s.reading)
+	case len(payload) != readingSize:
+		err = fmt.Errorf("%w, length = %d", ErrShortFrame, len(payload))
+		if len(payload) > readingSize {
+			err = fmt.Errorf("%w, length = %d", ErrLongFrame, len(payload))
 		}
+		c.metrics.Errors.Inc()
+		c.stats.decodeErrors.Inc()
+		c.logError.Printf("[IMEI %d] Failed to Client.processFrames\terr = %s\n", c.IMEI(), err)
+	default:
+		err = c.processReading(ctx, payload, &s.reading)
+	}
+	if err := c.acknowledge(err); err != nil {
+		c.Close(closeReasonOf(err))
+		return true, err
+	}
+	if err := c.checkDecodeFailures(err, &s.decodeFailures); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// extendDeadline pushes the Client's read deadline its reading timeout into
+// the future, recording it in s.
+func (c Client) extendDeadline(s *Session) error {
+	deadline := time.Now().Add(c.tunables.ReadingTimeout())
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	s.deadline.Set(deadline)
+	return nil
+}
+
+// wait blocks until the read ticker of s, ticking at the Client's current
+// reading interval, permits another reading to be read. If the Client or ctx
+// is closed while waiting, ErrClientClose is returned.
+func (c Client) wait(ctx context.Context, s *Session) error {
+	now := time.Now()
+	if interval := c.tunables.ReadingInterval(); interval != s.read.interval {
+		s.read.reset(interval, now)
+	}
+	d := s.read.take(now)
+	if d <= 0 {
+		return nil
+	}
+	c.stats.rateLimitStalls.Inc()
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		c.Close(CloseServerShutdown)
+		return ErrClientClose
+	case <-c.done:
+		return ErrClientClose
+	case <-timer.C:
+		return nil
+	}
+}
+
+// checkDecodeFailures tracks consecutive decode failures, where err is the
+// decode result of the latest reading. If the Client's decode failure limit
+// is reached, the Client is closed and ErrClientQuarantined is returned.
+func (c Client) checkDecodeFailures(err error, failures *int) error {
+	if err != nil {
+		*failures++
+	} else {
+		*failures = 0
+	}
+	if c.decodeFailureLimit > 0 && *failures >= c.decodeFailureLimit {
+		c.logWarn.Printf("[IMEI %d] %d Consecutive Decode Failures, Quarantining Client\n", c.IMEI(), *failures)
+		c.Close(CloseQuarantined)
+		return ErrClientQuarantined
+	}
+	return nil
+}
+
+// processReading runs a received reading message through the decode, store,
+// and export stages of the reading pipeline. If the reading fails to decode,
+// or is rejected by the Client's ReadingValidator, the error is returned.
+func (c Client) processReading(ctx context.Context, b []byte, reading *Reading) error {
+	ctx, span := c.tracer.Start(ctx, "reading", trace.KindInternal)
+	defer span.End()
+	readAt := time.Now()
+
+	_, decode := c.tracer.Start(ctx, "reading.decode", trace.KindInternal)
+	err := reading.Decode(b)
+	if err == nil && c.validateReading != nil {
+		err = c.validateReading(c.imei.Get(), *reading)
 	}
+	if err != nil {
+		decode.RecordError(err)
+		decode.End()
+		span.RecordError(err)
+		c.metrics.Errors.Inc()
+		c.stats.decodeErrors.Inc()
+		c.logError.Printf(
+			"[IMEI %d] Failed to Client.ProcessReadings/decode\t b = %x, err = %s\n",
+			c.imei.Get(),
+			b,
+			err)
+		return err
+	}
+	decode.End()
+	c.metrics.IngestLatency.Histogram("decode").ObserveDuration(time.Since(readAt))
+	c.metrics.Readings.Inc()
+	if c.tenantReadings != nil {
+		c.tenantReadings.Inc()
+	}
+	c.stats.readings.Inc()
+
+	_, store := c.tracer.Start(ctx, "reading.store", trace.KindInternal)
+	now := time.Now()
+	// The first reading has no predecessor to measure an interval from.
+	if c.stats.readings.Value() > 1 {
+		interval := now.Sub(c.lastReadAt.Get())
+		c.stats.intervals.ObserveDuration(interval)
+		c.metrics.ReadingIntervals.ObserveDuration(interval)
+	}
+	c.lastReadAt.Set(now)
+	c.lastReading.Set(*reading)
+	for _, s := range c.readingStores {
+		s.StoreReading(c.imei.Get(), now, *reading)
+	}
+	store.End()
+	exportAt := time.Now()
+	c.metrics.IngestLatency.Histogram("store").ObserveDuration(exportAt.Sub(now))
+
+	_, export := c.tracer.Start(ctx, "reading.export", trace.KindInternal)
+	j := job{
+		logReading: c.logReading,
+		logger:     c.readingLogger(),
+		imei:       c.imei.Get(),
+		receivedAt: now,
+		reading:    *reading,
+		readAt:     readAt,
+		exportAt:   exportAt,
+		latency:    c.metrics.IngestLatency,
+	}
+	if c.workers != nil {
+		queued := c.workers.submit(j)
+		export.SetAttributes(trace.Bool("queued", queued))
+	} else {
+		j.run()
+	}
+	export.End()
+	return nil
 }
 
 // ClientOption modifies a Client object. Typically used with New to initialize
@@ -229,7 +687,9 @@ type ClientOption func(*Client)
 func WithLoggerOutput(w io.Writer) ClientOption {
 	return func(c *Client) {
 		c.logError.SetOutput(w)
+		c.logWarn.SetOutput(w)
 		c.logInfo.SetOutput(w)
+		c.logDebug.SetOutput(w)
 	}
 }
 
@@ -238,12 +698,50 @@ func WithLoggerOutput(w io.Writer) ClientOption {
 func WithLoggerFlags(flags int) ClientOption {
 	return func(c *Client) {
 		c.logError.SetFlags(flags)
+		c.logWarn.SetFlags(flags)
 		c.logInfo.SetFlags(flags)
+		c.logDebug.SetFlags(flags)
 	}
 }
 
-// logReadingFunc logs a Reading.
-type logReadingFunc func(*log.Logger, uint64, Reading)
+// WithLogger returns a ClientOption that sets the Logger the Client's messages
+// are written to. Once set, WithLoggerOutput and WithLoggerFlags have no
+// effect.
+func WithLogger(l common.Logger) ClientOption {
+	return func(c *Client) {
+		c.logError.SetLogger(l)
+		c.logWarn.SetLogger(l)
+		c.logInfo.SetLogger(l)
+		c.logDebug.SetLogger(l)
+	}
+}
+
+// WithLogLevel returns a ClientOption that sets the threshold consulted by the
+// Client's loggers. Sharing level between Clients allows their verbosity to be
+// changed at runtime.
+func WithLogLevel(level *common.LevelVar) ClientOption {
+	return func(c *Client) {
+		c.logError.SetThreshold(level)
+		c.logWarn.SetThreshold(level)
+		c.logInfo.SetThreshold(level)
+		c.logDebug.SetThreshold(level)
+	}
+}
+
+// WithLogRateLimiter returns a ClientOption that collapses the Client's
+// repeated error and warning messages with limiter, so that a misbehaving
+// device cannot flood the log. Sharing limiter between Clients collapses
+// the messages of a device across its connections.
+func WithLogRateLimiter(limiter *common.RateLimiter) ClientOption {
+	return func(c *Client) {
+		c.logError.SetRateLimiter(limiter)
+		c.logWarn.SetRateLimiter(limiter)
+	}
+}
+
+// logReadingFunc logs a Reading, along with the device's IMEI and when the
+// Reading was received.
+type logReadingFunc func(*common.LevelLogger, uint64, time.Time, Reading)
 
 // WithLogReading returns a ClientOption that sets the client's LogReading
 // function to the function specified.
@@ -252,3 +750,82 @@ func WithLogReading(f logReadingFunc) ClientOption {
 		c.logReading = f
 	}
 }
+
+// ReadingStore stores the readings of Clients as they are received.
+// StoreReading is called on the Client's goroutine, and must not block.
+type ReadingStore interface {
+	StoreReading(imei uint64, receivedAt time.Time, reading Reading)
+}
+
+// WithReadingStore returns a ClientOption that stores each of the Client's
+// readings in s, in addition to any ReadingStores already set.
+func WithReadingStore(s ReadingStore) ClientOption {
+	return func(c *Client) {
+		c.readingStores = append(c.readingStores, s)
+	}
+}
+
+// WithMetrics returns a ClientOption that sets the Metrics the Client records
+// its readings and errors to.
+func WithMetrics(m *metrics.Metrics) ClientOption {
+	return func(c *Client) {
+		c.metrics = m
+	}
+}
+
+// WithTransfers returns a ClientOption that sets the Transfers tracking the
+// Client's firmware transfers.
+func WithTransfers(t *Transfers) ClientOption {
+	return func(c *Client) {
+		c.transfers = t
+	}
+}
+
+// WithWorkerPool returns a ClientOption that hands the Client's post-decode
+// work to p rather than performing it on the Client's goroutine.
+func WithWorkerPool(p *WorkerPool) ClientOption {
+	return func(c *Client) {
+		c.workers = p
+	}
+}
+
+// WithAcknowledgements returns a ClientOption that runs protocol v2 Clients in
+// acknowledged mode, where each reading and alarm frame is answered with a
+// FrameReadingAck frame, or a FrameNack frame describing why it was rejected.
+func WithAcknowledgements() ClientOption {
+	return func(c *Client) {
+		c.acknowledged = true
+	}
+}
+
+// WithTracer returns a ClientOption that sets the Tracer used to record the
+// Client's login and reading pipeline spans.
+func WithTracer(t *trace.Tracer) ClientOption {
+	return func(c *Client) {
+		c.tracer = t
+	}
+}
+
+// ReadingValidator checks a decoded reading of the device with imei, beyond
+// the valid ranges of Decode. It returns an error, typically an
+// ErrInvalidRange, if the reading is invalid.
+type ReadingValidator func(imei uint64, reading Reading) error
+
+// WithReadingValidator returns a ClientOption that rejects readings v returns
+// an error for, as if they failed to decode: they are neither stored nor
+// exported, count towards the decode failure limit, and are answered with
+// the NackCode of the error in acknowledged mode.
+func WithReadingValidator(v ReadingValidator) ClientOption {
+	return func(c *Client) {
+		c.validateReading = v
+	}
+}
+
+// WithDecodeFailureLimit returns a ClientOption that closes the Client with
+// ErrClientQuarantined once limit consecutive readings fail to decode. A limit
+// of zero disables the check.
+func WithDecodeFailureLimit(limit int) ClientOption {
+	return func(c *Client) {
+		c.decodeFailureLimit = limit
+	}
+}
@@ -0,0 +1,408 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/common"
+	"github.com/tjper/thermomatic/internal/imei"
+)
+
+func TestNewStartsNoGoroutines(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	newClient(t, "490154203237518")
+
+	// Allow the device's write goroutine to exit.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n != goroutines {
+		t.Errorf("expected %d goroutines, actual = %d", goroutines, n)
+	}
+}
+
+// BenchmarkConnection measures the cost of establishing a protocol v2 client
+// and processing its frames until the device disconnects.
+func BenchmarkConnection(b *testing.B) {
+	login := append([]byte("490154203237518"), "logv2"...)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		server, device := net.Pipe()
+		go func() {
+			device.Write(login)
+			device.Close()
+		}()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		c, err := client.New(ctx, server, client.WithLoggerOutput(io.Discard))
+		if err != nil {
+			b.Fatalf("unexpected error = %s\n", err)
+		}
+		if err := c.ProcessLogin(ctx); err != nil {
+			b.Fatalf("unexpected error = %s\n", err)
+		}
+		cancel()
+		c.ProcessReadings(ctx)
+		server.Close()
+	}
+}
+
+// BenchmarkProcessAlarmFrames measures the per-frame cost of processing alarm
+// frames, which bypass the reading rate limit, on an established connection.
+func BenchmarkProcessAlarmFrames(b *testing.B) {
+	reading, err := client.Reading{
+		Temperature:  67.77,
+		Altitude:     2.63555,
+		Latitude:     33.41,
+		Longitude:    44.4,
+		BatteryLevel: 0.25666,
+	}.Encode()
+	if err != nil {
+		b.Fatalf("unexpected error = %s\n", err)
+	}
+	frame := client.AppendFrame(nil, client.FrameAlarm, reading)
+
+	server, device := net.Pipe()
+	defer server.Close()
+	go device.Write(append([]byte("490154203237518"), "logv2"...))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := client.New(
+		ctx,
+		server,
+		client.WithLoggerOutput(io.Discard),
+		client.WithLogReading(func(*common.LevelLogger, uint64, time.Time, client.Reading) {}))
+	if err != nil {
+		b.Fatalf("unexpected error = %s\n", err)
+	}
+	if err := c.ProcessLogin(ctx); err != nil {
+		b.Fatalf("unexpected error = %s\n", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			device.Write(frame)
+		}
+		cancel()
+		device.Close()
+	}()
+	c.ProcessReadings(ctx)
+}
+
+func TestNewInvalidIMEI(t *testing.T) {
+	server, device := net.Pipe()
+	defer server.Close()
+	defer device.Close()
+	go device.Write([]byte("490154203237519"))
+
+	_, err := client.New(context.Background(), server)
+	if !errors.Is(err, imei.ErrChecksum) {
+		t.Errorf("expected error wrapping %v, actual = %v", imei.ErrChecksum, err)
+	}
+}
+
+func TestCancelInterruptsReads(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Login   string
+		Process func(*client.Client, context.Context) error
+	}{
+		{
+			Name:    "login",
+			Process: (*client.Client).ProcessLogin,
+		},
+		{
+			Name:    "readings",
+			Login:   "login",
+			Process: (*client.Client).ProcessReadings,
+		},
+		{
+			Name:    "frames",
+			Login:   "logv2",
+			Process: (*client.Client).ProcessReadings,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			server, device := net.Pipe()
+			defer server.Close()
+			defer device.Close()
+			go device.Write(append([]byte("490154203237518"), test.Login...))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			c, err := client.New(ctx, server, client.WithLoggerOutput(io.Discard))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if test.Login != "" {
+				if err := c.ProcessLogin(ctx); err != nil {
+					t.Fatalf("unexpected error = %s\n", err)
+				}
+			}
+
+			time.AfterFunc(100*time.Millisecond, cancel)
+			start := time.Now()
+			if err := test.Process(c, ctx); err != client.ErrClientClose {
+				t.Errorf("expected error %v, actual = %v", client.ErrClientClose, err)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("expected read to be interrupted, elapsed = %s", elapsed)
+			}
+			if reason := c.CloseReason(); reason != client.CloseServerShutdown {
+				t.Errorf("expected close reason %s, actual = %s", client.CloseServerShutdown, reason)
+			}
+		})
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Messages []string
+		Close    bool
+		Expected client.CloseReason
+	}{
+		{
+			Name:     "unauthorized",
+			Messages: []string{"490154203237518", "logxx"},
+			Expected: client.CloseUnauthorized,
+		},
+		{
+			Name:     "login expired",
+			Messages: []string{"490154203237518"},
+			Expected: client.CloseLoginExpired,
+		},
+		{
+			Name:     "peer reset",
+			Messages: []string{"490154203237518", "logv2"},
+			Close:    true,
+			Expected: client.ClosePeerReset,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			server, device := net.Pipe()
+			defer server.Close()
+			go func(messages []string, close bool) {
+				for _, message := range messages {
+					device.Write([]byte(message))
+				}
+				if close {
+					device.Close()
+				}
+			}(test.Messages, test.Close)
+			defer device.Close()
+
+			ctx := context.Background()
+			c, err := client.New(ctx, server, client.WithLoggerOutput(io.Discard))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if reason := c.CloseReason(); reason != client.CloseNone {
+				t.Fatalf("expected close reason %s, actual = %s", client.CloseNone, reason)
+			}
+			if err := c.ProcessLogin(ctx); err == nil {
+				c.ProcessNext(ctx, client.NewSession())
+			}
+			if reason := c.CloseReason(); reason != test.Expected {
+				t.Errorf("expected close reason %s, actual = %s", test.Expected, reason)
+			}
+		})
+	}
+}
+
+func TestWithProtocols(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Login string
+		Err   error
+	}{
+		{Name: "allowed", Login: "login"},
+		{Name: "refused", Login: "logv2", Err: client.ErrClientUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			server, device := net.Pipe()
+			defer server.Close()
+			defer device.Close()
+			go device.Write([]byte("490154203237518" + test.Login))
+
+			ctx := context.Background()
+			c, err := client.New(
+				ctx,
+				server,
+				client.WithLoggerOutput(io.Discard),
+				client.WithProtocols(func(p client.Protocol) bool { return p == client.ProtocolV1 }))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if err := c.ProcessLogin(ctx); !errors.Is(err, test.Err) {
+				t.Fatalf("expected error wrapping %v, actual = %v", test.Err, err)
+			}
+			if test.Err == nil {
+				return
+			}
+			if reason := c.CloseReason(); reason != client.CloseUnauthorized {
+				t.Errorf("expected close reason %s, actual = %s", client.CloseUnauthorized, reason)
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	server, device := net.Pipe()
+	defer server.Close()
+	defer device.Close()
+	go device.Write(append([]byte("490154203237518"), "logv2"...))
+
+	ctx := context.Background()
+	c, err := client.New(ctx, server, client.WithLoggerOutput(io.Discard))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if err := c.ProcessLogin(ctx); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	processed := make(chan error, 1)
+	go func() {
+		processed <- c.ProcessReadings(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := c.Close(client.CloseKicked); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	select {
+	case err := <-processed:
+		if err != client.ErrClientClose {
+			t.Errorf("expected error %v, actual = %v", client.ErrClientClose, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected ProcessReadings to return once closed")
+	}
+
+	if err := c.Close(client.CloseError); err != nil {
+		t.Errorf("unexpected error = %s\n", err)
+	}
+	if reason := c.CloseReason(); reason != client.CloseKicked {
+		t.Errorf("expected close reason %s, actual = %s", client.CloseKicked, reason)
+	}
+}
+
+// readingStore is a client.ReadingStore recording the readings stored.
+type readingStore struct {
+	imeis    []uint64
+	readings []client.Reading
+}
+
+func (s *readingStore) StoreReading(imei uint64, _ time.Time, reading client.Reading) {
+	s.imeis = append(s.imeis, imei)
+	s.readings = append(s.readings, reading)
+}
+
+func TestReadingStore(t *testing.T) {
+	expected := client.Reading{Temperature: 67.77, BatteryLevel: 0.25}
+	b, err := expected.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	server, device := net.Pipe()
+	defer server.Close()
+	defer device.Close()
+	go device.Write(append([]byte("490154203237518"), "logv2"...))
+
+	store := new(readingStore)
+	ctx := context.Background()
+	c, err := client.New(
+		ctx,
+		server,
+		client.WithLoggerOutput(io.Discard),
+		client.WithReadingStore(store),
+		client.WithLogReading(func(*common.LevelLogger, uint64, time.Time, client.Reading) {}))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if err := c.ProcessLogin(ctx); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	go device.Write(client.AppendFrame(nil, client.FrameReading, b))
+	if _, err := c.ProcessNext(ctx, client.NewSession()); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if len(store.readings) != 1 || store.imeis[0] != 490154203237518 || store.readings[0] != expected {
+		t.Errorf("unexpected stored readings = %v %+v", store.imeis, store.readings)
+	}
+}
+
+func TestProcessDatagram(t *testing.T) {
+	valid, err := client.Reading{Temperature: 67.77, BatteryLevel: 0.25}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	outOfRange, err := client.Reading{Temperature: 67.77, BatteryLevel: 101}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	store := new(readingStore)
+	c := client.NewDatagram(
+		490154203237518,
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5683},
+		client.WithLoggerOutput(io.Discard),
+		client.WithReadingStore(store),
+		client.WithDecodeFailureLimit(2),
+		client.WithLogReading(func(*common.LevelLogger, uint64, time.Time, client.Reading) {}))
+	defer c.Close(client.CloseInactive)
+	if c.Protocol() != client.ProtocolV1 {
+		t.Errorf("expected protocol = %d, actual = %d", client.ProtocolV1, c.Protocol())
+	}
+
+	ctx := context.Background()
+	s := client.NewSession()
+	tests := []struct {
+		name     string
+		datagram []byte
+		err      error
+	}{
+		{name: "valid", datagram: valid},
+		{name: "short", datagram: valid[:10], err: client.ErrInvalidDatagram},
+		{name: "valid after failure", datagram: valid},
+		{name: "out of range", datagram: outOfRange, err: client.ErrInvalidRange{Field: "BatteryLevel", Value: 101}},
+		{name: "quarantined", datagram: outOfRange, err: client.ErrClientQuarantined},
+		{name: "closed", datagram: valid, err: client.ErrClientClose},
+	}
+	for _, test := range tests {
+		err := c.ProcessDatagram(ctx, s, test.datagram)
+		switch {
+		case test.err == nil && err != nil:
+			t.Errorf("%s: unexpected error = %s", test.name, err)
+		case test.err != nil && !errors.Is(err, test.err):
+			t.Errorf("%s: expected error = %s, actual = %v", test.name, test.err, err)
+		}
+	}
+	if len(store.readings) != 2 {
+		t.Errorf("expected 2 stored readings, actual = %d", len(store.readings))
+	}
+	if c.CloseReason() != client.CloseQuarantined {
+		t.Errorf("expected close reason = %s, actual = %s", client.CloseQuarantined, c.CloseReason())
+	}
+	if stats := c.Stats(); stats.DecodeErrors != 3 || stats.BytesRead != 4*40+10 {
+		t.Errorf("unexpected stats = %+v", stats)
+	}
+}
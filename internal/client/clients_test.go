@@ -0,0 +1,61 @@
+package client_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+func newClient(t *testing.T, imei string) *client.Client {
+	t.Helper()
+	server, device := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		device.Close()
+	})
+	go device.Write([]byte(imei))
+
+	c, err := client.New(context.Background(), server)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	return c
+}
+
+func TestClientMap(t *testing.T) {
+	m := client.NewClientMap()
+	first := newClient(t, "490154203237518")
+	second := newClient(t, "356938035643809")
+	m.Store(first.IMEI(), first)
+	m.Store(second.IMEI(), second)
+
+	// Loaded Clients are the stored reference, not a copy, so changes to
+	// state held by value in a Client, such as its listener, made through the
+	// map are observed through the original.
+	loaded, ok := m.Load(first.IMEI())
+	if !ok {
+		t.Fatalf("expected IMEI %d to be loaded", first.IMEI())
+	}
+	client.WithListener("loaded")(loaded)
+	if actual := first.Listener(); actual != "loaded" {
+		t.Errorf("expected listener set through the map, actual = %q", actual)
+	}
+
+	if n := m.Len(); n != 2 {
+		t.Errorf("expected 2 clients, actual = %d", n)
+	}
+	m.Range(func(imei uint64, c *client.Client) bool {
+		client.WithListener("ranged")(c)
+		return true
+	})
+	if actual := second.Listener(); actual != "ranged" {
+		t.Errorf("expected listener set through Range, actual = %q", actual)
+	}
+
+	m.Delete(first.IMEI())
+	if m.Exists(first.IMEI()) {
+		t.Errorf("expected IMEI %d to be deleted", first.IMEI())
+	}
+}
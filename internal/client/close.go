@@ -0,0 +1,94 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"syscall"
+)
+
+// CloseReason is why a Client was closed.
+type CloseReason string
+
+const (
+	// CloseNone is the CloseReason of a Client that has not been closed.
+	CloseNone CloseReason = ""
+
+	// CloseLoginExpired Clients did not login within the login window.
+	CloseLoginExpired CloseReason = "login_expired"
+
+	// CloseUnauthorized Clients sent an unrecognized login.
+	CloseUnauthorized CloseReason = "unauthorized"
+
+	// CloseInactive Clients sent no messages for the reading timeout.
+	CloseInactive CloseReason = "inactive"
+
+	// CloseIdle Clients logged in but sent no readings for the idle eviction
+	// period.
+	CloseIdle CloseReason = "idle"
+
+	// CloseQuarantined Clients sent too many consecutive readings that failed
+	// to decode.
+	CloseQuarantined CloseReason = "quarantined"
+
+	// CloseDuplicate Clients connected while a Client with the same IMEI was
+	// already connected.
+	CloseDuplicate CloseReason = "duplicate"
+
+	// CloseQuotaExceeded Clients connected while their tenant had as many
+	// Clients connected as its quota permits.
+	CloseQuotaExceeded CloseReason = "quota_exceeded"
+
+	// CloseKicked Clients were disconnected by an administrator.
+	CloseKicked CloseReason = "kicked"
+
+	// CloseServerShutdown Clients were closed as the server shut down.
+	CloseServerShutdown CloseReason = "server_shutdown"
+
+	// ClosePeerReset Clients' devices closed or reset the connection.
+	ClosePeerReset CloseReason = "peer_reset"
+
+	// CloseError Clients failed to read from or write to their connection.
+	CloseError CloseReason = "error"
+)
+
+// String retrieves the CloseReason's name, or "none" for CloseNone.
+func (r CloseReason) String() string {
+	if r == CloseNone {
+		return "none"
+	}
+	return string(r)
+}
+
+// closeReasonOf retrieves the CloseReason of a Client whose connection failed
+// with err.
+func closeReasonOf(err error) CloseReason {
+	switch {
+	case errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE):
+		return ClosePeerReset
+	default:
+		return CloseError
+	}
+}
+
+// CloseReason retrieves why the Client was closed. CloseNone is returned
+// while the Client is open.
+func (c Client) CloseReason() CloseReason {
+	return c.closeReason.Get()
+}
+
+// Close closes the Client, recording reason as its CloseReason. The Client's
+// processes are signaled to stop, and its connection is closed, interrupting
+// any read in progress. Close is idempotent; only the first reason is
+// recorded, and later calls return nil.
+func (c Client) Close(reason CloseReason) error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.closeReason.Set(reason)
+		close(c.done)
+		err = c.Conn.Close()
+	})
+	return err
+}
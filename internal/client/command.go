@@ -0,0 +1,202 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrProtocolUnsupported indicates the Client's negotiated protocol does
+	// not support the operation.
+	ErrProtocolUnsupported = errors.New("protocol unsupported")
+
+	// ErrCommandTooLarge indicates a command payload does not fit in a frame.
+	ErrCommandTooLarge = errors.New("command too large")
+)
+
+const (
+	// commandIDSize is the size of the Big-Endian command ID prefixing
+	// command and ack frame payloads.
+	commandIDSize = 4
+
+	// commandHistory is the number of commands tracked per Client. Older
+	// commands are forgotten.
+	commandHistory = 64
+
+	// writeTimeout is how long a write to a Client's connection may block.
+	writeTimeout = 5 * time.Second
+)
+
+// CommandStatus is the delivery state of a Command.
+type CommandStatus string
+
+const (
+	// CommandDelivered denotes the command was written to the connection.
+	CommandDelivered CommandStatus = "delivered"
+
+	// CommandAcked denotes the device acknowledged the command.
+	CommandAcked CommandStatus = "acked"
+
+	// CommandFailed denotes the command could not be written.
+	CommandFailed CommandStatus = "failed"
+)
+
+// Command is an opaque payload sent to a device in a FrameCommand frame.
+type Command struct {
+	ID          uint32
+	Payload     []byte
+	Status      CommandStatus
+	CreatedAt   time.Time
+	DeliveredAt time.Time `json:",omitempty"`
+	AckedAt     time.Time `json:",omitempty"`
+}
+
+// downlink serializes writes to a Client's connection, and tracks the
+// commands sent. It is referenced by pointer so that copies of a Client share
+// it.
+type downlink struct {
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	nextID   uint32
+	commands map[uint32]*Command
+}
+
+func newDownlink() *downlink {
+	return &downlink{
+		commands: make(map[uint32]*Command),
+	}
+}
+
+// track records a new Command carrying payload, and returns a reference to
+// it. The oldest Command is forgotten once commandHistory is exceeded.
+func (d *downlink) track(payload []byte) *Command {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.nextID++
+	cmd := &Command{
+		ID:        d.nextID,
+		Payload:   payload,
+		CreatedAt: time.Now(),
+	}
+	d.commands[cmd.ID] = cmd
+	delete(d.commands, cmd.ID-commandHistory)
+	return cmd
+}
+
+// setStatus sets the status of cmd, and returns a copy of cmd.
+func (d *downlink) setStatus(cmd *Command, status CommandStatus) Command {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cmd.Status = status
+	switch status {
+	case CommandDelivered:
+		cmd.DeliveredAt = time.Now()
+	case CommandAcked:
+		cmd.AckedAt = time.Now()
+	}
+	return *cmd
+}
+
+// ack marks the Command with id as acknowledged, and reports whether it was
+// tracked.
+func (d *downlink) ack(id uint32) bool {
+	d.mu.Lock()
+	cmd, ok := d.commands[id]
+	d.mu.Unlock()
+	if !ok {
+		return false
+	}
+	d.setStatus(cmd, CommandAcked)
+	return true
+}
+
+// list retrieves copies of the tracked Commands ordered by ID.
+func (d *downlink) list() []Command {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	list := make([]Command, 0, len(d.commands))
+	for _, cmd := range d.commands {
+		list = append(list, *cmd)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// SendCommand writes payload to the Client's device in a FrameCommand frame,
+// and returns the tracked Command. The device acknowledges the Command by
+// replying with a FrameAck frame carrying the Command's ID. Only protocol v2
+// Clients support commands; otherwise ErrProtocolUnsupported is returned.
+func (c Client) SendCommand(payload []byte) (Command, error) {
+	if c.Protocol() != ProtocolV2 {
+		return Command{}, ErrProtocolUnsupported
+	}
+	if len(payload)+commandIDSize > maxFramePayload {
+		return Command{}, ErrCommandTooLarge
+	}
+
+	cmd := c.downlink.track(payload)
+	b := make([]byte, commandIDSize, commandIDSize+len(payload))
+	binary.BigEndian.PutUint32(b, cmd.ID)
+	b = append(b, payload...)
+
+	if err := c.writeFrame(FrameCommand, b); err != nil {
+		c.downlink.setStatus(cmd, CommandFailed)
+		return Command{}, err
+	}
+	c.logInfo.Printf("[IMEI %d] Command %d Delivered\n", c.IMEI(), cmd.ID)
+	return c.downlink.setStatus(cmd, CommandDelivered), nil
+}
+
+// Commands retrieves the Commands recently sent to the Client's device.
+func (c Client) Commands() []Command {
+	return c.downlink.list()
+}
+
+// Goodbye informs the Client's device that the server is shutting down with a
+// FrameGoodbye frame. Only protocol v2 Clients support goodbye frames;
+// otherwise ErrProtocolUnsupported is returned.
+func (c Client) Goodbye() error {
+	if c.Protocol() != ProtocolV2 {
+		return ErrProtocolUnsupported
+	}
+	return c.writeFrame(FrameGoodbye, nil)
+}
+
+// writeFrame writes a single frame to the Client's connection. Concurrent
+// calls are serialized.
+func (c Client) writeFrame(t FrameType, payload []byte) error {
+	b := AppendFrame(make([]byte, 0, frameHeaderSize+len(payload)), t, payload)
+
+	c.downlink.writeMu.Lock()
+	defer c.downlink.writeMu.Unlock()
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return fmt.Errorf("[IMEI %d] failed to client.writeFrame/SetWriteDeadline\terr = %w", c.IMEI(), err)
+	}
+	if _, err := c.Conn.Write(b); err != nil {
+		return fmt.Errorf("[IMEI %d] failed to client.writeFrame/Write\terr = %w", c.IMEI(), err)
+	}
+	return nil
+}
+
+// processAck marks the Command identified by an ack frame payload as
+// acknowledged.
+func (c Client) processAck(payload []byte) {
+	if len(payload) < commandIDSize {
+		c.logWarn.Printf("[IMEI %d] Invalid Ack Frame, length = %d\n", c.IMEI(), len(payload))
+		return
+	}
+	id := binary.BigEndian.Uint32(payload)
+	if !c.downlink.ack(id) {
+		c.logWarn.Printf("[IMEI %d] Ack for Unknown Command %d\n", c.IMEI(), id)
+		return
+	}
+	c.logInfo.Printf("[IMEI %d] Command %d Acked\n", c.IMEI(), id)
+}
@@ -0,0 +1,29 @@
+package client
+
+import "testing"
+
+func TestDownlink(t *testing.T) {
+	d := newDownlink()
+	for i := 0; i < commandHistory+2; i++ {
+		cmd := d.track([]byte("cmd"))
+		d.setStatus(cmd, CommandDelivered)
+	}
+
+	list := d.list()
+	if len(list) != commandHistory {
+		t.Fatalf("expected %d commands, actual = %d", commandHistory, len(list))
+	}
+	if list[0].ID != 3 {
+		t.Errorf("expected oldest command ID 3, actual = %d", list[0].ID)
+	}
+
+	if d.ack(1) {
+		t.Errorf("expected forgotten command 1 not to be acked")
+	}
+	if !d.ack(3) {
+		t.Errorf("expected command 3 to be acked")
+	}
+	if status := d.list()[0].Status; status != CommandAcked {
+		t.Errorf("expected status %s, actual = %s", CommandAcked, status)
+	}
+}
@@ -0,0 +1,320 @@
+package client
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+)
+
+// Compression is the stream compression a protocol v2 device negotiates at
+// login. Once negotiated, everything the device sends is compressed, and is
+// decompressed before frames are parsed. Frames sent to the device are not
+// compressed.
+type Compression byte
+
+const (
+	// CompressionNone devices send uncompressed streams.
+	CompressionNone Compression = 0
+
+	// CompressionZlib devices send a zlib stream (RFC 1950), flushing it after
+	// each frame.
+	CompressionZlib Compression = 1
+
+	// CompressionSnappy devices send a Snappy framed stream.
+	CompressionSnappy Compression = 2
+)
+
+var (
+	// ErrUnsupportedCompression indicates a device requested a Compression the
+	// server does not support.
+	ErrUnsupportedCompression = errors.New("unsupported compression")
+
+	// ErrCorruptStream indicates a compressed stream could not be
+	// decompressed.
+	ErrCorruptStream = errors.New("corrupt compressed stream")
+)
+
+// String retrieves the Compression's name.
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionZlib:
+		return "zlib"
+	case CompressionSnappy:
+		return "snappy"
+	default:
+		return fmt.Sprintf("Compression(%d)", byte(c))
+	}
+}
+
+// MarshalText satisfies the encoding.TextMarshaler interface.
+func (c Compression) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText satisfies the encoding.TextUnmarshaler interface.
+func (c *Compression) UnmarshalText(b []byte) error {
+	for _, compression := range []Compression{CompressionNone, CompressionZlib, CompressionSnappy} {
+		if string(b) == compression.String() {
+			*c = compression
+			return nil
+		}
+	}
+	return fmt.Errorf("%w, compression = %q", ErrUnsupportedCompression, b)
+}
+
+// decompressingConn is a net.Conn whose reads are decompressed once the
+// Client negotiates compression. It is referenced by pointer so that copies
+// of a Client share it.
+type decompressingConn struct {
+	net.Conn
+
+	// r decompresses reads from Conn, and is nil until compression is
+	// negotiated. It is only used by the goroutine reading the Client.
+	r io.Reader
+}
+
+// Read satisfies the io.Reader interface, decompressing the bytes read once
+// compression is negotiated.
+func (c *decompressingConn) Read(b []byte) (int, error) {
+	if c.r == nil {
+		return c.Conn.Read(b)
+	}
+	return c.r.Read(b)
+}
+
+// decompress decompresses the Conn's subsequent reads per compression.
+func (c *decompressingConn) decompress(compression Compression) error {
+	switch compression {
+	case CompressionZlib:
+		c.r = &zlibReader{src: c.Conn}
+	case CompressionSnappy:
+		c.r = &snappyReader{src: c.Conn}
+	default:
+		return fmt.Errorf("%w, compression = %s", ErrUnsupportedCompression, compression)
+	}
+	return nil
+}
+
+// zlibReader decompresses a zlib stream from src. The stream's header is read
+// by the first Read, as devices may not send it until they have a frame to
+// send.
+type zlibReader struct {
+	src io.Reader
+	r   io.ReadCloser
+}
+
+// Read satisfies the io.Reader interface.
+func (z *zlibReader) Read(b []byte) (int, error) {
+	if z.r == nil {
+		r, err := zlib.NewReader(z.src)
+		if err != nil {
+			if errors.Is(err, zlib.ErrHeader) {
+				err = fmt.Errorf("%w, err = %s", ErrCorruptStream, err)
+			}
+			return 0, err
+		}
+		z.r = r
+	}
+	return z.r.Read(b)
+}
+
+const (
+	// snappyChunkHeaderSize is the size of a Snappy framed stream chunk
+	// header: a 1 byte chunk type followed by a 3 byte Little-Endian length.
+	snappyChunkHeaderSize = 4
+
+	// snappyChecksumSize is the size of the masked CRC-32C prefixing the
+	// data of compressed and uncompressed chunks.
+	snappyChecksumSize = 4
+
+	// maxSnappyBlock is the largest amount of data a single chunk may
+	// decompress to.
+	maxSnappyBlock = 1 << 16
+
+	// maxSnappyChunk is the largest chunk accepted, which is the worst case
+	// encoding of a maxSnappyBlock block.
+	maxSnappyChunk = snappyChecksumSize + 32 + maxSnappyBlock + maxSnappyBlock/6
+
+	snappyChunkCompressed   = 0x00
+	snappyChunkUncompressed = 0x01
+	snappyChunkStreamID     = 0xff
+)
+
+// snappyStreamID is the body of the stream identifier chunk starting every
+// Snappy framed stream.
+const snappyStreamID = "sNaPpY"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// snappyReader decompresses a Snappy framed stream from src, per
+// https://github.com/google/snappy/blob/main/framing_format.txt.
+type snappyReader struct {
+	src io.Reader
+
+	identified bool
+	chunk      []byte
+	decoded    []byte
+	buf        []byte
+}
+
+// Read satisfies the io.Reader interface.
+func (s *snappyReader) Read(b []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// next reads the next chunk from src, leaving any data it carries in s.buf.
+func (s *snappyReader) next() error {
+	var header [snappyChunkHeaderSize]byte
+	if _, err := io.ReadFull(s.src, header[:]); err != nil {
+		return err
+	}
+	typ := header[0]
+	length := int(header[1]) | int(header[2])<<8 | int(header[3])<<16
+	if length > maxSnappyChunk {
+		return fmt.Errorf("%w, chunk length = %d", ErrCorruptStream, length)
+	}
+	if cap(s.chunk) < length {
+		s.chunk = make([]byte, length)
+	}
+	chunk := s.chunk[:length]
+	if _, err := io.ReadFull(s.src, chunk); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	if typ == snappyChunkStreamID {
+		if string(chunk) != snappyStreamID {
+			return fmt.Errorf("%w, stream identifier = %q", ErrCorruptStream, chunk)
+		}
+		s.identified = true
+		return nil
+	}
+	if !s.identified {
+		return fmt.Errorf("%w, missing stream identifier", ErrCorruptStream)
+	}
+
+	switch {
+	case typ == snappyChunkCompressed, typ == snappyChunkUncompressed:
+		if length < snappyChecksumSize {
+			return fmt.Errorf("%w, chunk length = %d", ErrCorruptStream, length)
+		}
+		checksum := binary.LittleEndian.Uint32(chunk)
+		data := chunk[snappyChecksumSize:]
+		if typ == snappyChunkCompressed {
+			decoded, err := snappyDecode(s.decoded[:0], data)
+			if err != nil {
+				return err
+			}
+			s.decoded = decoded
+			data = decoded
+		} else if len(data) > maxSnappyBlock {
+			return fmt.Errorf("%w, chunk length = %d", ErrCorruptStream, length)
+		}
+		if snappyChecksum(data) != checksum {
+			return fmt.Errorf("%w, checksum mismatch", ErrCorruptStream)
+		}
+		s.buf = data
+	case typ <= 0x7f:
+		// Reserved unskippable chunks cannot be understood.
+		return fmt.Errorf("%w, chunk type = %#x", ErrCorruptStream, typ)
+	}
+	// Padding and reserved skippable chunks are skipped.
+	return nil
+}
+
+// snappyChecksum retrieves the masked CRC-32C of b.
+func snappyChecksum(b []byte) uint32 {
+	c := crc32.Checksum(b, castagnoli)
+	return (c>>15 | c<<17) + 0xa282ead8
+}
+
+// snappyDecode appends the decoding of src, a Snappy block, to dst and
+// returns the extended slice.
+func snappyDecode(dst, src []byte) ([]byte, error) {
+	size, n := binary.Uvarint(src)
+	if n <= 0 || size > maxSnappyBlock {
+		return nil, fmt.Errorf("%w, invalid block length", ErrCorruptStream)
+	}
+	src = src[n:]
+	start := len(dst)
+	end := start + int(size)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 0x03 {
+		case 0x00:
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, fmt.Errorf("%w, truncated literal", ErrCorruptStream)
+				}
+				var l uint64
+				for i := 0; i < extra; i++ {
+					l |= uint64(src[i]) << (8 * i)
+				}
+				if l >= maxSnappyBlock {
+					return nil, fmt.Errorf("%w, literal too long", ErrCorruptStream)
+				}
+				length = int(l)
+				src = src[extra:]
+			}
+			length++
+			if length > len(src) || len(dst)+length > end {
+				return nil, fmt.Errorf("%w, literal too long", ErrCorruptStream)
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 0x01:
+			if len(src) < 2 {
+				return nil, fmt.Errorf("%w, truncated copy", ErrCorruptStream)
+			}
+			length = 4 + int(tag>>2&0x07)
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 0x02:
+			if len(src) < 3 {
+				return nil, fmt.Errorf("%w, truncated copy", ErrCorruptStream)
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:3]))
+			src = src[3:]
+		case 0x03:
+			if len(src) < 5 {
+				return nil, fmt.Errorf("%w, truncated copy", ErrCorruptStream)
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:5]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst)-start || len(dst)+length > end {
+			return nil, fmt.Errorf("%w, invalid copy", ErrCorruptStream)
+		}
+		// Copies may overlap the bytes they produce, so are made bytewise.
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != end {
+		return nil, fmt.Errorf("%w, block length mismatch", ErrCorruptStream)
+	}
+	return dst, nil
+}
@@ -0,0 +1,174 @@
+package client_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+func TestCompression(t *testing.T) {
+	reading := client.Reading{Temperature: 67.77, BatteryLevel: 0.25666}
+	b, err := reading.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	frame := client.AppendFrame(nil, client.FrameAlarm, b)
+	frames := bytes.Repeat(frame, 20)
+
+	tests := []struct {
+		Name        string
+		Compression client.Compression
+		Stream      func(*testing.T) []byte
+	}{
+		{
+			Name:        "zlib",
+			Compression: client.CompressionZlib,
+			Stream: func(t *testing.T) []byte {
+				var buf bytes.Buffer
+				w := zlib.NewWriter(&buf)
+				w.Write(frames)
+				if err := w.Flush(); err != nil {
+					t.Fatalf("unexpected error = %s\n", err)
+				}
+				return buf.Bytes()
+			},
+		},
+		{
+			Name:        "snappy",
+			Compression: client.CompressionSnappy,
+			Stream: func(*testing.T) []byte {
+				stream := snappyChunk(nil, 0xff, []byte("sNaPpY"))
+				stream = snappyChunk(stream, 0xfe, make([]byte, 3))
+				stream = snappyChunk(stream, 0x01, append(snappyChecksum(frame), frame...))
+				rest := frames[len(frame):]
+				return snappyChunk(stream, 0x00, append(snappyChecksum(rest), snappyBlock(rest, len(frame))...))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			stream := test.Stream(t)
+			server, device := net.Pipe()
+			defer server.Close()
+			go func(compression client.Compression) {
+				device.Write(append([]byte("490154203237518"), "logcz"...))
+				device.Write([]byte{byte(compression)})
+				device.Write(stream)
+				device.Close()
+			}(test.Compression)
+
+			ctx := context.Background()
+			c, err := client.New(ctx, server, client.WithLoggerOutput(io.Discard))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if err := c.ProcessLogin(ctx); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if m := c.Metadata(); m.Protocol != client.ProtocolV2 || m.Compression != test.Compression {
+				t.Errorf("unexpected metadata = %+v", m)
+			}
+			s := client.NewSession()
+			for {
+				if finished, _ := c.ProcessNext(ctx, s); finished {
+					break
+				}
+			}
+
+			if stats := c.Stats(); stats.Alarms != 20 {
+				t.Errorf("expected 20 alarms, actual = %d", stats.Alarms)
+			}
+			if last := c.LastReading(); last.Temperature != reading.Temperature {
+				t.Errorf("unexpected last reading = %+v", last)
+			}
+			if stats := c.Stats(); stats.BytesRead >= int64(len(frames)) {
+				t.Errorf("expected fewer than %d bytes read, actual = %d", len(frames), stats.BytesRead)
+			}
+		})
+	}
+}
+
+func TestCompressionRejected(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Login    []byte
+		Err      error
+		Expected client.CloseReason
+	}{
+		{
+			Name:     "unsupported",
+			Login:    []byte{'l', 'o', 'g', 'c', 'z', 9},
+			Err:      client.ErrUnsupportedCompression,
+			Expected: client.CloseUnauthorized,
+		},
+		{
+			Name:     "corrupt",
+			Login:    []byte{'l', 'o', 'g', 'c', 'z', byte(client.CompressionSnappy), 0x00, 0x04, 0x00, 0x00, 1, 2, 3, 4},
+			Err:      client.ErrCorruptStream,
+			Expected: client.CloseError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			server, device := net.Pipe()
+			defer server.Close()
+			defer device.Close()
+			go device.Write(append([]byte("490154203237518"), test.Login...))
+
+			ctx := context.Background()
+			c, err := client.New(ctx, server, client.WithLoggerOutput(io.Discard))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			err = c.ProcessLogin(ctx)
+			if err == nil {
+				_, err = c.ProcessNext(ctx, client.NewSession())
+			}
+			if !errors.Is(err, test.Err) {
+				t.Errorf("expected error wrapping %v, actual = %v", test.Err, err)
+			}
+			if reason := c.CloseReason(); reason != test.Expected {
+				t.Errorf("expected close reason %s, actual = %s", test.Expected, reason)
+			}
+		})
+	}
+}
+
+// snappyChunk appends a Snappy framed stream chunk of type typ to b.
+func snappyChunk(b []byte, typ byte, data []byte) []byte {
+	b = append(b, typ, byte(len(data)), byte(len(data)>>8), byte(len(data)>>16))
+	return append(b, data...)
+}
+
+// snappyChecksum retrieves the Little-Endian masked CRC-32C of b.
+func snappyChecksum(b []byte) []byte {
+	c := crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli))
+	return binary.LittleEndian.AppendUint32(nil, (c>>15|c<<17)+0xa282ead8)
+}
+
+// snappyBlock encodes b, which repeats every period bytes, as a Snappy block
+// of a literal followed by copies.
+func snappyBlock(b []byte, period int) []byte {
+	block := binary.AppendUvarint(nil, uint64(len(b)))
+	block = append(block, byte(period-1)<<2)
+	block = append(block, b[:period]...)
+	for n := len(b) - period; n > 0; {
+		length := n
+		if length > 64 {
+			length = 64
+		}
+		block = append(block, byte(length-1)<<2|0x02, byte(period), byte(period>>8))
+		n -= length
+	}
+	return block
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// configSize is the size of a FrameConfig payload.
+const configSize = 32
+
+// Config is the configuration of a device, pushed to devices in a FrameConfig
+// frame.
+type Config struct {
+	// Version identifies the Config. It is assigned by PushConfig.
+	Version uint32
+
+	// ReportingInterval is how often the device should send readings. It is
+	// transmitted with millisecond precision.
+	ReportingInterval time.Duration
+
+	// TemperatureLow and TemperatureHigh bound the temperatures at which the
+	// device raises an alarm.
+	TemperatureLow  float64
+	TemperatureHigh float64
+
+	// BatteryLow is the battery level at which the device raises an alarm.
+	BatteryLow float64
+}
+
+// MarshalJSON satisfies the json.Marshaler interface, encoding
+// ReportingInterval as a duration string, e.g. "30s".
+func (c Config) MarshalJSON() ([]byte, error) {
+	type config Config
+	return json.Marshal(struct {
+		config
+		ReportingInterval string
+	}{config: config(c), ReportingInterval: c.ReportingInterval.String()})
+}
+
+// UnmarshalJSON satisfies the json.Unmarshaler interface, decoding
+// ReportingInterval from a duration string, e.g. "30s".
+func (c *Config) UnmarshalJSON(b []byte) error {
+	type config Config
+	var v struct {
+		config
+		ReportingInterval string
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*c = Config(v.config)
+	if v.ReportingInterval == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(v.ReportingInterval)
+	if err != nil {
+		return fmt.Errorf("failed to client.Config.UnmarshalJSON/ParseDuration\terr = %w", err)
+	}
+	c.ReportingInterval = interval
+	return nil
+}
+
+// encode encodes c as a FrameConfig payload. All fields are Big-Endian.
+func (c Config) encode() []byte {
+	b := make([]byte, configSize)
+	binary.BigEndian.PutUint32(b[0:4], c.Version)
+	binary.BigEndian.PutUint32(b[4:8], uint32(c.ReportingInterval/time.Millisecond))
+	binary.BigEndian.PutUint64(b[8:16], math.Float64bits(c.TemperatureLow))
+	binary.BigEndian.PutUint64(b[16:24], math.Float64bits(c.TemperatureHigh))
+	binary.BigEndian.PutUint64(b[24:32], math.Float64bits(c.BatteryLow))
+	return b
+}
+
+// ConfigState describes the configuration most recently pushed to a device,
+// and the configuration the device last confirmed.
+type ConfigState struct {
+	Pending     *Config    `json:",omitempty"`
+	PushedAt    *time.Time `json:",omitempty"`
+	Applied     *Config    `json:",omitempty"`
+	ConfirmedAt *time.Time `json:",omitempty"`
+}
+
+// configState tracks a Client's ConfigState. It is referenced by pointer so
+// that copies of a Client share it.
+type configState struct {
+	mu      sync.Mutex
+	version uint32
+	state   ConfigState
+}
+
+// push assigns cfg the next version, and records it as pending. The
+// ConfigState before the push is returned, for rollback.
+func (s *configState) push(cfg Config) (Config, ConfigState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.state
+	s.version++
+	cfg.Version = s.version
+	now := time.Now()
+	s.state.Pending = &cfg
+	s.state.PushedAt = &now
+	return cfg, prev
+}
+
+// rollback restores prev, the ConfigState before cfg was pushed, if cfg is
+// still pending.
+func (s *configState) rollback(cfg Config, prev ConfigState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state.Pending != nil && s.state.Pending.Version == cfg.Version {
+		s.state = prev
+	}
+}
+
+// confirm records the pending Config as applied if its version matches, and
+// reports whether it did.
+func (s *configState) confirm(version uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state.Pending == nil || s.state.Pending.Version != version {
+		return false
+	}
+	now := time.Now()
+	s.state.Applied = s.state.Pending
+	s.state.Pending = nil
+	s.state.ConfirmedAt = &now
+	return true
+}
+
+// get retrieves the ConfigState.
+func (s *configState) get() ConfigState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// PushConfig writes cfg to the Client's device in a FrameConfig frame, and
+// returns cfg with its assigned Version. The Config remains pending until the
+// device confirms it with a FrameConfigAck frame carrying the Version. If the
+// frame fails to be written, the ConfigState is left as it was. Only protocol
+// v2 Clients support configuration; otherwise ErrProtocolUnsupported is
+// returned.
+func (c Client) PushConfig(cfg Config) (Config, error) {
+	if c.Protocol() != ProtocolV2 {
+		return Config{}, ErrProtocolUnsupported
+	}
+
+	// The Config is recorded as pending before it is written, so that a
+	// device acking it at once finds it pending.
+	cfg, prev := c.config.push(cfg)
+	if err := c.writeFrame(FrameConfig, cfg.encode()); err != nil {
+		c.config.rollback(cfg, prev)
+		return Config{}, err
+	}
+	c.logInfo.Printf("[IMEI %d] Config %d Pushed\n", c.IMEI(), cfg.Version)
+	return cfg, nil
+}
+
+// ConfigState retrieves the configuration state of the Client's device.
+func (c Client) ConfigState() ConfigState {
+	return c.config.get()
+}
+
+// processConfigAck confirms the Config identified by a config ack frame
+// payload.
+func (c Client) processConfigAck(payload []byte) {
+	if len(payload) < 4 {
+		c.logWarn.Printf("[IMEI %d] Invalid Config Ack Frame, length = %d\n", c.IMEI(), len(payload))
+		return
+	}
+	version := binary.BigEndian.Uint32(payload)
+	if !c.config.confirm(version) {
+		c.logWarn.Printf("[IMEI %d] Ack for Stale Config %d\n", c.IMEI(), version)
+		return
+	}
+	c.logInfo.Printf("[IMEI %d] Config %d Confirmed\n", c.IMEI(), version)
+}
@@ -0,0 +1,113 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConfigEncode(t *testing.T) {
+	cfg := Config{
+		Version:           7,
+		ReportingInterval: 250 * time.Millisecond,
+		TemperatureLow:    -10,
+		TemperatureHigh:   45.5,
+		BatteryLow:        15,
+	}
+	b := cfg.encode()
+	if len(b) != configSize {
+		t.Fatalf("expected %d bytes, actual = %d", configSize, len(b))
+	}
+	if v := binary.BigEndian.Uint32(b[0:4]); v != 7 {
+		t.Errorf("expected version 7, actual = %d", v)
+	}
+	if v := binary.BigEndian.Uint32(b[4:8]); v != 250 {
+		t.Errorf("expected interval 250, actual = %d", v)
+	}
+	if v := math.Float64frombits(binary.BigEndian.Uint64(b[16:24])); v != 45.5 {
+		t.Errorf("expected temperature high 45.5, actual = %f", v)
+	}
+}
+
+func TestConfigState(t *testing.T) {
+	s := new(configState)
+	first, _ := s.push(Config{BatteryLow: 10})
+	second, _ := s.push(Config{BatteryLow: 20})
+	if first.Version != 1 || second.Version != 2 {
+		t.Fatalf("expected versions 1 and 2, actual = %d and %d", first.Version, second.Version)
+	}
+
+	if s.confirm(first.Version) {
+		t.Errorf("expected stale version %d not to be confirmed", first.Version)
+	}
+	if !s.confirm(second.Version) {
+		t.Errorf("expected version %d to be confirmed", second.Version)
+	}
+
+	state := s.get()
+	if state.Pending != nil {
+		t.Errorf("expected no pending config, actual = %+v", *state.Pending)
+	}
+	if state.Applied == nil || state.Applied.BatteryLow != 20 {
+		t.Errorf("expected applied config with battery low 20, actual = %+v", state.Applied)
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	cfg := Config{Version: 3, ReportingInterval: 30 * time.Second, BatteryLow: 15}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	expected := `{"Version":3,"TemperatureLow":0,"TemperatureHigh":0,"BatteryLow":15,"ReportingInterval":"30s"}`
+	if string(b) != expected {
+		t.Errorf("expected = %s\nactual = %s", expected, b)
+	}
+
+	var actual Config
+	if err := json.Unmarshal(b, &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if actual != cfg {
+		t.Errorf("expected = %+v, actual = %+v", cfg, actual)
+	}
+	if err := json.Unmarshal([]byte(`{"ReportingInterval": 30}`), &actual); err == nil {
+		t.Error("expected error decoding a numeric interval")
+	}
+
+	b, err = json.Marshal(ConfigState{})
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if string(b) != "{}" {
+		t.Errorf("expected empty ConfigState to omit its fields, actual = %s", b)
+	}
+}
+
+func TestPushConfigWriteFailure(t *testing.T) {
+	server, device := net.Pipe()
+	defer server.Close()
+	go device.Write([]byte("490154203237518logv2"))
+
+	ctx := context.Background()
+	c, err := New(ctx, server, WithLoggerOutput(io.Discard))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if err := c.ProcessLogin(ctx); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	device.Close()
+
+	if _, err := c.PushConfig(Config{BatteryLow: 10}); err == nil {
+		t.Fatal("expected error")
+	}
+	if state := c.ConfigState(); state.Pending != nil || state.PushedAt != nil {
+		t.Errorf("expected no pending config, actual = %+v", state)
+	}
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrInvalidDatagram indicates a datagram did not hold a reading.
+var ErrInvalidDatagram = errors.New("invalid datagram")
+
+// NewDatagram initializes a Client for the device imei, which sends readings
+// from remote in datagrams, such as CoAP requests, rather than over a
+// connection. The Client is logged in to protocol v1 once initialized; each
+// datagram received from the device is passed to ProcessDatagram. The Client
+// has no downlink, so commands and acknowledgements cannot reach the device.
+func NewDatagram(imei uint64, remote net.Addr, options ...ClientOption) *Client {
+	c := newClient(newDatagramConn(remote), imei, nil, options)
+	c.meta.setProtocol(ProtocolV1)
+	c.logInfo.Printf("[IMEI %d] Datagram Session Established\n", c.IMEI())
+	return c
+}
+
+// ProcessDatagram processes b, a datagram sent by the Client's device holding
+// a single reading, carrying state between calls in s. The error returned
+// describes why the reading was not stored: ErrInvalidDatagram or an
+// ErrInvalidRange if it failed to decode, ErrQuotaExceeded if the Client's
+// tenant rejected it, ErrClientQuarantined if it failed to decode once too
+// often, or ErrClientClose if the Client is closed.
+func (c Client) ProcessDatagram(ctx context.Context, s *Session, b []byte) error {
+	if c.closed(ctx) {
+		return ErrClientClose
+	}
+	c.stats.bytesRead.Add(int64(len(b)))
+	c.metrics.BytesRead.Add(int64(len(b)))
+	if !c.allowReading() {
+		return ErrQuotaExceeded
+	}
+
+	var err error
+	if len(b) != readingSize {
+		err = fmt.Errorf("[IMEI %d] failed to client.ProcessDatagram\tlen = %d err = %w", c.IMEI(), len(b), ErrInvalidDatagram)
+		c.metrics.Errors.Inc()
+		c.stats.decodeErrors.Inc()
+		c.logError.Println(err)
+	} else {
+		err = c.processReading(ctx, b, &s.reading)
+	}
+	if quarantined := c.checkDecodeFailures(err, &s.decodeFailures); quarantined != nil {
+		return quarantined
+	}
+	return err
+}
+
+// datagramConn is the net.Conn of a Client whose device sends datagrams. Its
+// reads block until it is closed, and its writes fail, as datagrams are
+// received and answered by the server rather than the Client.
+type datagramConn struct {
+	remote net.Addr
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newDatagramConn(remote net.Addr) *datagramConn {
+	return &datagramConn{remote: remote, closed: make(chan struct{})}
+}
+
+// Read satisfies the io.Reader interface, blocking until the conn is closed.
+func (c *datagramConn) Read([]byte) (int, error) {
+	<-c.closed
+	return 0, net.ErrClosed
+}
+
+// Write satisfies the io.Writer interface, and always fails.
+func (c *datagramConn) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("failed to client.datagramConn.Write\terr = %w", errors.ErrUnsupported)
+}
+
+// Close satisfies the io.Closer interface.
+func (c *datagramConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *datagramConn) LocalAddr() net.Addr              { return nil }
+func (c *datagramConn) RemoteAddr() net.Addr             { return c.remote }
+func (c *datagramConn) SetDeadline(time.Time) error      { return nil }
+func (c *datagramConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *datagramConn) SetWriteDeadline(time.Time) error { return nil }
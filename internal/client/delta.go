@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	// ErrNoBaseReading indicates a delta frame was received before any
+	// reading it could be applied to.
+	ErrNoBaseReading = errors.New("no base reading")
+
+	// ErrInvalidDelta indicates a delta frame's field mask names unknown
+	// fields, or its payload does not match its field mask.
+	ErrInvalidDelta = errors.New("invalid delta")
+)
+
+// deltaFields is the number of Reading fields a delta frame may carry, in
+// encoded order.
+const deltaFields = readingSize / 8
+
+// applyDelta writes into b, which must be readingSize bytes long, the encoded
+// reading described by payload, the payload of a FrameDelta, relative to
+// base.
+func applyDelta(b []byte, base Reading, payload []byte) error {
+	if len(payload) < 1 {
+		return fmt.Errorf("%w, length = %d", ErrShortFrame, len(payload))
+	}
+	mask := payload[0]
+	if mask>>deltaFields != 0 {
+		return fmt.Errorf("%w, mask = %#x", ErrInvalidDelta, mask)
+	}
+	fields := payload[1:]
+
+	previous := [deltaFields]float64{
+		base.Temperature,
+		base.Altitude,
+		base.Latitude,
+		base.Longitude,
+		base.BatteryLevel,
+	}
+	for i, value := range previous {
+		field := b[i*8 : i*8+8]
+		if mask&(1<<i) == 0 {
+			binary.BigEndian.PutUint64(field, math.Float64bits(value))
+			continue
+		}
+		if len(fields) < 8 {
+			return fmt.Errorf("%w, mask = %#x, length = %d", ErrShortFrame, mask, len(payload))
+		}
+		copy(field, fields[:8])
+		fields = fields[8:]
+	}
+	if len(fields) != 0 {
+		return fmt.Errorf("%w, mask = %#x, length = %d", ErrInvalidDelta, mask, len(payload))
+	}
+	return nil
+}
+
+// processDelta reconstructs the reading described by payload, the payload of
+// a FrameDelta, from the Client's last reading, and processes it.
+func (c Client) processDelta(ctx context.Context, payload []byte, reading *Reading) error {
+	var b [readingSize]byte
+	err := ErrNoBaseReading
+	if c.hasReading() {
+		err = applyDelta(b[:], c.lastReading.Get(), payload)
+	}
+	if err != nil {
+		c.metrics.Errors.Inc()
+		c.stats.decodeErrors.Inc()
+		c.logError.Printf("[IMEI %d] Failed to Client.processDelta\terr = %s\n", c.IMEI(), err)
+		return err
+	}
+	return c.processReading(ctx, b[:], reading)
+}
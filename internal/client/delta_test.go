@@ -0,0 +1,124 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"testing"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+func TestDeltaFrames(t *testing.T) {
+	base := client.Reading{Temperature: 67.77, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.25666}
+	full, err := base.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	field := func(v float64) []byte {
+		return binary.BigEndian.AppendUint64(nil, math.Float64bits(v))
+	}
+	delta := func(mask byte, fields ...[]byte) []byte {
+		return client.AppendFrame(nil, client.FrameDelta, append([]byte{mask}, bytes.Join(fields, nil)...))
+	}
+	ack := client.AppendFrame(nil, client.FrameReadingAck, nil)
+	nack := func(code client.NackCode) []byte {
+		return client.AppendFrame(nil, client.FrameNack, []byte{byte(code)})
+	}
+
+	steps := []struct {
+		Name     string
+		Frame    []byte
+		Expected []byte
+		Reading  client.Reading
+	}{
+		{
+			Name:     "delta before reading",
+			Frame:    delta(0x01, field(70)),
+			Expected: nack(client.NackNoBaseReading),
+		},
+		{
+			Name:     "full reading",
+			Frame:    client.AppendFrame(nil, client.FrameReading, full),
+			Expected: ack,
+			Reading:  base,
+		},
+		{
+			Name:     "temperature and battery level changed",
+			Frame:    delta(0x11, field(70), field(0.2)),
+			Expected: ack,
+			Reading:  client.Reading{Temperature: 70, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.2},
+		},
+		{
+			Name:     "nothing changed",
+			Frame:    delta(0x00),
+			Expected: ack,
+			Reading:  client.Reading{Temperature: 70, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.2},
+		},
+		{
+			Name:     "latitude out of range",
+			Frame:    delta(0x04, field(91)),
+			Expected: nack(client.NackInvalidLatitude),
+			Reading:  client.Reading{Temperature: 70, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.2},
+		},
+		{
+			Name:     "unknown field",
+			Frame:    delta(0x20, field(1)),
+			Expected: nack(client.NackInvalidDelta),
+			Reading:  client.Reading{Temperature: 70, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.2},
+		},
+		{
+			Name:     "missing field",
+			Frame:    delta(0x03, field(1)),
+			Expected: nack(client.NackShortFrame),
+			Reading:  client.Reading{Temperature: 70, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.2},
+		},
+		{
+			Name:     "trailing bytes",
+			Frame:    delta(0x01, field(1), field(2)),
+			Expected: nack(client.NackInvalidDelta),
+			Reading:  client.Reading{Temperature: 70, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.2},
+		},
+	}
+
+	server, device := net.Pipe()
+	defer server.Close()
+	defer device.Close()
+	go device.Write(append([]byte("490154203237518"), "logv2"...))
+
+	ctx := context.Background()
+	c, err := client.New(
+		ctx,
+		server,
+		client.WithLoggerOutput(io.Discard),
+		client.WithAcknowledgements())
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if err := c.ProcessLogin(ctx); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	s := client.NewSession()
+	for _, step := range steps {
+		go device.Write(step.Frame)
+		answer := make(chan []byte, 1)
+		go func(n int) {
+			b := make([]byte, n)
+			io.ReadFull(device, b)
+			answer <- b
+		}(len(step.Expected))
+		if finished, err := c.ProcessNext(ctx, s); finished {
+			t.Fatalf("%s: unexpected finished client, err = %v", step.Name, err)
+		}
+		if actual := <-answer; !bytes.Equal(step.Expected, actual) {
+			t.Errorf("%s: expected % x, actual = % x", step.Name, step.Expected, actual)
+		}
+		if last := c.LastReading(); last != step.Reading {
+			t.Errorf("%s: expected last reading %+v, actual = %+v", step.Name, step.Reading, last)
+		}
+	}
+}
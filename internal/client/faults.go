@@ -0,0 +1,97 @@
+//go:build faults
+// +build faults
+
+package client
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Faults configures the faults injected into Client connections, so that
+// resilience behaviors can be exercised deterministically. Faults are only
+// available in builds with the faults build tag.
+type Faults struct {
+	// ReadLatency delays each read from the connection.
+	ReadLatency time.Duration
+
+	// PartialWriteRate is the fraction of writes that write only half of
+	// their bytes, and fail with io.ErrShortWrite.
+	PartialWriteRate float64
+
+	// DisconnectRate is the fraction of reads that close the connection
+	// before reading.
+	DisconnectRate float64
+
+	// Seed seeds the random faults of each connection, so that a connection
+	// sees the same sequence of faults each run.
+	Seed int64
+}
+
+var faults atomic.Pointer[Faults]
+
+// InjectFaults sets the faults injected into the connections of Clients
+// initialized afterwards. The zero Faults disables injection.
+func InjectFaults(f Faults) {
+	faults.Store(&f)
+}
+
+// injectFaults wraps conn with the faults set by InjectFaults.
+func injectFaults(conn net.Conn) net.Conn {
+	f := faults.Load()
+	if f == nil || *f == (Faults{}) {
+		return conn
+	}
+	return &faultyConn{
+		Conn:   conn,
+		faults: *f,
+		rand:   rand.New(rand.NewSource(f.Seed)),
+	}
+}
+
+// faultyConn is a net.Conn that injects faults into its reads and writes.
+type faultyConn struct {
+	net.Conn
+	faults Faults
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// Read satisfies the io.Reader interface, delaying the read and randomly
+// closing the connection beforehand.
+func (c *faultyConn) Read(b []byte) (int, error) {
+	if c.faults.ReadLatency > 0 {
+		time.Sleep(c.faults.ReadLatency)
+	}
+	if c.chance(c.faults.DisconnectRate) {
+		c.Conn.Close()
+	}
+	return c.Conn.Read(b)
+}
+
+// Write satisfies the io.Writer interface, randomly writing only half of b.
+func (c *faultyConn) Write(b []byte) (int, error) {
+	if !c.chance(c.faults.PartialWriteRate) {
+		return c.Conn.Write(b)
+	}
+	n, err := c.Conn.Write(b[:len(b)/2])
+	if err != nil {
+		return n, err
+	}
+	return n, io.ErrShortWrite
+}
+
+// chance reports whether a fault occurring at rate occurs.
+func (c *faultyConn) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rand.Float64() < rate
+}
@@ -0,0 +1,12 @@
+//go:build !faults
+// +build !faults
+
+package client
+
+import "net"
+
+// injectFaults returns conn, as faults are only injected in builds with the
+// faults build tag.
+func injectFaults(conn net.Conn) net.Conn {
+	return conn
+}
@@ -0,0 +1,85 @@
+//go:build faults
+// +build faults
+
+package client_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+// loggedIn initializes a protocol v2 Client with faults injected into its
+// connection, and logs it in. The device end of the connection is returned.
+func loggedIn(t *testing.T, faults client.Faults) (*client.Client, net.Conn) {
+	t.Helper()
+	client.InjectFaults(faults)
+	t.Cleanup(func() { client.InjectFaults(client.Faults{}) })
+
+	server, device := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		device.Close()
+	})
+	go device.Write(append([]byte("490154203237518"), "logv2"...))
+
+	ctx := context.Background()
+	c, err := client.New(ctx, server, client.WithLoggerOutput(io.Discard))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if err := c.ProcessLogin(ctx); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	return c, device
+}
+
+func TestFaultsReadLatency(t *testing.T) {
+	start := time.Now()
+	loggedIn(t, client.Faults{ReadLatency: 50 * time.Millisecond})
+
+	// The IMEI and login are each read once.
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected reads to be delayed, elapsed = %s", elapsed)
+	}
+}
+
+func TestFaultsPartialWrites(t *testing.T) {
+	c, device := loggedIn(t, client.Faults{PartialWriteRate: 1})
+
+	received := make(chan int, 1)
+	go func() {
+		b := make([]byte, 64)
+		n, _ := device.Read(b)
+		received <- n
+	}()
+	if _, err := c.SendCommand([]byte("reboot")); err == nil {
+		t.Errorf("expected partial write to fail")
+	}
+
+	// A 3 byte header, 4 byte ID, and 6 byte payload, of which half is
+	// written.
+	if n := <-received; n != 6 {
+		t.Errorf("expected 6 bytes written, actual = %d", n)
+	}
+	if commands := c.Commands(); len(commands) != 1 || commands[0].Status != client.CommandFailed {
+		t.Errorf("expected failed command, actual = %+v", commands)
+	}
+}
+
+func TestFaultsDisconnects(t *testing.T) {
+	client.InjectFaults(client.Faults{DisconnectRate: 1})
+	t.Cleanup(func() { client.InjectFaults(client.Faults{}) })
+
+	server, device := net.Pipe()
+	defer device.Close()
+	go device.Write([]byte("490154203237518"))
+
+	if _, err := client.New(context.Background(), server); err == nil {
+		t.Errorf("expected disconnected client to fail")
+	}
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// Metadata describes a Client's connection, for troubleshooting.
+type Metadata struct {
+	// RemoteAddr is the address of the device's end of the connection.
+	RemoteAddr string
+
+	// ConnectedAt denotes when the Client connected.
+	ConnectedAt time.Time
+
+	// Protocol is the protocol negotiated at login, or zero before login.
+	Protocol Protocol
+
+	// Compression is the stream compression negotiated at login.
+	Compression Compression `json:",omitempty"`
+
+	// TLS describes the connection's TLS session, and is nil for plain TCP
+	// connections.
+	TLS *TLSState `json:",omitempty"`
+
+	// Tenant is the tenant owning the device, if any.
+	Tenant string `json:",omitempty"`
+
+	// Listener is the listener the device connected through, if named.
+	Listener string `json:",omitempty"`
+}
+
+// TLSState describes the TLS session of a Client's connection.
+type TLSState struct {
+	Version     string
+	CipherSuite string
+	ServerName  string `json:",omitempty"`
+
+	// Organization is the organization named by the device's certificate, if
+	// it presented one that was verified against the server's client CAs.
+	// Organizations of unverified certificates are not trusted, as any device
+	// could claim any organization.
+	Organization string `json:",omitempty"`
+}
+
+// tlsConn is satisfied by connections that carry a TLS session, such as
+// *tls.Conn.
+type tlsConn interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// tlsStateOf retrieves the TLS session of conn, or nil if conn does not
+// carry one. The state is only complete once the handshake has finished,
+// which the first read ensures.
+func tlsStateOf(conn net.Conn) *TLSState {
+	tc, ok := conn.(tlsConn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	if !state.HandshakeComplete {
+		return nil
+	}
+	s := &TLSState{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+	}
+	if len(state.VerifiedChains) > 0 {
+		if org := state.VerifiedChains[0][0].Subject.Organization; len(org) > 0 {
+			s.Organization = org[0]
+		}
+	}
+	return s
+}
+
+// Metadata retrieves a description of the Client's connection.
+func (c Client) Metadata() Metadata {
+	return Metadata{
+		RemoteAddr:  c.remoteAddr,
+		ConnectedAt: c.createdAt.Get(),
+		Protocol:    c.Protocol(),
+		Compression: c.Compression(),
+		TLS:         c.tls,
+		Tenant:      c.tenant,
+		Listener:    c.listener,
+	}
+}
+
+// WithListener returns a ClientOption that names the listener the Client's
+// device connected through, e.g. "tcp", for its Metadata.
+func WithListener(name string) ClientOption {
+	return func(c *Client) {
+		c.listener = name
+	}
+}
+
+// Listener retrieves the name of the listener the Client's device connected
+// through. An empty string is returned if it was not named.
+func (c Client) Listener() string {
+	return c.listener
+}
@@ -0,0 +1,106 @@
+package client_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+func TestMetadata(t *testing.T) {
+	server, device := net.Pipe()
+	defer server.Close()
+	defer device.Close()
+	go device.Write(append([]byte("490154203237518"), "logv2"...))
+
+	ctx := context.Background()
+	c, err := client.New(ctx, server, client.WithLoggerOutput(io.Discard))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if err := c.ProcessLogin(ctx); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	m := c.Metadata()
+	if m.RemoteAddr != "pipe" || m.Protocol != client.ProtocolV2 || m.ConnectedAt.IsZero() || m.TLS != nil {
+		t.Errorf("unexpected metadata = %+v", m)
+	}
+}
+
+func TestMetadataTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"acme"}},
+		DNSNames:     []string{"thermomatic.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(parsed)
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	tests := map[string]struct {
+		clientAuth   tls.ClientAuthType
+		clientCAs    *x509.CertPool
+		organization string
+	}{
+		// Organizations of unverified certificates are not trusted, as any
+		// device could claim any organization.
+		"unverified": {clientAuth: tls.RequireAnyClientCert},
+		"verified":   {clientAuth: tls.RequireAndVerifyClientCert, clientCAs: roots, organization: "acme"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, device := net.Pipe()
+			defer server.Close()
+			defer device.Close()
+			tlsServer := tls.Server(server, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				ClientAuth:   test.clientAuth,
+				ClientCAs:    test.clientCAs,
+			})
+			tlsDevice := tls.Client(device, &tls.Config{
+				Certificates:       []tls.Certificate{cert},
+				ServerName:         "thermomatic.test",
+				InsecureSkipVerify: true,
+			})
+			go tlsDevice.Write([]byte("490154203237518"))
+
+			c, err := client.New(context.Background(), tlsServer, client.WithLoggerOutput(io.Discard))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+
+			m := c.Metadata()
+			if m.TLS == nil {
+				t.Fatal("expected TLS state")
+			}
+			if m.TLS.Version != "TLS 1.3" || m.TLS.ServerName != "thermomatic.test" || m.TLS.CipherSuite == "" || m.TLS.Organization != test.organization {
+				t.Errorf("unexpected TLS state = %+v", m.TLS)
+			}
+		})
+	}
+}
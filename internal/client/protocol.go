@@ -0,0 +1,206 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Protocol is the version of the device protocol negotiated at login.
+type Protocol int32
+
+const (
+	// ProtocolV1 devices login with "login", and then send bare 40 byte
+	// reading messages.
+	ProtocolV1 Protocol = 1
+
+	// ProtocolV2 devices login with "logv2", and then exchange typed frames.
+	// Devices may instead login with "logfw", followed by a 1 byte length and
+	// their firmware version, or login with "logcz", followed by a 1 byte
+	// Compression, to compress the stream they send.
+	ProtocolV2 Protocol = 2
+)
+
+// WithProtocols returns a ClientOption that refuses logins with protocols
+// for which allowed returns false. Refused Clients are closed with
+// CloseUnauthorized.
+func WithProtocols(allowed func(Protocol) bool) ClientOption {
+	return func(c *Client) {
+		c.allowsProtocol = allowed
+	}
+}
+
+const (
+	loginV1         = "login"
+	loginV2         = "logv2"
+	loginV2Firmware = "logfw"
+	loginV2Compress = "logcz"
+)
+
+var (
+	// ErrFrameTooLarge indicates a frame's declared payload length exceeds
+	// the largest payload accepted.
+	ErrFrameTooLarge = errors.New("frame too large")
+
+	// ErrShortFrame indicates a frame's payload is shorter than its frame
+	// type requires.
+	ErrShortFrame = errors.New("frame too short")
+
+	// ErrLongFrame indicates a frame's payload is longer than its frame type
+	// allows.
+	ErrLongFrame = errors.New("frame too long")
+)
+
+// FrameType identifies the payload of a protocol v2 frame. Uplink frames are
+// sent by devices, and downlink frames are sent by the server.
+type FrameType byte
+
+const (
+	// FrameReading is an uplink frame carrying a 40 byte reading. Reading
+	// frames are subject to the reading rate limit.
+	FrameReading FrameType = 0x01
+
+	// FrameAlarm is an uplink frame carrying a 40 byte reading that describes
+	// a critical event detected on-device. Alarm frames bypass the reading
+	// rate limit.
+	FrameAlarm FrameType = 0x02
+
+	// FrameAck is an uplink frame acknowledging a FrameCommand. Its payload
+	// is the 4 byte Big-Endian ID of the command.
+	FrameAck FrameType = 0x03
+
+	// FrameConfigAck is an uplink frame confirming a FrameConfig was applied.
+	// Its payload is the 4 byte Big-Endian version of the config.
+	FrameConfigAck FrameType = 0x04
+
+	// FrameFirmwareAck is an uplink frame acknowledging firmware chunks. Its
+	// payload is the 4 byte Big-Endian transfer ID, followed by the 4 byte
+	// Big-Endian image offset the device next expects.
+	FrameFirmwareAck FrameType = 0x05
+
+	// FrameDelta is an uplink frame carrying only the fields of a reading
+	// that changed since the device's previous reading. Its payload is a 1
+	// byte mask, where bit i is set if the i-th field of an encoded reading
+	// changed, followed by the 8 byte encoding of each changed field, in
+	// order. Delta frames are subject to the reading rate limit.
+	FrameDelta FrameType = 0x06
+
+	// FrameCommand is a downlink frame carrying a command for the device. Its
+	// payload is a 4 byte Big-Endian command ID, followed by the command.
+	FrameCommand FrameType = 0x81
+
+	// FrameConfig is a downlink frame carrying a device Config.
+	FrameConfig FrameType = 0x82
+
+	// FrameFirmwareChunk is a downlink frame carrying a chunk of a firmware
+	// image. Its payload is the 4 byte Big-Endian transfer ID, 4 byte
+	// Big-Endian chunk offset, 4 byte Big-Endian image size, and the chunk.
+	FrameFirmwareChunk FrameType = 0x83
+
+	// FrameGoodbye is a downlink frame informing the device the server is
+	// shutting down, so that it may reconnect to another server. Its payload
+	// is empty.
+	FrameGoodbye FrameType = 0x84
+
+	// FrameReadingAck is a downlink frame acknowledging a FrameReading or
+	// FrameAlarm was processed, sent in acknowledged mode. Its payload is
+	// empty.
+	FrameReadingAck FrameType = 0x85
+
+	// FrameNack is a downlink frame rejecting an uplink frame, sent in
+	// acknowledged mode. Its payload is a 1 byte NackCode.
+	FrameNack FrameType = 0x86
+)
+
+const (
+	// frameHeaderSize is the size of a frame header: a 1 byte FrameType
+	// followed by a 2 byte Big-Endian payload length.
+	frameHeaderSize = 3
+
+	// maxFramePayload is the largest frame payload accepted.
+	maxFramePayload = 1024
+
+	// readingSize is the size of an encoded Reading.
+	readingSize = 40
+)
+
+// readingBufPool pools the buffers protocol v1 readings are read into, so
+// that connections do not each allocate one.
+var readingBufPool = sync.Pool{
+	New: func() interface{} {
+		return new([readingSize]byte)
+	},
+}
+
+// frameBufPool pools the scratch space protocol v2 frame headers and payloads
+// are read into, so that connections do not each allocate one.
+var frameBufPool = sync.Pool{
+	New: func() interface{} {
+		return new([frameHeaderSize + maxFramePayload]byte)
+	},
+}
+
+// readFrame reads a single frame from r. header must be frameHeaderSize bytes
+// long, and the frame payload is read into buf, which must be maxFramePayload
+// bytes long. The frame's type and payload are returned.
+func readFrame(r io.Reader, header, buf []byte) (FrameType, []byte, error) {
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[1:3]))
+	if length > len(buf) {
+		return 0, nil, ErrFrameTooLarge
+	}
+	payload := buf[:length]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return FrameType(header[0]), payload, nil
+}
+
+// AppendFrame appends a frame of type t carrying payload to b, and returns
+// the extended slice. AppendFrame panics if payload exceeds the largest
+// payload accepted.
+func AppendFrame(b []byte, t FrameType, payload []byte) []byte {
+	if len(payload) > maxFramePayload {
+		panic("payload too large")
+	}
+	b = append(b, byte(t), 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(payload)))
+	return append(b, payload...)
+}
+
+// meta holds Client attributes negotiated after the Client is initialized. It
+// is referenced by pointer so that copies of a Client share them.
+type meta struct {
+	protocol    int32
+	compression int32
+	firmware    atomic.Value
+}
+
+func (m *meta) getProtocol() Protocol {
+	return Protocol(atomic.LoadInt32(&m.protocol))
+}
+
+func (m *meta) setProtocol(p Protocol) {
+	atomic.StoreInt32(&m.protocol, int32(p))
+}
+
+func (m *meta) getCompression() Compression {
+	return Compression(atomic.LoadInt32(&m.compression))
+}
+
+func (m *meta) setCompression(c Compression) {
+	atomic.StoreInt32(&m.compression, int32(c))
+}
+
+func (m *meta) getFirmware() string {
+	firmware, _ := m.firmware.Load().(string)
+	return firmware
+}
+
+func (m *meta) setFirmware(firmware string) {
+	m.firmware.Store(firmware)
+}
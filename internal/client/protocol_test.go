@@ -0,0 +1,76 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Type    FrameType
+		Payload []byte
+	}{
+		{
+			Name:    "reading",
+			Type:    FrameReading,
+			Payload: bytes.Repeat([]byte{0xab}, readingSize),
+		},
+		{
+			Name:    "empty payload",
+			Type:    FrameAlarm,
+			Payload: []byte{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			b := AppendFrame(nil, test.Type, test.Payload)
+
+			header := make([]byte, frameHeaderSize)
+			buf := make([]byte, maxFramePayload)
+			actualType, actualPayload, err := readFrame(bytes.NewReader(b), header, buf)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if actualType != test.Type {
+				t.Errorf("expected type = %#x, actual = %#x", test.Type, actualType)
+			}
+			if !bytes.Equal(actualPayload, test.Payload) {
+				t.Errorf("expected payload = % x\nactual = % x\n", test.Payload, actualPayload)
+			}
+		})
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	b := []byte{byte(FrameReading), 0xff, 0xff}
+	header := make([]byte, frameHeaderSize)
+	buf := make([]byte, maxFramePayload)
+	if _, _, err := readFrame(bytes.NewReader(b), header, buf); err != ErrFrameTooLarge {
+		t.Fatalf("expected err = %s, actual = %v", ErrFrameTooLarge, err)
+	}
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add(AppendFrame(nil, FrameReading, make([]byte, readingSize)))
+	f.Add(AppendFrame(nil, FrameAck, []byte{0, 0, 0, 1}))
+	f.Add([]byte{byte(FrameReading), 0xff, 0xff})
+	f.Add([]byte{byte(FrameAlarm), 0, 40, 1, 2})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		header := make([]byte, frameHeaderSize)
+		buf := make([]byte, maxFramePayload)
+		ft, payload, err := readFrame(bytes.NewReader(b), header, buf)
+		if err != nil {
+			return
+		}
+		if len(payload) > maxFramePayload {
+			t.Fatalf("expected payload of at most %d bytes, actual = %d", maxFramePayload, len(payload))
+		}
+		frame := AppendFrame(nil, ft, payload)
+		if !bytes.HasPrefix(b, frame) {
+			t.Errorf("expected frame % x to prefix % x", frame, b)
+		}
+	})
+}
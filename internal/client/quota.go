@@ -0,0 +1,55 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrQuotaExceeded indicates a reading was rejected, as the tenant of the
+// device sending it exceeded its reading rate limit.
+var ErrQuotaExceeded = errors.New("tenant quota exceeded")
+
+// RateLimit is a concurrent safe rate limiter, shared by the Clients of a
+// tenant to limit the tenant's combined reading rate.
+type RateLimit struct {
+	mu sync.Mutex
+	b  *bucket
+}
+
+// NewRateLimit initializes a RateLimit permitting perSecond readings each
+// second, in bursts of up to perSecond readings.
+func NewRateLimit(perSecond int) *RateLimit {
+	return &RateLimit{b: newBucket(time.Second/time.Duration(perSecond), perSecond)}
+}
+
+// Allow reports whether another reading is permitted now, counting it
+// against the RateLimit if so.
+func (l *RateLimit) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.take(time.Now())
+}
+
+// WithTenantRateLimits returns a ClientOption that limits the readings of a
+// Client to the RateLimit of its tenant in limits. Readings exceeding the
+// RateLimit are rejected with ErrQuotaExceeded, and counted in the Client's
+// Metrics. Alarms are not limited. Clients of tenants without a RateLimit
+// are unaffected.
+func WithTenantRateLimits(limits map[string]*RateLimit) ClientOption {
+	return func(c *Client) {
+		c.tenantLimits = limits
+	}
+}
+
+// allowReading reports whether the Client's tenant permits another reading.
+// Rejected readings are counted, and logged.
+func (c Client) allowReading() bool {
+	if c.readingLimit == nil || c.readingLimit.Allow() {
+		return true
+	}
+	c.metrics.TenantQuotaExceeded.Counter(c.tenant + ".readings").Inc()
+	c.stats.quotaRejections.Inc()
+	c.logDebug.Printf("[IMEI %d] Reading Rejected\terr = %s\n", c.IMEI(), ErrQuotaExceeded)
+	return false
+}
@@ -6,6 +6,18 @@ import (
 	"math"
 )
 
+// ErrInvalidRange indicates a decoded reading field is outside its valid
+// range. Field is the name of the Reading field.
+type ErrInvalidRange struct {
+	Field string
+	Value float64
+}
+
+// Error satisfies the error interface.
+func (e ErrInvalidRange) Error() string {
+	return fmt.Sprintf("invalid %s, value = %v", e.Field, e.Value)
+}
+
 // Reading is the set of device readings.
 type Reading struct {
 	// Temperature denotes the temperature reading of the message.
@@ -22,11 +34,16 @@ type Reading struct {
 
 	// BatteryLevel denotes the battery level reading of the message.
 	BatteryLevel float64
+
+	// Alarm denotes the reading was sent in a priority alarm frame. It is not
+	// part of the encoded reading.
+	Alarm bool `json:",omitempty"`
 }
 
 // Decode decodes the reading message payload in the given b into r.
 //
-// If any of the fields are outside their valid min/max ranges ok will be unset.
+// If any of the fields are outside their valid min/max ranges, or are NaN, an
+// ErrInvalidRange is returned.
 //
 // Decode does NOT allocate under any condition. Additionally, it panics if b
 // isn't at least 40 bytes long.
@@ -35,36 +52,37 @@ func (r *Reading) Decode(b []byte) error {
 		panic("invalid payload, too short")
 	}
 
-	temp := math.Float64frombits(binary.BigEndian.Uint64(b[0:8]))
-	if temp < -300 || temp > 300 {
-		return fmt.Errorf("invalid temperature, temp = %v", temp)
-	}
-	r.Temperature = temp
-
-	alt := math.Float64frombits(binary.BigEndian.Uint64(b[8:16]))
-	if alt < -20000 || alt > 20000 {
-		return fmt.Errorf("invalid altitude, alt = %v", alt)
+	decoded := Reading{
+		Temperature:  math.Float64frombits(binary.BigEndian.Uint64(b[0:8])),
+		Altitude:     math.Float64frombits(binary.BigEndian.Uint64(b[8:16])),
+		Latitude:     math.Float64frombits(binary.BigEndian.Uint64(b[16:24])),
+		Longitude:    math.Float64frombits(binary.BigEndian.Uint64(b[24:32])),
+		BatteryLevel: math.Float64frombits(binary.BigEndian.Uint64(b[32:40])),
+		Alarm:        r.Alarm,
 	}
-	r.Altitude = alt
-
-	lat := math.Float64frombits(binary.BigEndian.Uint64(b[16:24]))
-	if lat < -90 || lat > 90 {
-		return fmt.Errorf("invalid latitude, lat = %v", lat)
+	if err := decoded.Validate(); err != nil {
+		return err
 	}
-	r.Latitude = lat
-
-	long := math.Float64frombits(binary.BigEndian.Uint64(b[24:32]))
-	if long < -180 || long > 180 {
-		return fmt.Errorf("invalid longitude, long = %v", long)
-	}
-	r.Longitude = long
+	*r = decoded
+	return nil
+}
 
-	batteryLvl := math.Float64frombits(binary.BigEndian.Uint64(b[32:40]))
-	if batteryLvl < 0 || batteryLvl > 100 {
-		return fmt.Errorf("invalid battery level, batteryLvl = %v", batteryLvl)
+// Validate returns an ErrInvalidRange if any of the fields of r are outside
+// their valid min/max ranges, or are NaN. Decode validates each reading it
+// decodes; Validate is for readings from other sources, such as imports.
+func (r Reading) Validate() error {
+	switch {
+	case math.IsNaN(r.Temperature) || r.Temperature < -300 || r.Temperature > 300:
+		return ErrInvalidRange{Field: "Temperature", Value: r.Temperature}
+	case math.IsNaN(r.Altitude) || r.Altitude < -20000 || r.Altitude > 20000:
+		return ErrInvalidRange{Field: "Altitude", Value: r.Altitude}
+	case math.IsNaN(r.Latitude) || r.Latitude < -90 || r.Latitude > 90:
+		return ErrInvalidRange{Field: "Latitude", Value: r.Latitude}
+	case math.IsNaN(r.Longitude) || r.Longitude < -180 || r.Longitude > 180:
+		return ErrInvalidRange{Field: "Longitude", Value: r.Longitude}
+	case math.IsNaN(r.BatteryLevel) || r.BatteryLevel < 0 || r.BatteryLevel > 100:
+		return ErrInvalidRange{Field: "BatteryLevel", Value: r.BatteryLevel}
 	}
-	r.BatteryLevel = batteryLvl
-
 	return nil
 }
 
@@ -95,13 +113,16 @@ func (r Reading) Encode() ([]byte, error) {
 }
 
 // String satisfies the fmt.Stringer interface, and returns a string
-// representation of Reading.
+// representation of Reading. Alarm readings are suffixed with ",alarm".
 func (r Reading) String() string {
-	return fmt.Sprintf("%v,%v,%v,%v,%v",
+	s := fmt.Sprintf("%v,%v,%v,%v,%v",
 		r.Temperature,
 		r.Altitude,
 		r.Latitude,
 		r.Longitude,
 		r.BatteryLevel)
-
+	if r.Alarm {
+		s += ",alarm"
+	}
+	return s
 }
@@ -2,6 +2,8 @@ package client_test
 
 import (
 	"bytes"
+	"errors"
+	"math"
 	"testing"
 
 	"github.com/tjper/thermomatic/internal/client"
@@ -112,3 +114,113 @@ func BenchmarkDecode1(b *testing.B) {
 	b.ResetTimer()
 	benchmarkDecode(b, buf)
 }
+
+func FuzzDecode(f *testing.F) {
+	valid, err := client.Reading{
+		Temperature:  67.77,
+		Altitude:     2.63555,
+		Latitude:     33.41,
+		Longitude:    44.4,
+		BatteryLevel: 0.25666,
+	}.Encode()
+	if err != nil {
+		f.Fatalf("unexpected error = %s", err)
+	}
+	f.Add(valid)
+	f.Add(make([]byte, 40))
+	f.Add(bytes.Repeat([]byte{0xff}, 40))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// Decode documents a panic for payloads shorter than a reading.
+		if len(b) < 40 {
+			return
+		}
+		var reading client.Reading
+		if err := reading.Decode(b); err != nil {
+			return
+		}
+		if !(reading.Temperature >= -300 && reading.Temperature <= 300) ||
+			!(reading.Altitude >= -20000 && reading.Altitude <= 20000) ||
+			!(reading.Latitude >= -90 && reading.Latitude <= 90) ||
+			!(reading.Longitude >= -180 && reading.Longitude <= 180) ||
+			!(reading.BatteryLevel >= 0 && reading.BatteryLevel <= 100) {
+			t.Fatalf("decoded reading out of range, reading = %v", reading)
+		}
+		actual, err := reading.Encode()
+		if err != nil {
+			t.Fatalf("unexpected error = %s", err)
+		}
+		if !bytes.Equal(b[:40], actual) {
+			t.Errorf("expected = % x\nactual = % x", b[:40], actual)
+		}
+	})
+}
+
+func TestDecodeInvalidRange(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Reading client.Reading
+		Field   string
+	}{
+		{
+			Name:    "temperature",
+			Reading: client.Reading{Temperature: 1000},
+			Field:   "Temperature",
+		},
+		{
+			Name:    "battery level",
+			Reading: client.Reading{BatteryLevel: -1},
+			Field:   "BatteryLevel",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			b, err := test.Reading.Encode()
+			if err != nil {
+				t.Fatalf("unexpected error = %s", err)
+			}
+			var reading client.Reading
+			err = reading.Decode(b)
+
+			var invalid client.ErrInvalidRange
+			if !errors.As(err, &invalid) {
+				t.Fatalf("expected ErrInvalidRange, actual = %v", err)
+			}
+			if invalid.Field != test.Field {
+				t.Errorf("expected field %s, actual = %s", test.Field, invalid.Field)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := map[string]struct {
+		Reading client.Reading
+		Field   string
+	}{
+		"valid":     {Reading: client.Reading{Temperature: 67.77, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 100}},
+		"altitude":  {Reading: client.Reading{Altitude: 20001}, Field: "Altitude"},
+		"latitude":  {Reading: client.Reading{Latitude: -90.5}, Field: "Latitude"},
+		"longitude": {Reading: client.Reading{Longitude: math.NaN()}, Field: "Longitude"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.Reading.Validate()
+			if test.Field == "" {
+				if err != nil {
+					t.Fatalf("unexpected error = %s", err)
+				}
+				return
+			}
+			var invalid client.ErrInvalidRange
+			if !errors.As(err, &invalid) {
+				t.Fatalf("expected ErrInvalidRange, actual = %v", err)
+			}
+			if invalid.Field != test.Field {
+				t.Errorf("expected field %s, actual = %s", test.Field, invalid.Field)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package client
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Resumptions keeps the session state of disconnected devices for a grace
+// window, so that a device reconnecting within it resumes its session rather
+// than starting fresh: its last reading, from which delta frames are
+// reconstructed, its command ID sequence, and the commands it has not
+// acknowledged. A Resumptions is shared by every Client.
+type Resumptions struct {
+	grace time.Duration
+
+	mu       sync.Mutex
+	sessions map[uint64]*suspended
+}
+
+// suspended is the session state of a disconnected device.
+type suspended struct {
+	lastReading Reading
+	lastReadAt  time.Time
+	hasReading  bool
+	nextID      uint32
+	commands    []Command
+	timer       *time.Timer
+}
+
+// NewResumptions initializes a Resumptions keeping the session state of
+// disconnected devices for grace.
+func NewResumptions(grace time.Duration) *Resumptions {
+	return &Resumptions{
+		grace:    grace,
+		sessions: make(map[uint64]*suspended),
+	}
+}
+
+// Len retrieves the number of devices whose session state is kept.
+func (r *Resumptions) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+// Forget discards the session state kept of the device with imei, and
+// reports whether there was any.
+func (r *Resumptions) Forget(imei uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[imei]
+	if !ok {
+		return false
+	}
+	s.timer.Stop()
+	delete(r.sessions, imei)
+	return true
+}
+
+// suspend keeps s, the session state of the device with imei, until the
+// grace window passes, replacing any kept before.
+func (r *Resumptions) suspend(imei uint64, s *suspended) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if prev, ok := r.sessions[imei]; ok {
+		prev.timer.Stop()
+	}
+	s.timer = time.AfterFunc(r.grace, func() { r.expire(imei, s) })
+	r.sessions[imei] = s
+}
+
+// take removes, and retrieves, the session state kept of the device with
+// imei.
+func (r *Resumptions) take(imei uint64) (*suspended, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[imei]
+	if !ok {
+		return nil, false
+	}
+	s.timer.Stop()
+	delete(r.sessions, imei)
+	return s, true
+}
+
+// expire discards s, the session state of the device with imei, once the
+// grace window passes, unless it was resumed or replaced.
+func (r *Resumptions) expire(imei uint64, s *suspended) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[imei] == s {
+		delete(r.sessions, imei)
+	}
+}
+
+// WithResumptions returns a ClientOption that sets the Resumptions the
+// Client's session state is suspended to, and resumed from.
+func WithResumptions(r *Resumptions) ClientOption {
+	return func(c *Client) {
+		c.resumptions = r
+	}
+}
+
+// Suspend keeps the Client's session state in its Resumptions, so that its
+// device may resume the session by reconnecting within the grace window.
+// It should be called once the Client is disconnected. Without Resumptions,
+// Suspend does nothing.
+func (c Client) Suspend() {
+	if c.resumptions == nil {
+		return
+	}
+	s := &suspended{
+		lastReading: c.lastReading.Get(),
+		lastReadAt:  c.lastReadAt.Get(),
+		hasReading:  c.hasReading(),
+	}
+	c.downlink.mu.Lock()
+	s.nextID = c.downlink.nextID
+	c.downlink.mu.Unlock()
+	for _, cmd := range c.downlink.list() {
+		if cmd.Status != CommandAcked {
+			s.commands = append(s.commands, cmd)
+		}
+	}
+	c.resumptions.suspend(c.IMEI(), s)
+}
+
+// Resume restores the session state of the Client's device suspended by a
+// previous Client within the grace window, and reports whether there was
+// any. Commands the device had not acknowledged are sent again, with their
+// original IDs, once it logs in with protocol v2. Resume should be called
+// once the Client is admitted, before it processes readings.
+func (c Client) Resume() bool {
+	if c.resumptions == nil {
+		return false
+	}
+	s, ok := c.resumptions.take(c.IMEI())
+	if !ok {
+		return false
+	}
+	c.lastReading.Set(s.lastReading)
+	c.lastReadAt.Set(s.lastReadAt)
+	c.resumption.Set(s)
+
+	c.downlink.mu.Lock()
+	c.downlink.nextID = s.nextID
+	for i := range s.commands {
+		cmd := s.commands[i]
+		c.downlink.commands[cmd.ID] = &cmd
+	}
+	c.downlink.mu.Unlock()
+
+	c.logInfo.Printf("[IMEI %d] Session Resumed\n", c.IMEI())
+	return true
+}
+
+// hasReading reports whether the Client has received a reading, or resumed
+// the session of a Client that had.
+func (c Client) hasReading() bool {
+	if c.stats.readings.Value() > 0 {
+		return true
+	}
+	s := c.resumption.Get()
+	return s != nil && s.hasReading
+}
+
+// resendCommands sends the commands restored by Resume that the device has
+// not acknowledged again.
+func (c Client) resendCommands() error {
+	s := c.resumption.Get()
+	if s == nil {
+		return nil
+	}
+	for _, cmd := range s.commands {
+		b := make([]byte, commandIDSize, commandIDSize+len(cmd.Payload))
+		binary.BigEndian.PutUint32(b, cmd.ID)
+		b = append(b, cmd.Payload...)
+
+		c.downlink.mu.Lock()
+		tracked := c.downlink.commands[cmd.ID]
+		c.downlink.mu.Unlock()
+		if tracked == nil || tracked.Status == CommandAcked {
+			continue
+		}
+		if err := c.writeFrame(FrameCommand, b); err != nil {
+			c.downlink.setStatus(tracked, CommandFailed)
+			return err
+		}
+		c.downlink.setStatus(tracked, CommandDelivered)
+		c.logInfo.Printf("[IMEI %d] Command %d Redelivered\n", c.IMEI(), cmd.ID)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResumptions(t *testing.T) {
+	r := NewResumptions(50 * time.Millisecond)
+	r.suspend(1, &suspended{nextID: 1})
+	r.suspend(2, &suspended{nextID: 2})
+	r.suspend(2, &suspended{nextID: 3})
+	if r.Len() != 2 {
+		t.Fatalf("unexpected len = %d", r.Len())
+	}
+
+	if s, ok := r.take(2); !ok || s.nextID != 3 {
+		t.Errorf("unexpected session = %+v, ok = %t", s, ok)
+	}
+	if _, ok := r.take(2); ok {
+		t.Error("expected session to be taken once")
+	}
+	if !r.Forget(1) || r.Forget(1) {
+		t.Error("expected session to be forgotten once")
+	}
+
+	r.suspend(3, &suspended{})
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := r.take(3); ok || r.Len() != 0 {
+		t.Errorf("expected session to expire, len = %d", r.Len())
+	}
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/common"
+)
+
+// partialReadTimeout bounds how long ProcessNext waits for the rest of a
+// message once it has read part of it.
+const partialReadTimeout = 10 * time.Millisecond
+
+// errPartialRead indicates only part of a message was read before
+// partialReadTimeout passed.
+var errPartialRead = errors.New("partial read")
+
+// Session is the state of a logged-in Client's reading loop. ProcessReadings
+// keeps a Session on its goroutine, while callers of ProcessNext carry one
+// between calls.
+type Session struct {
+	read           *readTicker
+	reading        Reading
+	decodeFailures int
+	resumed        bool
+	deadline       common.Holder[time.Time]
+
+	// partial holds the part of a message read by the last ProcessNext call,
+	// which it returned without waiting for the rest of.
+	partial []byte
+}
+
+// NewSession initializes a Session for a Client that has just logged in.
+func NewSession() *Session {
+	return &Session{
+		read:     newReadTicker(defaultReadingInterval, time.Now()),
+		deadline: common.NewHolder(time.Now().Add(defaultReadingTimeout)),
+	}
+}
+
+// Deadline retrieves the time the Client's connection times out, unless the
+// device sends another message.
+func (s *Session) Deadline() time.Time {
+	return s.deadline.Get()
+}
+
+// ProcessNext reads and processes the next message sent by the Client,
+// carrying state between calls in s. Unlike ProcessReadings, ProcessNext
+// returns once the message is processed, so that the caller may wait for the
+// connection to become readable before calling it again. If only part of a
+// message has arrived, ProcessNext waits briefly for the rest, and otherwise
+// returns with the part held in s, rather than waiting out the deadline of s.
+// Once the deadline of s has passed, ProcessNext closes the Client as
+// ProcessReadings would.
+//
+// ProcessNext reports whether the Client is finished, along with the error
+// finishing it. A Client whose connection is readable but has nothing to
+// read has been closed by the device, and is finished with a nil error.
+func (c Client) ProcessNext(ctx context.Context, s *Session) (bool, error) {
+	if c.closed(ctx) {
+		return true, ErrClientClose
+	}
+
+	stop := c.interruptReads(ctx)
+	defer stop()
+
+	// Compressed connections are read through a decompressor, which does not
+	// survive a timed out read, so they wait for whole messages.
+	var (
+		r        = &sessionReader{conn: c.Conn, s: s, short: c.Compression() == CompressionNone}
+		finished bool
+		err      error
+	)
+	if c.Protocol() == ProtocolV2 {
+		if !s.resumed {
+			s.resumed = true
+			if err := c.resumeTransfer(); err != nil {
+				c.Close(closeReasonOf(err))
+				return true, err
+			}
+			if err := c.resendCommands(); err != nil {
+				c.Close(closeReasonOf(err))
+				return true, err
+			}
+		}
+		scratch := frameBufPool.Get().(*[frameHeaderSize + maxFramePayload]byte)
+		finished, err = c.nextFrame(ctx, s, r, scratch[:frameHeaderSize], scratch[frameHeaderSize:])
+		s.hold(err, scratch[:r.n])
+		frameBufPool.Put(scratch)
+	} else {
+		scratch := readingBufPool.Get().(*[readingSize]byte)
+		finished, err = c.nextReading(ctx, s, r, scratch[:])
+		s.hold(err, scratch[:r.n])
+		readingBufPool.Put(scratch)
+	}
+	if err == errPartialRead {
+		return false, nil
+	}
+	if err == io.EOF {
+		c.logInfo.Printf("[IMEI %d] Connection Closed by Device\n", c.IMEI())
+		c.Close(ClosePeerReset)
+		return true, nil
+	}
+	return finished, err
+}
+
+// hold holds b, the part of a message read so far, in s if err indicates the
+// rest of it has yet to arrive. Otherwise, any part held is released.
+func (s *Session) hold(err error, b []byte) {
+	if err != errPartialRead {
+		s.partial = nil
+		return
+	}
+	s.partial = append(s.partial[:0], b...)
+}
+
+// sessionReader reads a message from a Client's connection, first replaying
+// the part of it held by the Session. n counts the bytes of the message read,
+// which are read into contiguous scratch space. If short is set, the
+// connection is read with a deadline partialReadTimeout away, unless the
+// deadline of the Session is sooner.
+type sessionReader struct {
+	conn  net.Conn
+	s     *Session
+	short bool
+	n     int
+}
+
+// Read satisfies the io.Reader interface. A read timing out before the
+// deadline of the Session returns errPartialRead.
+func (r *sessionReader) Read(p []byte) (int, error) {
+	if r.n < len(r.s.partial) {
+		n := copy(p, r.s.partial[r.n:])
+		r.n += n
+		return n, nil
+	}
+	if r.short {
+		// A connection whose deadline cannot be set has been closed, which the
+		// read reports.
+		r.short = false
+		if deadline := time.Now().Add(partialReadTimeout); deadline.Before(r.s.Deadline()) {
+			_ = r.conn.SetReadDeadline(deadline)
+		}
+	}
+	n, err := r.conn.Read(p)
+	r.n += n
+	if err, ok := err.(net.Error); ok && err.Timeout() && time.Now().Before(r.s.Deadline()) {
+		return n, errPartialRead
+	}
+	return n, err
+}
@@ -0,0 +1,319 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+func TestProcessNext(t *testing.T) {
+	reading := client.Reading{
+		Temperature:  67.77,
+		Altitude:     2.63555,
+		Latitude:     33.41,
+		Longitude:    44.4,
+		BatteryLevel: 0.25666,
+	}
+	b, err := reading.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	server, device := net.Pipe()
+	defer server.Close()
+	go device.Write(append([]byte("490154203237518"), "logv2"...))
+
+	ctx := context.Background()
+	c, err := client.New(ctx, server, client.WithLoggerOutput(io.Discard))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if err := c.ProcessLogin(ctx); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	s := client.NewSession()
+	go device.Write(client.AppendFrame(nil, client.FrameReading, b))
+	finished, err := c.ProcessNext(ctx, s)
+	if finished || err != nil {
+		t.Fatalf("expected unfinished client, actual finished = %t, err = %v", finished, err)
+	}
+	if actual := c.LastReading(); actual != reading {
+		t.Errorf("expected reading = %+v, actual = %+v", reading, actual)
+	}
+
+	// A device closing its connection finishes the Client.
+	device.Close()
+	finished, err = c.ProcessNext(ctx, s)
+	if !finished || err != nil {
+		t.Fatalf("expected finished client, actual finished = %t, err = %v", finished, err)
+	}
+
+	finished, err = c.ProcessNext(ctx, s)
+	if !finished || err != client.ErrClientClose {
+		t.Errorf("expected finished client, actual finished = %t, err = %v", finished, err)
+	}
+}
+
+func TestProcessNextPartial(t *testing.T) {
+	reading := client.Reading{Temperature: 67.77, BatteryLevel: 0.25666}
+	b, err := reading.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	tests := []struct {
+		Name    string
+		Login   string
+		Message []byte
+	}{
+		{Name: "protocol v1", Login: "login", Message: b},
+		{Name: "protocol v2", Login: "logv2", Message: client.AppendFrame(nil, client.FrameReading, b)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			server, device := net.Pipe()
+			defer server.Close()
+			defer device.Close()
+			go device.Write(append([]byte("490154203237518"), test.Login...))
+
+			ctx := context.Background()
+			c, err := client.New(ctx, server, client.WithLoggerOutput(io.Discard))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if err := c.ProcessLogin(ctx); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+
+			// Each part of the message is read without waiting out the
+			// reading timeout for the rest.
+			s := client.NewSession()
+			for _, part := range [][]byte{test.Message[:2], test.Message[2:20], test.Message[20:]} {
+				go device.Write(part)
+				start := time.Now()
+				if finished, err := c.ProcessNext(ctx, s); finished || err != nil {
+					t.Fatalf("expected unfinished client, actual finished = %t, err = %v", finished, err)
+				}
+				if elapsed := time.Since(start); elapsed > time.Second {
+					t.Fatalf("expected partial message to return promptly, actual = %s", elapsed)
+				}
+			}
+			if actual := c.LastReading(); actual != reading {
+				t.Errorf("expected reading = %+v, actual = %+v", reading, actual)
+			}
+		})
+	}
+}
+
+func FuzzProcessNext(f *testing.F) {
+	reading, err := client.Reading{Temperature: 67.77, BatteryLevel: 0.25666}.Encode()
+	if err != nil {
+		f.Fatalf("unexpected error = %s\n", err)
+	}
+	f.Add(false, reading)
+	f.Add(true, client.AppendFrame(nil, client.FrameAlarm, reading))
+	f.Add(true, client.AppendFrame(nil, client.FrameFirmwareAck, []byte{0, 0, 0, 1}))
+	f.Add(true, []byte{byte(client.FrameReading), 0, 3, 1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, v2 bool, b []byte) {
+		login := append([]byte("490154203237518"), "login"...)
+		if v2 {
+			login = append([]byte("490154203237518"), "logv2"...)
+		}
+		server, device := net.Pipe()
+		defer server.Close()
+		go func() {
+			device.Write(append(login, b...))
+			device.Close()
+		}()
+
+		ctx := context.Background()
+		c, err := client.New(ctx, server, client.WithLoggerOutput(io.Discard))
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		if err := c.ProcessLogin(ctx); err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+
+		// Each call consumes at least one byte, or finishes the Client.
+		s := client.NewSession()
+		for i := 0; i <= len(b); i++ {
+			if finished, _ := c.ProcessNext(ctx, s); finished {
+				return
+			}
+		}
+		t.Errorf("expected client to finish within %d calls", len(b)+1)
+	})
+}
+
+func TestAcknowledgedMode(t *testing.T) {
+	valid, err := client.Reading{Temperature: 67.77, BatteryLevel: 0.25666}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	invalid, err := client.Reading{Temperature: 67.77, BatteryLevel: 101}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	tests := []struct {
+		Name     string
+		Frame    []byte
+		Expected []byte
+	}{
+		{
+			Name:     "reading acknowledged",
+			Frame:    client.AppendFrame(nil, client.FrameReading, valid),
+			Expected: client.AppendFrame(nil, client.FrameReadingAck, nil),
+		},
+		{
+			Name:     "invalid battery level",
+			Frame:    client.AppendFrame(nil, client.FrameAlarm, invalid),
+			Expected: client.AppendFrame(nil, client.FrameNack, []byte{byte(client.NackInvalidBatteryLevel)}),
+		},
+		{
+			Name:     "short frame",
+			Frame:    client.AppendFrame(nil, client.FrameReading, valid[:8]),
+			Expected: client.AppendFrame(nil, client.FrameNack, []byte{byte(client.NackShortFrame)}),
+		},
+		{
+			Name:     "long frame",
+			Frame:    client.AppendFrame(nil, client.FrameReading, append(valid, 0xff)),
+			Expected: client.AppendFrame(nil, client.FrameNack, []byte{byte(client.NackLongFrame)}),
+		},
+		{
+			Name:     "long alarm frame",
+			Frame:    client.AppendFrame(nil, client.FrameAlarm, append(valid, 0xff)),
+			Expected: client.AppendFrame(nil, client.FrameNack, []byte{byte(client.NackLongFrame)}),
+		},
+		{
+			Name:     "unknown frame",
+			Frame:    client.AppendFrame(nil, 0x7f, nil),
+			Expected: client.AppendFrame(nil, client.FrameNack, []byte{byte(client.NackUnknownFrame)}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			server, device := net.Pipe()
+			defer server.Close()
+			defer device.Close()
+			go device.Write(append([]byte("490154203237518"), "logv2"...))
+
+			ctx := context.Background()
+			c, err := client.New(
+				ctx,
+				server,
+				client.WithLoggerOutput(io.Discard),
+				client.WithAcknowledgements())
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if err := c.ProcessLogin(ctx); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+
+			go device.Write(test.Frame)
+			answer := make(chan []byte, 1)
+			go func() {
+				b := make([]byte, len(test.Expected))
+				io.ReadFull(device, b)
+				answer <- b
+			}()
+			if finished, err := c.ProcessNext(ctx, client.NewSession()); finished {
+				t.Fatalf("unexpected finished client, err = %v", err)
+			}
+			if actual := <-answer; !bytes.Equal(test.Expected, actual) {
+				t.Errorf("expected % x, actual = % x", test.Expected, actual)
+			}
+		})
+	}
+}
+
+func TestWithReadingValidator(t *testing.T) {
+	cold, err := client.Reading{Temperature: 5, BatteryLevel: 0.25666}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	hot, err := client.Reading{Temperature: 67.77, BatteryLevel: 0.25666}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	tests := []struct {
+		Name     string
+		Payload  []byte
+		Expected []byte
+		Stored   bool
+	}{
+		{
+			Name:     "valid",
+			Payload:  cold,
+			Expected: client.AppendFrame(nil, client.FrameReadingAck, nil),
+			Stored:   true,
+		},
+		{
+			Name:     "rejected",
+			Payload:  hot,
+			Expected: client.AppendFrame(nil, client.FrameNack, []byte{byte(client.NackInvalidTemperature)}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			server, device := net.Pipe()
+			defer server.Close()
+			defer device.Close()
+			go device.Write(append([]byte("490154203237518"), "logv2"...))
+
+			store := new(readingStore)
+			ctx := context.Background()
+			c, err := client.New(
+				ctx,
+				server,
+				client.WithLoggerOutput(io.Discard),
+				client.WithAcknowledgements(),
+				client.WithReadingStore(store),
+				client.WithReadingValidator(func(imei uint64, r client.Reading) error {
+					if imei != 490154203237518 {
+						t.Errorf("unexpected imei = %d", imei)
+					}
+					if r.Temperature > 50 {
+						return client.ErrInvalidRange{Field: "Temperature", Value: r.Temperature}
+					}
+					return nil
+				}))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if err := c.ProcessLogin(ctx); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+
+			go device.Write(client.AppendFrame(nil, client.FrameReading, test.Payload))
+			answer := make(chan []byte, 1)
+			go func() {
+				b := make([]byte, len(test.Expected))
+				io.ReadFull(device, b)
+				answer <- b
+			}()
+			if finished, err := c.ProcessNext(ctx, client.NewSession()); finished {
+				t.Fatalf("unexpected finished client, err = %v", err)
+			}
+			if actual := <-answer; !bytes.Equal(test.Expected, actual) {
+				t.Errorf("expected % x, actual = % x", test.Expected, actual)
+			}
+			if (len(store.readings) == 1) != test.Stored {
+				t.Errorf("expected stored = %t, actual = %+v", test.Stored, store.readings)
+			}
+		})
+	}
+}
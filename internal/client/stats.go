@@ -0,0 +1,91 @@
+package client
+
+import (
+	"net"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/metrics"
+)
+
+// Stats is a snapshot of a Client's statistics.
+type Stats struct {
+	// ConnectedAt denotes when the Client connected.
+	ConnectedAt time.Time
+
+	// BytesRead denotes the number of bytes read from the Client's connection.
+	BytesRead int64
+
+	// BytesWritten denotes the number of bytes written to the Client's
+	// connection.
+	BytesWritten int64
+
+	// BytesReadPerSecond denotes the average rate bytes have been read.
+	BytesReadPerSecond float64
+
+	// BytesWrittenPerSecond denotes the average rate bytes have been written.
+	BytesWrittenPerSecond float64
+
+	// Readings denotes the number of readings successfully decoded.
+	Readings int64
+
+	// DecodeErrors denotes the number of readings that failed to decode.
+	DecodeErrors int64
+
+	// RateLimitStalls denotes the number of times the Client's read loop
+	// waited on the read rate limit before reading.
+	RateLimitStalls int64
+
+	// Alarms denotes the number of priority alarm frames received.
+	Alarms int64
+
+	// QuotaRejections denotes the number of readings rejected as the Client's
+	// tenant exceeded its reading rate limit.
+	QuotaRejections int64
+
+	// ReadingIntervals denotes the distribution of time in seconds between
+	// consecutive readings.
+	ReadingIntervals metrics.HistogramSnapshot
+}
+
+// stats holds a Client's statistics. It is referenced by pointer so that
+// copies of a Client share their statistics.
+type stats struct {
+	bytesRead       metrics.Counter
+	bytesWritten    metrics.Counter
+	readings        metrics.Counter
+	decodeErrors    metrics.Counter
+	rateLimitStalls metrics.Counter
+	alarms          metrics.Counter
+	quotaRejections metrics.Counter
+	intervals       *metrics.Histogram
+}
+
+func newStats() *stats {
+	return &stats{
+		intervals: metrics.NewHistogram(metrics.IntervalBuckets),
+	}
+}
+
+// countingConn is a net.Conn that counts the bytes read and written in a
+// Client's stats, and the server-wide Metrics.
+type countingConn struct {
+	net.Conn
+	stats   *stats
+	metrics *metrics.Metrics
+}
+
+// Read satisfies the io.Reader interface, counting the bytes read.
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.bytesRead.Add(int64(n))
+	c.metrics.BytesRead.Add(int64(n))
+	return n, err
+}
+
+// Write satisfies the io.Writer interface, counting the bytes written.
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.bytesWritten.Add(int64(n))
+	c.metrics.BytesWritten.Add(int64(n))
+	return n, err
+}
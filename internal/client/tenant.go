@@ -0,0 +1,41 @@
+package client
+
+import (
+	"github.com/tjper/thermomatic/internal/common"
+)
+
+// TenantResolver retrieves the tenant owning the device with imei, connected
+// over a TLS session described by tls, or over plain TCP if tls is nil. An
+// empty tenant denotes a device owned by no tenant.
+type TenantResolver func(imei uint64, tls *TLSState) string
+
+// WithTenantResolver returns a ClientOption that sets the TenantResolver used
+// to retrieve the Client's tenant once its IMEI has been read.
+func WithTenantResolver(f TenantResolver) ClientOption {
+	return func(c *Client) {
+		c.tenantOf = f
+	}
+}
+
+// WithTenantReadingLoggers returns a ClientOption that logs the readings of a
+// Client to the logger of its tenant in loggers, rather than its debug logger.
+// Clients of tenants without a logger are unaffected.
+func WithTenantReadingLoggers(loggers map[string]*common.LevelLogger) ClientOption {
+	return func(c *Client) {
+		c.tenantLoggers = loggers
+	}
+}
+
+// Tenant retrieves the tenant owning the Client's device, or an empty string
+// if it is owned by no tenant.
+func (c Client) Tenant() string {
+	return c.tenant
+}
+
+// readingLogger retrieves the logger the Client's readings are logged to.
+func (c Client) readingLogger() *common.LevelLogger {
+	if logger, ok := c.tenantLoggers[c.tenant]; ok && c.tenant != "" {
+		return logger
+	}
+	return c.logDebug
+}
@@ -0,0 +1,160 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/common"
+	"github.com/tjper/thermomatic/internal/metrics"
+)
+
+func TestTenant(t *testing.T) {
+	tests := []struct {
+		Name     string
+		IMEI     string
+		Expected string
+	}{
+		{
+			Name:     "prefix tenant",
+			IMEI:     "490154203237518",
+			Expected: "acme",
+		},
+		{
+			Name:     "no tenant",
+			IMEI:     "356938035643809",
+			Expected: "",
+		},
+	}
+
+	resolver := func(imei uint64, _ *client.TLSState) string {
+		if strings.HasPrefix(strconv.FormatUint(imei, 10), "4901") {
+			return "acme"
+		}
+		return ""
+	}
+	reading, err := client.Reading{Temperature: 67.77, BatteryLevel: 0.25}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			server, device := net.Pipe()
+			defer server.Close()
+			defer device.Close()
+			go device.Write(append([]byte(test.IMEI), "logv2"...))
+
+			tenantLogger := common.NewLevelLogger(
+				common.NewStdLogger(io.Discard, "", 0),
+				common.LevelDebug,
+				common.NewLevelVar(common.LevelDebug))
+			var logger *common.LevelLogger
+			m := metrics.New()
+			ctx := context.Background()
+			c, err := client.New(
+				ctx,
+				server,
+				client.WithLoggerOutput(io.Discard),
+				client.WithMetrics(m),
+				client.WithTenantResolver(resolver),
+				client.WithTenantReadingLoggers(map[string]*common.LevelLogger{"acme": tenantLogger}),
+				client.WithLogReading(func(l *common.LevelLogger, _ uint64, _ time.Time, _ client.Reading) { logger = l }))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if err := c.ProcessLogin(ctx); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			go device.Write(client.AppendFrame(nil, client.FrameReading, reading))
+			if _, err := c.ProcessNext(ctx, client.NewSession()); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+
+			if actual := c.Tenant(); actual != test.Expected {
+				t.Fatalf("expected tenant = %q, actual = %q", test.Expected, actual)
+			}
+			if actual := c.Metadata().Tenant; actual != test.Expected {
+				t.Errorf("expected metadata tenant = %q, actual = %q", test.Expected, actual)
+			}
+			if (logger == tenantLogger) != (test.Expected == "acme") {
+				t.Errorf("unexpected reading logger, tenant logger = %t", logger == tenantLogger)
+			}
+			snapshot := m.TenantReadings.Snapshot()
+			if test.Expected == "" && len(snapshot) != 0 {
+				t.Errorf("unexpected tenant readings = %v", snapshot)
+			}
+			if test.Expected != "" && snapshot[test.Expected] != 1 {
+				t.Errorf("unexpected tenant readings = %v", snapshot)
+			}
+		})
+	}
+}
+
+func TestTenantRateLimit(t *testing.T) {
+	reading, err := client.Reading{Temperature: 67.77, BatteryLevel: 0.25}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	frame := client.AppendFrame(nil, client.FrameReading, reading)
+
+	server, device := net.Pipe()
+	defer server.Close()
+	defer device.Close()
+	go device.Write(append([]byte("490154203237518"), "logv2"...))
+
+	m := metrics.New()
+	ctx := context.Background()
+	c, err := client.New(
+		ctx,
+		server,
+		client.WithLoggerOutput(io.Discard),
+		client.WithMetrics(m),
+		client.WithAcknowledgements(),
+		client.WithTenantResolver(func(uint64, *client.TLSState) string { return "acme" }),
+		client.WithTenantRateLimits(map[string]*client.RateLimit{"acme": client.NewRateLimit(1)}),
+		client.WithLogReading(func(*common.LevelLogger, uint64, time.Time, client.Reading) {}))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if err := c.ProcessLogin(ctx); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	expected := [][]byte{
+		client.AppendFrame(nil, client.FrameReadingAck, nil),
+		client.AppendFrame(nil, client.FrameNack, []byte{byte(client.NackQuotaExceeded)}),
+	}
+	s := client.NewSession()
+	for _, e := range expected {
+		go device.Write(frame)
+		answer := make(chan []byte, 1)
+		go func(n int) {
+			b := make([]byte, n)
+			io.ReadFull(device, b)
+			answer <- b
+		}(len(e))
+		if finished, err := c.ProcessNext(ctx, s); finished {
+			t.Fatalf("unexpected finished client, err = %v", err)
+		}
+		if actual := <-answer; !bytes.Equal(e, actual) {
+			t.Errorf("expected % x, actual = % x", e, actual)
+		}
+	}
+
+	if n := c.Stats().QuotaRejections; n != 1 {
+		t.Errorf("expected 1 quota rejection, actual = %d", n)
+	}
+	if n := m.TenantQuotaExceeded.Snapshot()["acme.readings"]; n != 1 {
+		t.Errorf("expected 1 quota exceeded, actual = %d", n)
+	}
+	if n := m.TenantReadings.Snapshot()["acme"]; n != 1 {
+		t.Errorf("expected 1 tenant reading, actual = %d", n)
+	}
+}
@@ -0,0 +1,39 @@
+package client
+
+import "time"
+
+// readTicker paces reads to one per tick, as a time.Ticker would: ticks fall
+// every interval from when the readTicker is started, and a single tick is
+// held for a reader that falls behind, while ticks beyond it are dropped.
+// Unlike a time.Ticker, a readTicker holds no timer between reads, so a
+// Session may be abandoned without stopping it. A readTicker is not
+// concurrent safe.
+type readTicker struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// newReadTicker starts a readTicker at now, ticking every interval.
+func newReadTicker(interval time.Duration, now time.Time) *readTicker {
+	return &readTicker{interval: interval, next: now.Add(interval)}
+}
+
+// reset restarts the readTicker at now, ticking every interval, as
+// time.Ticker.Reset does.
+func (t *readTicker) reset(interval time.Duration, now time.Time) {
+	t.interval = interval
+	t.next = now.Add(interval)
+}
+
+// take consumes the next tick at time now, and returns how long the caller
+// must wait for it. Zero is returned if a tick is already held.
+func (t *readTicker) take(now time.Time) time.Duration {
+	if t.next.After(now) {
+		d := t.next.Sub(now)
+		t.next = t.next.Add(t.interval)
+		return d
+	}
+	missed := now.Sub(t.next) / t.interval
+	t.next = t.next.Add((missed + 1) * t.interval)
+	return 0
+}
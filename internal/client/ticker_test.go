@@ -0,0 +1,34 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadTicker(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		Name     string
+		At       time.Duration
+		Expected time.Duration
+	}{
+		{Name: "first tick", At: 0, Expected: 25 * time.Millisecond},
+		{Name: "second tick", At: 25 * time.Millisecond, Expected: 25 * time.Millisecond},
+		{Name: "between ticks", At: 60 * time.Millisecond, Expected: 15 * time.Millisecond},
+		{Name: "held tick", At: time.Second, Expected: 0},
+		{Name: "dropped ticks", At: time.Second + 10*time.Millisecond, Expected: 15 * time.Millisecond},
+	}
+
+	ticker := newReadTicker(25*time.Millisecond, start)
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			actual := ticker.take(start.Add(test.At))
+			if actual != test.Expected {
+				t.Fatalf(
+					"expected != actual\nexpected = %v\nactual = %v\n",
+					test.Expected,
+					actual)
+			}
+		})
+	}
+}
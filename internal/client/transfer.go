@@ -0,0 +1,262 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrTransferInProgress indicates a device already has a firmware transfer
+// in progress.
+var ErrTransferInProgress = errors.New("transfer in progress")
+
+const (
+	// chunkHeaderSize is the size of the transfer ID, offset, and image size
+	// prefixing a FrameFirmwareChunk payload.
+	chunkHeaderSize = 12
+
+	// chunkSize is the largest image chunk carried by a FrameFirmwareChunk.
+	chunkSize = maxFramePayload - chunkHeaderSize
+)
+
+// TransferStatus is the state of a firmware Transfer.
+type TransferStatus string
+
+const (
+	// TransferInProgress denotes the device has not acknowledged the whole
+	// image.
+	TransferInProgress TransferStatus = "in-progress"
+
+	// TransferComplete denotes the device acknowledged the whole image.
+	TransferComplete TransferStatus = "complete"
+
+	// TransferFailed denotes the first chunk failed to be sent to the device.
+	TransferFailed TransferStatus = "failed"
+
+	// TransferAborted denotes the transfer was aborted before the device
+	// acknowledged the whole image.
+	TransferAborted TransferStatus = "aborted"
+)
+
+// Transfer describes the progress of a firmware image transfer to a device.
+type Transfer struct {
+	ID        uint32
+	IMEI      uint64
+	Size      int
+	Offset    int
+	Status    TransferStatus
+	StartedAt time.Time
+	UpdatedAt time.Time
+}
+
+// transfer is a Transfer and the image being transferred.
+type transfer struct {
+	Transfer
+	image []byte
+}
+
+// Transfers tracks firmware transfers by device. A Transfers shared by every
+// Client allows transfers to resume after a device reconnects.
+type Transfers struct {
+	mu        sync.Mutex
+	nextID    uint32
+	transfers map[uint64]*transfer
+}
+
+// NewTransfers creates a Transfers instance.
+func NewTransfers() *Transfers {
+	return &Transfers{
+		transfers: make(map[uint64]*transfer),
+	}
+}
+
+// Get retrieves the most recent Transfer to the device with imei.
+func (t *Transfers) Get(imei uint64) (Transfer, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tr, ok := t.transfers[imei]
+	if !ok {
+		return Transfer{}, false
+	}
+	return tr.Transfer, true
+}
+
+// List retrieves the most recent Transfer to each device, ordered by ID.
+func (t *Transfers) List() []Transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := make([]Transfer, 0, len(t.transfers))
+	for _, tr := range t.transfers {
+		list = append(list, tr.Transfer)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Abort aborts the transfer in progress to the device with imei, allowing
+// another transfer to start. ok is false if no transfer is in progress.
+func (t *Transfers) Abort(imei uint64) (transfer Transfer, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tr, exists := t.transfers[imei]
+	if !exists || tr.Status != TransferInProgress {
+		return Transfer{}, false
+	}
+	tr.Status = TransferAborted
+	tr.UpdatedAt = time.Now()
+	return tr.Transfer, true
+}
+
+// start begins a transfer of image to the device with imei, replacing any
+// transfer no longer in progress.
+func (t *Transfers) start(imei uint64, image []byte) (*transfer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tr, ok := t.transfers[imei]; ok && tr.Status == TransferInProgress {
+		return nil, ErrTransferInProgress
+	}
+	t.nextID++
+	now := time.Now()
+	tr := &transfer{
+		Transfer: Transfer{
+			ID:        t.nextID,
+			IMEI:      imei,
+			Size:      len(image),
+			Status:    TransferInProgress,
+			StartedAt: now,
+			UpdatedAt: now,
+		},
+		image: image,
+	}
+	t.transfers[imei] = tr
+	return tr, nil
+}
+
+// fail marks transfer id to the device with imei as failed, if it is still in
+// progress.
+func (t *Transfers) fail(imei uint64, id uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tr, ok := t.transfers[imei]
+	if !ok || tr.ID != id || tr.Status != TransferInProgress {
+		return
+	}
+	tr.Status = TransferFailed
+	tr.UpdatedAt = time.Now()
+}
+
+// ack records that the device with imei holds the image of transfer id up to
+// offset, and returns the next chunk to send. ok is false if id is not the
+// device's transfer in progress.
+func (t *Transfers) ack(imei uint64, id uint32, offset int) (chunk []byte, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tr, exists := t.transfers[imei]
+	if !exists || tr.ID != id || tr.Status != TransferInProgress {
+		return nil, false
+	}
+	if offset > tr.Size {
+		offset = tr.Size
+	}
+	tr.Offset = offset
+	tr.UpdatedAt = time.Now()
+	if offset == tr.Size {
+		tr.Status = TransferComplete
+		return nil, true
+	}
+	return tr.chunk(offset), true
+}
+
+// resume returns the chunk following the device's last acknowledged offset,
+// if a transfer is in progress.
+func (t *Transfers) resume(imei uint64) ([]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tr, ok := t.transfers[imei]
+	if !ok || tr.Status != TransferInProgress {
+		return nil, false
+	}
+	return tr.chunk(tr.Offset), true
+}
+
+// chunk encodes the FrameFirmwareChunk payload carrying the image from
+// offset.
+func (tr *transfer) chunk(offset int) []byte {
+	end := offset + chunkSize
+	if end > tr.Size {
+		end = tr.Size
+	}
+	b := make([]byte, chunkHeaderSize, chunkHeaderSize+end-offset)
+	binary.BigEndian.PutUint32(b[0:4], tr.ID)
+	binary.BigEndian.PutUint32(b[4:8], uint32(offset))
+	binary.BigEndian.PutUint32(b[8:12], uint32(tr.Size))
+	return append(b, tr.image[offset:end]...)
+}
+
+// StartTransfer begins transferring a firmware image to the Client's device
+// in FrameFirmwareChunk frames, one chunk at a time. The device acknowledges
+// each chunk with a FrameFirmwareAck frame carrying the offset it next
+// expects, which also allows the device to resume an interrupted transfer.
+// If the first chunk fails to be written, the transfer is marked
+// TransferFailed. Only protocol v2 Clients support transfers; otherwise
+// ErrProtocolUnsupported is returned.
+func (c Client) StartTransfer(image []byte) (Transfer, error) {
+	if c.Protocol() != ProtocolV2 {
+		return Transfer{}, ErrProtocolUnsupported
+	}
+
+	tr, err := c.transfers.start(c.IMEI(), image)
+	if err != nil {
+		return Transfer{}, err
+	}
+	c.logInfo.Printf("[IMEI %d] Firmware Transfer %d Started, size = %d\n", c.IMEI(), tr.ID, tr.Size)
+	chunk, _ := c.transfers.resume(c.IMEI())
+	if err := c.writeFrame(FrameFirmwareChunk, chunk); err != nil {
+		c.transfers.fail(c.IMEI(), tr.ID)
+		return Transfer{}, err
+	}
+	transfer, _ := c.transfers.Get(c.IMEI())
+	return transfer, nil
+}
+
+// resumeTransfer resends the next chunk of the device's transfer in progress,
+// if any.
+func (c Client) resumeTransfer() error {
+	chunk, ok := c.transfers.resume(c.IMEI())
+	if !ok {
+		return nil
+	}
+	c.logInfo.Printf("[IMEI %d] Firmware Transfer Resumed\n", c.IMEI())
+	return c.writeFrame(FrameFirmwareChunk, chunk)
+}
+
+// processTransferAck records the progress carried by a firmware ack frame
+// payload, and sends the next chunk.
+func (c Client) processTransferAck(payload []byte) error {
+	if len(payload) < 8 {
+		c.logWarn.Printf("[IMEI %d] Invalid Firmware Ack Frame, length = %d\n", c.IMEI(), len(payload))
+		return nil
+	}
+	id := binary.BigEndian.Uint32(payload[0:4])
+	offset := int(binary.BigEndian.Uint32(payload[4:8]))
+
+	chunk, ok := c.transfers.ack(c.IMEI(), id, offset)
+	if !ok {
+		c.logWarn.Printf("[IMEI %d] Ack for Unknown Firmware Transfer %d\n", c.IMEI(), id)
+		return nil
+	}
+	if chunk == nil {
+		c.logInfo.Printf("[IMEI %d] Firmware Transfer %d Complete\n", c.IMEI(), id)
+		return nil
+	}
+	return c.writeFrame(FrameFirmwareChunk, chunk)
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestTransfers(t *testing.T) {
+	const imei = 490154203237518
+	image := bytes.Repeat([]byte{0xab}, chunkSize*2+10)
+
+	transfers := NewTransfers()
+	tr, err := transfers.start(imei, image)
+	if err != nil {
+		t.Fatalf("unexpected error = %s", err)
+	}
+	if _, err := transfers.start(imei, image); err != ErrTransferInProgress {
+		t.Errorf("expected error = %s, actual = %v", ErrTransferInProgress, err)
+	}
+
+	chunk, ok := transfers.resume(imei)
+	if !ok {
+		t.Fatalf("expected transfer to resume")
+	}
+	if len(chunk) != maxFramePayload {
+		t.Errorf("expected chunk of %d bytes, actual = %d", maxFramePayload, len(chunk))
+	}
+
+	// The device acks the first chunk, then reconnects and resumes.
+	if _, ok := transfers.ack(imei, tr.ID, chunkSize); !ok {
+		t.Fatalf("expected ack to be accepted")
+	}
+	chunk, _ = transfers.resume(imei)
+	if offset := binary.BigEndian.Uint32(chunk[4:8]); offset != chunkSize {
+		t.Errorf("expected resumed offset %d, actual = %d", chunkSize, offset)
+	}
+
+	chunk, _ = transfers.ack(imei, tr.ID, chunkSize*2)
+	if len(chunk) != chunkHeaderSize+10 {
+		t.Errorf("expected final chunk of %d bytes, actual = %d", chunkHeaderSize+10, len(chunk))
+	}
+	if chunk, ok := transfers.ack(imei, tr.ID, len(image)); !ok || chunk != nil {
+		t.Errorf("expected transfer to complete")
+	}
+
+	transfer, _ := transfers.Get(imei)
+	if transfer.Status != TransferComplete {
+		t.Errorf("expected status %s, actual = %s", TransferComplete, transfer.Status)
+	}
+	if _, ok := transfers.resume(imei); ok {
+		t.Errorf("expected completed transfer not to resume")
+	}
+}
+
+func TestTransfersAbort(t *testing.T) {
+	const imei = 490154203237518
+	image := bytes.Repeat([]byte{0xab}, chunkSize*2)
+
+	transfers := NewTransfers()
+	if _, ok := transfers.Abort(imei); ok {
+		t.Errorf("expected no transfer to abort")
+	}
+	tr, err := transfers.start(imei, image)
+	if err != nil {
+		t.Fatalf("unexpected error = %s", err)
+	}
+	aborted, ok := transfers.Abort(imei)
+	if !ok || aborted.ID != tr.ID || aborted.Status != TransferAborted {
+		t.Errorf("expected transfer %d aborted, actual = %+v", tr.ID, aborted)
+	}
+	if _, ok := transfers.ack(imei, tr.ID, chunkSize); ok {
+		t.Errorf("expected ack of aborted transfer to be rejected")
+	}
+	if _, ok := transfers.resume(imei); ok {
+		t.Errorf("expected aborted transfer not to resume")
+	}
+	if _, err := transfers.start(imei, image); err != nil {
+		t.Errorf("unexpected error = %s", err)
+	}
+}
+
+func TestStartTransferWriteFailure(t *testing.T) {
+	server, device := net.Pipe()
+	defer server.Close()
+	go device.Write([]byte("490154203237518logv2"))
+
+	ctx := context.Background()
+	c, err := New(ctx, server, WithLoggerOutput(io.Discard))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if err := c.ProcessLogin(ctx); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	device.Close()
+
+	image := bytes.Repeat([]byte{0xab}, 10)
+	if _, err := c.StartTransfer(image); err == nil {
+		t.Fatal("expected error")
+	}
+	transfer, _ := c.transfers.Get(c.IMEI())
+	if transfer.Status != TransferFailed {
+		t.Errorf("expected status %s, actual = %s", TransferFailed, transfer.Status)
+	}
+	if _, err := c.transfers.start(c.IMEI(), image); err != nil {
+		t.Errorf("unexpected error = %s", err)
+	}
+}
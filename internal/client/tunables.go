@@ -0,0 +1,79 @@
+package client
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultReadingInterval is the interval a Client's read ticker ticks
+	// at, bounding the rate readings are read.
+	defaultReadingInterval = 25 * time.Millisecond
+
+	// defaultReadingTimeout is how long a logged-in Client may go without
+	// sending a message before it is closed.
+	defaultReadingTimeout = 2 * time.Second
+)
+
+// ErrInvalidTunable indicates a Tunables setting was set to a value outside
+// its valid range.
+var ErrInvalidTunable = errors.New("invalid tunable")
+
+// Tunables are the settings of Clients that may be adjusted while they run.
+// Sharing Tunables between Clients adjusts the settings of each, including
+// Clients already processing readings, which apply an adjustment to the next
+// message they read. Tunables are concurrent safe.
+type Tunables struct {
+	readingInterval int64
+	readingTimeout  int64
+}
+
+// NewTunables initializes Tunables with the default settings.
+func NewTunables() *Tunables {
+	return &Tunables{
+		readingInterval: int64(defaultReadingInterval),
+		readingTimeout:  int64(defaultReadingTimeout),
+	}
+}
+
+// ReadingInterval retrieves the interval a Client's read ticker ticks at; a
+// Client reads at most one message per interval.
+func (t *Tunables) ReadingInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.readingInterval))
+}
+
+// SetReadingInterval sets the interval a Client's read ticker ticks at. A
+// non-positive interval returns ErrInvalidTunable.
+func (t *Tunables) SetReadingInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return ErrInvalidTunable
+	}
+	atomic.StoreInt64(&t.readingInterval, int64(interval))
+	return nil
+}
+
+// ReadingTimeout retrieves how long a logged-in Client may go without sending
+// a message before it is closed.
+func (t *Tunables) ReadingTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.readingTimeout))
+}
+
+// SetReadingTimeout sets how long a logged-in Client may go without sending a
+// message before it is closed. A non-positive timeout returns
+// ErrInvalidTunable.
+func (t *Tunables) SetReadingTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return ErrInvalidTunable
+	}
+	atomic.StoreInt64(&t.readingTimeout, int64(timeout))
+	return nil
+}
+
+// WithTunables returns a ClientOption that sets the Tunables the Client's
+// settings are read from.
+func WithTunables(t *Tunables) ClientOption {
+	return func(c *Client) {
+		c.tunables = t
+	}
+}
@@ -0,0 +1,58 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+func TestTunables(t *testing.T) {
+	tunables := client.NewTunables()
+	if err := tunables.SetReadingTimeout(0); !errors.Is(err, client.ErrInvalidTunable) {
+		t.Errorf("unexpected error = %v", err)
+	}
+	if err := tunables.SetReadingInterval(-time.Millisecond); !errors.Is(err, client.ErrInvalidTunable) {
+		t.Errorf("unexpected error = %v", err)
+	}
+
+	server, device := net.Pipe()
+	defer server.Close()
+	defer device.Close()
+	go device.Write(append([]byte("490154203237518"), "login"...))
+
+	ctx := context.Background()
+	c, err := client.New(ctx, server, client.WithLoggerOutput(io.Discard), client.WithTunables(tunables))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if err := c.ProcessLogin(ctx); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	// The reading timeout is adjusted for a Client already logged in, and
+	// applied once it reads another message.
+	if err := tunables.SetReadingTimeout(100 * time.Millisecond); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	reading, err := client.Reading{Temperature: 67.77}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	go device.Write(reading)
+
+	start := time.Now()
+	if err := c.ProcessReadings(ctx); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("unexpected elapsed = %s", elapsed)
+	}
+	if c.CloseReason() != client.CloseInactive {
+		t.Errorf("unexpected close reason = %s", c.CloseReason())
+	}
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/common"
+	"github.com/tjper/thermomatic/internal/metrics"
+)
+
+// job is the post-decode work of a single reading: logging, and any
+// downstream export.
+type job struct {
+	logReading logReadingFunc
+	logger     *common.LevelLogger
+	imei       uint64
+	receivedAt time.Time
+	reading    Reading
+
+	// readAt and exportAt are when the reading was read, and when its export
+	// began. If latency is not nil, the latency of the export stage, and of
+	// the reading pipeline as a whole, is recorded in it once j is run.
+	readAt   time.Time
+	exportAt time.Time
+	latency  *metrics.HistogramSet
+}
+
+// run performs j, recording its latency.
+func (j job) run() {
+	j.logReading(j.logger, j.imei, j.receivedAt, j.reading)
+	if j.latency == nil {
+		return
+	}
+	now := time.Now()
+	j.latency.Histogram("export").ObserveDuration(now.Sub(j.exportAt))
+	j.latency.Histogram("total").ObserveDuration(now.Sub(j.readAt))
+}
+
+// WorkerPool performs post-decode work on a bounded set of goroutines,
+// decoupling the reading hot path from slow downstream sinks. Each device's
+// readings are handled by the same worker, in the order they were read.
+// Readings received while a worker's queue is full are dropped and counted.
+type WorkerPool struct {
+	queues  []chan job
+	dropped *metrics.Counter
+	wg      sync.WaitGroup
+}
+
+// NewWorkerPool initializes a WorkerPool of workers goroutines, each with a
+// queue of size readings. Dropped readings are counted by dropped. Run must be
+// called to begin processing.
+func NewWorkerPool(workers, size int, dropped *metrics.Counter) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	queues := make([]chan job, workers)
+	for i := range queues {
+		queues[i] = make(chan job, size)
+	}
+	return &WorkerPool{
+		queues:  queues,
+		dropped: dropped,
+	}
+}
+
+// Run starts the WorkerPool's workers. They exit once Close is called and
+// their queues are drained.
+func (p *WorkerPool) Run() {
+	for _, queue := range p.queues {
+		p.wg.Add(1)
+		go p.work(queue)
+	}
+}
+
+// Close stops the WorkerPool after processing all queued readings. No reading
+// may be submitted once Close is called.
+func (p *WorkerPool) Close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+// Len retrieves the number of readings queued across the WorkerPool's
+// workers.
+func (p *WorkerPool) Len() int {
+	var n int
+	for _, queue := range p.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// submit queues j on the worker assigned to j's device, and reports whether
+// it was queued.
+func (p *WorkerPool) submit(j job) bool {
+	select {
+	case p.queues[j.imei%uint64(len(p.queues))] <- j:
+		return true
+	default:
+		p.dropped.Inc()
+		return false
+	}
+}
+
+func (p *WorkerPool) work(queue chan job) {
+	defer p.wg.Done()
+	for j := range queue {
+		j.run()
+	}
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/common"
+	"github.com/tjper/thermomatic/internal/metrics"
+)
+
+func TestWorkerPool(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received = make(map[uint64][]float64)
+	)
+	logReading := func(_ *common.LevelLogger, imei uint64, _ time.Time, reading Reading) {
+		mu.Lock()
+		received[imei] = append(received[imei], reading.Temperature)
+		mu.Unlock()
+	}
+
+	var dropped metrics.Counter
+	p := NewWorkerPool(4, 100, &dropped)
+	p.Run()
+	for i := 0; i < 100; i++ {
+		for _, imei := range []uint64{490154203237518, 356938035643809} {
+			p.submit(job{logReading: logReading, imei: imei, reading: Reading{Temperature: float64(i)}})
+		}
+	}
+	p.Close()
+
+	if n := dropped.Value(); n != 0 {
+		t.Fatalf("expected no dropped readings, actual = %d", n)
+	}
+	for imei, temperatures := range received {
+		if len(temperatures) != 100 {
+			t.Errorf("[IMEI %d] expected 100 readings, actual = %d", imei, len(temperatures))
+		}
+		for i, temperature := range temperatures {
+			if temperature != float64(i) {
+				t.Errorf("[IMEI %d] expected reading %d in order, actual = %v", imei, i, temperature)
+				break
+			}
+		}
+	}
+}
+
+func TestWorkerPoolDrops(t *testing.T) {
+	var dropped metrics.Counter
+	p := NewWorkerPool(1, 1, &dropped)
+	noop := func(*common.LevelLogger, uint64, time.Time, Reading) {}
+
+	// Without Run, the single queue fills after one reading.
+	if !p.submit(job{logReading: noop}) {
+		t.Errorf("expected first reading to be queued")
+	}
+	if p.submit(job{logReading: noop}) {
+		t.Errorf("expected second reading to be dropped")
+	}
+	if n := dropped.Value(); n != 1 {
+		t.Errorf("expected 1 dropped reading, actual = %d", n)
+	}
+	if n := p.Len(); n != 1 {
+		t.Errorf("expected 1 queued reading, actual = %d", n)
+	}
+	p.Run()
+	p.Close()
+}
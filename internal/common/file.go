@@ -0,0 +1,29 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes b to the file at path, replacing it atomically, so
+// that readers see either its previous or its new content, never a partial
+// write.
+func WriteFileAtomic(path string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to common.WriteFileAtomic/CreateTemp\terr = %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to common.WriteFileAtomic/Write\terr = %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to common.WriteFileAtomic/Close\terr = %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to common.WriteFileAtomic/Rename\terr = %w", err)
+	}
+	return nil
+}
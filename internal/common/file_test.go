@@ -0,0 +1,31 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.json")
+	for _, content := range []string{"first", "second"} {
+		if err := WriteFileAtomic(path, []byte(content)); err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		if string(b) != content {
+			t.Errorf("expected content = %q, actual = %q", content, b)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected 1 file, actual = %d", len(entries))
+	}
+}
@@ -1,86 +1,75 @@
 package common
 
-import "time"
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
 
-// Uint64Holder stores and controls access to a uint64 value.
-type Uint64Holder struct {
-	setValCh       chan uint64
-	getValCh       chan uint64
-	decrementValCh chan struct{}
-}
-
-// NewUint64Holder initializes a Uint64Holder with v.
-func NewUint64Holder(v uint64) Uint64Holder {
-	h := Uint64Holder{
-		setValCh:       make(chan uint64),
-		getValCh:       make(chan uint64),
-		decrementValCh: make(chan struct{}),
-	}
-	go h.mux()
-	h.Set(v)
-	return h
-}
+var (
+	// trackHolders enables counting Holders, and holders is the number of
+	// counted Holders not yet garbage collected.
+	trackHolders atomic.Bool
+	holders      atomic.Int64
+)
 
-func (h Uint64Holder) mux() {
-	var value uint64
-	for {
-		select {
-		case value = <-h.setValCh:
-		case h.getValCh <- value:
-		case <-h.decrementValCh:
-			value--
-		}
-	}
-}
-
-// Get retrieves the uint64 value.
-func (h Uint64Holder) Get() uint64 {
-	return <-h.getValCh
+// TrackHolders enables counting the Holders initialized afterwards, so that
+// leaked Holders may be detected by Holders. A counted Holder is uncounted by
+// a finalizer, which delays its collection by a garbage collection cycle, so
+// Holders are not counted by default.
+func TrackHolders() {
+	trackHolders.Store(true)
 }
 
-// Set sets the uint64 value to v.
-func (h Uint64Holder) Set(v uint64) {
-	h.setValCh <- v
+// Holders retrieves the number of Holders counted since TrackHolders was
+// called, and not yet garbage collected. Holders are counted until the
+// garbage collector finalizes them, so the count lags those released.
+func Holders() int64 {
+	return holders.Load()
 }
 
-// Decrement decrements the uint64 value.
-func (h Uint64Holder) Decrement() {
-	h.decrementValCh <- struct{}{}
+// Holder stores and controls access to a value of type T. Copies of a Holder
+// share the value. Holder does not run a goroutine, so there is nothing to
+// release once it is no longer in use.
+type Holder[T any] struct {
+	value *holderValue[T]
 }
 
-// TimeHolder stores and controls access to a time.Time value.
-type TimeHolder struct {
-	setValCh chan time.Time
-	getValCh chan time.Time
+// holderValue guards a value. A mutex is used rather than an atomic pointer so
+// that Set does not allocate.
+type holderValue[T any] struct {
+	sync.RWMutex
+	v T
 }
 
-// NewTimeHolder initializes a TimeHolder with v.
-func NewTimeHolder(v time.Time) TimeHolder {
-	h := TimeHolder{
-		setValCh: make(chan time.Time),
-		getValCh: make(chan time.Time),
+// NewHolder initializes a Holder with v.
+func NewHolder[T any](v T) Holder[T] {
+	value := &holderValue[T]{v: v}
+	if trackHolders.Load() {
+		holders.Add(1)
+		runtime.SetFinalizer(value, func(*holderValue[T]) { holders.Add(-1) })
 	}
-	go h.mux()
-	h.Set(v)
-	return h
+	return Holder[T]{value: value}
 }
 
-func (h TimeHolder) mux() {
-	var value time.Time
-	for {
-		select {
-		case value = <-h.setValCh:
-		case h.getValCh <- value:
-		}
-	}
+// Get retrieves the value.
+func (h Holder[T]) Get() T {
+	h.value.RLock()
+	defer h.value.RUnlock()
+	return h.value.v
 }
 
-// Get retrieves the time.Time value.
-func (h TimeHolder) Get() time.Time {
-	return <-h.getValCh
+// Set sets the value to v.
+func (h Holder[T]) Set(v T) {
+	h.value.Lock()
+	h.value.v = v
+	h.value.Unlock()
 }
 
-// Set sets the time.Time value to v.
-func (h TimeHolder) Set(v time.Time) {
-	h.setValCh <- v
+// Update sets the value to the result of f, called with the current value.
+// The Holder is locked for the duration of f.
+func (h Holder[T]) Update(f func(T) T) {
+	h.value.Lock()
+	h.value.v = f(h.value.v)
+	h.value.Unlock()
 }
@@ -0,0 +1,85 @@
+package common
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHolder(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	u := NewHolder[uint64](2)
+	copied := u
+	copied.Set(copied.Get() + 10)
+	if v := u.Get(); v != 12 {
+		t.Errorf("expected 12, actual = %d", v)
+	}
+
+	now := time.Now()
+	h := NewHolder(time.Time{})
+	h.Set(now)
+	if v := h.Get(); !v.Equal(now) {
+		t.Errorf("expected %s, actual = %s", now, v)
+	}
+
+	if n := runtime.NumGoroutine(); n != goroutines {
+		t.Errorf("expected %d goroutines, actual = %d", goroutines, n)
+	}
+}
+
+func TestHolders(t *testing.T) {
+	before := Holders()
+	untracked := NewHolder(0)
+	if n := Holders(); n != before {
+		t.Errorf("expected untracked holders to be uncounted, actual = %d", n)
+	}
+	runtime.KeepAlive(untracked)
+
+	TrackHolders()
+	defer trackHolders.Store(false)
+	h := NewHolder(0)
+	if n := Holders(); n != before+1 {
+		t.Errorf("expected %d holders, actual = %d", before+1, n)
+	}
+	runtime.KeepAlive(h)
+
+	// Holders are finalized by a GC after they are released, and their
+	// finalizers run on a separate goroutine.
+	for i := 0; i < 100 && Holders() > before; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	if n := Holders(); n > before {
+		t.Errorf("expected released holders to be uncounted, actual = %d", n)
+	}
+}
+
+func TestHolderUpdate(t *testing.T) {
+	h := NewHolder(0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				h.Update(func(v int) int { return v + 1 })
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v := h.Get(); v != 8000 {
+		t.Errorf("expected 8000, actual = %d", v)
+	}
+}
+
+func BenchmarkHolderSet(b *testing.B) {
+	h := NewHolder(time.Now())
+	now := time.Now()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.Set(now)
+	}
+}
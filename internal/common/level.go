@@ -0,0 +1,87 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrInvalidLevel indicates a logging level could not be parsed.
+var ErrInvalidLevel = errors.New("invalid log level")
+
+// Level is a logging severity. Higher levels are more severe.
+type Level int32
+
+const (
+	// LevelDebug is used for verbose diagnostics.
+	LevelDebug Level = iota
+	// LevelInfo is used for noteworthy events. It is the default level.
+	LevelInfo
+	// LevelWarn is used for unexpected, but recoverable, events.
+	LevelWarn
+	// LevelError is used for failures.
+	LevelError
+)
+
+// String satisfies the fmt.Stringer interface, and returns the lowercase name
+// of the Level.
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLevel returns the Level named by s. Parsing is case-insensitive. If s
+// does not name a Level, ErrInvalidLevel is returned.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return 0, ErrInvalidLevel
+	}
+}
+
+// LevelVar is a concurrent safe logging threshold. A single LevelVar is
+// typically shared by many Loggers so their verbosity can be changed at
+// runtime.
+type LevelVar struct {
+	level int32
+}
+
+// NewLevelVar initializes a LevelVar with l.
+func NewLevelVar(l Level) *LevelVar {
+	v := new(LevelVar)
+	v.Set(l)
+	return v
+}
+
+// Level retrieves the threshold Level.
+func (v *LevelVar) Level() Level {
+	return Level(atomic.LoadInt32(&v.level))
+}
+
+// Set sets the threshold Level to l.
+func (v *LevelVar) Set(l Level) {
+	atomic.StoreInt32(&v.level, int32(l))
+}
+
+// Enabled reports whether messages at Level l should be written.
+func (v *LevelVar) Enabled(l Level) bool {
+	return l >= v.Level()
+}
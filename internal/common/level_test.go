@@ -0,0 +1,48 @@
+package common
+
+import "testing"
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Level    string
+		Expected Level
+		Err      error
+	}{
+		{Name: "debug", Level: "debug", Expected: LevelDebug},
+		{Name: "info", Level: "info", Expected: LevelInfo},
+		{Name: "warn", Level: "warn", Expected: LevelWarn},
+		{Name: "error uppercase", Level: "ERROR", Expected: LevelError},
+		{Name: "invalid", Level: "verbose", Err: ErrInvalidLevel},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			actual, err := ParseLevel(test.Level)
+			if err != test.Err {
+				t.Fatalf("expected err = %v, actual err = %v\n", test.Err, err)
+			}
+			if actual != test.Expected {
+				t.Fatalf(
+					"expected != actual\nexpected = %v\nactual = %v\n",
+					test.Expected,
+					actual)
+			}
+		})
+	}
+}
+
+func TestLevelVarEnabled(t *testing.T) {
+	v := NewLevelVar(LevelInfo)
+	if v.Enabled(LevelDebug) {
+		t.Errorf("expected debug to be disabled at level %s", v.Level())
+	}
+	if !v.Enabled(LevelError) {
+		t.Errorf("expected error to be enabled at level %s", v.Level())
+	}
+
+	v.Set(LevelDebug)
+	if !v.Enabled(LevelDebug) {
+		t.Errorf("expected debug to be enabled at level %s", v.Level())
+	}
+}
@@ -0,0 +1,162 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// Logger is the minimal logging interface consumed by the server and its
+// clients. Implementations receive fully formatted messages without a trailing
+// newline.
+type Logger interface {
+	Log(level Level, msg string)
+}
+
+// LoggerFunc adapts an ordinary function to the Logger interface. It allows
+// third-party loggers such as zap or zerolog to be plugged in without
+// thermomatic depending on them, e.g. for a zap SugaredLogger:
+//
+//	logger := common.LoggerFunc(func(level common.Level, msg string) {
+//		switch level {
+//		case common.LevelDebug:
+//			sugar.Debug(msg)
+//		case common.LevelInfo:
+//			sugar.Info(msg)
+//		case common.LevelWarn:
+//			sugar.Warn(msg)
+//		default:
+//			sugar.Error(msg)
+//		}
+//	})
+type LoggerFunc func(level Level, msg string)
+
+// Log satisfies the Logger interface by calling f.
+func (f LoggerFunc) Log(level Level, msg string) {
+	f(level, msg)
+}
+
+// StdLogger adapts a *log.Logger to the Logger interface. The level of each
+// message is not written; distinguish levels with the *log.Logger's prefix.
+type StdLogger struct {
+	*log.Logger
+}
+
+// NewStdLogger initializes a StdLogger. See log.New for the arguments.
+func NewStdLogger(out io.Writer, prefix string, flag int) StdLogger {
+	return StdLogger{Logger: log.New(out, prefix, flag)}
+}
+
+// Log satisfies the Logger interface.
+func (l StdLogger) Log(level Level, msg string) {
+	_ = l.Output(2, msg)
+}
+
+// SlogLogger adapts a *slog.Logger to the Logger interface.
+type SlogLogger struct {
+	*slog.Logger
+}
+
+// Log satisfies the Logger interface, mapping level to its slog.Level.
+func (l SlogLogger) Log(level Level, msg string) {
+	var sl slog.Level
+	switch level {
+	case LevelDebug:
+		sl = slog.LevelDebug
+	case LevelInfo:
+		sl = slog.LevelInfo
+	case LevelWarn:
+		sl = slog.LevelWarn
+	default:
+		sl = slog.LevelError
+	}
+	l.Logger.Log(context.Background(), sl, msg)
+}
+
+// LevelLogger writes messages of a single Level to a Logger, but only when
+// the Level is enabled by its threshold.
+type LevelLogger struct {
+	out       Logger
+	level     Level
+	threshold *LevelVar
+	limiter   *RateLimiter
+	summarize func(msg string)
+}
+
+// NewLevelLogger initializes a LevelLogger writing messages of Level level to
+// out.
+func NewLevelLogger(out Logger, level Level, threshold *LevelVar) *LevelLogger {
+	return &LevelLogger{
+		out:       out,
+		level:     level,
+		threshold: threshold,
+	}
+}
+
+// SetLogger sets the Logger messages are written to.
+func (l *LevelLogger) SetLogger(out Logger) {
+	l.out = out
+}
+
+// SetThreshold sets the LevelVar consulted before each write.
+func (l *LevelLogger) SetThreshold(threshold *LevelVar) {
+	l.threshold = threshold
+}
+
+// SetOutput sets the output destination if the LevelLogger writes to a
+// StdLogger. Otherwise, SetOutput has no effect.
+func (l *LevelLogger) SetOutput(w io.Writer) {
+	if std, ok := l.out.(StdLogger); ok {
+		std.SetOutput(w)
+	}
+}
+
+// SetFlags sets the output flags if the LevelLogger writes to a StdLogger.
+// Otherwise, SetFlags has no effect.
+func (l *LevelLogger) SetFlags(flag int) {
+	if std, ok := l.out.(StdLogger); ok {
+		std.SetFlags(flag)
+	}
+}
+
+// SetRateLimiter sets the RateLimiter collapsing repeated messages. Sharing
+// limiter between LevelLoggers collapses the messages of them all. A nil
+// limiter writes every message.
+func (l *LevelLogger) SetRateLimiter(limiter *RateLimiter) {
+	l.limiter = limiter
+	l.summarize = func(msg string) { l.out.Log(l.level, msg) }
+}
+
+// Enabled reports whether the LevelLogger's messages are currently written.
+func (l *LevelLogger) Enabled() bool {
+	return l.threshold.Enabled(l.level)
+}
+
+// Printf formats a message in the manner of fmt.Printf and writes it if the
+// LevelLogger is enabled.
+func (l *LevelLogger) Printf(format string, v ...interface{}) {
+	if !l.Enabled() {
+		return
+	}
+	l.write(strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+}
+
+// Println formats a message in the manner of fmt.Println and writes it if the
+// LevelLogger is enabled.
+func (l *LevelLogger) Println(v ...interface{}) {
+	if !l.Enabled() {
+		return
+	}
+	l.write(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// write writes msg, unless it is suppressed by the LevelLogger's rate limit.
+func (l *LevelLogger) write(msg string) {
+	if l.limiter != nil && !l.limiter.allow(msg, l.summarize) {
+		return
+	}
+	l.out.Log(l.level, msg)
+}
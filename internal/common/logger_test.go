@@ -0,0 +1,60 @@
+package common
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+)
+
+func TestLevelLogger(t *testing.T) {
+	type entry struct {
+		Level Level
+		Msg   string
+	}
+	var entries []entry
+	out := LoggerFunc(func(level Level, msg string) {
+		entries = append(entries, entry{Level: level, Msg: msg})
+	})
+
+	threshold := NewLevelVar(LevelInfo)
+	debug := NewLevelLogger(out, LevelDebug, threshold)
+	info := NewLevelLogger(out, LevelInfo, threshold)
+
+	debug.Printf("[IMEI %d] Reading\n", uint64(490154203237518))
+	info.Printf("[IMEI %d] Logged-In\n", uint64(490154203237518))
+	info.Println("accepting TCP connections...")
+
+	expected := []entry{
+		{Level: LevelInfo, Msg: "[IMEI 490154203237518] Logged-In"},
+		{Level: LevelInfo, Msg: "accepting TCP connections..."},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, actual = %v", len(expected), entries)
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Errorf("expected = %v\nactual = %v\n", expected[i], entries[i])
+		}
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	logger := NewLevelLogger(SlogLogger{Logger: slog.New(handler)}, LevelError, NewLevelVar(LevelDebug))
+
+	logger.Printf("client %s\n", "unauthorized")
+
+	expected := "level=ERROR msg=\"client unauthorized\"\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("expected = %q\nactual = %q\n", expected, actual)
+	}
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRepeated is the number of distinct messages a RateLimiter tracks at
+// once. Messages beyond it are written without being limited.
+const maxRepeated = 1024
+
+// RateLimiter collapses repeated messages of the LevelLoggers it is set on,
+// so that one misbehaving device cannot flood the log. Messages are
+// identical if they share the text preceding their first tab, e.g.
+// "[IMEI 490154203237518] Failed to Client.ProcessReadings/decode", as the
+// text following it holds details, such as the bytes that failed to decode,
+// that differ between repetitions of the same error. Of identical messages,
+// the first within each interval is written, and the rest are written as a
+// single "repeated N times" message once the interval passes.
+type RateLimiter struct {
+	interval time.Duration
+
+	mu       sync.Mutex
+	repeated map[string]*repetitions
+}
+
+// repetitions are the repetitions of a message suppressed within an
+// interval, and how to write their summary.
+type repetitions struct {
+	count int
+	write func(msg string)
+	timer *time.Timer
+}
+
+// NewRateLimiter initializes a RateLimiter writing identical messages once
+// per interval.
+func NewRateLimiter(interval time.Duration) *RateLimiter {
+	return &RateLimiter{
+		interval: interval,
+		repeated: make(map[string]*repetitions),
+	}
+}
+
+// allow reports whether msg should be written. Once its interval passes,
+// the repetitions of msg suppressed are summarized with write.
+func (r *RateLimiter) allow(msg string, write func(msg string)) bool {
+	key, _, _ := strings.Cut(msg, "\t")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rep, ok := r.repeated[key]; ok {
+		rep.count++
+		return false
+	}
+	if len(r.repeated) >= maxRepeated {
+		return true
+	}
+	rep := &repetitions{write: write}
+	rep.timer = time.AfterFunc(r.interval, func() { r.expire(key, rep) })
+	r.repeated[key] = rep
+	return true
+}
+
+// expire ends the interval of the message key, writing how many times it was
+// repeated within it, if at all.
+func (r *RateLimiter) expire(key string, rep *repetitions) {
+	r.mu.Lock()
+	if r.repeated[key] != rep {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.repeated, key)
+	r.mu.Unlock()
+	r.summarize(key, rep)
+}
+
+// Flush ends the interval of every message immediately, writing how many
+// times each was repeated, e.g. before the log is closed.
+func (r *RateLimiter) Flush() {
+	r.mu.Lock()
+	repeated := r.repeated
+	r.repeated = make(map[string]*repetitions)
+	r.mu.Unlock()
+	for key, rep := range repeated {
+		rep.timer.Stop()
+		r.summarize(key, rep)
+	}
+}
+
+// summarize writes how many times the message key was repeated, if at all.
+func (r *RateLimiter) summarize(key string, rep *repetitions) {
+	if rep.count > 0 {
+		rep.write(fmt.Sprintf("%s\trepeated %d times in %s", key, rep.count, r.interval))
+	}
+}
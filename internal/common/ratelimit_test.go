@@ -0,0 +1,76 @@
+package common
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLevelLoggerRateLimit(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		messages []string
+	)
+	out := LoggerFunc(func(_ Level, msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		messages = append(messages, msg)
+	})
+	logged := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), messages...)
+	}
+
+	logger := NewLevelLogger(out, LevelError, NewLevelVar(LevelInfo))
+	limiter := NewRateLimiter(50 * time.Millisecond)
+	logger.SetRateLimiter(limiter)
+	for i := 0; i < 5; i++ {
+		logger.Printf("[IMEI 1] Failed to decode\tb = %d\n", i)
+	}
+	logger.Printf("[IMEI 2] Failed to decode\tb = %d\n", 0)
+
+	expected := []string{"[IMEI 1] Failed to decode\tb = 0", "[IMEI 2] Failed to decode\tb = 0"}
+	if actual := logged(); !slices.Equal(actual, expected) {
+		t.Fatalf("expected = %q\nactual = %q", expected, actual)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	expected = append(expected, "[IMEI 1] Failed to decode\trepeated 4 times in 50ms")
+	if actual := logged(); !slices.Equal(actual, expected) {
+		t.Fatalf("expected = %q\nactual = %q", expected, actual)
+	}
+
+	// A new interval begins with the next repetition.
+	logger.Printf("[IMEI 1] Failed to decode\tb = %d\n", 5)
+	logger.Printf("[IMEI 1] Failed to decode\tb = %d\n", 6)
+	limiter.Flush()
+	expected = append(expected, "[IMEI 1] Failed to decode\tb = 5", "[IMEI 1] Failed to decode\trepeated 1 times in 50ms")
+	if actual := logged(); !slices.Equal(actual, expected) {
+		t.Fatalf("expected = %q\nactual = %q", expected, actual)
+	}
+
+	logger.SetRateLimiter(nil)
+	logger.Println("unlimited")
+	logger.Println("unlimited")
+	if actual := logged(); len(actual) != len(expected)+2 {
+		t.Fatalf("expected every message to be written, actual = %q", actual)
+	}
+
+	// LevelLoggers sharing a RateLimiter collapse the messages of both.
+	mu.Lock()
+	messages = nil
+	mu.Unlock()
+	shared := NewRateLimiter(time.Hour)
+	for i := 0; i < 2; i++ {
+		l := NewLevelLogger(out, LevelError, NewLevelVar(LevelInfo))
+		l.SetRateLimiter(shared)
+		l.Printf("[IMEI 3] Failed to decode\tb = %d\n", i)
+	}
+	shared.Flush()
+	expected = []string{"[IMEI 3] Failed to decode\tb = 0", "[IMEI 3] Failed to decode\trepeated 1 times in 1h0m0s"}
+	if actual := logged(); !slices.Equal(actual, expected) {
+		t.Fatalf("expected = %q\nactual = %q", expected, actual)
+	}
+}
@@ -0,0 +1,220 @@
+package common
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the timestamp suffixed to rotated files. It sorts
+// lexically in chronological order.
+const backupTimeFormat = "20060102T150405.000000000"
+
+// Rotation configures when a RotatingFile is rotated, and what becomes of the
+// rotated files.
+type Rotation struct {
+	// MaxSize is the size in bytes at which the file is rotated. Zero disables
+	// size-based rotation.
+	MaxSize int64
+
+	// MaxAge is the duration after which the file is rotated. Zero disables
+	// age-based rotation.
+	MaxAge time.Duration
+
+	// MaxBackups is the number of rotated files retained. Zero retains all
+	// rotated files.
+	MaxBackups int
+
+	// Compress denotes rotated files should be gzip compressed.
+	Compress bool
+}
+
+// RotatingFile is a concurrent safe io.Writer appending to a file, which is
+// rotated according to its Rotation. Rotated files are renamed with a
+// timestamp suffix, e.g. thermomatic.log.20200102T150405.000000000.
+type RotatingFile struct {
+	path     string
+	rotation Rotation
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	compressing sync.WaitGroup
+}
+
+// OpenRotatingFile opens, or creates, the file at path for appending. On
+// success, a RotatingFile reference and a nil error is returned. On failure, a
+// nil RotatingFile reference and a non-nil error is returned.
+func OpenRotatingFile(path string, rotation Rotation) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:     path,
+		rotation: rotation,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write satisfies the io.Writer interface. The file is rotated before p is
+// written if p would exceed MaxSize, or the file is older than MaxAge.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.shouldRotate(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file regardless of its Rotation.
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rotate()
+}
+
+// Close closes the file, and waits for any rotated files to finish
+// compressing.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	err := f.file.Close()
+	f.mu.Unlock()
+
+	f.compressing.Wait()
+	return err
+}
+
+func (f *RotatingFile) shouldRotate(n int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.rotation.MaxSize > 0 && f.size+n > f.rotation.MaxSize {
+		return true
+	}
+	if f.rotation.MaxAge > 0 && time.Since(f.openedAt) > f.rotation.MaxAge {
+		return true
+	}
+	return false
+}
+
+// open opens the file at f.path. The caller must hold f.mu, or have exclusive
+// access to f.
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to common.open/OpenFile\tpath = %s err = %w", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to common.open/Stat\tpath = %s err = %w", f.path, err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+// rotate renames the current file with a timestamp suffix, and opens a new
+// file in its place. The caller must hold f.mu.
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to common.rotate/Close\tpath = %s err = %w", f.path, err)
+	}
+	backup := f.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		return fmt.Errorf("failed to common.rotate/Rename\tpath = %s err = %w", f.path, err)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	if f.rotation.Compress {
+		f.compressing.Add(1)
+		go func() {
+			defer f.compressing.Done()
+			_ = compress(backup)
+		}()
+	}
+	return f.prune()
+}
+
+// prune removes the oldest rotated files in excess of MaxBackups. The caller
+// must hold f.mu.
+func (f *RotatingFile) prune() error {
+	if f.rotation.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return fmt.Errorf("failed to common.prune/Glob\tpath = %s err = %w", f.path, err)
+	}
+
+	// Strip compression suffixes so a backup mid-compression is counted once,
+	// and skip siblings not named by rotate, such as thermomatic.log.lock.
+	seen := make(map[string]bool, len(backups))
+	unique := make([]string, 0, len(backups))
+	for _, backup := range backups {
+		name := strings.TrimSuffix(backup, ".gz")
+		stamp := strings.TrimPrefix(name, f.path+".")
+		if _, err := time.Parse(backupTimeFormat, stamp); err != nil {
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	if len(unique) <= f.rotation.MaxBackups {
+		return nil
+	}
+
+	sort.Strings(unique)
+	for _, name := range unique[:len(unique)-f.rotation.MaxBackups] {
+		os.Remove(name)
+		os.Remove(name + ".gz")
+	}
+	return nil
+}
+
+// compress gzips the file at path to path.gz, and removes the original.
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
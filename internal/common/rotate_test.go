@@ -0,0 +1,123 @@
+package common
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Rotation Rotation
+		Writes   int
+		Backups  int
+		Suffix   string
+	}{
+		{
+			Name:     "size rotation",
+			Rotation: Rotation{MaxSize: 16},
+			Writes:   4,
+			Backups:  3,
+		},
+		{
+			Name:     "max backups",
+			Rotation: Rotation{MaxSize: 16, MaxBackups: 2},
+			Writes:   4,
+			Backups:  2,
+		},
+		{
+			Name:     "compressed",
+			Rotation: Rotation{MaxSize: 16, Compress: true},
+			Writes:   2,
+			Backups:  1,
+			Suffix:   ".gz",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "thermomatic.log")
+			f, err := OpenRotatingFile(path, test.Rotation)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			for i := 0; i < test.Writes; i++ {
+				if _, err := f.Write([]byte("0123456789abcdef")); err != nil {
+					t.Fatalf("unexpected error = %s\n", err)
+				}
+			}
+			if err := f.Close(); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+
+			backups, err := filepath.Glob(path + ".*" + test.Suffix)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if len(backups) != test.Backups {
+				t.Fatalf("expected %d backups, actual = %v", test.Backups, backups)
+			}
+			if test.Suffix == ".gz" {
+				isGzipped(t, backups[0], "0123456789abcdef")
+			}
+		})
+	}
+}
+
+func isGzipped(t *testing.T, path, expected string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if string(b) != expected {
+		t.Fatalf("expected = %q\nactual = %q\n", expected, b)
+	}
+}
+
+func TestRotatingFilePruneSiblings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "thermomatic.log")
+	siblings := []string{path + ".lock", path + ".bak", path + ".bak.gz"}
+	for _, sibling := range siblings {
+		if err := os.WriteFile(sibling, nil, 0644); err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+	}
+
+	f, err := OpenRotatingFile(path, Rotation{MaxSize: 16, MaxBackups: 1})
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := f.Write([]byte("0123456789abcdef")); err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	for _, sibling := range siblings {
+		if _, err := os.Stat(sibling); err != nil {
+			t.Errorf("expected %s to be kept, err = %s", sibling, err)
+		}
+	}
+	backups, err := filepath.Glob(path + ".2*")
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if len(backups) != 1 {
+		t.Errorf("expected 1 backup, actual = %v", backups)
+	}
+}
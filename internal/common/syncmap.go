@@ -0,0 +1,103 @@
+package common
+
+import "sync"
+
+// SyncMap is a concurrent safe map from keys of type K to values of type V.
+type SyncMap[K comparable, V any] struct {
+	mu sync.RWMutex
+	m  map[K]V
+}
+
+// NewSyncMap initializes an empty SyncMap.
+func NewSyncMap[K comparable, V any]() *SyncMap[K, V] {
+	return &SyncMap[K, V]{
+		m: make(map[K]V),
+	}
+}
+
+// Load retrieves the value stored for key, and whether it exists.
+func (m *SyncMap[K, V]) Load(key K) (V, bool) {
+	m.mu.RLock()
+	value, ok := m.m[key]
+	m.mu.RUnlock()
+	return value, ok
+}
+
+// Store stores value for key.
+func (m *SyncMap[K, V]) Store(key K, value V) {
+	m.mu.Lock()
+	m.m[key] = value
+	m.mu.Unlock()
+}
+
+// LoadOrStore retrieves the value stored for key if it exists. Otherwise, it
+// stores and returns value. loaded reports whether the value was retrieved.
+func (m *SyncMap[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.m[key]; ok {
+		return existing, true
+	}
+	m.m[key] = value
+	return value, false
+}
+
+// Update calls f with the value stored for key, and whether it exists, and
+// stores the value f returns if keep is true, or deletes key otherwise. The
+// SyncMap is locked for the duration of f.
+func (m *SyncMap[K, V]) Update(key K, f func(value V, ok bool) (updated V, keep bool)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	value, ok := m.m[key]
+	updated, keep := f(value, ok)
+	if !keep {
+		delete(m.m, key)
+		return
+	}
+	m.m[key] = updated
+}
+
+// Delete deletes the value stored for key.
+func (m *SyncMap[K, V]) Delete(key K) {
+	m.mu.Lock()
+	delete(m.m, key)
+	m.mu.Unlock()
+}
+
+// LoadAndDelete deletes the value stored for key, returning it and whether it
+// existed.
+func (m *SyncMap[K, V]) LoadAndDelete(key K) (V, bool) {
+	m.mu.Lock()
+	value, ok := m.m[key]
+	delete(m.m, key)
+	m.mu.Unlock()
+	return value, ok
+}
+
+// Range calls f for each key-value pair in the SyncMap. If f returns false,
+// the iteration stops. f must not modify the SyncMap.
+func (m *SyncMap[K, V]) Range(f func(K, V) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for key, value := range m.m {
+		if !f(key, value) {
+			break
+		}
+	}
+}
+
+// Exists reports whether a value is stored for key.
+func (m *SyncMap[K, V]) Exists(key K) bool {
+	m.mu.RLock()
+	_, ok := m.m[key]
+	m.mu.RUnlock()
+	return ok
+}
+
+// Len retrieves the number of key-value pairs in the SyncMap.
+func (m *SyncMap[K, V]) Len() int {
+	m.mu.RLock()
+	n := len(m.m)
+	m.mu.RUnlock()
+	return n
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSyncMap(t *testing.T) {
+	m := NewSyncMap[string, int]()
+	m.Store("a", 1)
+
+	if actual, loaded := m.LoadOrStore("a", 2); !loaded || actual != 1 {
+		t.Errorf("expected loaded 1, actual = %d, loaded = %t", actual, loaded)
+	}
+	if actual, loaded := m.LoadOrStore("b", 2); loaded || actual != 2 {
+		t.Errorf("expected stored 2, actual = %d, loaded = %t", actual, loaded)
+	}
+
+	m.Update("a", func(value int, ok bool) (int, bool) {
+		return value + 10, ok
+	})
+	if value, _ := m.Load("a"); value != 11 {
+		t.Errorf("expected 11, actual = %d", value)
+	}
+	m.Update("b", func(value int, ok bool) (int, bool) {
+		return value, false
+	})
+	if m.Exists("b") {
+		t.Errorf("expected b to be deleted by Update")
+	}
+
+	if value, ok := m.LoadAndDelete("a"); !ok || value != 11 {
+		t.Errorf("expected deleted 11, actual = %d, ok = %t", value, ok)
+	}
+	if n := m.Len(); n != 0 {
+		t.Errorf("expected empty map, actual len = %d", n)
+	}
+}
+
+func TestSyncMapConcurrency(t *testing.T) {
+	m := NewSyncMap[int, int]()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				m.Update(0, func(value int, _ bool) (int, bool) {
+					return value + 1, true
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _ := m.Load(0); value != 8000 {
+		t.Errorf("expected 8000, actual = %d", value)
+	}
+}
@@ -0,0 +1,56 @@
+package export
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+// anonymizer replaces the IMEIs of exported readings with pseudonyms, and
+// rounds their positions to precision decimal places.
+type anonymizer struct {
+	key       []byte
+	precision int
+}
+
+// WithAnonymization returns an Option function that configures an exporter to
+// replace each IMEI with a pseudonym, the first 8 bytes of the HMAC-SHA256 of
+// the IMEI under key, and to round latitudes and longitudes to precision
+// decimal places, e.g. 2 places is roughly a kilometer. Pseudonyms are stable
+// for as long as key is, so that datasets may be shared with analysts without
+// exposing device identities or exact locations.
+func WithAnonymization(key []byte, precision int) Option {
+	return func(o *options) {
+		o.anonymize = &anonymizer{key: key, precision: precision}
+	}
+}
+
+// sample initializes the sample of reading, received from imei at receivedAt,
+// anonymized if a is non-nil.
+func (a *anonymizer) sample(imei uint64, receivedAt time.Time, reading client.Reading) sample {
+	if a == nil {
+		return sample{imei: imei, receivedAt: receivedAt, reading: reading}
+	}
+	reading.Latitude = a.round(reading.Latitude)
+	reading.Longitude = a.round(reading.Longitude)
+	return sample{imei: a.pseudonym(imei), receivedAt: receivedAt, reading: reading}
+}
+
+// pseudonym retrieves the pseudonym of imei.
+func (a *anonymizer) pseudonym(imei uint64) uint64 {
+	mac := hmac.New(sha256.New, a.key)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], imei)
+	mac.Write(b[:])
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// round rounds v to the anonymizer's precision.
+func (a *anonymizer) round(v float64) float64 {
+	scale := math.Pow10(a.precision)
+	return math.Round(v*scale) / scale
+}
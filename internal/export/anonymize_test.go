@@ -0,0 +1,43 @@
+package export
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+func TestAnonymizer(t *testing.T) {
+	var o options
+	WithAnonymization([]byte("secret"), 2)(&o)
+	a := o.anonymize
+	receivedAt := time.Unix(1700000000, 0)
+	reading := client.Reading{Temperature: 67.77, Latitude: 45.523456, Longitude: -122.676543}
+
+	s := a.sample(490154203237518, receivedAt, reading)
+	if s.imei == 490154203237518 {
+		t.Error("expected IMEI to be replaced")
+	}
+	if s.reading.Latitude != 45.52 || s.reading.Longitude != -122.68 || s.reading.Temperature != 67.77 {
+		t.Errorf("unexpected reading = %+v", s.reading)
+	}
+	if !s.receivedAt.Equal(receivedAt) {
+		t.Errorf("unexpected received at = %s", s.receivedAt)
+	}
+
+	if again := a.sample(490154203237518, receivedAt, reading); again.imei != s.imei {
+		t.Errorf("expected stable pseudonym, actual = %d and %d", s.imei, again.imei)
+	}
+	if other := a.sample(490154203237519, receivedAt, reading); other.imei == s.imei {
+		t.Error("expected distinct pseudonyms of distinct IMEIs")
+	}
+	rekeyed := &anonymizer{key: []byte("other"), precision: 2}
+	if r := rekeyed.sample(490154203237518, receivedAt, reading); r.imei == s.imei {
+		t.Error("expected pseudonyms to depend on the key")
+	}
+
+	var disabled *anonymizer
+	if s := disabled.sample(490154203237518, receivedAt, reading); s.imei != 490154203237518 || s.reading != reading {
+		t.Errorf("unexpected sample = %+v", s)
+	}
+}
@@ -0,0 +1,66 @@
+// Package export implements exporters shipping readings to external
+// telemetry stores. Exporters satisfy the client.ReadingStore interface, and
+// queue readings so that clients are never blocked by a slow store.
+package export
+
+import (
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+// sample is a reading received from a device, awaiting export.
+type sample struct {
+	imei       uint64
+	receivedAt time.Time
+	reading    client.Reading
+}
+
+// fields are the reading fields exported, and their names.
+var fields = []struct {
+	name  string
+	value func(client.Reading) float64
+}{
+	{name: "temperature", value: func(r client.Reading) float64 { return r.Temperature }},
+	{name: "altitude", value: func(r client.Reading) float64 { return r.Altitude }},
+	{name: "latitude", value: func(r client.Reading) float64 { return r.Latitude }},
+	{name: "longitude", value: func(r client.Reading) float64 { return r.Longitude }},
+	{name: "battery_level", value: func(r client.Reading) float64 { return r.BatteryLevel }},
+}
+
+// Logger logs what exporters in dry run mode would send. A *log.Logger
+// satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// options are the settings of an exporter.
+type options struct {
+	// dryRun, if non-nil, is where readings are logged rather than sent.
+	dryRun Logger
+
+	// anonymize, if non-nil, anonymizes readings before they are exported.
+	anonymize *anonymizer
+}
+
+// Option configures an exporter.
+type Option func(*options)
+
+// WithDryRun returns an Option function that configures an exporter to
+// serialize readings as usual, but to log what it would send to l rather
+// than contacting the external system, so that new configurations may be
+// validated safely.
+func WithDryRun(l Logger) Option {
+	return func(o *options) {
+		o.dryRun = l
+	}
+}
+
+// newOptions applies each Option to the default options.
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
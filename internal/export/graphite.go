@@ -0,0 +1,225 @@
+package export
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+// maxDatagramSize is the largest Graphite payload sent in a single UDP
+// datagram. It is sized to avoid IP fragmentation on typical networks.
+const maxDatagramSize = 1432
+
+// Graphite emits readings to a Graphite carbon receiver in the plaintext
+// protocol, over TCP or UDP. Each reading field is written as a metric named
+// <prefix>.<imei>.<field>, e.g. "thermomatic.490154203237518.temperature",
+// timestamped at the reading's receipt. Readings are buffered as they are
+// received and sent every interval.
+type Graphite struct {
+	network   string
+	addr      string
+	prefix    string
+	interval  time.Duration
+	dryRun    Logger
+	anonymize *anonymizer
+
+	mu      sync.Mutex
+	conn    net.Conn
+	pending []sample
+	dropped int64
+	health  health
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+var (
+	_ client.ReadingStore   = (*Graphite)(nil)
+	_ plugin.HealthReporter = (*Graphite)(nil)
+)
+
+// NewGraphite initializes a Graphite emitter sending readings to the carbon
+// receiver at addr over network, "tcp" or "udp", every interval. Each metric
+// name is prefixed with prefix, unless it is empty. Run must be called to
+// begin emitting. In dry run mode, the receiver is never dialed.
+func NewGraphite(network, addr, prefix string, interval time.Duration, opts ...Option) (*Graphite, error) {
+	switch network {
+	case "tcp", "udp":
+	default:
+		return nil, fmt.Errorf("failed to export.NewGraphite\tnetwork = %s", network)
+	}
+	o := newOptions(opts)
+	var conn net.Conn
+	if o.dryRun == nil {
+		var err error
+		conn, err = net.Dial(network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export.NewGraphite/Dial\taddr = %s err = %w", addr, err)
+		}
+	}
+	if prefix != "" {
+		prefix += "."
+	}
+	return &Graphite{
+		network:   network,
+		addr:      addr,
+		prefix:    prefix,
+		interval:  interval,
+		dryRun:    o.dryRun,
+		anonymize: o.anonymize,
+		conn:      conn,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// StoreReading buffers reading, received from imei at receivedAt, to be
+// sent, dropping it if queueSize readings are already buffered.
+func (g *Graphite) StoreReading(imei uint64, receivedAt time.Time, reading client.Reading) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.pending) >= queueSize {
+		atomic.AddInt64(&g.dropped, 1)
+		return
+	}
+	g.pending = append(g.pending, g.anonymize.sample(imei, receivedAt, reading))
+}
+
+// Len retrieves the number of readings buffered.
+func (g *Graphite) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.pending)
+}
+
+// Dropped retrieves the number of readings dropped because the buffer was
+// full.
+func (g *Graphite) Dropped() int64 {
+	return atomic.LoadInt64(&g.dropped)
+}
+
+// Health retrieves the health of the Graphite emitter's sends to its
+// receiver.
+func (g *Graphite) Health() plugin.Health {
+	return g.health.snapshot(g.Len(), g.Dropped())
+}
+
+// Run sends buffered readings every interval until Close is called. The last
+// error encountered is returned.
+func (g *Graphite) Run() error {
+	defer close(g.done)
+
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		select {
+		case <-g.stop:
+			if err := g.flush(); err != nil {
+				lastErr = err
+			}
+			return lastErr
+		case <-ticker.C:
+			if err := g.flush(); err != nil {
+				lastErr = err
+			}
+		}
+	}
+}
+
+// Close stops Run after a final flush, and releases the connection.
+func (g *Graphite) Close() error {
+	close(g.stop)
+	<-g.done
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.conn == nil {
+		return nil
+	}
+	return g.conn.Close()
+}
+
+// flush sends the buffered readings. Over TCP, a failed connection is
+// redialed by the next flush, and the readings it failed to send are lost. In
+// dry run mode, the lines of the readings are logged instead.
+func (g *Graphite) flush() (err error) {
+	g.mu.Lock()
+	pending := g.pending
+	g.pending = nil
+	g.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	defer func() { g.health.record(err) }()
+
+	if g.dryRun != nil {
+		g.dryRun.Printf("dry run: graphite would send %d readings to %s://%s\n", len(pending), g.network, g.addr)
+		for _, s := range pending {
+			for _, line := range g.lines(s) {
+				g.dryRun.Printf("dry run: %s", line)
+			}
+		}
+		return nil
+	}
+
+	if g.conn == nil {
+		conn, err := net.Dial(g.network, g.addr)
+		if err != nil {
+			return fmt.Errorf("failed to export.Graphite.flush/Dial\taddr = %s err = %w", g.addr, err)
+		}
+		g.mu.Lock()
+		g.conn = conn
+		g.mu.Unlock()
+	}
+
+	buf := make([]byte, 0, maxDatagramSize)
+	for _, s := range pending {
+		for _, line := range g.lines(s) {
+			if g.network == "udp" && len(buf)+len(line) > maxDatagramSize {
+				if err := g.send(buf); err != nil {
+					return err
+				}
+				buf = buf[:0]
+			}
+			buf = append(buf, line...)
+		}
+	}
+	return g.send(buf)
+}
+
+// lines formats the plaintext protocol lines of s, one per reading field.
+func (g *Graphite) lines(s sample) []string {
+	imei := strconv.FormatUint(s.imei, 10)
+	ts := strconv.FormatInt(s.receivedAt.Unix(), 10)
+	lines := make([]string, 0, len(fields))
+	for _, f := range fields {
+		value := strconv.FormatFloat(f.value(s.reading), 'f', -1, 64)
+		lines = append(lines, g.prefix+imei+"."+f.name+" "+value+" "+ts+"\n")
+	}
+	return lines
+}
+
+// send writes b to the connection, discarding a failed TCP connection.
+func (g *Graphite) send(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	if _, err := g.conn.Write(b); err != nil {
+		if g.network == "tcp" {
+			g.mu.Lock()
+			g.conn.Close()
+			g.conn = nil
+			g.mu.Unlock()
+		}
+		return fmt.Errorf("failed to export.Graphite.send/Write\taddr = %s err = %w", g.addr, err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+func TestGraphite(t *testing.T) {
+	reading := client.Reading{
+		Temperature:  67.77,
+		Altitude:     2.63555,
+		Latitude:     33.41,
+		Longitude:    44.4,
+		BatteryLevel: 0.25666,
+	}
+	expected := []string{
+		"fleet.490154203237518.temperature 67.77 1700000000",
+		"fleet.490154203237518.altitude 2.63555 1700000000",
+		"fleet.490154203237518.latitude 33.41 1700000000",
+		"fleet.490154203237518.longitude 44.4 1700000000",
+		"fleet.490154203237518.battery_level 0.25666 1700000000",
+	}
+
+	t.Run("tcp", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		defer l.Close()
+		lines := make(chan []string, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			var received []string
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				received = append(received, scanner.Text())
+			}
+			lines <- received
+		}()
+
+		graphite, err := NewGraphite("tcp", l.Addr().String(), "fleet", time.Hour)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- graphite.Run() }()
+		graphite.StoreReading(490154203237518, time.Unix(1700000000, 0), reading)
+		if err := graphite.Close(); err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+
+		if actual := <-lines; strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("unexpected lines\nexpected:\n%s\nactual:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+		}
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		defer conn.Close()
+
+		graphite, err := NewGraphite("udp", conn.LocalAddr().String(), "fleet", 10*time.Millisecond)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		go graphite.Run()
+		defer graphite.Close()
+		graphite.StoreReading(490154203237518, time.Unix(1700000000, 0), reading)
+
+		buf := make([]byte, maxDatagramSize)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		if actual := strings.TrimSuffix(string(buf[:n]), "\n"); actual != strings.Join(expected, "\n") {
+			t.Errorf("unexpected datagram\nexpected:\n%s\nactual:\n%s", strings.Join(expected, "\n"), actual)
+		}
+	})
+}
+
+func TestGraphiteDatagrams(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer conn.Close()
+
+	graphite, err := NewGraphite("udp", conn.LocalAddr().String(), "", time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	go graphite.Run()
+	const readings = 100
+	for i := 0; i < readings; i++ {
+		graphite.StoreReading(490154203237518, time.Unix(1700000000, 0), client.Reading{})
+	}
+	graphite.Close()
+
+	var lines int
+	buf := make([]byte, 65536)
+	for lines < readings*len(fields) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		if n > maxDatagramSize {
+			t.Fatalf("expected datagram <= %d bytes, actual = %d", maxDatagramSize, n)
+		}
+		if !strings.HasPrefix(string(buf[:n]), "490154203237518.") {
+			t.Fatalf("unexpected datagram = %q", buf[:n])
+		}
+		lines += strings.Count(string(buf[:n]), "\n")
+	}
+}
+
+func TestGraphiteNetwork(t *testing.T) {
+	if _, err := NewGraphite("unix", "/tmp/carbon.sock", "", time.Second); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestGraphiteDryRun(t *testing.T) {
+	var out bytes.Buffer
+	// Nothing listens at the address; a dry run must not dial it.
+	graphite, err := NewGraphite("tcp", "127.0.0.1:1", "fleet", time.Hour, WithDryRun(log.New(&out, "", 0)))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- graphite.Run() }()
+	graphite.StoreReading(490154203237518, time.Unix(1700000000, 0), client.Reading{Temperature: 67.77})
+	if err := graphite.Close(); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	expected := []string{
+		"dry run: graphite would send 1 readings to tcp://127.0.0.1:1",
+		"dry run: fleet.490154203237518.temperature 67.77 1700000000",
+		"dry run: fleet.490154203237518.altitude 0 1700000000",
+		"dry run: fleet.490154203237518.latitude 0 1700000000",
+		"dry run: fleet.490154203237518.longitude 0 1700000000",
+		"dry run: fleet.490154203237518.battery_level 0 1700000000",
+	}
+	if actual := strings.TrimSuffix(out.String(), "\n"); actual != strings.Join(expected, "\n") {
+		t.Errorf("unexpected log\nexpected:\n%s\nactual:\n%s", strings.Join(expected, "\n"), actual)
+	}
+}
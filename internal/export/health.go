@@ -0,0 +1,52 @@
+package export
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+// health tracks the outcome of an exporter's sends.
+type health struct {
+	mu          sync.Mutex
+	lastSuccess time.Time
+	downSince   time.Time
+	lastErr     error
+}
+
+// record records the outcome of a send, failed if err is not nil.
+func (h *health) record(err error) {
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.lastErr = err
+		if h.downSince.IsZero() {
+			h.downSince = now
+		}
+		return
+	}
+	h.lastSuccess = now
+	h.downSince = time.Time{}
+}
+
+// snapshot retrieves the plugin.Health of an exporter with queued readings
+// awaiting export, and dropped readings dropped.
+func (h *health) snapshot(queued int, dropped int64) plugin.Health {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := plugin.Health{Queued: queued, Dropped: dropped}
+	if !h.lastSuccess.IsZero() {
+		lastSuccess := h.lastSuccess
+		s.LastSuccess = &lastSuccess
+	}
+	if !h.downSince.IsZero() {
+		downSince := h.downSince
+		s.DownSince = &downSince
+	}
+	if h.lastErr != nil {
+		s.LastError = h.lastErr.Error()
+	}
+	return s
+}
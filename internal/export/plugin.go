@@ -0,0 +1,80 @@
+package export
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+// defaultGraphiteInterval is how often readings are sent by Graphite
+// exporters whose configuration names no interval.
+const defaultGraphiteInterval = 10 * time.Second
+
+func init() {
+	plugin.RegisterExporter("remote_write", newRemoteWriteExporter)
+	plugin.RegisterExporter("graphite", newGraphiteExporter)
+}
+
+// remoteWriteExporter adapts a RemoteWrite to the plugin.Exporter interface.
+type remoteWriteExporter struct {
+	*RemoteWrite
+}
+
+// newRemoteWriteExporter initializes a RemoteWrite exporter, configured with
+// the URL of its remote-write endpoint.
+func newRemoteWriteExporter(config string, options plugin.ExporterOptions) (plugin.Exporter, error) {
+	if _, err := url.ParseRequestURI(config); err != nil {
+		return nil, fmt.Errorf("failed to export.newRemoteWriteExporter/ParseRequestURI\terr = %w", err)
+	}
+	return remoteWriteExporter{NewRemoteWrite(config, exportOptions(options)...)}, nil
+}
+
+// Close satisfies the plugin.Exporter interface.
+func (e remoteWriteExporter) Close() error {
+	e.RemoteWrite.Close()
+	return nil
+}
+
+// GraphiteURL formats the configuration of a Graphite exporter, as accepted
+// by the "graphite" plugin: network://addr?prefix=prefix&interval=interval.
+func GraphiteURL(network, addr, prefix string, interval time.Duration) string {
+	u := url.URL{
+		Scheme:   network,
+		Host:     addr,
+		RawQuery: url.Values{"prefix": {prefix}, "interval": {interval.String()}}.Encode(),
+	}
+	return u.String()
+}
+
+// newGraphiteExporter initializes a Graphite exporter, configured with a URL
+// formatted by GraphiteURL. An omitted interval defaults to
+// defaultGraphiteInterval.
+func newGraphiteExporter(config string, options plugin.ExporterOptions) (plugin.Exporter, error) {
+	u, err := url.Parse(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export.newGraphiteExporter/Parse\terr = %w", err)
+	}
+	interval := defaultGraphiteInterval
+	if s := u.Query().Get("interval"); s != "" {
+		interval, err = time.ParseDuration(s)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("failed to export.newGraphiteExporter\tinterval = %s", s)
+		}
+	}
+	return NewGraphite(u.Scheme, u.Host, u.Query().Get("prefix"), interval, exportOptions(options)...)
+}
+
+// exportOptions translates the plugin.ExporterOptions of an exporter to
+// Options.
+func exportOptions(options plugin.ExporterOptions) []Option {
+	var opts []Option
+	if options.DryRun != nil {
+		opts = append(opts, WithDryRun(options.DryRun))
+	}
+	if a := options.Anonymize; a != nil {
+		opts = append(opts, WithAnonymization(a.Key, a.Precision))
+	}
+	return opts
+}
@@ -0,0 +1,45 @@
+package export
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+func TestGraphitePlugin(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer conn.Close()
+
+	e, err := plugin.NewExporter("graphite", GraphiteURL("udp", conn.LocalAddr().String(), "thermomatic", time.Minute), plugin.ExporterOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	go e.Run()
+	defer e.Close()
+	g, ok := e.(*Graphite)
+	if !ok {
+		t.Fatalf("unexpected exporter = %T", e)
+	}
+	if g.network != "udp" || g.addr != conn.LocalAddr().String() || g.prefix != "thermomatic." || g.interval != time.Minute {
+		t.Errorf("unexpected graphite = %+v", g)
+	}
+}
+
+func TestRemoteWritePlugin(t *testing.T) {
+	if _, err := plugin.NewExporter("remote_write", "not a url", plugin.ExporterOptions{}); err == nil {
+		t.Error("expected error")
+	}
+	e, err := plugin.NewExporter("remote_write", "http://localhost:9090/api/v1/write", plugin.ExporterOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	go e.Run()
+	if err := e.Close(); err != nil {
+		t.Errorf("unexpected error = %s\n", err)
+	}
+}
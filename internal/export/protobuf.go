@@ -0,0 +1,53 @@
+package export
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Protocol buffer wire types.
+const (
+	wireVarint = 0
+	wire64Bit  = 1
+	wireBytes  = 2
+)
+
+// appendVarint appends v to b as a protocol buffer base 128 varint.
+func appendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// appendTag appends the key of field number field, of wire type wire, to b.
+func appendTag(b []byte, field int, wire int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wire))
+}
+
+// appendBytes appends v to b as length-delimited field number field.
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendString appends v to b as string field number field.
+func appendString(b []byte, field int, v string) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendDouble appends v to b as double field number field.
+func appendDouble(b []byte, field int, v float64) []byte {
+	b = appendTag(b, field, wire64Bit)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+// appendInt64 appends v to b as int64 field number field.
+func appendInt64(b []byte, field int, v int64) []byte {
+	b = appendTag(b, field, wireVarint)
+	return appendVarint(b, uint64(v))
+}
@@ -0,0 +1,233 @@
+package export
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+const (
+	// queueSize bounds the number of readings awaiting export. Readings
+	// received while the queue is full are dropped.
+	queueSize = 4096
+
+	// batchSize is the default maximum number of readings per export
+	// request.
+	batchSize = 512
+
+	// interval is the longest a reading waits in the queue.
+	interval = 5 * time.Second
+)
+
+// ErrInvalidBatchSize indicates a batch size was set outside the range of
+// readings the queue can hold.
+var ErrInvalidBatchSize = errors.New("invalid batch size")
+
+// metricPrefix prefixes the name of each reading field's metric.
+const metricPrefix = "thermomatic_"
+
+// RemoteWrite batches readings and posts them to a Prometheus remote-write
+// endpoint, e.g. "http://localhost:9009/api/v1/push". Each reading field is
+// written as its own series, named thermomatic_<field> and labeled with the
+// device's IMEI, with a sample timestamped at the reading's receipt.
+type RemoteWrite struct {
+	endpoint  string
+	client    *http.Client
+	dryRun    Logger
+	anonymize *anonymizer
+
+	queue     chan sample
+	dropped   int64
+	batchSize int64
+	health    health
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+var (
+	_ client.ReadingStore   = (*RemoteWrite)(nil)
+	_ plugin.Batcher        = (*RemoteWrite)(nil)
+	_ plugin.HealthReporter = (*RemoteWrite)(nil)
+)
+
+// NewRemoteWrite initializes a RemoteWrite posting to endpoint. Run must be
+// called to begin exporting.
+func NewRemoteWrite(endpoint string, opts ...Option) *RemoteWrite {
+	o := newOptions(opts)
+	return &RemoteWrite{
+		endpoint:  endpoint,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		dryRun:    o.dryRun,
+		anonymize: o.anonymize,
+		queue:     make(chan sample, queueSize),
+		batchSize: batchSize,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// StoreReading queues reading, received from imei at receivedAt, for export,
+// dropping it if the queue is full.
+func (w *RemoteWrite) StoreReading(imei uint64, receivedAt time.Time, reading client.Reading) {
+	select {
+	case w.queue <- w.anonymize.sample(imei, receivedAt, reading):
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+	}
+}
+
+// Len retrieves the number of readings queued.
+func (w *RemoteWrite) Len() int {
+	return len(w.queue)
+}
+
+// Dropped retrieves the number of readings dropped because the queue was
+// full.
+func (w *RemoteWrite) Dropped() int64 {
+	return atomic.LoadInt64(&w.dropped)
+}
+
+// Health retrieves the health of the RemoteWrite's requests to its endpoint.
+func (w *RemoteWrite) Health() plugin.Health {
+	return w.health.snapshot(w.Len(), w.Dropped())
+}
+
+// BatchSize retrieves the maximum number of readings per export request.
+func (w *RemoteWrite) BatchSize() int {
+	return int(atomic.LoadInt64(&w.batchSize))
+}
+
+// SetBatchSize sets the maximum number of readings per export request,
+// applied from the next reading queued. A size outside [1, queueSize]
+// returns ErrInvalidBatchSize.
+func (w *RemoteWrite) SetBatchSize(size int) error {
+	if size < 1 || size > queueSize {
+		return ErrInvalidBatchSize
+	}
+	atomic.StoreInt64(&w.batchSize, int64(size))
+	return nil
+}
+
+// Run exports queued readings in batches until Close is called. The last
+// error encountered is returned.
+func (w *RemoteWrite) Run() error {
+	defer close(w.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]sample, 0, w.BatchSize())
+	var lastErr error
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := w.post(batch)
+		w.health.record(err)
+		if err != nil {
+			lastErr = err
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-w.stop:
+			for {
+				select {
+				case s := <-w.queue:
+					batch = append(batch, s)
+					if len(batch) >= w.BatchSize() {
+						flush()
+					}
+				default:
+					flush()
+					return lastErr
+				}
+			}
+		case s := <-w.queue:
+			batch = append(batch, s)
+			if len(batch) >= w.BatchSize() {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close stops Run after exporting all queued readings.
+func (w *RemoteWrite) Close() {
+	close(w.stop)
+	<-w.done
+}
+
+// post sends samples to the endpoint as a snappy compressed WriteRequest. In
+// dry run mode, the series of samples are logged instead.
+func (w *RemoteWrite) post(samples []sample) error {
+	body := snappyEncode(writeRequest(samples))
+	if w.dryRun != nil {
+		w.dryRun.Printf("dry run: remote write would POST %d bytes of %d readings to %s\n", len(body), len(samples), w.endpoint)
+		for _, s := range samples {
+			for _, f := range fields {
+				w.dryRun.Printf(
+					"dry run: %s%s{imei=\"%d\"} %s %d\n",
+					metricPrefix, f.name, s.imei, strconv.FormatFloat(f.value(s.reading), 'f', -1, 64), s.receivedAt.UnixMilli())
+			}
+		}
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to export.RemoteWrite.post/NewRequest\terr = %w", err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export.RemoteWrite.post/Do\terr = %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to export.RemoteWrite.post\tstatus = %s", resp.Status)
+	}
+	return nil
+}
+
+// writeRequest encodes samples as a Prometheus WriteRequest protocol buffer,
+// with a TimeSeries per reading field of each sample.
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func writeRequest(samples []sample) []byte {
+	var req, series, buf []byte
+	for _, s := range samples {
+		imei := strconv.FormatUint(s.imei, 10)
+		ts := s.receivedAt.UnixMilli()
+		for _, f := range fields {
+			// Labels must be sorted by name; __name__ sorts first.
+			series = series[:0]
+			buf = appendString(appendString(buf[:0], 1, "__name__"), 2, metricPrefix+f.name)
+			series = appendBytes(series, 1, buf)
+			buf = appendString(appendString(buf[:0], 1, "imei"), 2, imei)
+			series = appendBytes(series, 1, buf)
+			buf = appendInt64(appendDouble(buf[:0], 1, f.value(s.reading)), 2, ts)
+			series = appendBytes(series, 2, buf)
+			req = appendBytes(req, 1, series)
+		}
+	}
+	return req
+}
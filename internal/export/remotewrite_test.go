@@ -0,0 +1,328 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+func TestRemoteWrite(t *testing.T) {
+	requests := make(chan []string, 1)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("unexpected Content-Encoding = %s", r.Header.Get("Content-Encoding"))
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("unexpected error = %s\n", err)
+		}
+		series, err := decodeWriteRequest(snappyDecode(t, b))
+		if err != nil {
+			t.Errorf("unexpected error = %s\n", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		requests <- series
+	}))
+	defer endpoint.Close()
+
+	exporter := NewRemoteWrite(endpoint.URL)
+	done := make(chan error, 1)
+	go func() { done <- exporter.Run() }()
+
+	receivedAt := time.UnixMilli(1700000000123)
+	exporter.StoreReading(490154203237518, receivedAt, client.Reading{
+		Temperature:  67.77,
+		Altitude:     2.63555,
+		Latitude:     33.41,
+		Longitude:    44.4,
+		BatteryLevel: 0.25666,
+	})
+	exporter.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	expected := []string{
+		"__name__=thermomatic_temperature,imei=490154203237518 67.77@1700000000123",
+		"__name__=thermomatic_altitude,imei=490154203237518 2.63555@1700000000123",
+		"__name__=thermomatic_latitude,imei=490154203237518 33.41@1700000000123",
+		"__name__=thermomatic_longitude,imei=490154203237518 44.4@1700000000123",
+		"__name__=thermomatic_battery_level,imei=490154203237518 0.25666@1700000000123",
+	}
+	actual := <-requests
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected series\nexpected:\n%s\nactual:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
+
+func TestRemoteWriteStatus(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer endpoint.Close()
+
+	exporter := NewRemoteWrite(endpoint.URL)
+	done := make(chan error, 1)
+	go func() { done <- exporter.Run() }()
+	exporter.StoreReading(490154203237518, time.Now(), client.Reading{})
+	exporter.Close()
+	if err := <-done; err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRemoteWriteDryRun(t *testing.T) {
+	var requests atomic.Int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer endpoint.Close()
+
+	var out bytes.Buffer
+	exporter := NewRemoteWrite(endpoint.URL, WithDryRun(log.New(&out, "", 0)))
+	done := make(chan error, 1)
+	go func() { done <- exporter.Run() }()
+	exporter.StoreReading(490154203237518, time.UnixMilli(1700000000123), client.Reading{Temperature: 67.77})
+	exporter.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	if n := requests.Load(); n != 0 {
+		t.Errorf("expected no requests, actual = %d", n)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 1+len(fields) {
+		t.Fatalf("expected %d lines, actual = %q", 1+len(fields), lines)
+	}
+	if !strings.HasPrefix(lines[0], "dry run: remote write would POST ") || !strings.HasSuffix(lines[0], " bytes of 1 readings to "+endpoint.URL) {
+		t.Errorf("unexpected summary = %q", lines[0])
+	}
+	if expected := `dry run: thermomatic_temperature{imei="490154203237518"} 67.77 1700000000123`; lines[1] != expected {
+		t.Errorf("expected line = %q, actual = %q", expected, lines[1])
+	}
+}
+
+func TestSnappyEncode(t *testing.T) {
+	tests := map[string]int{
+		"empty":    0,
+		"short":    10,
+		"max":      maxSnappyLiteral,
+		"multiple": maxSnappyLiteral*2 + 7,
+	}
+	for name, n := range tests {
+		t.Run(name, func(t *testing.T) {
+			src := make([]byte, n)
+			for i := range src {
+				src[i] = byte(i)
+			}
+			if dst := snappyDecode(t, snappyEncode(src)); string(dst) != string(src) {
+				t.Errorf("unexpected decoding, len = %d", len(dst))
+			}
+		})
+	}
+}
+
+// snappyDecode decodes the snappy block src, which must hold only literals.
+func snappyDecode(t *testing.T, src []byte) []byte {
+	t.Helper()
+	n, i := binary.Uvarint(src)
+	src = src[i:]
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		if tag&0x03 != 0 {
+			t.Fatalf("unexpected copy element, tag = %#x", tag)
+		}
+		var length int
+		switch l := int(tag >> 2); {
+		case l < 60:
+			length, src = l+1, src[1:]
+		case l == 60:
+			length, src = int(src[1])+1, src[2:]
+		case l == 61:
+			length, src = int(binary.LittleEndian.Uint16(src[1:]))+1, src[3:]
+		default:
+			t.Fatalf("unexpected literal tag = %#x", tag)
+		}
+		dst, src = append(dst, src[:length]...), src[length:]
+	}
+	if uint64(len(dst)) != n {
+		t.Fatalf("expected length = %d, actual = %d", n, len(dst))
+	}
+	return dst
+}
+
+// decodeWriteRequest decodes a WriteRequest, describing each of its series as
+// "<name>=<value>,... <value>@<timestamp>".
+func decodeWriteRequest(b []byte) ([]string, error) {
+	var series []string
+	err := decodeFields(b, func(field int, v []byte, _ uint64) error {
+		var labels []string
+		var samples []string
+		err := decodeFields(v, func(field int, v []byte, _ uint64) error {
+			switch field {
+			case 1:
+				var name, value string
+				err := decodeFields(v, func(field int, v []byte, _ uint64) error {
+					if field == 1 {
+						name = string(v)
+					} else {
+						value = string(v)
+					}
+					return nil
+				})
+				labels = append(labels, name+"="+value)
+				return err
+			default:
+				var value float64
+				var ts uint64
+				err := decodeFields(v, func(field int, _ []byte, n uint64) error {
+					if field == 1 {
+						value = math.Float64frombits(n)
+					} else {
+						ts = n
+					}
+					return nil
+				})
+				samples = append(samples, fmt.Sprintf("%v@%d", value, ts))
+				return err
+			}
+		})
+		series = append(series, strings.Join(labels, ",")+" "+strings.Join(samples, " "))
+		return err
+	})
+	return series, err
+}
+
+// decodeFields passes each field of the protocol buffer message b to fn,
+// with the field's bytes if length-delimited, or its number otherwise.
+func decodeFields(b []byte, fn func(field int, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		key, i := binary.Uvarint(b)
+		if i <= 0 {
+			return fmt.Errorf("invalid key")
+		}
+		b = b[i:]
+		field := int(key >> 3)
+		switch key & 0x07 {
+		case wireVarint:
+			n, i := binary.Uvarint(b)
+			if i <= 0 {
+				return fmt.Errorf("invalid varint")
+			}
+			b = b[i:]
+			if err := fn(field, nil, n); err != nil {
+				return err
+			}
+		case wire64Bit:
+			if err := fn(field, nil, binary.LittleEndian.Uint64(b)); err != nil {
+				return err
+			}
+			b = b[8:]
+		case wireBytes:
+			n, i := binary.Uvarint(b)
+			if i <= 0 || uint64(len(b)-i) < n {
+				return fmt.Errorf("invalid length")
+			}
+			if err := fn(field, b[i:i+int(n)], 0); err != nil {
+				return err
+			}
+			b = b[i+int(n):]
+		default:
+			return fmt.Errorf("unexpected wire type = %d", key&0x07)
+		}
+	}
+	return nil
+}
+
+func TestRemoteWriteBatchSize(t *testing.T) {
+	var requests int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer endpoint.Close()
+
+	exporter := NewRemoteWrite(endpoint.URL)
+	if exporter.BatchSize() != batchSize {
+		t.Errorf("unexpected batch size = %d", exporter.BatchSize())
+	}
+	for _, size := range []int{0, queueSize + 1} {
+		if err := exporter.SetBatchSize(size); err != ErrInvalidBatchSize {
+			t.Errorf("unexpected error = %v", err)
+		}
+	}
+	if err := exporter.SetBatchSize(2); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		exporter.StoreReading(490154203237518, time.Now(), client.Reading{})
+	}
+	done := make(chan error, 1)
+	go func() { done <- exporter.Run() }()
+	exporter.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if actual := atomic.LoadInt32(&requests); actual != 3 {
+		t.Errorf("unexpected requests = %d", actual)
+	}
+}
+
+func TestRemoteWriteHealth(t *testing.T) {
+	var failing int32 = 1
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer endpoint.Close()
+
+	exporter := NewRemoteWrite(endpoint.URL)
+	if err := exporter.SetBatchSize(1); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if health := exporter.Health(); health.LastSuccess != nil || health.DownSince != nil {
+		t.Errorf("unexpected health = %+v", health)
+	}
+	done := make(chan error, 1)
+	go func() { done <- exporter.Run() }()
+	defer func() {
+		exporter.Close()
+		<-done
+	}()
+
+	exporter.StoreReading(490154203237518, time.Now(), client.Reading{})
+	time.Sleep(50 * time.Millisecond)
+	health := exporter.Health()
+	if health.LastSuccess != nil || health.DownSince == nil || !strings.Contains(health.LastError, "503") {
+		t.Errorf("unexpected health = %+v", health)
+	}
+	if !health.Down(time.Now(), 0) || health.Down(time.Now(), time.Hour) {
+		t.Errorf("unexpected down, health = %+v", health)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	exporter.StoreReading(490154203237518, time.Now(), client.Reading{})
+	time.Sleep(50 * time.Millisecond)
+	health = exporter.Health()
+	if health.LastSuccess == nil || health.DownSince != nil || health.Down(time.Now(), 0) {
+		t.Errorf("unexpected health = %+v", health)
+	}
+}
@@ -0,0 +1,25 @@
+package export
+
+// maxSnappyLiteral is the longest literal a single snappy literal element
+// encodes with a 2 byte length.
+const maxSnappyLiteral = 1 << 16
+
+// snappyEncode encodes src in the snappy block format, as required of
+// Prometheus remote-write requests. src is stored as literals, without
+// compression, which every snappy decoder accepts; readings compress poorly,
+// and request bodies are small.
+func snappyEncode(src []byte) []byte {
+	dst := appendVarint(make([]byte, 0, len(src)+len(src)/maxSnappyLiteral*3+8), uint64(len(src)))
+	for len(src) > 0 {
+		n := len(src)
+		if n > maxSnappyLiteral {
+			n = maxSnappyLiteral
+		}
+		// Literal elements are tagged 0b00 in their low bits, with the
+		// length minus one held in the following 2 bytes for tag 61.
+		dst = append(dst, 61<<2, byte(n-1), byte((n-1)>>8))
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
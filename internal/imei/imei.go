@@ -11,7 +11,7 @@ import (
 )
 
 var (
-	ErrInvalid  = errors.New("imei: invalid ")
+	ErrInvalid  = errors.New("imei: invalid")
 	ErrChecksum = errors.New("imei: invalid checksum")
 )
 
@@ -1,6 +1,7 @@
 package imei
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -102,3 +103,28 @@ func benchmarkDecode(b *testing.B, imei []byte) {
 
 func BenchmarkDecode1(b *testing.B) { benchmarkDecode(b, []byte("490154203237518")) }
 func BenchmarkDecode2(b *testing.B) { benchmarkDecode(b, []byte("355041000729140")) }
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte("490154203237518"))
+	f.Add([]byte("355041000729140"))
+	f.Add([]byte("490154203237519"))
+	f.Add([]byte("4901542032375l8"))
+	f.Add([]byte("490154203237518login"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// Decode documents a panic for inputs shorter than an IMEI.
+		if len(b) < length {
+			return
+		}
+		code, err := Decode(b)
+		if err != nil {
+			if err != ErrInvalid && err != ErrChecksum {
+				t.Fatalf("unexpected error = %s", err)
+			}
+			return
+		}
+		if expected := fmt.Sprintf("%015d", code); expected != string(b[:length]) {
+			t.Errorf("expected = %s, actual = %s", b[:length], expected)
+		}
+	})
+}
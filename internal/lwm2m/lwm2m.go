@@ -0,0 +1,117 @@
+// Package lwm2m maps the objects reported by LwM2M devices onto
+// client.Reading, so that standards-based devices report into thermomatic
+// without custom firmware. Devices report their resources with the LwM2M
+// Send operation, in the SenML JSON format.
+//
+// The following resources are mapped:
+//
+//	/3303/<instance>/5700  Temperature Sensor Value  Reading.Temperature
+//	/6/0/0                 Location Latitude         Reading.Latitude
+//	/6/0/1                 Location Longitude        Reading.Longitude
+//	/6/0/2                 Location Altitude         Reading.Altitude
+//	/3/0/9                 Device Battery Level      Reading.BatteryLevel
+package lwm2m
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/imei"
+)
+
+// ContentFormatSenMLJSON is the CoAP Content-Format of SenML JSON payloads.
+const ContentFormatSenMLJSON = 110
+
+var (
+	// ErrNoResources indicates a payload held none of the mapped resources.
+	ErrNoResources = errors.New("no mapped resources")
+
+	// ErrEndpoint indicates an endpoint name does not name an IMEI.
+	ErrEndpoint = errors.New("endpoint is not an imei")
+)
+
+// Record is a SenML record. Only numeric values are mapped.
+type Record struct {
+	BaseName string   `json:"bn,omitempty"`
+	Name     string   `json:"n,omitempty"`
+	Value    *float64 `json:"v,omitempty"`
+}
+
+// ParseSenML parses the SenML JSON pack in b.
+func ParseSenML(b []byte) ([]Record, error) {
+	var records []Record
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, fmt.Errorf("failed to lwm2m.ParseSenML/Unmarshal\terr = %w", err)
+	}
+	return records, nil
+}
+
+// Apply sets the fields of reading mapped from the resources of records,
+// leaving the fields of resources not reported unchanged. Each record's name
+// is resolved against the base name in effect. The number of fields set is
+// returned; if none were, ErrNoResources is returned.
+func Apply(reading *client.Reading, records []Record) (int, error) {
+	var (
+		baseName string
+		applied  int
+	)
+	for _, record := range records {
+		if record.BaseName != "" {
+			baseName = record.BaseName
+		}
+		if record.Value == nil {
+			continue
+		}
+		field := fieldOf(baseName + record.Name)
+		if field == nil {
+			continue
+		}
+		*field(reading) = *record.Value
+		applied++
+	}
+	if applied == 0 {
+		return 0, ErrNoResources
+	}
+	return applied, nil
+}
+
+// fieldOf retrieves the accessor of the Reading field mapped from the
+// resource at path, or nil if the resource is not mapped.
+func fieldOf(path string) func(*client.Reading) *float64 {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(segments) != 3 {
+		return nil
+	}
+	object, instance, resource := segments[0], segments[1], segments[2]
+	switch {
+	case object == "3303" && resource == "5700":
+		return func(r *client.Reading) *float64 { return &r.Temperature }
+	case object == "6" && instance == "0" && resource == "0":
+		return func(r *client.Reading) *float64 { return &r.Latitude }
+	case object == "6" && instance == "0" && resource == "1":
+		return func(r *client.Reading) *float64 { return &r.Longitude }
+	case object == "6" && instance == "0" && resource == "2":
+		return func(r *client.Reading) *float64 { return &r.Altitude }
+	case object == "3" && instance == "0" && resource == "9":
+		return func(r *client.Reading) *float64 { return &r.BatteryLevel }
+	default:
+		return nil
+	}
+}
+
+// EndpointIMEI retrieves the IMEI named by endpoint, a client endpoint name
+// in the "urn:imei:<imei>" format, or a bare IMEI.
+func EndpointIMEI(endpoint string) (uint64, error) {
+	s := strings.TrimPrefix(endpoint, "urn:imei:")
+	if len(s) != 15 {
+		return 0, fmt.Errorf("failed to lwm2m.EndpointIMEI\tendpoint = %s err = %w", endpoint, ErrEndpoint)
+	}
+	code, err := imei.Decode([]byte(s))
+	if err != nil {
+		return 0, fmt.Errorf("failed to lwm2m.EndpointIMEI/Decode\tendpoint = %s err = %w", endpoint, err)
+	}
+	return code, nil
+}
@@ -0,0 +1,82 @@
+package lwm2m
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		previous client.Reading
+		expected client.Reading
+		applied  int
+		err      error
+	}{
+		{
+			name: "every resource",
+			payload: `[
+				{"bn":"/3303/0/","n":"5700","v":21.5},
+				{"bn":"/6/0/","n":"0","v":33.41},
+				{"n":"1","v":44.4},
+				{"n":"2","v":120},
+				{"bn":"/3/0/","n":"9","v":87}
+			]`,
+			expected: client.Reading{Temperature: 21.5, Latitude: 33.41, Longitude: 44.4, Altitude: 120, BatteryLevel: 87},
+			applied:  5,
+		},
+		{
+			name:     "some resources",
+			payload:  `[{"n":"/3303/1/5700","v":-4},{"n":"/3303/0/5701","vs":"Cel"}]`,
+			previous: client.Reading{Temperature: 21.5, BatteryLevel: 87},
+			expected: client.Reading{Temperature: -4, BatteryLevel: 87},
+			applied:  1,
+		},
+		{
+			name:    "no resources",
+			payload: `[{"n":"/3/0/0","vs":"thermomatic"},{"n":"/6/1/0","v":33.41}]`,
+			err:     ErrNoResources,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records, err := ParseSenML([]byte(test.payload))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			reading := test.previous
+			applied, err := Apply(&reading, records)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("expected error = %v, actual = %v", test.err, err)
+			}
+			if applied != test.applied || reading != test.expected {
+				t.Errorf("expected %d applied %+v, actual = %d applied %+v", test.applied, test.expected, applied, reading)
+			}
+		})
+	}
+}
+
+func TestEndpointIMEI(t *testing.T) {
+	tests := map[string]struct {
+		endpoint string
+		imei     uint64
+		err      bool
+	}{
+		"urn":      {endpoint: "urn:imei:490154203237518", imei: 490154203237518},
+		"bare":     {endpoint: "490154203237518", imei: 490154203237518},
+		"checksum": {endpoint: "urn:imei:490154203237519", err: true},
+		"length":   {endpoint: "urn:imei:4901542032375", err: true},
+		"name":     {endpoint: "thermometer-7", err: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			imei, err := EndpointIMEI(test.endpoint)
+			if (err != nil) != test.err || imei != test.imei {
+				t.Errorf("unexpected imei = %d, err = %v", imei, err)
+			}
+		})
+	}
+}
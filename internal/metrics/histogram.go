@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IntervalBuckets are histogram upper bounds, in seconds, suited to the time
+// between readings of a device reporting every 25ms.
+var IntervalBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2}
+
+// LatencyBuckets are histogram upper bounds, in seconds, suited to the time
+// taken to process a reading, from microseconds in memory to seconds behind a
+// slow sink.
+var LatencyBuckets = []float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Histogram is a concurrent safe histogram of observations over fixed
+// buckets.
+type Histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    uint64 // float64 bits
+}
+
+// NewHistogram initializes a Histogram with the ascending upper bounds
+// specified. Observations greater than the last bound are only counted in the
+// Histogram's total.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+// Observe records v.
+func (h *Histogram) Observe(v float64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			atomic.AddUint64(&h.counts[i], 1)
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+// ObserveDuration records d in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// Bucket is the cumulative count of observations less than or equal to
+// UpperBound.
+type Bucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// HistogramSnapshot is a point in time copy of a Histogram.
+type HistogramSnapshot struct {
+	// Buckets are cumulative; observations beyond the last bucket are
+	// included only in Count.
+	Buckets []Bucket
+	Count   uint64
+	Sum     float64
+}
+
+// Snapshot retrieves a HistogramSnapshot of h.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Buckets: make([]Bucket, len(h.bounds)),
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     math.Float64frombits(atomic.LoadUint64(&h.sum)),
+	}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		s.Buckets[i] = Bucket{UpperBound: bound, Count: cumulative}
+	}
+	return s
+}
+
+// HistogramSet is a concurrent safe set of Histograms over the same buckets,
+// each created the first time its name is used.
+type HistogramSet struct {
+	bounds []float64
+	m      sync.Map
+}
+
+// NewHistogramSet initializes an empty HistogramSet whose Histograms have the
+// ascending upper bounds specified.
+func NewHistogramSet(bounds []float64) *HistogramSet {
+	return &HistogramSet{bounds: bounds}
+}
+
+// Histogram retrieves the Histogram named name, creating it if necessary.
+func (s *HistogramSet) Histogram(name string) *Histogram {
+	if h, ok := s.m.Load(name); ok {
+		return h.(*Histogram)
+	}
+	h, _ := s.m.LoadOrStore(name, NewHistogram(s.bounds))
+	return h.(*Histogram)
+}
+
+// Snapshot retrieves a HistogramSnapshot of each Histogram, keyed by name.
+func (s *HistogramSet) Snapshot() map[string]HistogramSnapshot {
+	snapshot := make(map[string]HistogramSnapshot)
+	s.m.Range(func(name, h interface{}) bool {
+		snapshot[name.(string)] = h.(*Histogram).Snapshot()
+		return true
+	})
+	return snapshot
+}
@@ -0,0 +1,263 @@
+// Package metrics implements the counters recorded by the thermomatic server
+// and its clients, and the means of publishing them.
+package metrics
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a concurrent safe int64 counter.
+type Counter struct {
+	value int64
+}
+
+// Inc increments the Counter by 1.
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.value, 1)
+}
+
+// Add adds n to the Counter.
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+// Value retrieves the Counter's current value.
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// CounterSet is a concurrent safe set of Counters, each created the first
+// time its name is used.
+type CounterSet struct {
+	m sync.Map
+}
+
+// NewCounterSet initializes an empty CounterSet.
+func NewCounterSet() *CounterSet {
+	return new(CounterSet)
+}
+
+// Counter retrieves the Counter named name, creating it if necessary.
+func (s *CounterSet) Counter(name string) *Counter {
+	if c, ok := s.m.Load(name); ok {
+		return c.(*Counter)
+	}
+	c, _ := s.m.LoadOrStore(name, new(Counter))
+	return c.(*Counter)
+}
+
+// Snapshot retrieves the current value of each Counter, keyed by name.
+func (s *CounterSet) Snapshot() map[string]int64 {
+	snapshot := make(map[string]int64)
+	s.m.Range(func(name, c interface{}) bool {
+		snapshot[name.(string)] = c.(*Counter).Value()
+		return true
+	})
+	return snapshot
+}
+
+// Metrics is the set of counters recorded by a thermomatic server and its
+// clients. Metrics satisfies the expvar.Var interface.
+type Metrics struct {
+	// Connections counts accepted TCP connections.
+	Connections Counter
+
+	// AcceptErrors counts failures to accept TCP connections.
+	AcceptErrors Counter
+
+	// Accepting is 1 while the server is accepting TCP connections, and 0
+	// otherwise.
+	Accepting Counter
+
+	// Clients counts the clients currently connected.
+	Clients Counter
+
+	// Readings counts successfully decoded readings.
+	Readings Counter
+
+	// Errors counts connection, login, and decode failures.
+	Errors Counter
+
+	// Alarms counts priority alarm frames received.
+	Alarms Counter
+
+	// BytesRead counts bytes read from client connections.
+	BytesRead Counter
+
+	// BytesWritten counts bytes written to client connections.
+	BytesWritten Counter
+
+	// Quarantines counts clients quarantined for repeated decode failures.
+	Quarantines Counter
+
+	// DroppedReadingLogs counts readings not logged because the asynchronous
+	// reading log buffer was full.
+	DroppedReadingLogs Counter
+
+	// DroppedReadings counts decoded readings not processed because the
+	// worker pool queue was full.
+	DroppedReadings Counter
+
+	// Panics counts panics recovered while handling client connections and
+	// http requests.
+	Panics Counter
+
+	// Disconnects counts client disconnections, keyed by the reason the
+	// client was closed.
+	Disconnects *CounterSet
+
+	// TenantConnections counts accepted client connections, keyed by the
+	// tenant of the client.
+	TenantConnections *CounterSet
+
+	// ListenerConnections counts accepted client connections, keyed by the
+	// listener the client connected through.
+	ListenerConnections *CounterSet
+
+	// TenantReadings counts successfully decoded readings, keyed by the
+	// tenant of the client.
+	TenantReadings *CounterSet
+
+	// TenantQuotaExceeded counts rejections due to tenant quotas, keyed by the
+	// tenant and the quota exceeded, as in "acme.readings".
+	TenantQuotaExceeded *CounterSet
+
+	// ReadingIntervals records the time in seconds between consecutive
+	// readings of each device.
+	ReadingIntervals *Histogram
+
+	// IngestLatency records the time in seconds readings spend in each stage
+	// of the reading pipeline, keyed by stage: "decode", "store", "export",
+	// and "total", from the reading being read to its export completing.
+	IngestLatency *HistogramSet
+
+	timingSinks []TimingSink
+}
+
+// TimingSink receives timings as they are recorded.
+type TimingSink interface {
+	Timing(name string, d time.Duration)
+}
+
+// New initializes a Metrics object with all counters at zero.
+func New() *Metrics {
+	return &Metrics{
+		Disconnects:         NewCounterSet(),
+		TenantConnections:   NewCounterSet(),
+		ListenerConnections: NewCounterSet(),
+		TenantReadings:      NewCounterSet(),
+		TenantQuotaExceeded: NewCounterSet(),
+		ReadingIntervals:    NewHistogram(IntervalBuckets),
+		IngestLatency:       NewHistogramSet(LatencyBuckets),
+	}
+}
+
+// AddTimingSink registers s to receive every timing recorded. AddTimingSink
+// is not concurrent safe, and must be called before the Metrics are in use.
+func (m *Metrics) AddTimingSink(s TimingSink) {
+	m.timingSinks = append(m.timingSinks, s)
+}
+
+// Timing records that the event name took d.
+func (m *Metrics) Timing(name string, d time.Duration) {
+	for _, s := range m.timingSinks {
+		s.Timing(name, d)
+	}
+}
+
+// value is a named snapshot of a Counter.
+type value struct {
+	name  string
+	value int64
+	gauge bool
+}
+
+// namedSet is a CounterSet, along with its name, and the label its Counters
+// are keyed by.
+type namedSet struct {
+	name  string
+	label string
+	set   *CounterSet
+}
+
+// sets retrieves each CounterSet of the Metrics.
+func (m *Metrics) sets() []namedSet {
+	return []namedSet{
+		{name: "Disconnects", label: "reason", set: m.Disconnects},
+		{name: "TenantConnections", label: "tenant", set: m.TenantConnections},
+		{name: "ListenerConnections", label: "listener", set: m.ListenerConnections},
+		{name: "TenantReadings", label: "tenant", set: m.TenantReadings},
+		{name: "TenantQuotaExceeded", label: "quota", set: m.TenantQuotaExceeded},
+	}
+}
+
+// values retrieves a snapshot of each Counter. Counters that may decrease are
+// flagged as gauges. The Counters of a CounterSet are named after the set and
+// the Counter, and ordered by name.
+func (m *Metrics) values() []value {
+	values := m.scalars()
+	for _, s := range m.sets() {
+		values = appendSet(values, s.name, s.set)
+	}
+	return values
+}
+
+// scalars retrieves a snapshot of each Counter not part of a CounterSet.
+func (m *Metrics) scalars() []value {
+	return []value{
+		{name: "Connections", value: m.Connections.Value()},
+		{name: "AcceptErrors", value: m.AcceptErrors.Value()},
+		{name: "Accepting", value: m.Accepting.Value(), gauge: true},
+		{name: "Clients", value: m.Clients.Value(), gauge: true},
+		{name: "Readings", value: m.Readings.Value()},
+		{name: "Errors", value: m.Errors.Value()},
+		{name: "Alarms", value: m.Alarms.Value()},
+		{name: "BytesRead", value: m.BytesRead.Value()},
+		{name: "BytesWritten", value: m.BytesWritten.Value()},
+		{name: "Quarantines", value: m.Quarantines.Value()},
+		{name: "DroppedReadingLogs", value: m.DroppedReadingLogs.Value()},
+		{name: "DroppedReadings", value: m.DroppedReadings.Value()},
+		{name: "Panics", value: m.Panics.Value()},
+	}
+}
+
+// appendSet appends a snapshot of each Counter of set to values, named after
+// prefix and the Counter, and ordered by name.
+func appendSet(values []value, prefix string, set *CounterSet) []value {
+	snapshot := set.Snapshot()
+	for _, name := range sortedKeys(snapshot) {
+		values = append(values, value{name: prefix + "." + name, value: snapshot[name]})
+	}
+	return values
+}
+
+// String satisfies the expvar.Var interface, and returns a JSON
+// representation of the current counter and histogram values.
+func (m *Metrics) String() string {
+	values := m.values()
+	snapshot := make(map[string]interface{}, len(values)+2)
+	for _, v := range values {
+		snapshot[v.name] = v.value
+	}
+	snapshot["ReadingIntervals"] = m.ReadingIntervals.Snapshot()
+	snapshot["IngestLatency"] = m.IngestLatency.Snapshot()
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// sortedKeys retrieves the keys of m in ascending order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCounterConcurrent(t *testing.T) {
+	var (
+		c  Counter
+		wg sync.WaitGroup
+	)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Inc()
+		}()
+	}
+	wg.Wait()
+
+	if c.Value() != 100 {
+		t.Fatalf("expected counter value = 100, actual = %d", c.Value())
+	}
+}
+
+func TestCounterSet(t *testing.T) {
+	s := NewCounterSet()
+	s.Counter("inactive").Inc()
+	s.Counter("inactive").Inc()
+	s.Counter("kicked").Add(3)
+
+	snapshot := s.Snapshot()
+	if len(snapshot) != 2 || snapshot["inactive"] != 2 || snapshot["kicked"] != 3 {
+		t.Fatalf("unexpected snapshot = %v", snapshot)
+	}
+}
+
+func TestMetricsString(t *testing.T) {
+	m := New()
+	m.Connections.Inc()
+	m.Readings.Add(10)
+
+	var actual struct {
+		Connections      int64
+		Readings         int64
+		ReadingIntervals HistogramSnapshot
+	}
+	if err := json.Unmarshal([]byte(m.String()), &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if actual.Connections != 1 || actual.Readings != 10 {
+		t.Fatalf("unexpected metrics = %+v", actual)
+	}
+}
+
+func TestStatsD(t *testing.T) {
+	agent, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer agent.Close()
+
+	m := New()
+	s, err := NewStatsD(agent.LocalAddr().String(), "thermomatic.", time.Hour, m, "env:test")
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	go s.Run()
+
+	m.Readings.Add(3)
+	m.Disconnects.Counter("peer_reset").Inc()
+	m.TenantReadings.Counter("acme").Add(3)
+	m.Timing("login", 1500*time.Microsecond)
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	b := make([]byte, maxPacketSize)
+	if err := agent.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	n, err := agent.Read(b)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	expected := "thermomatic.login:1.5|ms|#env:test\n" +
+		"thermomatic.accepting:0|g|#env:test\n" +
+		"thermomatic.clients:0|g|#env:test\n" +
+		"thermomatic.readings:3|c|#env:test\n" +
+		"thermomatic.disconnects.peer_reset:1|c|#env:test\n" +
+		"thermomatic.tenantreadings.acme:3|c|#env:test\n"
+	if actual := string(b[:n]); actual != expected {
+		t.Fatalf("expected != actual\nexpected = %q\nactual = %q\n", expected, actual)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{0.025, 0.1, 1})
+	for _, v := range []float64{0.01, 0.025, 0.05, 0.5, 5} {
+		h.Observe(v)
+	}
+
+	s := h.Snapshot()
+	expected := []Bucket{
+		{UpperBound: 0.025, Count: 2},
+		{UpperBound: 0.1, Count: 3},
+		{UpperBound: 1, Count: 4},
+	}
+	for i := range expected {
+		if s.Buckets[i] != expected[i] {
+			t.Errorf("expected = %v\nactual = %v\n", expected[i], s.Buckets[i])
+		}
+	}
+	if s.Count != 5 {
+		t.Errorf("expected count = 5, actual = %d", s.Count)
+	}
+	if s.Sum < 5.584 || s.Sum > 5.586 {
+		t.Errorf("expected sum = 5.585, actual = %v", s.Sum)
+	}
+}
+
+func TestHistogramSet(t *testing.T) {
+	s := NewHistogramSet([]float64{0.1, 1})
+	s.Histogram("decode").Observe(0.05)
+	s.Histogram("export").Observe(0.5)
+	s.Histogram("export").Observe(2)
+
+	snapshot := s.Snapshot()
+	if len(snapshot) != 2 {
+		t.Fatalf("expected 2 histograms, actual = %v", snapshot)
+	}
+	if actual := snapshot["decode"]; actual.Count != 1 || actual.Buckets[0].Count != 1 {
+		t.Errorf("unexpected decode histogram = %+v", actual)
+	}
+	if actual := snapshot["export"]; actual.Count != 2 || actual.Buckets[0].Count != 0 || actual.Buckets[1].Count != 1 {
+		t.Errorf("unexpected export histogram = %+v", actual)
+	}
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	m := New()
+	m.Readings.Add(3)
+	m.Clients.Inc()
+	m.Disconnects.Counter("peer_reset").Inc()
+	m.IngestLatency.Histogram("total").Observe(0.003)
+	m.IngestLatency.Histogram("total").Observe(2)
+
+	var b strings.Builder
+	if err := m.WriteOpenMetrics(&b); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	actual := b.String()
+	for _, expected := range []string{
+		"# TYPE thermomatic_readings counter\nthermomatic_readings_total 3\n",
+		"# TYPE thermomatic_clients gauge\nthermomatic_clients 1\n",
+		"# TYPE thermomatic_bytes_read counter\n",
+		`thermomatic_disconnects_total{reason="peer_reset"} 1` + "\n",
+		"# TYPE thermomatic_reading_interval_seconds histogram\n",
+		"# TYPE thermomatic_ingest_latency_seconds histogram\n# UNIT thermomatic_ingest_latency_seconds seconds\n",
+		`thermomatic_ingest_latency_seconds_bucket{stage="total",le="0.0025"} 0` + "\n",
+		`thermomatic_ingest_latency_seconds_bucket{stage="total",le="0.005"} 1` + "\n",
+		`thermomatic_ingest_latency_seconds_bucket{stage="total",le="+Inf"} 2` + "\n",
+		`thermomatic_ingest_latency_seconds_count{stage="total"} 2` + "\n",
+		`thermomatic_ingest_latency_seconds_sum{stage="total"} 2.003` + "\n",
+		"thermomatic_reading_interval_seconds_count 0\n",
+	} {
+		if !strings.Contains(actual, expected) {
+			t.Errorf("expected output to contain %q\nactual = %s", expected, actual)
+		}
+	}
+	if !strings.HasSuffix(actual, "# EOF\n") {
+		t.Errorf("expected output to end with # EOF, actual = %s", actual)
+	}
+}
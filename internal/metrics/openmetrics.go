@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// OpenMetricsContentType is the content type of the OpenMetrics text format
+// written by WriteOpenMetrics.
+const OpenMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// openMetricsPrefix prefixes the name of each metric family written by
+// WriteOpenMetrics.
+const openMetricsPrefix = "thermomatic_"
+
+// labelEscaper escapes label values per the OpenMetrics text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteOpenMetrics writes the current counter and histogram values to w in
+// the OpenMetrics text format, for scraping by Prometheus and compatible
+// collectors. Counters are named in snake case, as in
+// "thermomatic_bytes_read_total", and the Counters of a CounterSet share a
+// metric family, labelled with their name.
+func (m *Metrics) WriteOpenMetrics(w io.Writer) error {
+	var b strings.Builder
+	for _, v := range m.scalars() {
+		name := openMetricsPrefix + snakeCase(v.name)
+		if v.gauge {
+			fmt.Fprintf(&b, "# TYPE %s gauge\n%s %d\n", name, name, v.value)
+			continue
+		}
+		fmt.Fprintf(&b, "# TYPE %s counter\n%s_total %d\n", name, name, v.value)
+	}
+	for _, s := range m.sets() {
+		name := openMetricsPrefix + snakeCase(s.name)
+		fmt.Fprintf(&b, "# TYPE %s counter\n", name)
+		snapshot := s.set.Snapshot()
+		for _, key := range sortedKeys(snapshot) {
+			fmt.Fprintf(&b, "%s_total{%s=\"%s\"} %d\n", name, s.label, labelEscaper.Replace(key), snapshot[key])
+		}
+	}
+
+	name := openMetricsPrefix + "reading_interval_seconds"
+	writeHistogramFamily(&b, name)
+	writeHistogram(&b, name, "", m.ReadingIntervals.Snapshot())
+
+	name = openMetricsPrefix + "ingest_latency_seconds"
+	writeHistogramFamily(&b, name)
+	stages := m.IngestLatency.Snapshot()
+	for _, stage := range sortedKeys(stages) {
+		writeHistogram(&b, name, `stage="`+labelEscaper.Replace(stage)+`",`, stages[stage])
+	}
+
+	b.WriteString("# EOF\n")
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return fmt.Errorf("failed to metrics.WriteOpenMetrics/WriteString\terr = %w", err)
+	}
+	return nil
+}
+
+// writeHistogramFamily writes the metadata of the histogram family name, in
+// seconds.
+func writeHistogramFamily(b *strings.Builder, name string) {
+	fmt.Fprintf(b, "# TYPE %s histogram\n# UNIT %s seconds\n", name, name)
+}
+
+// writeHistogram writes the samples of s, a histogram of the family name.
+// labels, if not empty, are the histogram's labels, each followed by a comma.
+func writeHistogram(b *strings.Builder, name, labels string, s HistogramSnapshot) {
+	for _, bucket := range s.Buckets {
+		fmt.Fprintf(b, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, formatFloat(bucket.UpperBound), bucket.Count)
+	}
+	fmt.Fprintf(b, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, s.Count)
+	if labels != "" {
+		labels = "{" + strings.TrimSuffix(labels, ",") + "}"
+	}
+	fmt.Fprintf(b, "%s_count%s %d\n", name, labels, s.Count)
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, labels, formatFloat(s.Sum))
+}
+
+// formatFloat formats v in the shortest representation that parses back to
+// it.
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// snakeCase converts name from camel case to snake case, as in "BytesRead"
+// to "bytes_read".
+func snakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPacketSize is the largest StatsD payload sent in a single UDP datagram.
+// It is sized to avoid IP fragmentation on typical networks.
+const maxPacketSize = 1432
+
+// StatsD emits Metrics to a StatsD or DogStatsD agent over UDP. Counters are
+// flushed as deltas every interval, and timings are buffered as they are
+// recorded and sent alongside them.
+type StatsD struct {
+	conn     net.Conn
+	prefix   string
+	tags     string
+	interval time.Duration
+	metrics  *Metrics
+
+	mu   sync.Mutex
+	buf  []byte
+	last map[string]int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewStatsD initializes a StatsD emitter sending m to the agent at addr. Each
+// metric name is prefixed with prefix. If tags are specified, they are
+// appended to each metric in the DogStatsD format. On success, the StatsD
+// emitter is registered as a TimingSink of m.
+func NewStatsD(addr, prefix string, interval time.Duration, m *Metrics, tags ...string) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to metrics.NewStatsD/Dial\taddr = %s err = %w", addr, err)
+	}
+
+	s := &StatsD{
+		conn:     conn,
+		prefix:   prefix,
+		interval: interval,
+		metrics:  m,
+		buf:      make([]byte, 0, maxPacketSize),
+		last:     make(map[string]int64),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if len(tags) > 0 {
+		s.tags = "|#" + strings.Join(tags, ",")
+	}
+	m.AddTimingSink(s)
+	return s, nil
+}
+
+// Run flushes the Metrics to the agent every interval until Close is called.
+func (s *StatsD) Run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			s.flushCounters()
+			return
+		case <-ticker.C:
+			s.flushCounters()
+		}
+	}
+}
+
+// Close stops Run after a final flush, and releases the UDP socket.
+func (s *StatsD) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.conn.Close()
+}
+
+// Timing satisfies the TimingSink interface, and buffers d to be sent to the
+// agent in milliseconds.
+func (s *StatsD) Timing(name string, d time.Duration) {
+	s.mu.Lock()
+	s.write(name, float64(d)/float64(time.Millisecond), "ms")
+	s.mu.Unlock()
+}
+
+// flushCounters buffers the change in each counter since the previous flush,
+// and sends all buffered metrics.
+func (s *StatsD) flushCounters() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.metrics.values() {
+		if v.gauge {
+			s.write(v.name, float64(v.value), "g")
+			continue
+		}
+		delta := v.value - s.last[v.name]
+		s.last[v.name] = v.value
+		if delta == 0 {
+			continue
+		}
+		s.write(v.name, float64(delta), "c")
+	}
+	s.send()
+}
+
+// write appends a single metric line to the buffer, sending the buffer first
+// if the line would not fit. The caller must hold s.mu.
+func (s *StatsD) write(name string, value float64, kind string) {
+	line := fmt.Sprintf("%s%s:%v|%s%s\n", s.prefix, strings.ToLower(name), value, kind, s.tags)
+	if len(s.buf)+len(line) > maxPacketSize {
+		s.send()
+	}
+	s.buf = append(s.buf, line...)
+}
+
+// send writes the buffer to the agent and resets it. Write errors are
+// ignored, as StatsD delivery is best-effort. The caller must hold s.mu.
+func (s *StatsD) send() {
+	if len(s.buf) == 0 {
+		return
+	}
+	_, _ = s.conn.Write(s.buf)
+	s.buf = s.buf[:0]
+}
@@ -0,0 +1,296 @@
+// Package plugin is a registry of the backends compiled into thermomatic.
+// Packages providing a backend register it under a name from their init
+// function, as database/sql drivers do, and servers instantiate the backends
+// their configuration names. Adding a backend requires only that its package
+// be imported, without changes to the server.
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+// ErrUnknownPlugin indicates no backend is registered under a name.
+var ErrUnknownPlugin = errors.New("unknown plugin")
+
+// Store keeps the readings of Clients as they are received. StoreReading is
+// called on the Client's goroutine, and must not block. Close is called once
+// the server no longer stores readings.
+type Store interface {
+	client.ReadingStore
+	Close() error
+}
+
+// Eraser is implemented by Stores able to erase the readings they keep of a
+// device, to satisfy right-to-erasure requests. EraseDevice retrieves the
+// number of readings erased.
+type Eraser interface {
+	EraseDevice(imei uint64) (int, error)
+}
+
+// Batcher is implemented by Exporters exporting readings in batches, whose
+// batch size may be adjusted while they run. SetBatchSize returns an error
+// if size is invalid.
+type Batcher interface {
+	BatchSize() int
+	SetBatchSize(size int) error
+}
+
+// HealthReporter is implemented by Exporters reporting the health of their
+// sends to their external system.
+type HealthReporter interface {
+	Health() Health
+}
+
+// Health is the health of an Exporter's sends to its external system.
+type Health struct {
+	// LastSuccess is when readings were last sent successfully, and is nil
+	// if none have been.
+	LastSuccess *time.Time `json:",omitempty"`
+
+	// DownSince is when sends began failing, and is nil while they succeed.
+	// LastError is the error of the latest failed send.
+	DownSince *time.Time `json:",omitempty"`
+	LastError string     `json:",omitempty"`
+
+	// Queued is the number of readings awaiting export, and Dropped the
+	// number dropped because the queue was full.
+	Queued  int
+	Dropped int64
+}
+
+// Down reports whether sends have been failing for longer than d as of now.
+func (h Health) Down(now time.Time, d time.Duration) bool {
+	return h.DownSince != nil && now.Sub(*h.DownSince) > d
+}
+
+// Exporter is a Store shipping readings to an external system in the
+// background. Run exports readings until Close is called.
+type Exporter interface {
+	Store
+	Run() error
+}
+
+// Logger logs the messages of backends. A *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// ExporterOptions are the settings every Exporter is initialized with,
+// beyond its configuration.
+type ExporterOptions struct {
+	// DryRun, if non-nil, makes the Exporter serialize readings as usual, but
+	// log what it would send to DryRun without contacting its external
+	// system.
+	DryRun Logger
+
+	// Anonymize, if non-nil, makes the Exporter replace IMEIs with stable
+	// pseudonyms and reduce the precision of positions.
+	Anonymize *Anonymization
+}
+
+// Anonymization configures how an Exporter anonymizes readings.
+type Anonymization struct {
+	// Key is the secret pseudonyms of IMEIs are derived with. Pseudonyms are
+	// stable for as long as Key is.
+	Key []byte
+
+	// Precision is the number of decimal places latitudes and longitudes are
+	// rounded to.
+	Precision int
+}
+
+// Identity is who a bearer token authenticates.
+type Identity struct {
+	// Tenant is the tenant the token is scoped to. It is ignored for
+	// administrative tokens.
+	Tenant string
+
+	// Admin is set for administrative tokens, which are scoped to every
+	// tenant.
+	Admin bool
+}
+
+// Authenticator authenticates the bearer tokens of http requests.
+type Authenticator interface {
+	// Authenticate retrieves the Identity of token, and reports whether the
+	// token is known.
+	Authenticate(token string) (Identity, bool)
+}
+
+// Geocoder resolves coordinates to the names of places, such as addresses or
+// cities.
+type Geocoder interface {
+	// ReverseGeocode retrieves the name of the place at latitude and
+	// longitude, in degrees. It should return once ctx is done.
+	ReverseGeocode(ctx context.Context, latitude, longitude float64) (string, error)
+}
+
+// Factories initialize a backend from its configuration, a string whose
+// format is defined by the backend.
+type (
+	StoreFactory         func(config string) (Store, error)
+	ExporterFactory      func(config string, options ExporterOptions) (Exporter, error)
+	AuthenticatorFactory func(config string) (Authenticator, error)
+	GeocoderFactory      func(config string) (Geocoder, error)
+)
+
+// registry is a concurrent safe set of factories of one kind of backend.
+type registry[F any] struct {
+	kind string
+
+	mu        sync.RWMutex
+	factories map[string]F
+}
+
+func newRegistry[F any](kind string) *registry[F] {
+	return &registry[F]{kind: kind, factories: make(map[string]F)}
+}
+
+// register registers factory under name. register panics if a factory is
+// already registered under name.
+func (r *registry[F]) register(name string, factory F) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.factories[name]; ok {
+		panic(fmt.Sprintf("plugin: %s %q registered twice", r.kind, name))
+	}
+	r.factories[name] = factory
+}
+
+// lookup retrieves the factory registered under name.
+func (r *registry[F]) lookup(name string) (F, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	factory, ok := r.factories[name]
+	if !ok {
+		return factory, fmt.Errorf("%w, %s = %s", ErrUnknownPlugin, r.kind, name)
+	}
+	return factory, nil
+}
+
+// names retrieves the names registered, ordered.
+func (r *registry[F]) names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var (
+	stores         = newRegistry[StoreFactory]("store")
+	exporters      = newRegistry[ExporterFactory]("exporter")
+	authenticators = newRegistry[AuthenticatorFactory]("authenticator")
+	geocoders      = newRegistry[GeocoderFactory]("geocoder")
+)
+
+// RegisterStore makes a Store available under name. RegisterStore panics if
+// factory is nil, or a Store is already registered under name.
+func RegisterStore(name string, factory StoreFactory) {
+	if factory == nil {
+		panic("plugin: nil store factory")
+	}
+	stores.register(name, factory)
+}
+
+// RegisterExporter makes an Exporter available under name.
+// RegisterExporter panics if factory is nil, or an Exporter is already
+// registered under name.
+func RegisterExporter(name string, factory ExporterFactory) {
+	if factory == nil {
+		panic("plugin: nil exporter factory")
+	}
+	exporters.register(name, factory)
+}
+
+// RegisterAuthenticator makes an Authenticator available under name.
+// RegisterAuthenticator panics if factory is nil, or an Authenticator is
+// already registered under name.
+func RegisterAuthenticator(name string, factory AuthenticatorFactory) {
+	if factory == nil {
+		panic("plugin: nil authenticator factory")
+	}
+	authenticators.register(name, factory)
+}
+
+// RegisterGeocoder makes a Geocoder available under name. RegisterGeocoder
+// panics if factory is nil, or a Geocoder is already registered under name.
+func RegisterGeocoder(name string, factory GeocoderFactory) {
+	if factory == nil {
+		panic("plugin: nil geocoder factory")
+	}
+	geocoders.register(name, factory)
+}
+
+// NewStore initializes the Store registered under name with config. If no
+// Store is registered under name, ErrUnknownPlugin is returned.
+func NewStore(name, config string) (Store, error) {
+	factory, err := stores.lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plugin.NewStore\terr = %w", err)
+	}
+	return factory(config)
+}
+
+// NewExporter initializes the Exporter registered under name with config and
+// options. If no Exporter is registered under name, ErrUnknownPlugin is
+// returned.
+func NewExporter(name, config string, options ExporterOptions) (Exporter, error) {
+	factory, err := exporters.lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plugin.NewExporter\terr = %w", err)
+	}
+	return factory(config, options)
+}
+
+// NewAuthenticator initializes the Authenticator registered under name with
+// config. If no Authenticator is registered under name, ErrUnknownPlugin is
+// returned.
+func NewAuthenticator(name, config string) (Authenticator, error) {
+	factory, err := authenticators.lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plugin.NewAuthenticator\terr = %w", err)
+	}
+	return factory(config)
+}
+
+// NewGeocoder initializes the Geocoder registered under name with config. If
+// no Geocoder is registered under name, ErrUnknownPlugin is returned.
+func NewGeocoder(name, config string) (Geocoder, error) {
+	factory, err := geocoders.lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plugin.NewGeocoder\terr = %w", err)
+	}
+	return factory(config)
+}
+
+// Stores retrieves the names of the registered Stores, ordered.
+func Stores() []string {
+	return stores.names()
+}
+
+// Exporters retrieves the names of the registered Exporters, ordered.
+func Exporters() []string {
+	return exporters.names()
+}
+
+// Authenticators retrieves the names of the registered Authenticators,
+// ordered.
+func Authenticators() []string {
+	return authenticators.names()
+}
+
+// Geocoders retrieves the names of the registered Geocoders, ordered.
+func Geocoders() []string {
+	return geocoders.names()
+}
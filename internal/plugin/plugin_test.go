@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+type fakeExporter struct {
+	config string
+}
+
+func (fakeExporter) StoreReading(uint64, time.Time, client.Reading) {}
+func (fakeExporter) Run() error                                     { return nil }
+func (fakeExporter) Close() error                                   { return nil }
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry[ExporterFactory]("exporter")
+	r.register("b", func(config string, _ ExporterOptions) (Exporter, error) { return fakeExporter{config: config}, nil })
+	r.register("a", func(config string, _ ExporterOptions) (Exporter, error) { return fakeExporter{config: config}, nil })
+
+	if names := r.names(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("unexpected names = %v", names)
+	}
+
+	factory, err := r.lookup("a")
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	e, err := factory("config", ExporterOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if e.(fakeExporter).config != "config" {
+		t.Errorf("unexpected exporter = %+v", e)
+	}
+
+	if _, err := r.lookup("c"); !errors.Is(err, ErrUnknownPlugin) {
+		t.Errorf("expected error wrapping %v, actual = %v", ErrUnknownPlugin, err)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := newRegistry[StoreFactory]("store")
+	r.register("a", func(string) (Store, error) { return nil, nil })
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic")
+		}
+	}()
+	r.register("a", func(string) (Store, error) { return nil, nil })
+}
+
+func TestNewAuthenticatorUnknown(t *testing.T) {
+	if _, err := NewAuthenticator("unknown", ""); !errors.Is(err, ErrUnknownPlugin) {
+		t.Errorf("expected error wrapping %v, actual = %v", ErrUnknownPlugin, err)
+	}
+}
+
+func TestNewGeocoderUnknown(t *testing.T) {
+	if _, err := NewGeocoder("unknown", ""); !errors.Is(err, ErrUnknownPlugin) {
+		t.Errorf("expected error wrapping %v, actual = %v", ErrUnknownPlugin, err)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+// Aggregate is a summary of the statistics of a set of devices.
+type Aggregate struct {
+	// Devices is the number of devices summarized. Online and Offline count
+	// them by presence, and Flapping counts those repeatedly going offline
+	// and back online.
+	Devices  int
+	Online   int
+	Offline  int
+	Flapping int
+
+	// Readings, DecodeErrors, and Alarms total the statistics of the online
+	// devices' connections.
+	Readings     int64
+	DecodeErrors int64
+	Alarms       int64
+
+	// Temperature and BatteryLevel summarize the latest readings of the
+	// online devices that have sent one, and are omitted if none have.
+	Temperature  *Range `json:",omitempty"`
+	BatteryLevel *Range `json:",omitempty"`
+}
+
+// Range summarizes a set of values.
+type Range struct {
+	Min  float64
+	Max  float64
+	Mean float64
+}
+
+// aggregate accumulates the statistics of a set of devices, one at a time.
+type aggregate struct {
+	Aggregate
+	temperature  rangeOf
+	batteryLevel rangeOf
+}
+
+// add accumulates the statistics of the device with presence p, where c is
+// the device's Client, or nil if the device is offline.
+func (a *aggregate) add(p Presence, c *client.Client) {
+	a.Devices++
+	if p.Flapping {
+		a.Flapping++
+	}
+	if c == nil {
+		a.Offline++
+		return
+	}
+	a.Online++
+	stats := c.Stats()
+	a.Readings += stats.Readings
+	a.DecodeErrors += stats.DecodeErrors
+	a.Alarms += stats.Alarms
+	if stats.Readings > 0 {
+		reading := c.LastReading()
+		a.temperature.add(reading.Temperature)
+		a.batteryLevel.add(reading.BatteryLevel)
+	}
+}
+
+// summary retrieves the Aggregate of the devices accumulated.
+func (a *aggregate) summary() Aggregate {
+	summary := a.Aggregate
+	summary.Temperature = a.temperature.summary()
+	summary.BatteryLevel = a.batteryLevel.summary()
+	return summary
+}
+
+// rangeOf accumulates a Range, one value at a time.
+type rangeOf struct {
+	n   int
+	sum float64
+	min float64
+	max float64
+}
+
+func (r *rangeOf) add(v float64) {
+	if r.n == 0 || v < r.min {
+		r.min = v
+	}
+	if r.n == 0 || v > r.max {
+		r.max = v
+	}
+	r.n++
+	r.sum += v
+}
+
+// summary retrieves the Range of the values accumulated, or nil if there were
+// none.
+func (r *rangeOf) summary() *Range {
+	if r.n == 0 {
+		return nil
+	}
+	return &Range{Min: r.min, Max: r.max, Mean: r.sum / float64(r.n)}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/common"
+)
+
+// maxAlertHistory is the number of most recent Alerts kept in memory by the
+// alert history.
+const maxAlertHistory = 10000
+
+// alertHistory is a concurrent safe record of the Alerts fired, and resolved,
+// by AlertRules. Each change of an Alert is appended to a file, if the Server
+// has one, as a line of JSON.
+type alertHistory struct {
+	mu     sync.RWMutex
+	alerts []Alert
+	file   *os.File
+	path   string
+}
+
+// record adds a fired alert to the history, or completes the fired Alert a
+// resolved alert resolves. The caller must hold h.mu.
+func (h *alertHistory) record(alert Alert) {
+	if alert.ResolvedAt != nil {
+		for i := len(h.alerts) - 1; i >= 0; i-- {
+			fired := h.alerts[i]
+			if fired.RuleID == alert.RuleID && fired.IMEI == alert.IMEI && fired.FiredAt.Equal(alert.FiredAt) {
+				h.alerts[i] = alert
+				return
+			}
+		}
+	}
+	h.alerts = append(h.alerts, alert)
+	if n := len(h.alerts); n > maxAlertHistory {
+		h.alerts = append(h.alerts[:0], h.alerts[n-maxAlertHistory:]...)
+	}
+}
+
+// add records alert, appending it to the history file, if any.
+func (h *alertHistory) add(alert Alert) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.record(alert)
+	if h.file == nil {
+		return nil
+	}
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to server.alertHistory.add/Marshal\terr = %w", err)
+	}
+	if _, err := h.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to server.alertHistory.add/Write\terr = %w", err)
+	}
+	return nil
+}
+
+// query retrieves the Alerts of imei, or of every IMEI if imei is zero, that
+// were firing at any time from from until to, ordered by when they fired.
+// Alerts are retrieved only if allows reports their tenant may be accessed.
+func (h *alertHistory) query(imei uint64, from, to time.Time, allows func(tenant string) bool) []Alert {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	alerts := make([]Alert, 0)
+	for _, alert := range h.alerts {
+		if imei != 0 && alert.IMEI != imei ||
+			!to.IsZero() && alert.FiredAt.After(to) ||
+			!from.IsZero() && alert.ResolvedAt != nil && alert.ResolvedAt.Before(from) ||
+			!allows(alert.Tenant) {
+			continue
+		}
+		alerts = append(alerts, alert)
+	}
+	sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].FiredAt.Before(alerts[j].FiredAt) })
+	return alerts
+}
+
+// open reads the Alerts appended to the file at path, and appends subsequent
+// changes to it. A missing file is created.
+func (h *alertHistory) open(path string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return fmt.Errorf("failed to server.alertHistory.open/Open\terr = %w", err)
+	default:
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var alert Alert
+			if err := json.Unmarshal(scanner.Bytes(), &alert); err != nil {
+				return fmt.Errorf("failed to server.alertHistory.open/Unmarshal\tpath = %s err = %w", path, err)
+			}
+			h.record(alert)
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to server.alertHistory.open/Scan\terr = %w", err)
+		}
+	}
+
+	h.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to server.alertHistory.open/OpenFile\terr = %w", err)
+	}
+	h.path = path
+	return nil
+}
+
+// erase drops the Alerts of imei from the history, and retrieves how many
+// were dropped. The history file, if any, is rewritten without them.
+func (h *alertHistory) erase(imei uint64) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var n int
+	alerts := h.alerts[:0]
+	for _, alert := range h.alerts {
+		if alert.IMEI == imei {
+			n++
+			continue
+		}
+		alerts = append(alerts, alert)
+	}
+	h.alerts = alerts
+	if h.file == nil {
+		return n, nil
+	}
+
+	b, err := os.ReadFile(h.path)
+	if err != nil {
+		return n, fmt.Errorf("failed to server.alertHistory.erase/ReadFile\terr = %w", err)
+	}
+	var kept bytes.Buffer
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		var alert Alert
+		if err := json.Unmarshal(line, &alert); err == nil && alert.IMEI == imei {
+			continue
+		}
+		kept.Write(line)
+	}
+	if err := common.WriteFileAtomic(h.path, kept.Bytes()); err != nil {
+		return n, fmt.Errorf("failed to server.alertHistory.erase\terr = %w", err)
+	}
+	// The file appended to was replaced.
+	h.file.Close()
+	h.file, err = os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return n, fmt.Errorf("failed to server.alertHistory.erase/OpenFile\terr = %w", err)
+	}
+	return n, nil
+}
+
+// close closes the history file, if any.
+func (h *alertHistory) close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	if err := h.file.Close(); err != nil {
+		return fmt.Errorf("failed to server.alertHistory.close/Close\terr = %w", err)
+	}
+	h.file = nil
+	return nil
+}
+
+// WithAlertHistoryFile returns a ServerOption function that configures the
+// Server to append each Alert fired or resolved to the file at path, and to
+// load the Alerts appended to it by previous runs, so that the alert history
+// survives restarts.
+func WithAlertHistoryFile(path string) ServerOption {
+	return func(srv *Server) {
+		srv.alertHistoryFile = path
+	}
+}
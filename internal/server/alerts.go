@@ -0,0 +1,539 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/common"
+)
+
+var (
+	// ErrInvalidAlertRule indicates an AlertRule names an unknown reading
+	// field or comparison operator, has a ClearThreshold on the firing side of
+	// its Threshold, or has a negative duration.
+	ErrInvalidAlertRule = errors.New("invalid alert rule")
+
+	// ErrUnknownAlertRule indicates no AlertRule has the ID specified.
+	ErrUnknownAlertRule = errors.New("unknown alert rule")
+)
+
+// alertFields retrieves the reading fields AlertRules may compare, by name.
+var alertFields = map[string]func(client.Reading) float64{
+	"Temperature":  func(r client.Reading) float64 { return r.Temperature },
+	"Altitude":     func(r client.Reading) float64 { return r.Altitude },
+	"Latitude":     func(r client.Reading) float64 { return r.Latitude },
+	"Longitude":    func(r client.Reading) float64 { return r.Longitude },
+	"BatteryLevel": func(r client.Reading) float64 { return r.BatteryLevel },
+}
+
+// alertFieldBatteryDrain is the derived field AlertRules may compare to fire
+// on fast battery drain: the battery level lost per hour, per the IMEI's
+// BatteryDrain. Rules comparing it apply only while the drain rate can be
+// estimated, which requires a reading history.
+const alertFieldBatteryDrain = "BatteryDrain"
+
+// alertOps retrieves the comparison operators AlertRules may apply, by name.
+var alertOps = map[string]func(value, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+}
+
+// AlertRule fires an Alert for each device whose reading Field compares to
+// Threshold per Op, and resolves it once a reading of the device no longer
+// does. To keep Alerts from flapping while readings hover around Threshold, a
+// rule may resolve its Alerts at a distinct ClearThreshold, and require that
+// readings keep satisfying it, or clearing it, for a minimum duration.
+type AlertRule struct {
+	// ID is assigned by the Server.
+	ID uint64
+
+	// Tenant is the tenant whose devices the rule applies to. Rules of no
+	// tenant apply to every device. It is assigned by the Server from the
+	// scope of the request creating the rule.
+	Tenant string `json:",omitempty"`
+
+	Name string
+
+	// Field is the reading field compared, one of "Temperature", "Altitude",
+	// "Latitude", "Longitude", or "BatteryLevel", or "BatteryDrain", the
+	// battery level lost per hour.
+	Field string
+
+	// Op is the comparison operator, one of ">", ">=", "<", or "<=".
+	Op string
+
+	Threshold float64
+
+	// ClearThreshold, if set, is the value the rule's Alerts resolve at: once
+	// Field no longer compares to ClearThreshold per Op. It must be on the
+	// other side of Threshold than Op fires at, or equal to it.
+	ClearThreshold *float64 `json:",omitempty"`
+
+	// FireAfter is the least time readings must satisfy the rule before an
+	// Alert fires, and ResolveAfter the least time readings must clear it
+	// before the Alert resolves. Zero fires, or resolves, on the first such
+	// reading.
+	FireAfter    time.Duration `json:",omitempty"`
+	ResolveAfter time.Duration `json:",omitempty"`
+
+	// Throttle is the least time between notifications of the rule's Alerts
+	// for an IMEI. Changes within it are notified once it has elapsed, if the
+	// IMEI sends a reading, unless they were undone meanwhile. Zero notifies
+	// each change.
+	Throttle time.Duration `json:",omitempty"`
+}
+
+// validate returns ErrInvalidAlertRule if the rule names an unknown Field or
+// Op, has a ClearThreshold Op fires at, or has a negative duration.
+func (rule AlertRule) validate() error {
+	if _, ok := alertFields[rule.Field]; !ok && rule.Field != alertFieldBatteryDrain {
+		return fmt.Errorf("%w, field = %q", ErrInvalidAlertRule, rule.Field)
+	}
+	if _, ok := alertOps[rule.Op]; !ok {
+		return fmt.Errorf("%w, op = %q", ErrInvalidAlertRule, rule.Op)
+	}
+	if rule.ClearThreshold != nil && rule.clears(rule.Threshold) {
+		return fmt.Errorf("%w, clear threshold = %v", ErrInvalidAlertRule, *rule.ClearThreshold)
+	}
+	for _, d := range []time.Duration{rule.Throttle, rule.FireAfter, rule.ResolveAfter} {
+		if d < 0 {
+			return fmt.Errorf("%w, duration = %s", ErrInvalidAlertRule, d)
+		}
+	}
+	return nil
+}
+
+// matches reports whether value, of the rule's Field, satisfies the rule.
+func (rule AlertRule) matches(value float64) bool {
+	return alertOps[rule.Op](value, rule.Threshold)
+}
+
+// clears reports whether value, of the rule's Field, resolves the rule's
+// Alerts.
+func (rule AlertRule) clears(value float64) bool {
+	if rule.ClearThreshold == nil {
+		return !rule.matches(value)
+	}
+	return !alertOps[rule.Op](value, *rule.ClearThreshold)
+}
+
+// applies reports whether the rule applies to the devices of tenant.
+func (rule AlertRule) applies(tenant string) bool {
+	return rule.Tenant == "" || rule.Tenant == tenant
+}
+
+// Alert is the firing of an AlertRule for an IMEI.
+type Alert struct {
+	RuleID uint64
+	Rule   string
+	IMEI   uint64
+	Tenant string `json:",omitempty"`
+
+	// Place is the name of the place at the IMEI's last known position when
+	// the Alert fired, if the Server has a geocoder.
+	Place string `json:",omitempty"`
+
+	// Value is the reading field value that fired the Alert.
+	Value   float64
+	FiredAt time.Time
+
+	// ResolvedAt is when a reading of the IMEI no longer satisfied the rule,
+	// or nil while the Alert is firing.
+	ResolvedAt *time.Time `json:",omitempty"`
+}
+
+// alertKey identifies the Alert of rule for imei.
+type alertKey struct {
+	rule uint64
+	imei uint64
+}
+
+// alertState is the state of the Alert of a rule for an IMEI.
+type alertState struct {
+	// alert is the Alert fired most recently, resolved if it is no longer
+	// firing. It is zero until an Alert fires.
+	alert Alert
+
+	// since is when readings began satisfying the rule, while the Alert is
+	// not firing, or clearing it, while it is, or zero if the last reading
+	// did not.
+	since time.Time
+
+	// notified is the Alert last notified, if any, and notifiedAt when.
+	notified   *Alert
+	notifiedAt time.Time
+}
+
+// firing reports whether the Alert is firing.
+func (st *alertState) firing() bool {
+	return !st.alert.FiredAt.IsZero() && st.alert.ResolvedAt == nil
+}
+
+// pending reports whether the state of the Alert differs from the state last
+// notified.
+func (st *alertState) pending() bool {
+	return st.notified == nil || (st.notified.ResolvedAt == nil) != (st.alert.ResolvedAt == nil)
+}
+
+// alerts is a concurrent safe set of AlertRules, and the Alerts they fire.
+type alerts struct {
+	mu     sync.RWMutex
+	rules  map[uint64]AlertRule
+	nextID uint64
+
+	// path is the file rules are saved to on each change. Empty keeps rules in
+	// memory only.
+	path string
+
+	statesMu sync.Mutex
+	states   map[alertKey]*alertState
+
+	// tenantOf retrieves the tenant owning the device with imei.
+	tenantOf func(imei uint64) string
+
+	// placeOf retrieves the place of the last known position of imei.
+	placeOf func(imei uint64) string
+
+	// thresholdOf retrieves the override of imei for the thresholds of the
+	// rule with id, and reports whether there is one.
+	thresholdOf func(imei, id uint64) (ThresholdOverride, bool)
+
+	// drainOf retrieves the battery level imei loses per hour, and reports
+	// whether it is known.
+	drainOf func(imei uint64) (float64, bool)
+
+	// silenced reports whether the notifications of imei, owned by tenant,
+	// are suppressed at t.
+	silenced func(imei uint64, tenant string, t time.Time) bool
+
+	// record is called with each Alert fired or resolved, while alerts are
+	// serialized.
+	record func(Alert)
+
+	// notify is called with each Alert fired or resolved, subject to the
+	// Throttle of its rule, while alerts are serialized.
+	notify func(Alert)
+}
+
+func newAlerts(tenantOf func(uint64) string, silenced func(uint64, string, time.Time) bool) *alerts {
+	return &alerts{
+		rules:       make(map[uint64]AlertRule),
+		nextID:      1,
+		states:      make(map[alertKey]*alertState),
+		tenantOf:    tenantOf,
+		placeOf:     func(uint64) string { return "" },
+		drainOf:     func(uint64) (float64, bool) { return 0, false },
+		thresholdOf: func(uint64, uint64) (ThresholdOverride, bool) { return ThresholdOverride{}, false },
+		silenced:    silenced,
+		record:      func(Alert) {},
+		notify:      func(Alert) {},
+	}
+}
+
+// list retrieves the rules of tenant, ordered by ID.
+func (a *alerts) list(tenant string) []AlertRule {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	list := make([]AlertRule, 0, len(a.rules))
+	for _, rule := range a.rules {
+		if rule.Tenant == tenant {
+			list = append(list, rule)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// get retrieves the rule of tenant with id, and reports whether it exists.
+func (a *alerts) get(tenant string, id uint64) (AlertRule, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	rule, ok := a.rules[id]
+	if !ok || rule.Tenant != tenant {
+		return AlertRule{}, false
+	}
+	return rule, true
+}
+
+// rule retrieves the rule with id, of any tenant, and reports whether it
+// exists.
+func (a *alerts) rule(id uint64) (AlertRule, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	rule, ok := a.rules[id]
+	return rule, ok
+}
+
+// create assigns rule an ID, and adds it to the rules of tenant.
+func (a *alerts) create(tenant string, rule AlertRule) (AlertRule, error) {
+	if err := rule.validate(); err != nil {
+		return AlertRule{}, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rule.ID, rule.Tenant = a.nextID, tenant
+	a.rules[rule.ID] = rule
+	if err := a.save(); err != nil {
+		delete(a.rules, rule.ID)
+		return AlertRule{}, err
+	}
+	a.nextID++
+	return rule, nil
+}
+
+// update replaces the rule of tenant with id. Alerts fired by the rule it
+// replaces are forgotten, without being resolved.
+func (a *alerts) update(tenant string, id uint64, rule AlertRule) (AlertRule, error) {
+	if err := rule.validate(); err != nil {
+		return AlertRule{}, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	prev, ok := a.rules[id]
+	if !ok || prev.Tenant != tenant {
+		return AlertRule{}, fmt.Errorf("%w, id = %d", ErrUnknownAlertRule, id)
+	}
+	rule.ID, rule.Tenant = id, tenant
+	a.rules[id] = rule
+	if err := a.save(); err != nil {
+		a.rules[id] = prev
+		return AlertRule{}, err
+	}
+	a.forget(id)
+	return rule, nil
+}
+
+// delete removes the rule of tenant with id. Alerts fired by the rule are
+// forgotten, without being resolved.
+func (a *alerts) delete(tenant string, id uint64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rule, ok := a.rules[id]
+	if !ok || rule.Tenant != tenant {
+		return fmt.Errorf("%w, id = %d", ErrUnknownAlertRule, id)
+	}
+	delete(a.rules, id)
+	if err := a.save(); err != nil {
+		a.rules[id] = rule
+		return err
+	}
+	a.forget(id)
+	return nil
+}
+
+// forget drops the Alerts fired by the rule with id.
+func (a *alerts) forget(id uint64) {
+	a.statesMu.Lock()
+	defer a.statesMu.Unlock()
+	for key := range a.states {
+		if key.rule == id {
+			delete(a.states, key)
+		}
+	}
+}
+
+// erase drops the Alerts fired for imei, and retrieves how many were dropped.
+func (a *alerts) erase(imei uint64) int {
+	a.statesMu.Lock()
+	defer a.statesMu.Unlock()
+	var n int
+	for key := range a.states {
+		if key.imei == imei {
+			delete(a.states, key)
+			n++
+		}
+	}
+	return n
+}
+
+// StoreReading satisfies the client.ReadingStore interface, firing and
+// resolving the Alerts of imei per reading.
+func (a *alerts) StoreReading(imei uint64, receivedAt time.Time, reading client.Reading) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if len(a.rules) == 0 {
+		return
+	}
+	tenant := a.tenantOf(imei)
+
+	a.statesMu.Lock()
+	defer a.statesMu.Unlock()
+	for _, rule := range a.rules {
+		if !rule.applies(tenant) {
+			continue
+		}
+		if override, ok := a.thresholdOf(imei, rule.ID); ok {
+			rule = override.apply(rule)
+		}
+		value, known := a.value(rule.Field, imei, reading)
+		if !known {
+			continue
+		}
+		key := alertKey{rule: rule.ID, imei: imei}
+		st, ok := a.states[key]
+		if !ok {
+			st = new(alertState)
+		}
+		// The Alert changes state once readings have satisfied the rule, while
+		// it is not firing, or cleared it, while it is, for long enough.
+		firing := st.firing()
+		wait := rule.FireAfter
+		if firing {
+			wait = rule.ResolveAfter
+		}
+		changing := !firing && rule.matches(value) || firing && rule.clears(value)
+		switch {
+		case !changing:
+			st.since = time.Time{}
+		case st.since.IsZero():
+			st.since = receivedAt
+			a.states[key] = st
+		}
+		if changing && receivedAt.Sub(st.since) >= wait {
+			st.since = time.Time{}
+			if firing {
+				st.alert.ResolvedAt = &receivedAt
+			} else {
+				st.alert = Alert{
+					RuleID:  rule.ID,
+					Rule:    rule.Name,
+					IMEI:    imei,
+					Tenant:  tenant,
+					Place:   a.placeOf(imei),
+					Value:   value,
+					FiredAt: receivedAt,
+				}
+			}
+			a.record(st.alert)
+		}
+		if st.alert.FiredAt.IsZero() {
+			// No Alert has fired; only the time readings began satisfying
+			// the rule is kept.
+			if st.since.IsZero() {
+				delete(a.states, key)
+			}
+			continue
+		}
+		a.notifyState(key, st, rule, receivedAt)
+	}
+}
+
+// value retrieves the value of field for reading of imei, and reports
+// whether it is known.
+func (a *alerts) value(field string, imei uint64, reading client.Reading) (float64, bool) {
+	if field == alertFieldBatteryDrain {
+		return a.drainOf(imei)
+	}
+	return alertFields[field](reading), true
+}
+
+// notifyState notifies the Alert of st if its state differs from the state
+// last notified, the rule's Throttle has elapsed since, and its IMEI is not
+// silenced. Resolved Alerts are forgotten once notified, unless their
+// notification may throttle the next.
+func (a *alerts) notifyState(key alertKey, st *alertState, rule AlertRule, now time.Time) {
+	if !st.pending() {
+		return
+	}
+	if st.notified != nil && now.Sub(st.notifiedAt) < rule.Throttle {
+		return
+	}
+	if a.silenced(st.alert.IMEI, st.alert.Tenant, now) {
+		return
+	}
+	alert := st.alert
+	st.notified, st.notifiedAt = &alert, now
+	a.notify(alert)
+	if alert.ResolvedAt != nil && rule.Throttle == 0 {
+		delete(a.states, key)
+	}
+}
+
+// save writes every rule to the Server's alert rules file, replacing it
+// atomically. a.mu must be held.
+func (a *alerts) save() error {
+	if a.path == "" {
+		return nil
+	}
+	list := make([]AlertRule, 0, len(a.rules))
+	for _, rule := range a.rules {
+		list = append(list, rule)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	b, err := json.Marshal(list)
+	if err != nil {
+		return fmt.Errorf("failed to server.alerts.save/Marshal\terr = %w", err)
+	}
+	if err := common.WriteFileAtomic(a.path, b); err != nil {
+		return fmt.Errorf("failed to server.alerts.save\terr = %w", err)
+	}
+	return nil
+}
+
+// load reads the rules saved to the file at path, and saves subsequent
+// changes to it. A missing file holds no rules.
+func (a *alerts) load(path string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.path = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to server.alerts.load/ReadFile\terr = %w", err)
+	}
+	var list []AlertRule
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("failed to server.alerts.load/Unmarshal\tpath = %s err = %w", path, err)
+	}
+	for _, rule := range list {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("failed to server.alerts.load\tpath = %s err = %w", path, err)
+		}
+		a.rules[rule.ID] = rule
+		if rule.ID >= a.nextID {
+			a.nextID = rule.ID + 1
+		}
+	}
+	return nil
+}
+
+// WithAlertRulesFile returns a ServerOption function that configures the
+// Server to load its AlertRules from the file at path, and to save them to it
+// whenever they change, so that they survive restarts. A missing file holds
+// no rules.
+func WithAlertRulesFile(path string) ServerOption {
+	return func(srv *Server) {
+		srv.alertRulesFile = path
+	}
+}
+
+// WithAlertHook returns a ServerOption function that configures the Server
+// to call f with each Alert fired or resolved, such as to notify a webhook.
+// Notifications are throttled per the Throttle of the Alert's rule, and a
+// notification repeating the state last notified is dropped. f is called
+// while alerts are serialized, and must not block.
+func WithAlertHook(f func(Alert)) ServerOption {
+	return func(srv *Server) {
+		srv.alerts.notify = f
+	}
+}
+
+// tenantOf retrieves the tenant owning the device connected with imei.
+func (srv *Server) tenantOf(imei uint64) string {
+	c, ok := srv.clientMap.Load(imei)
+	if !ok {
+		return ""
+	}
+	return c.Tenant()
+}
@@ -0,0 +1,77 @@
+package server
+
+import "time"
+
+const (
+	// minDrainReadings is the fewest readings since a battery was last
+	// charged its drain rate is estimated from.
+	minDrainReadings = 3
+
+	// batteryChargeThreshold is the least increase of a battery level, between
+	// consecutive readings, taken as a charge rather than as noise.
+	batteryChargeThreshold = 1
+)
+
+// BatteryDrain is the rate an IMEI's battery is draining, estimated from its
+// readings since the battery was last charged.
+type BatteryDrain struct {
+	// PerHour is the battery level lost per hour. It is zero or negative if
+	// the battery is not draining.
+	PerHour float64
+
+	// Since is when the first reading the estimate is based on was received,
+	// and Readings the number of readings it is based on.
+	Since    time.Time
+	Readings int
+
+	// TimeToEmpty is the time projected until the battery is empty from the
+	// last reading, received at EmptyAt less TimeToEmpty. Both are omitted if
+	// the battery is not draining.
+	TimeToEmpty time.Duration `json:",omitempty"`
+	EmptyAt     *time.Time    `json:",omitempty"`
+}
+
+// batteryDrain estimates the drain rate of the battery whose levels are those
+// of readings, oldest first, by a least squares fit of the levels since the
+// battery was last charged, and reports whether there were enough readings
+// to do so.
+func batteryDrain(readings []StoredReading) (BatteryDrain, bool) {
+	if len(readings) == 0 {
+		return BatteryDrain{}, false
+	}
+	first := len(readings) - 1
+	for first > 0 && readings[first-1].BatteryLevel+batteryChargeThreshold > readings[first].BatteryLevel {
+		first--
+	}
+	readings = readings[first:]
+	if len(readings) < minDrainReadings {
+		return BatteryDrain{}, false
+	}
+
+	slope, _, ok := fitLine(readings, func(r StoredReading) float64 { return r.BatteryLevel })
+	if !ok {
+		return BatteryDrain{}, false
+	}
+	drain := BatteryDrain{
+		PerHour:  -slope,
+		Since:    readings[0].ReceivedAt,
+		Readings: len(readings),
+	}
+	if drain.PerHour > 0 {
+		last := readings[len(readings)-1]
+		drain.TimeToEmpty = time.Duration(last.BatteryLevel / drain.PerHour * float64(time.Hour))
+		emptyAt := last.ReceivedAt.Add(drain.TimeToEmpty)
+		drain.EmptyAt = &emptyAt
+	}
+	return drain, true
+}
+
+// batteryDrain estimates the drain rate of the battery of imei from the
+// reading history, and reports whether it could be estimated. It cannot
+// without a reading history.
+func (srv *Server) batteryDrain(imei uint64) (BatteryDrain, bool) {
+	if srv.history == nil {
+		return BatteryDrain{}, false
+	}
+	return batteryDrain(srv.history.readings(imei, time.Time{}, time.Now()))
+}
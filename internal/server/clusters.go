@@ -0,0 +1,174 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+const (
+	// maxClusterZoom is the deepest map zoom level clusters are computed for.
+	maxClusterZoom = 22
+
+	// clusterCellsPerTile is the number of cells per axis each map tile is
+	// divided into, so that positions within a cell are clustered: 64 pixels
+	// of a 256 pixel tile.
+	clusterCellsPerTile = 4
+
+	// maxMercatorLatitude is the latitude, in degrees, beyond which Web
+	// Mercator maps are cut off.
+	maxMercatorLatitude = 85.05112878
+)
+
+// errInvalidBBox indicates a bounding box is malformed.
+var errInvalidBBox = errors.New("invalid bounding box")
+
+// BBox bounds a region of a map, in degrees. A BBox whose MinLon exceeds its
+// MaxLon crosses the antimeridian.
+type BBox struct {
+	MinLon, MinLat, MaxLon, MaxLat float64
+}
+
+// world is the BBox of the whole map.
+var world = BBox{MinLon: -180, MinLat: -90, MaxLon: 180, MaxLat: 90}
+
+// parseBBox parses a BBox formatted as "minLon,minLat,maxLon,maxLat".
+func parseBBox(s string) (BBox, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 4 {
+		return BBox{}, fmt.Errorf("%w, bbox = %q", errInvalidBBox, s)
+	}
+	var v [4]float64
+	for i, field := range fields {
+		f, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return BBox{}, fmt.Errorf("%w, bbox = %q", errInvalidBBox, s)
+		}
+		v[i] = f
+	}
+	b := BBox{MinLon: v[0], MinLat: v[1], MaxLon: v[2], MaxLat: v[3]}
+	if b.MinLat > b.MaxLat ||
+		b.MinLat < -90 || b.MaxLat > 90 ||
+		b.MinLon < -180 || b.MinLon > 180 || b.MaxLon < -180 || b.MaxLon > 180 {
+		return BBox{}, fmt.Errorf("%w, bbox = %q", errInvalidBBox, s)
+	}
+	return b, nil
+}
+
+// contains reports whether the BBox contains the position at lat and lon.
+func (b BBox) contains(lat, lon float64) bool {
+	if lat < b.MinLat || lat > b.MaxLat {
+		return false
+	}
+	if b.MinLon <= b.MaxLon {
+		return lon >= b.MinLon && lon <= b.MaxLon
+	}
+	return lon >= b.MinLon || lon <= b.MaxLon
+}
+
+// Cluster is a group of devices whose positions are near each other at a map
+// zoom level.
+type Cluster struct {
+	// Latitude and Longitude are the mean position of the devices.
+	Latitude  float64
+	Longitude float64
+	Count     int
+
+	// IMEI is the device of clusters of a single device.
+	IMEI uint64 `json:",omitempty"`
+}
+
+// clusterCell identifies a cell of the Web Mercator grid of a zoom level.
+type clusterCell struct {
+	x, y int
+}
+
+// clusterer groups positions into the cells of the Web Mercator grid of a
+// zoom level.
+type clusterer struct {
+	cells    float64
+	clusters map[clusterCell]*Cluster
+}
+
+func newClusterer(zoom int) *clusterer {
+	return &clusterer{
+		cells:    math.Exp2(float64(zoom)) * clusterCellsPerTile,
+		clusters: make(map[clusterCell]*Cluster),
+	}
+}
+
+// cellOf retrieves the cell of the position at lat and lon.
+func (c *clusterer) cellOf(lat, lon float64) clusterCell {
+	lat = math.Max(-maxMercatorLatitude, math.Min(maxMercatorLatitude, lat))
+	sin := math.Sin(lat * math.Pi / 180)
+	x := (lon + 180) / 360
+	y := 0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)
+	clamp := func(f float64) int {
+		return int(math.Max(0, math.Min(c.cells-1, math.Floor(f*c.cells))))
+	}
+	return clusterCell{x: clamp(x), y: clamp(y)}
+}
+
+// add adds the position of imei, at lat and lon, to the cluster of its cell.
+func (c *clusterer) add(imei uint64, lat, lon float64) {
+	cell := c.cellOf(lat, lon)
+	cluster, ok := c.clusters[cell]
+	if !ok {
+		cluster = new(Cluster)
+		c.clusters[cell] = cluster
+	}
+	n := float64(cluster.Count)
+	cluster.Latitude = (cluster.Latitude*n + lat) / (n + 1)
+	cluster.Longitude = (cluster.Longitude*n + lon) / (n + 1)
+	cluster.Count++
+	cluster.IMEI = 0
+	if cluster.Count == 1 {
+		cluster.IMEI = imei
+	}
+}
+
+// list retrieves the clusters, largest first, and otherwise from north to
+// south and west to east.
+func (c *clusterer) list() []Cluster {
+	cells := make([]clusterCell, 0, len(c.clusters))
+	for cell := range c.clusters {
+		cells = append(cells, cell)
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		a, b := c.clusters[cells[i]], c.clusters[cells[j]]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if cells[i].y != cells[j].y {
+			return cells[i].y < cells[j].y
+		}
+		return cells[i].x < cells[j].x
+	})
+	list := make([]Cluster, 0, len(cells))
+	for _, cell := range cells {
+		list = append(list, *c.clusters[cell])
+	}
+	return list
+}
+
+// clusters retrieves the clusters, at zoom, of the last known positions of the
+// connected IMEIs within bbox that allows reports may be accessed.
+func (srv *Server) clusters(zoom int, bbox BBox, allows func(tenant string) bool) []Cluster {
+	c := newClusterer(zoom)
+	srv.ForEachClient(func(cl *client.Client) bool {
+		if cl.LastReadingAt().IsZero() || !allows(cl.Tenant()) {
+			return true
+		}
+		reading := cl.LastReading()
+		if bbox.contains(reading.Latitude, reading.Longitude) {
+			c.add(cl.IMEI(), reading.Latitude, reading.Longitude)
+		}
+		return true
+	})
+	return c.list()
+}
@@ -0,0 +1,464 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/imei"
+)
+
+// CoAP message types, per RFC 7252.
+const (
+	coapConfirmable    = 0
+	coapNonConfirmable = 1
+	coapAcknowledgment = 2
+	coapReset          = 3
+)
+
+// CoAP codes, in their class.detail encoding.
+const (
+	coapEmpty             = 0x00
+	coapPost              = 0x02
+	coapDelete            = 0x04
+	coapCreated           = 0x41 // 2.01
+	coapDeleted           = 0x42 // 2.02
+	coapChanged           = 0x44 // 2.04
+	coapBadRequest        = 0x80 // 4.00
+	coapBadOption         = 0x82 // 4.02
+	coapForbidden         = 0x83 // 4.03
+	coapNotFound          = 0x84 // 4.04
+	coapMethodNotAllowed  = 0x85 // 4.05
+	coapConflict          = 0x89 // 4.09
+	coapUnsupportedFormat = 0x8f // 4.15
+	coapTooManyRequests   = 0x9d // 4.29
+	coapUnavailable       = 0xa3 // 5.03
+)
+
+// CoAP option numbers understood by the Server. Requests bearing any other
+// critical option are rejected.
+const (
+	coapOptionURIHost       = 3
+	coapOptionURIPort       = 7
+	coapOptionLocationPath  = 8
+	coapOptionURIPath       = 11
+	coapOptionContentFormat = 12
+	coapOptionURIQuery      = 15
+)
+
+const (
+	// coapVersion is the only CoAP version.
+	coapVersion = 1
+
+	// coapPayloadMarker separates a CoAP message's options from its payload.
+	coapPayloadMarker = 0xff
+
+	// maxCoAPMessage is the largest CoAP message read.
+	maxCoAPMessage = 1280
+
+	// coapExchangeLifetime is how long the response to a confirmable request
+	// is kept, so that retransmissions of the request are answered without
+	// being processed again.
+	coapExchangeLifetime = 247 * time.Second
+
+	// imeiLength is the length of an IMEI in decimal.
+	imeiLength = 15
+
+	// coapReadingsPath is the first segment of the Uri-Path readings are
+	// posted to, followed by the device's IMEI, e.g. "/readings/490154203237518".
+	coapReadingsPath = "readings"
+)
+
+// errCoAPFormat indicates a datagram is not a well-formed CoAP message.
+var errCoAPFormat = errors.New("malformed coap message")
+
+// coapMessage is a CoAP message, holding the options the Server understands.
+type coapMessage struct {
+	typ       byte
+	code      byte
+	messageID uint16
+	token     []byte
+	location  []string
+	path      []string
+	query     []string
+	payload   []byte
+
+	// contentFormat is the format of the payload, and is only meaningful if
+	// hasContentFormat is set.
+	contentFormat    int
+	hasContentFormat bool
+
+	// badOption is set if the message bears an unrecognized critical option.
+	badOption bool
+}
+
+// parseCoAP parses the CoAP message in b. The message returned references b.
+// If b's header is complete but the rest of the message is malformed, the
+// header is returned along with the error, so that the message may be reset.
+func parseCoAP(b []byte) (coapMessage, error) {
+	var m coapMessage
+	if len(b) < 4 || b[0]>>6 != coapVersion {
+		return m, errCoAPFormat
+	}
+	m.typ = b[0] >> 4 & 0x03
+	m.code = b[1]
+	m.messageID = binary.BigEndian.Uint16(b[2:4])
+	tkl := int(b[0] & 0x0f)
+	if tkl > 8 || len(b) < 4+tkl {
+		return m, errCoAPFormat
+	}
+	m.token = b[4 : 4+tkl]
+
+	b = b[4+tkl:]
+	var number int
+	for len(b) > 0 {
+		if b[0] == coapPayloadMarker {
+			if len(b) == 1 {
+				return m, errCoAPFormat
+			}
+			m.payload = b[1:]
+			break
+		}
+		delta, length := int(b[0]>>4), int(b[0]&0x0f)
+		b = b[1:]
+		var err error
+		if delta, b, err = coapOptionNibble(delta, b); err != nil {
+			return m, err
+		}
+		if length, b, err = coapOptionNibble(length, b); err != nil {
+			return m, err
+		}
+		if len(b) < length {
+			return m, errCoAPFormat
+		}
+		number += delta
+		value := b[:length]
+		b = b[length:]
+
+		switch number {
+		case coapOptionLocationPath:
+			m.location = append(m.location, string(value))
+		case coapOptionURIPath:
+			m.path = append(m.path, string(value))
+		case coapOptionURIQuery:
+			m.query = append(m.query, string(value))
+		case coapOptionContentFormat:
+			m.hasContentFormat = true
+			for _, v := range value {
+				m.contentFormat = m.contentFormat<<8 | int(v)
+			}
+		case coapOptionURIHost, coapOptionURIPort:
+		default:
+			// Odd option numbers are critical.
+			if number%2 == 1 {
+				m.badOption = true
+			}
+		}
+	}
+	return m, nil
+}
+
+// coapOptionNibble extends an option delta or length nibble n with the bytes
+// following it in b, returning its value and the rest of b.
+func coapOptionNibble(n int, b []byte) (int, []byte, error) {
+	switch n {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, errCoAPFormat
+		}
+		return int(b[0]) + 13, b[1:], nil
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, errCoAPFormat
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], nil
+	case 15:
+		return 0, nil, errCoAPFormat
+	default:
+		return n, b, nil
+	}
+}
+
+// append appends the encoding of m to b.
+func (m coapMessage) append(b []byte) []byte {
+	b = append(b, coapVersion<<6|m.typ<<4|byte(len(m.token)), m.code)
+	b = binary.BigEndian.AppendUint16(b, m.messageID)
+	b = append(b, m.token...)
+
+	var number int
+	option := func(n int, value []byte) {
+		b = appendCoAPOption(b, n-number, value)
+		number = n
+	}
+	for _, segment := range m.location {
+		option(coapOptionLocationPath, []byte(segment))
+	}
+	for _, segment := range m.path {
+		option(coapOptionURIPath, []byte(segment))
+	}
+	if m.hasContentFormat {
+		var value []byte
+		for v := m.contentFormat; v > 0; v >>= 8 {
+			value = append([]byte{byte(v)}, value...)
+		}
+		option(coapOptionContentFormat, value)
+	}
+	for _, param := range m.query {
+		option(coapOptionURIQuery, []byte(param))
+	}
+
+	if len(m.payload) > 0 {
+		b = append(b, coapPayloadMarker)
+		b = append(b, m.payload...)
+	}
+	return b
+}
+
+// appendCoAPOption appends the option delta numbers after the previous
+// option, with value, to b.
+func appendCoAPOption(b []byte, delta int, value []byte) []byte {
+	header := len(b)
+	b = append(b, 0)
+	var nibbles [2]byte
+	for i, n := range [2]int{delta, len(value)} {
+		switch {
+		case n < 13:
+			nibbles[i] = byte(n)
+		case n < 269:
+			nibbles[i] = 13
+			b = append(b, byte(n-13))
+		default:
+			nibbles[i] = 14
+			b = binary.BigEndian.AppendUint16(b, uint16(n-269))
+		}
+	}
+	b[header] = nibbles[0]<<4 | nibbles[1]
+	return append(b, value...)
+}
+
+// coapExchanges keeps the responses to recent confirmable requests, keyed by
+// the requesting endpoint and message ID.
+type coapExchanges struct {
+	mu sync.Mutex
+	m  map[coapExchangeKey]coapExchange
+}
+
+type coapExchangeKey struct {
+	addr      string
+	messageID uint16
+}
+
+type coapExchange struct {
+	response []byte
+	expires  time.Time
+}
+
+func newCoAPExchanges() *coapExchanges {
+	return &coapExchanges{m: make(map[coapExchangeKey]coapExchange)}
+}
+
+// get retrieves the response to the request key, if it is recent.
+func (e *coapExchanges) get(key coapExchangeKey) ([]byte, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	exchange, ok := e.m[key]
+	if !ok || time.Now().After(exchange.expires) {
+		return nil, false
+	}
+	return exchange.response, true
+}
+
+// add keeps response as the response to the request key.
+func (e *coapExchanges) add(key coapExchangeKey, response []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.m[key] = coapExchange{response: response, expires: time.Now().Add(coapExchangeLifetime)}
+}
+
+// prune discards the responses kept longer than coapExchangeLifetime.
+func (e *coapExchanges) prune(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, exchange := range e.m {
+		if now.After(exchange.expires) {
+			delete(e.m, key)
+		}
+	}
+}
+
+// serveCoAP receives CoAP requests on the Server's CoAP socket until it is
+// closed. Devices post readings, in the binary encoding of protocol v1, to
+// /readings/<imei>. Confirmable requests are acknowledged with the outcome
+// of the reading; non-confirmable requests are not answered.
+func (srv *Server) serveCoAP(ctx context.Context) {
+	b := make([]byte, maxCoAPMessage)
+	for {
+		n, addr, err := srv.coapConn.ReadFromUDP(b)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			srv.metrics.Errors.Inc()
+			srv.logError.Printf("failed to server.serveCoAP/ReadFromUDP\terr = %s\n", err)
+			continue
+		}
+		response := srv.handleCoAP(ctx, addr, b[:n])
+		if response == nil {
+			continue
+		}
+		if _, err := srv.coapConn.WriteToUDP(response, addr); err != nil && !errors.Is(err, net.ErrClosed) {
+			srv.logWarn.Printf("failed to server.serveCoAP/WriteToUDP\taddr = %s err = %s\n", addr, err)
+		}
+	}
+}
+
+// handleCoAP handles b, a datagram received from addr, and retrieves the
+// response to send, or nil if none is due. A panic handling b is recovered,
+// and b is left unanswered.
+func (srv *Server) handleCoAP(ctx context.Context, addr *net.UDPAddr, b []byte) (response []byte) {
+	defer func() {
+		if v := recover(); v != nil {
+			srv.metrics.Panics.Inc()
+			srv.metrics.Errors.Inc()
+			srv.logError.Printf("recovered from panic handling coap request from %s\tpanic = %v\n%s", addr, v, debug.Stack())
+			response = nil
+		}
+	}()
+
+	m, err := parseCoAP(b)
+	if err != nil {
+		srv.logDebug.Printf("failed to server.handleCoAP/parseCoAP\taddr = %s err = %s\n", addr, err)
+		if len(b) >= 4 && m.typ == coapConfirmable {
+			return coapMessage{typ: coapReset, messageID: m.messageID}.append(nil)
+		}
+		return nil
+	}
+	switch {
+	case m.typ == coapAcknowledgment || m.typ == coapReset:
+		return nil
+	case m.code == coapEmpty:
+		// Empty confirmable messages are pings, answered with a reset.
+		if m.typ == coapConfirmable {
+			return coapMessage{typ: coapReset, messageID: m.messageID}.append(nil)
+		}
+		return nil
+	}
+
+	key := coapExchangeKey{addr: addr.String(), messageID: m.messageID}
+	if m.typ == coapConfirmable {
+		if response, ok := srv.coapExchanges.get(key); ok {
+			return response
+		}
+	}
+	reply := srv.routeCoAP(ctx, addr, m)
+	if m.typ != coapConfirmable {
+		return nil
+	}
+	reply.typ = coapAcknowledgment
+	reply.messageID = m.messageID
+	reply.token = m.token
+	response = reply.append(nil)
+	srv.coapExchanges.add(key, response)
+	return response
+}
+
+// routeCoAP handles the request m from addr by its path, and retrieves the
+// response's code, options, and payload.
+func (srv *Server) routeCoAP(ctx context.Context, addr *net.UDPAddr, m coapMessage) coapMessage {
+	if m.badOption {
+		return coapReply(coapBadOption, "")
+	}
+	if len(m.path) == 0 {
+		return coapReply(coapNotFound, "")
+	}
+	switch m.path[0] {
+	case coapReadingsPath:
+		return coapReply(srv.coapReading(ctx, addr, m))
+	case lwm2mRegistrationPath:
+		return srv.lwm2mRegistration(addr, m)
+	case lwm2mSendPath:
+		return coapReply(srv.lwm2mSend(ctx, addr, m))
+	default:
+		return coapReply(coapNotFound, "")
+	}
+}
+
+// coapReply builds a response of code, with diagnostic as its payload.
+func coapReply(code byte, diagnostic string) coapMessage {
+	return coapMessage{code: code, payload: []byte(diagnostic)}
+}
+
+// coapReading processes the reading posted in m by the device at addr, and
+// retrieves the response code, along with a diagnostic message for failures.
+func (srv *Server) coapReading(ctx context.Context, addr *net.UDPAddr, m coapMessage) (byte, string) {
+	if len(m.path) != 2 {
+		return coapNotFound, ""
+	}
+	if m.code != coapPost {
+		return coapMethodNotAllowed, ""
+	}
+	if len(m.path[1]) != imeiLength {
+		return coapBadRequest, "invalid imei"
+	}
+	id, err := imei.Decode([]byte(m.path[1]))
+	if err != nil {
+		return coapBadRequest, "invalid imei"
+	}
+
+	ds, err := srv.datagramSession(id, addr, ListenerCoAP)
+	if err != nil {
+		return coapAdmitFailure(err)
+	}
+	return srv.coapProcess(ctx, ds, m.payload)
+}
+
+// coapAdmitFailure retrieves the response code, and diagnostic message, of a
+// request whose device failed to be admitted with err.
+func coapAdmitFailure(err error) (byte, string) {
+	switch {
+	case errors.Is(err, ErrBanned):
+		return coapForbidden, "quarantined"
+	case errors.Is(err, ErrQuotaExceeded):
+		return coapTooManyRequests, "quota exceeded"
+	case errors.Is(err, ErrDuplicateIMEI):
+		return coapConflict, "connected"
+	default:
+		return coapUnavailable, ""
+	}
+}
+
+// coapProcess processes b, a reading sent by the device of ds, and retrieves
+// the response code, along with a diagnostic message for failures.
+func (srv *Server) coapProcess(ctx context.Context, ds *datagramSession, b []byte) (byte, string) {
+	err := ds.client.ProcessDatagram(ctx, ds.session, b)
+	var invalidRange client.ErrInvalidRange
+	switch {
+	case err == nil:
+		return coapChanged, ""
+	case errors.Is(err, client.ErrClientQuarantined):
+		srv.quarantineDatagram(ds)
+		return coapForbidden, "quarantined"
+	case errors.Is(err, client.ErrQuotaExceeded):
+		return coapTooManyRequests, "quota exceeded"
+	case errors.Is(err, client.ErrInvalidDatagram), errors.As(err, &invalidRange):
+		return coapBadRequest, "invalid reading"
+	default:
+		return coapUnavailable, ""
+	}
+}
+
+// listenCoAP binds the Server's CoAP socket on port.
+func (srv *Server) listenCoAP(port int) error {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return fmt.Errorf("failed to server.listenCoAP/ListenUDP\tport = %d err = %w", port, err)
+	}
+	srv.coapConn = conn
+	return nil
+}
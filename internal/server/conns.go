@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net"
+	"sort"
+
+	"github.com/tjper/thermomatic/internal/common"
+)
+
+// conns is a concurrent safe set of the Server's open connections, and the
+// IMEIs identified on them. An IMEI of zero denotes a connection that has not
+// been identified.
+type conns struct {
+	m *common.SyncMap[net.Conn, uint64]
+}
+
+func newConns() *conns {
+	return &conns{
+		m: common.NewSyncMap[net.Conn, uint64](),
+	}
+}
+
+// add adds conn to the set.
+func (s *conns) add(conn net.Conn) {
+	s.m.Store(conn, 0)
+}
+
+// identify records that conn belongs to imei.
+func (s *conns) identify(conn net.Conn, imei uint64) {
+	s.m.Update(conn, func(_ uint64, ok bool) (uint64, bool) {
+		return imei, ok
+	})
+}
+
+// remove removes conn from the set.
+func (s *conns) remove(conn net.Conn) {
+	s.m.Delete(conn)
+}
+
+// closeAll closes every connection in the set. The IMEIs of the identified
+// connections closed are returned in order, along with the number of
+// unidentified connections closed.
+func (s *conns) closeAll() (imeis []uint64, unidentified int) {
+	s.m.Range(func(conn net.Conn, imei uint64) bool {
+		conn.Close()
+		if imei == 0 {
+			unidentified++
+			return true
+		}
+		imeis = append(imeis, imei)
+		return true
+	})
+	sort.Slice(imeis, func(i, j int) bool { return imeis[i] < imeis[j] })
+	return imeis, unidentified
+}
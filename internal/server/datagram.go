@@ -0,0 +1,148 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+const (
+	// defaultDatagramIdleTimeout is how long a device sending datagrams may
+	// go without sending a reading before its Client is closed.
+	defaultDatagramIdleTimeout = 10 * time.Minute
+
+	// datagramSweepInterval is how often idle and closed datagram Clients are
+	// released.
+	datagramSweepInterval = time.Second
+)
+
+// datagramSession is the Client of a device that sends datagrams, along with
+// the Session carried between its datagrams.
+type datagramSession struct {
+	client  *client.Client
+	session *client.Session
+}
+
+// datagrams is the set of datagram sessions, keyed by IMEI. Unlike Clients
+// with a connection, datagram Clients are never disconnected by their
+// device, so they are closed once idle for the idle timeout.
+type datagrams struct {
+	mu   sync.Mutex
+	m    map[uint64]*datagramSession
+	idle time.Duration
+}
+
+func newDatagrams() *datagrams {
+	return &datagrams{
+		m:    make(map[uint64]*datagramSession),
+		idle: defaultDatagramIdleTimeout,
+	}
+}
+
+// datagramSession retrieves the session of imei, whose device sent a datagram
+// from addr through the listener l. If imei has no open session, a Client is
+// initialized and admitted for it; the error admitting it is returned on
+// failure.
+func (srv *Server) datagramSession(imei uint64, addr net.Addr, l Listener) (*datagramSession, error) {
+	srv.datagrams.mu.Lock()
+	defer srv.datagrams.mu.Unlock()
+
+	if ds, ok := srv.datagrams.m[imei]; ok {
+		if ds.client.CloseReason() == client.CloseNone {
+			return ds, nil
+		}
+		srv.releaseDatagram(ds)
+	}
+
+	c := client.NewDatagram(imei, addr, srv.clientOptionsOf(l)...)
+	if err := srv.admit(c); err != nil {
+		srv.logWarn.Println(err)
+		c.Close(closeReasonOfAdmit(err))
+		return nil, err
+	}
+	srv.connected(c)
+	ds := &datagramSession{client: c, session: client.NewSession()}
+	srv.datagrams.m[imei] = ds
+	return ds, nil
+}
+
+// quarantineDatagram quarantines the device of ds, which was closed after
+// sending too many readings that failed to decode, and releases ds.
+func (srv *Server) quarantineDatagram(ds *datagramSession) {
+	srv.metrics.Quarantines.Inc()
+	srv.quarantine.add(ds.client.IMEI(), time.Now().Add(srv.quarantineDuration))
+	srv.logWarn.Printf("Client %d quarantined for %s\n", ds.client.IMEI(), srv.quarantineDuration)
+
+	srv.datagrams.mu.Lock()
+	defer srv.datagrams.mu.Unlock()
+	if srv.datagrams.m[ds.client.IMEI()] == ds {
+		srv.releaseDatagram(ds)
+	}
+}
+
+// closeDatagram closes the datagram Client of imei with reason, if it has
+// one, and releases it.
+func (srv *Server) closeDatagram(imei uint64, reason client.CloseReason) {
+	srv.datagrams.mu.Lock()
+	defer srv.datagrams.mu.Unlock()
+	if ds, ok := srv.datagrams.m[imei]; ok {
+		ds.client.Close(reason)
+		srv.releaseDatagram(ds)
+	}
+}
+
+// releaseDatagram removes ds from the Server, recording its Client's
+// disconnection. The caller must hold srv.datagrams.mu.
+func (srv *Server) releaseDatagram(ds *datagramSession) {
+	delete(srv.datagrams.m, ds.client.IMEI())
+	srv.metrics.Clients.Add(-1)
+	srv.clientMap.Delete(ds.client.IMEI())
+	srv.tenants.disconnect(ds.client.Tenant())
+	srv.disconnected(ds.client)
+}
+
+// sweepDatagrams closes datagram Clients idle for the idle timeout, and
+// releases them along with those closed otherwise, such as by being kicked,
+// every datagramSweepInterval until done is closed.
+func (srv *Server) sweepDatagrams(done <-chan struct{}) {
+	ticker := time.NewTicker(datagramSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			srv.sweepDatagramsAt(now)
+		}
+	}
+}
+
+// sweepDatagramsAt sweeps the datagram Clients idle as of now.
+func (srv *Server) sweepDatagramsAt(now time.Time) {
+	srv.coapExchanges.prune(now)
+
+	srv.datagrams.mu.Lock()
+	defer srv.datagrams.mu.Unlock()
+	for _, ds := range srv.datagrams.m {
+		if now.Sub(ds.client.LastSeen()) >= srv.datagrams.idle {
+			srv.logWarn.Printf("[IMEI %d] No Datagrams for %s, Closing Client\n", ds.client.IMEI(), srv.datagrams.idle)
+			ds.client.Close(client.CloseInactive)
+		}
+		if ds.client.CloseReason() != client.CloseNone {
+			srv.releaseDatagram(ds)
+		}
+	}
+}
+
+// closeDatagrams closes and releases every datagram Client, as the Server
+// shuts down.
+func (srv *Server) closeDatagrams() {
+	srv.datagrams.mu.Lock()
+	defer srv.datagrams.mu.Unlock()
+	for _, ds := range srv.datagrams.m {
+		ds.client.Close(client.CloseServerShutdown)
+		srv.releaseDatagram(ds)
+	}
+}
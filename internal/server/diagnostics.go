@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/common"
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+// modulePath prefixes the packages of the module, and is trimmed from the
+// subsystems goroutines are attributed to.
+const modulePath = "github.com/tjper/thermomatic/"
+
+// Diagnostics is a snapshot of the Server's goroutines and resources, used
+// to catch leaks in production: goroutines that never exit, Holders that are
+// never released, and connections or queues that grow without bound.
+type Diagnostics struct {
+	Time time.Time
+
+	// Goroutines is the number of goroutines, and Subsystems the number
+	// started by each package, e.g. "internal/client" or "net/http", named
+	// after the function the goroutine was started with.
+	Goroutines int
+	Subsystems map[string]int
+
+	// Holders is the number of common.Holders not yet garbage collected, if
+	// the Server was configured WithHolderTracking.
+	Holders int64
+
+	// Conns is the number of open TCP connections, and Clients the number of
+	// identified Clients. Unidentified is the number of connections without
+	// a Client, such as those awaiting a login; a count that only grows is a
+	// leak.
+	Conns        int
+	Clients      int
+	Unidentified int
+
+	// Queues is the depth of each queue of the Server, and of each exporter
+	// plugin, named "exporter:<name>", reporting it.
+	Queues map[string]int
+
+	// Exporters is the health of each exporter plugin reporting it, named
+	// "exporter:<name>".
+	Exporters map[string]plugin.Health
+}
+
+// Diagnostics retrieves a snapshot of the Server's goroutines and resources.
+// Queues of subsystems the Server was not configured with are omitted.
+func (srv *Server) Diagnostics() Diagnostics {
+	subsystems := goroutineSubsystems()
+	diagnostics := Diagnostics{
+		Time:       time.Now(),
+		Subsystems: subsystems,
+		Holders:    common.Holders(),
+		Conns:      srv.conns.m.Len(),
+		Clients:    srv.clientMap.Len(),
+		Queues:     make(map[string]int),
+		Exporters:  srv.ExporterHealth(),
+	}
+	for _, n := range subsystems {
+		diagnostics.Goroutines += n
+	}
+	if unidentified := diagnostics.Conns - diagnostics.Clients; unidentified > 0 {
+		diagnostics.Unidentified = unidentified
+	}
+
+	if srv.asyncReadingLogger != nil {
+		diagnostics.Queues["reading_log"] = srv.asyncReadingLogger.Len()
+	}
+	if srv.workerPool != nil {
+		diagnostics.Queues["worker_pool"] = srv.workerPool.Len()
+	}
+	if srv.reactor != nil {
+		diagnostics.Queues["reactor_ready"] = len(srv.reactor.ready)
+	}
+	if srv.geocoding != nil {
+		diagnostics.Queues["geocoding"] = len(srv.geocoding.queue)
+	}
+	if srv.resumptions != nil {
+		diagnostics.Queues["resumptions"] = srv.resumptions.Len()
+	}
+	for i, s := range srv.stores {
+		if q, ok := s.(interface{ Len() int }); ok {
+			diagnostics.Queues[srv.storeNames[i]] = q.Len()
+		}
+	}
+	return diagnostics
+}
+
+// goroutineSubsystems retrieves the number of goroutines started by each
+// package, per the function each goroutine was started with.
+func goroutineSubsystems() map[string]int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	subsystems := make(map[string]int)
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		subsystems[subsystemOf(string(stack))]++
+	}
+	return subsystems
+}
+
+// subsystemOf retrieves the package of the function the goroutine of stack,
+// as formatted by runtime.Stack, was started with: its outermost frame.
+func subsystemOf(stack string) string {
+	var function string
+	for _, line := range strings.Split(stack, "\n") {
+		if line == "" || strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "goroutine ") || strings.HasPrefix(line, "...") {
+			continue
+		}
+		if strings.HasPrefix(line, "created by ") {
+			break
+		}
+		function = line
+	}
+	if i := strings.LastIndex(function, "("); i > 0 {
+		function = function[:i]
+	}
+
+	// The package ends at the first dot following its last slash, e.g.
+	// "net/http" of "net/http.(*conn).serve".
+	pkg := function
+	slash := strings.LastIndex(pkg, "/")
+	if dot := strings.Index(pkg[slash+1:], "."); dot >= 0 {
+		pkg = pkg[:slash+1+dot]
+	}
+	if pkg == "" {
+		return "unknown"
+	}
+	return strings.TrimPrefix(pkg, modulePath)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/common"
+)
+
+const (
+	// earthRadius is the mean radius of the Earth, in meters.
+	earthRadius = 6371008.8
+
+	// odometerDays is the number of days the odometer keeps the distance
+	// traveled by each IMEI for.
+	odometerDays = 90
+)
+
+// greatCircle retrieves the great-circle distance, in meters, between the
+// positions of a and b, per the haversine formula.
+func greatCircle(a, b client.Reading) float64 {
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(math.Min(1, h)))
+}
+
+// distance retrieves the distance, in meters, along the positions of
+// readings, in order.
+func distance(readings []StoredReading) float64 {
+	var meters float64
+	for i := 1; i < len(readings); i++ {
+		meters += greatCircle(readings[i-1].Reading, readings[i].Reading)
+	}
+	return meters
+}
+
+// DailyDistance is the distance an IMEI traveled during a UTC day.
+type DailyDistance struct {
+	// Day is midnight UTC of the day.
+	Day    time.Time
+	Meters float64
+}
+
+// odometer keeps the distance traveled by each IMEI per UTC day, for the
+// most recent odometerDays days. Unlike the reading history, it is not
+// limited by how many readings an IMEI sends. It satisfies the
+// client.ReadingStore interface.
+type odometer struct {
+	m *common.SyncMap[uint64, *trip]
+}
+
+// trip is the distance traveled by an IMEI per day, and its last reading.
+type trip struct {
+	mu   sync.Mutex
+	last *StoredReading
+	days []DailyDistance
+}
+
+func newOdometer() *odometer {
+	return &odometer{m: common.NewSyncMap[uint64, *trip]()}
+}
+
+// erase forgets the distances traveled by imei, and reports whether any were
+// kept.
+func (o *odometer) erase(imei uint64) bool {
+	_, ok := o.m.LoadAndDelete(imei)
+	return ok
+}
+
+// StoreReading adds the distance from the last reading of imei to reading,
+// received at receivedAt, to the day reading was received.
+func (o *odometer) StoreReading(imei uint64, receivedAt time.Time, reading client.Reading) {
+	t, ok := o.m.Load(imei)
+	if !ok {
+		t, _ = o.m.LoadOrStore(imei, new(trip))
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stored := StoredReading{ReceivedAt: receivedAt, Reading: reading}
+	last := t.last
+	t.last = &stored
+	if last == nil {
+		return
+	}
+
+	day := receivedAt.UTC().Truncate(24 * time.Hour)
+	if n := len(t.days); n == 0 || t.days[n-1].Day.Before(day) {
+		t.days = append(t.days, DailyDistance{Day: day})
+	}
+	t.days[len(t.days)-1].Meters += greatCircle(last.Reading, reading)
+	for len(t.days) > 0 && day.Sub(t.days[0].Day) >= odometerDays*24*time.Hour {
+		t.days = t.days[1:]
+	}
+}
+
+// daily retrieves the distance imei traveled each day overlapping [from, to],
+// oldest first. Days without readings are omitted.
+func (o *odometer) daily(imei uint64, from, to time.Time) []DailyDistance {
+	days := make([]DailyDistance, 0)
+	t, ok := o.m.Load(imei)
+	if !ok {
+		return days
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, d := range t.days {
+		if d.Day.Add(24*time.Hour).After(from) && !d.Day.After(to) {
+			days = append(days, d)
+		}
+	}
+	return days
+}
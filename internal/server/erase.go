@@ -0,0 +1,96 @@
+package server
+
+import (
+	"time"
+
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+// ErasureReceipt records the erasure of a device's data, to satisfy a
+// right-to-erasure request.
+type ErasureReceipt struct {
+	IMEI     uint64
+	ErasedAt time.Time
+	Backends []ErasedBackend
+}
+
+// ErasedBackend is the data of a device erased from a backend of the Server.
+type ErasedBackend struct {
+	// Name is the backend, e.g. "history", or "store:<name>" and
+	// "exporter:<name>" for plugins.
+	Name string
+
+	// Records is the number of records of the device erased.
+	Records int
+
+	// Unsupported is set for plugins unable to erase data, such as exporters
+	// whose external systems must be erased separately.
+	Unsupported bool `json:",omitempty"`
+
+	// Error is why the backend failed to erase the device's data, if it did.
+	Error string `json:",omitempty"`
+}
+
+// failed reports whether a backend of the receipt failed to erase the
+// device's data.
+func (receipt ErasureReceipt) failed() bool {
+	for _, backend := range receipt.Backends {
+		if backend.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// eraseDevice erases the data of imei kept by the Server: its reading
+// history, distances, place, Presence record, group memberships, overrides,
+// quarantine, alerts, connection events, and suspended session, and the
+// readings kept by each store plugin implementing plugin.Eraser. The device
+// must not be connected, or it would record data anew.
+func (srv *Server) eraseDevice(imei uint64) ErasureReceipt {
+	receipt := ErasureReceipt{IMEI: imei, ErasedAt: time.Now()}
+	add := func(name string, records int, err error) {
+		backend := ErasedBackend{Name: name, Records: records}
+		if err != nil {
+			backend.Error = err.Error()
+		}
+		receipt.Backends = append(receipt.Backends, backend)
+	}
+	count := func(ok bool) int {
+		if ok {
+			return 1
+		}
+		return 0
+	}
+
+	if srv.history != nil {
+		add("history", srv.history.erase(imei), nil)
+		add("odometer", count(srv.odometer.erase(imei)), nil)
+	}
+	if srv.geocoding != nil {
+		add("geocoding", count(srv.geocoding.erase(imei)), nil)
+	}
+	add("presence", count(srv.presence.erase(imei)), nil)
+	srv.savePresence()
+	add("groups", srv.groups.erase(imei), nil)
+	erased, err := srv.overrides.erase(imei)
+	add("overrides", count(erased), err)
+	add("quarantine", count(srv.quarantine.remove(imei)), nil)
+	n, err := srv.alertHistory.erase(imei)
+	add("alerts", srv.alerts.erase(imei)+n, err)
+	add("events", srv.connects.erase(imei)+srv.disconnects.erase(imei), nil)
+	if srv.resumptions != nil {
+		add("sessions", count(srv.resumptions.Forget(imei)), nil)
+	}
+
+	for i, s := range srv.stores {
+		eraser, ok := s.(plugin.Eraser)
+		if !ok {
+			receipt.Backends = append(receipt.Backends, ErasedBackend{Name: srv.storeNames[i], Unsupported: true})
+			continue
+		}
+		n, err := eraser.EraseDevice(imei)
+		add(srv.storeNames[i], n, err)
+	}
+	return receipt
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+// ErrUnknownFlag indicates a feature flag is not recognized.
+var ErrUnknownFlag = errors.New("unknown feature flag")
+
+// Flag names an experimental subsystem that may be switched off per
+// deployment, or at runtime. Every Flag is enabled by default.
+type Flag string
+
+const (
+	// FlagProtocolV2 permits devices to login with protocol v2. While it is
+	// disabled, protocol v2 logins are refused as unauthorized.
+	FlagProtocolV2 Flag = "protocol_v2"
+
+	// FlagReactor hands connections to the reactor, if the Server runs one.
+	// While it is disabled, new connections are served by a goroutine each.
+	FlagReactor Flag = "reactor"
+
+	// FlagExporters passes readings to the Server's plugin exporters. While it
+	// is disabled, readings are not exported.
+	FlagExporters Flag = "exporters"
+)
+
+// flags is a concurrent safe set of the enabled feature flags.
+type flags struct {
+	m map[Flag]*atomic.Bool
+}
+
+// newFlags initializes a set of feature flags, each enabled.
+func newFlags() *flags {
+	f := &flags{m: make(map[Flag]*atomic.Bool)}
+	for _, flag := range []Flag{FlagProtocolV2, FlagReactor, FlagExporters} {
+		enabled := new(atomic.Bool)
+		enabled.Store(true)
+		f.m[flag] = enabled
+	}
+	return f
+}
+
+// enabled reports whether flag is enabled. Unknown flags are disabled.
+func (f *flags) enabled(flag Flag) bool {
+	enabled, ok := f.m[flag]
+	return ok && enabled.Load()
+}
+
+// set enables or disables flag. If flag is unknown, ErrUnknownFlag is
+// returned.
+func (f *flags) set(flag Flag, enabled bool) error {
+	v, ok := f.m[flag]
+	if !ok {
+		return fmt.Errorf("%w, flag = %s", ErrUnknownFlag, flag)
+	}
+	v.Store(enabled)
+	return nil
+}
+
+// list retrieves whether each flag is enabled.
+func (f *flags) list() map[Flag]bool {
+	list := make(map[Flag]bool, len(f.m))
+	for flag, enabled := range f.m {
+		list[flag] = enabled.Load()
+	}
+	return list
+}
+
+// load sets the flags named by the JSON object in the file at path, e.g.
+// {"reactor": false}. Flags the file does not name are left unchanged.
+func (f *flags) load(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to server.flags.load/ReadFile\terr = %w", err)
+	}
+	var m map[Flag]bool
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("failed to server.flags.load/Unmarshal\tpath = %s err = %w", path, err)
+	}
+	for flag, enabled := range m {
+		if err := f.set(flag, enabled); err != nil {
+			return fmt.Errorf("failed to server.flags.load\tpath = %s err = %w", path, err)
+		}
+	}
+	return nil
+}
+
+// WithFeatureFlags returns a ServerOption function that sets the feature
+// flags named by the JSON object in the file at path, e.g. {"reactor": false}.
+// New fails if the file cannot be read, or names an unknown flag.
+func WithFeatureFlags(path string) ServerOption {
+	return func(srv *Server) {
+		srv.flagsFile = path
+	}
+}
+
+// WithFeatureFlag returns a ServerOption function that enables or disables
+// flag, taking precedence over WithFeatureFlags. New fails if flag is
+// unknown.
+func WithFeatureFlag(flag Flag, enabled bool) ServerOption {
+	return func(srv *Server) {
+		srv.flagOverrides = append(srv.flagOverrides, flagOverride{flag: flag, enabled: enabled})
+	}
+}
+
+// flagOverride is a feature flag set by WithFeatureFlag.
+type flagOverride struct {
+	flag    Flag
+	enabled bool
+}
+
+// loadFlags sets the Server's feature flags from its flags file and
+// overrides.
+func (srv *Server) loadFlags() error {
+	if srv.flagsFile != "" {
+		if err := srv.flags.load(srv.flagsFile); err != nil {
+			return err
+		}
+	}
+	for _, o := range srv.flagOverrides {
+		if err := srv.flags.set(o.flag, o.enabled); err != nil {
+			return fmt.Errorf("failed to server.loadFlags\terr = %w", err)
+		}
+	}
+	return nil
+}
+
+// FeatureEnabled reports whether flag is enabled.
+func (srv *Server) FeatureEnabled(flag Flag) bool {
+	return srv.flags.enabled(flag)
+}
+
+// SetFeature enables or disables flag. Subsystems gated by flag observe the
+// change from their next connection or reading. If flag is unknown,
+// ErrUnknownFlag is returned.
+func (srv *Server) SetFeature(flag Flag, enabled bool) error {
+	if err := srv.flags.set(flag, enabled); err != nil {
+		return err
+	}
+	srv.logInfo.Printf("Feature %s enabled = %t\n", flag, enabled)
+	return nil
+}
+
+// allowsProtocol reports whether devices may login with p.
+func (srv *Server) allowsProtocol(p client.Protocol) bool {
+	return p != client.ProtocolV2 || srv.flags.enabled(FlagProtocolV2)
+}
+
+// flaggedStore passes readings to its Store only while flag is enabled.
+type flaggedStore struct {
+	plugin.Store
+	flags *flags
+	flag  Flag
+}
+
+// StoreReading satisfies the client.ReadingStore interface.
+func (s flaggedStore) StoreReading(imei uint64, receivedAt time.Time, reading client.Reading) {
+	if s.flags.enabled(s.flag) {
+		s.Store.StoreReading(imei, receivedAt, reading)
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/common"
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+const (
+	// geocodeQueueSize is the number of positions queued to be geocoded.
+	// Positions beyond it are dropped, and geocoded once their IMEI sends
+	// another reading.
+	geocodeQueueSize = 256
+
+	// geocodeCacheSize is the number of places cached. Once it is reached,
+	// the place cached first is forgotten.
+	geocodeCacheSize = 4096
+
+	// geocodeTimeout is the longest a position is waited on to be geocoded.
+	geocodeTimeout = 5 * time.Second
+
+	// geocodeResolution is the number of cells per degree positions are
+	// rounded to before they are geocoded, so that nearby positions share a
+	// place: roughly 110 meters at the equator.
+	geocodeResolution = 1000
+)
+
+// geocodeCell is a position rounded to geocodeResolution.
+type geocodeCell struct {
+	lat, lon int32
+}
+
+// cellOf retrieves the geocodeCell of the position of reading.
+func cellOf(reading client.Reading) geocodeCell {
+	return geocodeCell{
+		lat: int32(math.Round(reading.Latitude * geocodeResolution)),
+		lon: int32(math.Round(reading.Longitude * geocodeResolution)),
+	}
+}
+
+// geocodeJob is the position of an IMEI to be geocoded.
+type geocodeJob struct {
+	imei uint64
+	cell geocodeCell
+}
+
+// geocoding resolves the last known position of each IMEI to the name of a
+// place in the background, caching the places of positions already resolved.
+// It satisfies the client.ReadingStore interface.
+type geocoding struct {
+	geocoder plugin.Geocoder
+	logError *common.LevelLogger
+
+	// places is the place of each IMEI, and cells the cell of the position
+	// last queued to be geocoded for it.
+	places *common.SyncMap[uint64, string]
+	cells  *common.SyncMap[uint64, geocodeCell]
+
+	mu    sync.Mutex
+	cache map[geocodeCell]string
+	order []geocodeCell
+
+	queue chan geocodeJob
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newGeocoding(geocoder plugin.Geocoder, logError *common.LevelLogger) *geocoding {
+	return &geocoding{
+		geocoder: geocoder,
+		logError: logError,
+		places:   common.NewSyncMap[uint64, string](),
+		cells:    common.NewSyncMap[uint64, geocodeCell](),
+		cache:    make(map[geocodeCell]string),
+		queue:    make(chan geocodeJob, geocodeQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// StoreReading queues the position of reading to be geocoded, unless it was
+// already queued for imei, or its place is cached.
+func (g *geocoding) StoreReading(imei uint64, _ time.Time, reading client.Reading) {
+	cell := cellOf(reading)
+	if last, ok := g.cells.Load(imei); ok && last == cell {
+		return
+	}
+	if place, ok := g.cached(cell); ok {
+		g.cells.Store(imei, cell)
+		g.places.Store(imei, place)
+		return
+	}
+	select {
+	case g.queue <- geocodeJob{imei: imei, cell: cell}:
+		g.cells.Store(imei, cell)
+	default:
+	}
+}
+
+// cached retrieves the place of cell, and reports whether it is cached.
+func (g *geocoding) cached(cell geocodeCell) (string, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	place, ok := g.cache[cell]
+	return place, ok
+}
+
+// store caches place as the place of cell, forgetting the place cached first
+// if the cache is full.
+func (g *geocoding) store(cell geocodeCell, place string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.cache[cell]; ok {
+		return
+	}
+	if len(g.order) == geocodeCacheSize {
+		delete(g.cache, g.order[0])
+		g.order = g.order[1:]
+	}
+	g.cache[cell] = place
+	g.order = append(g.order, cell)
+}
+
+// place retrieves the place of the last known position of imei, or an empty
+// string if it is not yet known.
+func (g *geocoding) place(imei uint64) string {
+	place, _ := g.places.Load(imei)
+	return place
+}
+
+// erase forgets the place of imei, and reports whether it was known.
+func (g *geocoding) erase(imei uint64) bool {
+	g.cells.Delete(imei)
+	_, ok := g.places.LoadAndDelete(imei)
+	return ok
+}
+
+// Run geocodes the positions queued until Close is called.
+func (g *geocoding) Run() {
+	defer close(g.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-g.stop
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-g.stop:
+			return
+		case job := <-g.queue:
+			g.geocode(ctx, job)
+		}
+	}
+}
+
+// geocode resolves the place of job's position. On failure, job's IMEI is
+// queued again with its next reading.
+func (g *geocoding) geocode(ctx context.Context, job geocodeJob) {
+	place, ok := g.cached(job.cell)
+	if !ok {
+		ctx, cancel := context.WithTimeout(ctx, geocodeTimeout)
+		defer cancel()
+		var err error
+		place, err = g.geocoder.ReverseGeocode(
+			ctx,
+			float64(job.cell.lat)/geocodeResolution,
+			float64(job.cell.lon)/geocodeResolution)
+		if err != nil {
+			g.cells.Delete(job.imei)
+			g.logError.Printf("[IMEI %d] failed to server.geocoding.geocode/ReverseGeocode\terr = %s\n", job.imei, err)
+			return
+		}
+		g.store(job.cell, place)
+	}
+	g.places.Store(job.imei, place)
+}
+
+// Close stops Run, and waits for it to return.
+func (g *geocoding) Close() {
+	close(g.stop)
+	<-g.done
+}
+
+// WithGeocoder returns a ServerOption function that resolves the last known
+// position of each IMEI to the name of a place with the plugin.Geocoder
+// registered under name, initialized with config. Places are included in the
+// Presence of IMEIs, and in their Alerts. New fails if no Geocoder is
+// registered under name.
+func WithGeocoder(name, config string) ServerOption {
+	return func(srv *Server) {
+		srv.geocoderConfig = &pluginConfig{name: name, config: config}
+	}
+}
+
+// place retrieves the place of the last known position of imei, or an empty
+// string if it is not known or the Server has no geocoder.
+func (srv *Server) place(imei uint64) string {
+	if srv.geocoding == nil {
+		return ""
+	}
+	return srv.geocoding.place(imei)
+}
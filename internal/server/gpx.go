@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gpx is a GPX 1.1 document of a single track.
+type gpx struct {
+	XMLName xml.Name `xml:"http://www.topografix.com/GPX/1/1 gpx"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Track   struct {
+		Name    string `xml:"name"`
+		Segment struct {
+			Points []gpxPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+// gpxPoint is a position of a GPX track.
+type gpxPoint struct {
+	Latitude  float64   `xml:"lat,attr"`
+	Longitude float64   `xml:"lon,attr"`
+	Time      time.Time `xml:"time"`
+}
+
+// writeGPX writes the positions of readings of imei to w as a GPX track.
+func writeGPX(w io.Writer, imei uint64, readings []StoredReading) error {
+	doc := gpx{Version: "1.1", Creator: "thermomatic"}
+	doc.Track.Name = strconv.FormatUint(imei, 10)
+	doc.Track.Segment.Points = make([]gpxPoint, 0, len(readings))
+	for _, reading := range readings {
+		doc.Track.Segment.Points = append(doc.Track.Segment.Points, gpxPoint{
+			Latitude:  reading.Latitude,
+			Longitude: reading.Longitude,
+			Time:      reading.ReceivedAt.UTC(),
+		})
+	}
+	return writeXML(w, doc)
+}
+
+// kml is a KML 2.2 document of a single track.
+type kml struct {
+	XMLName  xml.Name `xml:"http://www.opengis.net/kml/2.2 kml"`
+	Document struct {
+		Name      string `xml:"name"`
+		Placemark struct {
+			Name       string `xml:"name"`
+			LineString struct {
+				Coordinates string `xml:"coordinates"`
+			}
+		}
+	}
+}
+
+// writeKML writes the positions of readings of imei to w as a KML path.
+func writeKML(w io.Writer, imei uint64, readings []StoredReading) error {
+	var doc kml
+	doc.Document.Name = strconv.FormatUint(imei, 10)
+	doc.Document.Placemark.Name = doc.Document.Name
+	coordinates := make([]string, 0, len(readings))
+	for _, reading := range readings {
+		coordinates = append(coordinates, fmt.Sprintf(
+			"%s,%s",
+			strconv.FormatFloat(reading.Longitude, 'f', -1, 64),
+			strconv.FormatFloat(reading.Latitude, 'f', -1, 64)))
+	}
+	doc.Document.Placemark.LineString.Coordinates = strings.Join(coordinates, " ")
+	return writeXML(w, doc)
+}
+
+// writeXML writes doc to w as an indented XML document.
+func writeXML(w io.Writer, doc interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return fmt.Errorf("failed to server.writeXML/WriteString\terr = %w", err)
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return fmt.Errorf("failed to server.writeXML/Encode\terr = %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+// groups is a concurrent safe registry of named groups of IMEIs. Each tenant
+// has its own set of group names.
+type groups struct {
+	mu sync.RWMutex
+	m  map[groupKey]map[uint64]struct{}
+}
+
+// groupKey identifies the group named name of tenant.
+type groupKey struct {
+	tenant string
+	name   string
+}
+
+func newGroups() *groups {
+	return &groups{m: make(map[groupKey]map[uint64]struct{})}
+}
+
+// add assigns imei to tenant's group name, creating the group if necessary.
+func (g *groups) add(tenant, name string, imei uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := groupKey{tenant: tenant, name: name}
+	members, ok := g.m[key]
+	if !ok {
+		members = make(map[uint64]struct{})
+		g.m[key] = members
+	}
+	members[imei] = struct{}{}
+}
+
+// remove unassigns imei from tenant's group name, and reports whether it was
+// assigned. Groups left empty are forgotten.
+func (g *groups) remove(tenant, name string, imei uint64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := groupKey{tenant: tenant, name: name}
+	members, ok := g.m[key]
+	if !ok {
+		return false
+	}
+	if _, ok := members[imei]; !ok {
+		return false
+	}
+	delete(members, imei)
+	if len(members) == 0 {
+		delete(g.m, key)
+	}
+	return true
+}
+
+// erase unassigns imei from every group, and retrieves how many it was
+// assigned to. Groups left empty are forgotten.
+func (g *groups) erase(imei uint64) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var n int
+	for key, members := range g.m {
+		if _, ok := members[imei]; !ok {
+			continue
+		}
+		delete(members, imei)
+		if len(members) == 0 {
+			delete(g.m, key)
+		}
+		n++
+	}
+	return n
+}
+
+// members retrieves the IMEIs assigned to tenant's group name, ordered, and
+// reports whether the group exists.
+func (g *groups) members(tenant, name string) ([]uint64, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	members, ok := g.m[groupKey{tenant: tenant, name: name}]
+	if !ok {
+		return nil, false
+	}
+	imeis := make([]uint64, 0, len(members))
+	for imei := range members {
+		imeis = append(imeis, imei)
+	}
+	sort.Slice(imeis, func(i, j int) bool { return imeis[i] < imeis[j] })
+	return imeis, true
+}
+
+// names retrieves the names of tenant's groups, ordered.
+func (g *groups) names(tenant string) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var names []string
+	for key := range g.m {
+		if key.tenant == tenant {
+			names = append(names, key.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// contains reports whether imei is assigned to tenant's group name.
+func (g *groups) contains(tenant, name string, imei uint64) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	_, ok := g.m[groupKey{tenant: tenant, name: name}][imei]
+	return ok
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/common"
+)
+
+// StoredReading is a reading, and when it was received.
+type StoredReading struct {
+	ReceivedAt time.Time
+	client.Reading
+}
+
+// history keeps the most recent readings of each IMEI in memory, so that they
+// may be charted. It satisfies the client.ReadingStore interface.
+type history struct {
+	size int
+	m    *common.SyncMap[uint64, *readingRing]
+}
+
+// readingRing is a concurrent safe ring of an IMEI's most recent readings.
+type readingRing struct {
+	mu       sync.Mutex
+	readings []StoredReading
+	next     int
+}
+
+// newHistory initializes a history keeping up to size readings of each IMEI.
+func newHistory(size int) *history {
+	return &history{
+		size: size,
+		m:    common.NewSyncMap[uint64, *readingRing](),
+	}
+}
+
+// StoreReading records reading, received from imei at receivedAt, forgetting
+// the oldest reading of imei if its ring is full.
+func (h *history) StoreReading(imei uint64, receivedAt time.Time, reading client.Reading) {
+	ring, ok := h.m.Load(imei)
+	if !ok {
+		ring, _ = h.m.LoadOrStore(imei, &readingRing{readings: make([]StoredReading, 0, h.size)})
+	}
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	stored := StoredReading{ReceivedAt: receivedAt, Reading: reading}
+	if len(ring.readings) < cap(ring.readings) {
+		ring.readings = append(ring.readings, stored)
+		return
+	}
+	ring.readings[ring.next] = stored
+	ring.next = (ring.next + 1) % len(ring.readings)
+}
+
+// backfill merges readings of imei, oldest first, into its ring, keeping the
+// most recent size readings, so that readings are ordered by when they were
+// received even if they are recorded out of order.
+func (h *history) backfill(imei uint64, readings []StoredReading) {
+	ring, ok := h.m.Load(imei)
+	if !ok {
+		ring, _ = h.m.LoadOrStore(imei, &readingRing{readings: make([]StoredReading, 0, h.size)})
+	}
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	merged := make([]StoredReading, 0, len(ring.readings)+len(readings))
+	for i := range ring.readings {
+		merged = append(merged, ring.readings[(ring.next+i)%len(ring.readings)])
+	}
+	merged = append(merged, readings...)
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].ReceivedAt.Before(merged[j].ReceivedAt)
+	})
+	if len(merged) > h.size {
+		merged = merged[len(merged)-h.size:]
+	}
+	ring.readings = append(make([]StoredReading, 0, h.size), merged...)
+	ring.next = 0
+}
+
+// readings retrieves the readings of imei received within [from, to], oldest
+// first.
+func (h *history) readings(imei uint64, from, to time.Time) []StoredReading {
+	ring, ok := h.m.Load(imei)
+	if !ok {
+		return nil
+	}
+
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	var readings []StoredReading
+	for i := range ring.readings {
+		stored := ring.readings[(ring.next+i)%len(ring.readings)]
+		if !stored.ReceivedAt.Before(from) && !stored.ReceivedAt.After(to) {
+			readings = append(readings, stored)
+		}
+	}
+	return readings
+}
+
+// erase forgets the readings of imei, and retrieves how many were forgotten.
+func (h *history) erase(imei uint64) int {
+	ring, ok := h.m.LoadAndDelete(imei)
+	if !ok {
+		return 0
+	}
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	return len(ring.readings)
+}
+
+// imeis retrieves the IMEIs with readings in the history, ordered.
+func (h *history) imeis() []uint64 {
+	imeis := make([]uint64, 0, h.m.Len())
+	h.m.Range(func(imei uint64, _ *readingRing) bool {
+		imeis = append(imeis, imei)
+		return true
+	})
+	sort.Slice(imeis, func(i, j int) bool { return imeis[i] < imeis[j] })
+	return imeis
+}
@@ -2,33 +2,213 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"regexp"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/common"
+	"github.com/tjper/thermomatic/internal/metrics"
+	"github.com/tjper/thermomatic/internal/plugin"
+	"github.com/tjper/thermomatic/internal/trace"
 )
 
 const (
-	pathHealth   = "/health"
-	pathReadings = "/readings/"
-	pathStatus   = "/status/"
+	pathHealth        = "/health"
+	pathReadings      = "/readings/"
+	pathStatus        = "/status/"
+	pathDevices       = "/devices/"
+	pathTenants       = "/tenants/"
+	pathGroups        = "/groups/"
+	pathFleet         = "/v1/fleet/aggregate"
+	pathSummary       = "/v1/summary"
+	pathGrafana       = "/v1/grafana/"
+	pathIngest        = "/v1/ingest"
+	pathAlertRules    = "/v1/alert-rules"
+	pathAlerts        = "/v1/alerts"
+	pathDeviceList    = "/v1/devices"
+	pathDeviceHistory = "/v1/devices/"
+	pathLive          = "/v1/readings/stream"
+	pathImport        = "/v1/import"
+	pathClusters      = "/v1/devices/clusters"
+	pathAdminLogLevel = "/admin/loglevel"
+	pathQuarantine    = "/admin/quarantine"
+	pathFirmware      = "/admin/firmware"
+	pathDrain         = "/admin/drain"
+	pathRuntime       = "/admin/runtime"
+	pathDiagnostics   = "/admin/diagnostics"
+	pathFlags         = "/admin/flags"
+	pathTunables      = "/admin/tunables"
+	pathSilences      = "/admin/silences"
+	pathMetrics       = "/metrics"
+	pathPprof         = "/debug/pprof/"
+	pathExpvar        = "/debug/vars"
 )
 
-func (srv *Server) router() *http.ServeMux {
+// maxFirmwareSize is the size of the largest firmware image accepted.
+const maxFirmwareSize = 16 << 20
+
+func (srv *Server) router() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc(pathHealth, srv.handleHealth())
 	mux.HandleFunc(pathReadings, srv.handleReadings())
 	mux.HandleFunc(pathStatus, srv.handleStatus())
-	return mux
+	mux.HandleFunc(pathDevices, srv.handleDevices())
+	mux.HandleFunc(pathTenants, srv.handleTenants())
+	mux.HandleFunc(pathGroups, srv.handleGroups())
+	mux.HandleFunc(pathFleet, srv.handleFleet())
+	mux.HandleFunc(pathSummary, srv.handleSummary())
+	mux.HandleFunc(pathGrafana, srv.handleGrafana())
+	mux.HandleFunc(pathIngest, srv.handleIngest())
+	mux.HandleFunc(pathAlertRules, srv.handleAlertRules())
+	mux.HandleFunc(pathAlertRules+"/", srv.handleAlertRules())
+	mux.HandleFunc(pathAlerts, srv.handleAlerts())
+	mux.HandleFunc(pathDeviceList, srv.handleDeviceList())
+	mux.HandleFunc(pathDeviceHistory, srv.handleDeviceHistory())
+	mux.HandleFunc(pathLive, srv.handleLive())
+	mux.HandleFunc(pathImport, srv.handleImport())
+	mux.HandleFunc(pathClusters, srv.handleClusters())
+	mux.HandleFunc(pathAdminLogLevel, srv.handleAdminLogLevel())
+	mux.HandleFunc(pathQuarantine, srv.handleQuarantine())
+	mux.HandleFunc(pathQuarantine+"/", srv.handleQuarantine())
+	mux.HandleFunc(pathFirmware, srv.handleFirmware())
+	mux.HandleFunc(pathFirmware+"/", srv.handleFirmware())
+	mux.HandleFunc(pathDrain, srv.handleDrain())
+	mux.HandleFunc(pathRuntime, srv.handleRuntime())
+	mux.HandleFunc(pathDiagnostics, srv.handleDiagnostics())
+	mux.HandleFunc(pathFlags, srv.handleFlags())
+	mux.HandleFunc(pathTunables, srv.handleTunables())
+	mux.HandleFunc(pathSilences, srv.handleSilences())
+	mux.HandleFunc(pathSilences+"/", srv.handleSilences())
+	mux.HandleFunc(pathMetrics, srv.handleMetrics())
+	if srv.expvar {
+		mux.Handle(pathExpvar, expvar.Handler())
+	}
+	if srv.pprof {
+		mux.HandleFunc(pathPprof, pprof.Index)
+		mux.HandleFunc(pathPprof+"cmdline", pprof.Cmdline)
+		mux.HandleFunc(pathPprof+"profile", pprof.Profile)
+		mux.HandleFunc(pathPprof+"symbol", pprof.Symbol)
+		mux.HandleFunc(pathPprof+"trace", pprof.Trace)
+	}
+	return srv.traced(srv.recoverer(srv.readOnly(srv.authenticated(mux))))
+}
+
+// errReadOnly is the body of requests rejected by a read-only http server.
+const errReadOnly = "Forbidden: the http server is read-only"
+
+// readOnly wraps h, rejecting requests to administrative endpoints, device
+// ingest, and requests with methods other than GET, HEAD, and OPTIONS with a
+// 403, if the http server is read-only. WebSocket ingest is rejected though
+// its handshake is a GET. Grafana queries are allowed, as they are POSTed
+// though they only read.
+func (srv *Server) readOnly(h http.Handler) http.Handler {
+	if !srv.httpReadOnly {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var allowed bool
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/debug/"):
+		case r.URL.Path == pathIngest:
+		case r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions:
+			allowed = true
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, pathGrafana):
+			allowed = true
+		}
+		if !allowed {
+			http.Error(w, errReadOnly, http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// recoverer wraps h, recovering panics so that a failing request responds
+// with a 500 and is counted, rather than only being logged by the http
+// server.
+func (srv *Server) recoverer(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			srv.metrics.Panics.Inc()
+			srv.metrics.Errors.Inc()
+			srv.logError.Printf("recovered from panic handling %s %s\tpanic = %v\n%s", r.Method, r.URL.RequestURI(), v, debug.Stack())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// traced wraps h, recording a span for each http request when tracing is
+// enabled.
+func (srv *Server) traced(h http.Handler) http.Handler {
+	if srv.tracer == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := srv.tracer.Start(
+			r.Context(),
+			"HTTP "+r.Method,
+			trace.KindServer,
+			trace.String("http.method", r.Method),
+			trace.String("http.target", r.URL.RequestURI()))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttributes(trace.Int("http.status_code", int64(rec.status)))
+	})
+}
+
+// statusRecorder is an http.ResponseWriter that records the response status
+// code.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records status and calls the underlying WriteHeader.
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap retrieves the underlying http.ResponseWriter, so that the
+// connection of an upgraded request may be hijacked through it.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
 }
 
 // handleHealth is an HTTP endpoint at path /health
 //
 // GET:
-// Retrieve the health of the http server. 200 on healthy.
+// Retrieve the health of the http server, and of each exporter reporting
+// it. 200 on healthy. 503 while the Server is draining, or while a critical
+// exporter has been down for longer than it may be, in which case Down names
+// the exporters.
 func (srv *Server) handleHealth() http.HandlerFunc {
 	pathRE := regexp.MustCompile(`^(/health){1}$`)
+	type Response struct {
+		Exporters map[string]plugin.Health
+		Down      []string `json:",omitempty"`
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
@@ -39,7 +219,19 @@ func (srv *Server) handleHealth() http.HandlerFunc {
 
 		switch r.Method {
 		case http.MethodGet:
-			w.WriteHeader(http.StatusOK)
+			if srv.Draining() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			response := Response{Exporters: srv.ExporterHealth()}
+			response.Down = srv.downExporters(time.Now(), response.Exporters)
+			w.Header().Set("Content-Type", "application/json")
+			if len(response.Down) > 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
 			return
 
 		default:
@@ -54,12 +246,18 @@ func (srv *Server) handleHealth() http.HandlerFunc {
 //
 // GET:
 // Retrieve the most recent reading for specified IMEI. Endpoint responds with
-// 200 and the most recent reading on success. If the IMEI is offline, the
-// endpoint responds with a 205.
+// 200 and the most recent reading on success. If the IMEI is not connected to
+// the Server, the request is forwarded to the Server's peers, and answered by
+// the node it is connected to. If the IMEI is offline, the endpoint responds
+// with a 204.
 func (srv *Server) handleReadings() http.HandlerFunc {
 	pathRE := regexp.MustCompile(`^(/readings/){1}(\d{15}){1}$`)
 	type Response struct {
 		Reading client.Reading
+
+		// ReceivedAt denotes when the server received the Reading, and is nil
+		// if the device has not sent one.
+		ReceivedAt *time.Time `json:",omitempty"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -76,18 +274,24 @@ func (srv *Server) handleReadings() http.HandlerFunc {
 
 		switch r.Method {
 		case http.MethodGet:
-			c, ok := srv.clientMap.Load(uint64(imei))
+			c, ok := srv.loadClient(r, uint64(imei))
 			if !ok {
+				if srv.forwardToPeers(w, r, http.StatusOK) {
+					return
+				}
 				http.Error(w, http.StatusText(http.StatusNoContent), http.StatusNoContent)
 				return
 			}
-			srv.logInfo.Println(c)
+			srv.logDebug.Println(c)
 
 			w.Header().Set("Content-Type", "application/json")
 			response := Response{
 				Reading: c.LastReading(),
 			}
-			srv.logInfo.Println(response)
+			if receivedAt := c.LastReadingAt(); !receivedAt.IsZero() {
+				response.ReceivedAt = &receivedAt
+			}
+			srv.logDebug.Println(response)
 			if err := json.NewEncoder(w).Encode(response); err != nil {
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			}
@@ -104,10 +308,19 @@ func (srv *Server) handleReadings() http.HandlerFunc {
 // handleStatus is an HTTP endpoint at path /status/:imei.
 //
 // GET:
-// If the imei is online the response status code is 200. If the imei is
-// offline the response status code is 204.
+// The response body holds the imei's presence: whether it is online, when it
+// was last seen, and when and why it last disconnected. If the imei is online
+// the response body also holds the firmware version reported by the device,
+// along with the connection's metadata. In both cases the response status
+// code is 200. If the imei has never connected the response status code is
+// 204.
 func (srv *Server) handleStatus() http.HandlerFunc {
 	pathRE := regexp.MustCompile(`^(/status/){1}(\d{15}){1}$`)
+	type Response struct {
+		Presence
+		*client.Metadata
+		Firmware string `json:",omitempty"`
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
@@ -123,11 +336,2007 @@ func (srv *Server) handleStatus() http.HandlerFunc {
 
 		switch r.Method {
 		case http.MethodGet:
-			if !srv.clientMap.Exists(uint64(imei)) {
+			presence, ok := srv.Presence(uint64(imei))
+			if !ok || !scopeOf(r).allows(presence.Tenant) {
 				w.WriteHeader(http.StatusNoContent)
 				return
 			}
-			w.WriteHeader(http.StatusOK)
+
+			response := Response{Presence: presence}
+			if c, ok := srv.clientMap.Load(uint64(imei)); ok && presence.Online {
+				metadata := c.Metadata()
+				response.Metadata = &metadata
+				response.Firmware = c.Firmware()
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleDevices is an HTTP endpoint at path /devices/:imei/:resource.
+//
+// GET /devices/:imei:
+// Retrieve the specified IMEI's protocol, firmware version, and connection
+// metadata. Endpoint responds with 200 and the device on success. If the
+// IMEI is offline, the endpoint responds with a 204.
+//
+// GET /devices/:imei/stats:
+// Retrieve the statistics of the specified IMEI's connection, and, if the
+// Server has a reading history with enough readings since the IMEI's battery
+// was last charged, its battery drain rate and projected time to empty.
+// Endpoint responds with 200 and the statistics on success. If the IMEI is
+// offline, the endpoint responds with a 204.
+//
+// GET /devices/:imei/commands:
+// Retrieve the commands recently sent to the specified IMEI and their delivery
+// status. Endpoint responds with 200 and the commands on success. If the IMEI
+// is offline, the endpoint responds with a 204.
+//
+// POST /devices/:imei/commands:
+// Send a command to the specified IMEI. The command Payload is base64
+// encoded. Endpoint responds with 202 and the delivered command on success.
+// If the IMEI is offline, the endpoint responds with a 404. If the IMEI's
+// protocol does not support commands, the endpoint responds with a 409.
+//
+// GET /devices/:imei/config:
+// Retrieve the configuration pending confirmation by, and last applied by,
+// the specified IMEI. Endpoint responds with 200 and the configuration state
+// on success. If the IMEI is offline, the endpoint responds with a 204.
+//
+// PUT /devices/:imei/config:
+// Push a configuration to the specified IMEI. The configuration's Version is
+// assigned by the server, and its ReportingInterval is a duration string, as
+// in "30s". Endpoint responds with 202 and the versioned configuration on
+// success. If the IMEI is offline, the endpoint responds with
+// a 404. If the IMEI's protocol does not support configuration, the endpoint
+// responds with a 409.
+//
+// GET /devices/:imei/overrides:
+// Retrieve the overrides of the specified IMEI: alert rule thresholds, by rule
+// ID, and valid ranges of reading fields, by field name, taking precedence
+// over those of the fleet. Endpoint responds with 200 and the overrides, empty
+// if there are none. Unlike the other endpoints, the IMEI need only have
+// connected once.
+//
+// PUT /devices/:imei/overrides:
+// Replace the overrides of the specified IMEI. Empty overrides remove them.
+// Endpoint responds with 200 and the overrides on success. If an override
+// names an alert rule not applying to the IMEI or an unknown field, has a
+// clear threshold at which its rule fires, or has a range whose Min exceeds
+// its Max, the endpoint responds with a 400.
+//
+// DELETE /devices/:imei:
+// Disconnect the specified IMEI, closing it with the "kicked" close reason.
+// Endpoint responds with 204 on success. If the IMEI is offline, the endpoint
+// responds with a 404.
+func (srv *Server) handleDevices() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/devices/){1}(\d{15}){1}(?:/(stats|commands|config|overrides))?$`)
+	type Device struct {
+		client.Metadata
+		IMEI     uint64
+		Firmware string `json:",omitempty"`
+	}
+	type DeviceResponse struct {
+		Device Device
+	}
+	type StatsResponse struct {
+		Stats   client.Stats
+		Battery *BatteryDrain `json:",omitempty"`
+	}
+	type CommandRequest struct {
+		Payload []byte
+	}
+	type CommandResponse struct {
+		Command client.Command
+	}
+	type CommandsResponse struct {
+		Commands []client.Command
+	}
+	type ConfigResponse struct {
+		Config client.Config
+	}
+	type ConfigStateResponse struct {
+		Config client.ConfigState
+	}
+	type OverridesResponse struct {
+		Overrides DeviceOverrides
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 4 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		imei, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		resource := parts[3]
+
+		switch {
+		case resource == "overrides":
+			presence, ok := srv.presence.get(uint64(imei))
+			if !ok || !scopeOf(r).allows(presence.Tenant) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			switch r.Method {
+			case http.MethodGet:
+			case http.MethodPut:
+				var request DeviceOverrides
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+				err := srv.setOverrides(uint64(imei), presence.Tenant, request)
+				switch {
+				case errors.Is(err, ErrInvalidOverrides):
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				case err != nil:
+					srv.logError.Println(err)
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+			default:
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+
+			overrides, _ := srv.overrides.get(uint64(imei))
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(OverridesResponse{Overrides: overrides}); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		case r.Method == http.MethodGet:
+			c, ok := srv.loadClient(r, uint64(imei))
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusNoContent), http.StatusNoContent)
+				return
+			}
+
+			var response interface{}
+			switch resource {
+			case "":
+				response = DeviceResponse{
+					Device: Device{
+						Metadata: c.Metadata(),
+						IMEI:     c.IMEI(),
+						Firmware: c.Firmware(),
+					},
+				}
+			case "stats":
+				stats := StatsResponse{Stats: c.Stats()}
+				if drain, ok := srv.batteryDrain(c.IMEI()); ok {
+					stats.Battery = &drain
+				}
+				response = stats
+			case "commands":
+				response = CommandsResponse{Commands: c.Commands()}
+			case "config":
+				response = ConfigStateResponse{Config: c.ConfigState()}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		case r.Method == http.MethodPost && resource == "commands":
+			var request CommandRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			c, ok := srv.loadClient(r, uint64(imei))
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+
+			cmd, err := c.SendCommand(request.Payload)
+			switch {
+			case errors.Is(err, client.ErrProtocolUnsupported):
+				http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+				return
+			case errors.Is(err, client.ErrCommandTooLarge):
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			case err != nil:
+				srv.logError.Printf("failed to handleDevices/SendCommand\terr = %s\n", err)
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			if err := json.NewEncoder(w).Encode(CommandResponse{Command: cmd}); err != nil {
+				srv.logError.Printf("failed to handleDevices/Encode\terr = %s\n", err)
+			}
+			return
+
+		case r.Method == http.MethodPut && resource == "config":
+			var request client.Config
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			c, ok := srv.loadClient(r, uint64(imei))
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+
+			cfg, err := c.PushConfig(request)
+			switch {
+			case errors.Is(err, client.ErrProtocolUnsupported):
+				http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+				return
+			case err != nil:
+				srv.logError.Printf("failed to handleDevices/PushConfig\terr = %s\n", err)
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			if err := json.NewEncoder(w).Encode(ConfigResponse{Config: cfg}); err != nil {
+				srv.logError.Printf("failed to handleDevices/Encode\terr = %s\n", err)
+			}
+			return
+
+		case r.Method == http.MethodDelete && resource == "":
+			if _, ok := srv.loadClient(r, uint64(imei)); !ok || !srv.CloseClient(uint64(imei), client.CloseKicked) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleTenants is an HTTP endpoint at path /tenants/:tenant.
+//
+// GET:
+// Retrieve the specified tenant's quota and metrics: the number of its
+// devices currently connected, and the connections, readings, and quota
+// rejections counted since the Server started. Endpoint responds with 200 and
+// the metrics on success. If the request is scoped to another tenant, the
+// endpoint responds with a 404.
+func (srv *Server) handleTenants() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/tenants/){1}([\w.-]+){1}$`)
+	type Response struct {
+		Tenant        string
+		Quota         Quota
+		Clients       int
+		Connections   int64
+		Readings      int64
+		QuotaExceeded map[string]int64 `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 3 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		tenant := parts[2]
+		if !scopeOf(r).allows(tenant) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			response := Response{
+				Tenant:      tenant,
+				Quota:       srv.tenants.quotas[tenant],
+				Connections: srv.metrics.TenantConnections.Snapshot()[tenant],
+				Readings:    srv.metrics.TenantReadings.Snapshot()[tenant],
+			}
+			for name, n := range srv.metrics.TenantQuotaExceeded.Snapshot() {
+				if quota, ok := strings.CutPrefix(name, tenant+"."); ok && !strings.Contains(quota, ".") {
+					if response.QuotaExceeded == nil {
+						response.QuotaExceeded = make(map[string]int64)
+					}
+					response.QuotaExceeded[quota] = n
+				}
+			}
+			srv.ForEachClient(func(c *client.Client) bool {
+				if c.Tenant() == tenant {
+					response.Clients++
+				}
+				return true
+			})
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleGroups is an HTTP endpoint at path /groups/:group/devices/:imei.
+// Groups are scoped to the tenant of the request; requests scoped to every
+// tenant share a separate set of groups.
+//
+// GET /groups/:
+// Retrieve the names of the groups. Endpoint responds with 200 and the names.
+//
+// GET /groups/:group:
+// Retrieve the presence of each device of the specified group, and a summary
+// of their statistics. Endpoint responds with 200 and the group on success.
+// If the group has no devices, the endpoint responds with a 404.
+//
+// PUT /groups/:group/devices/:imei:
+// Assign the specified IMEI to the specified group, creating the group if
+// necessary. Endpoint responds with 204 on success. If the IMEI has never
+// connected, the endpoint responds with a 404.
+//
+// DELETE /groups/:group/devices/:imei:
+// Unassign the specified IMEI from the specified group. Endpoint responds with
+// 204 on success. If the IMEI is not assigned to the group, the endpoint
+// responds with a 404.
+func (srv *Server) handleGroups() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/groups/){1}([\w.-]+)?(?:/devices/(\d{15}))?$`)
+	type GroupsResponse struct {
+		Groups []string
+	}
+	type GroupResponse struct {
+		Group     string
+		Devices   []Presence
+		Aggregate Aggregate
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 4 || parts[2] == "" && parts[3] != "" {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		group := parts[2]
+		var imei uint64
+		if parts[3] != "" {
+			var err error
+			imei, err = strconv.ParseUint(parts[3], 10, 64)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+		}
+		scope := scopeOf(r)
+
+		switch {
+		case r.Method == http.MethodGet && group == "":
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(GroupsResponse{Groups: srv.groups.names(scope.tenant)}); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		case r.Method == http.MethodGet && imei == 0:
+			imeis, ok := srv.groups.members(scope.tenant, group)
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+
+			response := GroupResponse{Group: group, Devices: make([]Presence, 0, len(imeis))}
+			var a aggregate
+			for _, imei := range imeis {
+				presence, ok := srv.Presence(imei)
+				if !ok || !scope.allows(presence.Tenant) {
+					continue
+				}
+				response.Devices = append(response.Devices, presence)
+				c, _ := srv.clientMap.Load(imei)
+				a.add(presence, c)
+			}
+			response.Aggregate = a.summary()
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		case r.Method == http.MethodPut && imei != 0:
+			presence, ok := srv.Presence(imei)
+			if !ok || !scope.allows(presence.Tenant) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			srv.groups.add(scope.tenant, group, imei)
+			w.WriteHeader(http.StatusNoContent)
+			return
+
+		case r.Method == http.MethodDelete && imei != 0:
+			if !srv.groups.remove(scope.tenant, group, imei) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleAlertRules is an HTTP endpoint at path /v1/alert-rules[/:id]. Rules
+// are scoped to the tenant of the request; requests scoped to every tenant
+// share a separate set of rules, which apply to every device.
+//
+// GET /v1/alert-rules:
+// Retrieve the alert rules. Endpoint responds with 200 and the rules.
+//
+// POST /v1/alert-rules:
+// Create an alert rule. Its ID is assigned by the server. Endpoint responds
+// with 201 and the rule on success. If the rule is invalid, the endpoint
+// responds with a 400.
+//
+// GET /v1/alert-rules/:id:
+// Retrieve the specified alert rule. Endpoint responds with 200 and the rule
+// on success. If the rule does not exist, the endpoint responds with a 404.
+//
+// PUT /v1/alert-rules/:id:
+// Replace the specified alert rule. Endpoint responds with 200 and the rule on
+// success. If the rule is invalid, the endpoint responds with a 400. If the
+// rule does not exist, the endpoint responds with a 404.
+//
+// DELETE /v1/alert-rules/:id:
+// Delete the specified alert rule. Endpoint responds with 204 on success. If
+// the rule does not exist, the endpoint responds with a 404.
+func (srv *Server) handleAlertRules() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/v1/alert-rules){1}(?:/(\d+))?$`)
+	type RulesResponse struct {
+		Rules []AlertRule
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 3 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		var id uint64
+		if parts[2] != "" {
+			var err error
+			id, err = strconv.ParseUint(parts[2], 10, 64)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+		}
+		tenant := scopeOf(r).tenant
+
+		var (
+			status   = http.StatusOK
+			response interface{}
+		)
+		switch {
+		case r.Method == http.MethodGet && parts[2] == "":
+			response = RulesResponse{Rules: srv.alerts.list(tenant)}
+
+		case r.Method == http.MethodPost && parts[2] == "":
+			var request AlertRule
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			rule, err := srv.alerts.create(tenant, request)
+			if err != nil {
+				srv.alertRuleError(w, err)
+				return
+			}
+			status, response = http.StatusCreated, rule
+
+		case r.Method == http.MethodGet:
+			rule, ok := srv.alerts.get(tenant, id)
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			response = rule
+
+		case r.Method == http.MethodPut && parts[2] != "":
+			var request AlertRule
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			rule, err := srv.alerts.update(tenant, id, request)
+			if err != nil {
+				srv.alertRuleError(w, err)
+				return
+			}
+			response = rule
+
+		case r.Method == http.MethodDelete && parts[2] != "":
+			if err := srv.alerts.delete(tenant, id); err != nil {
+				srv.alertRuleError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			srv.logError.Printf("failed to handleAlertRules/Encode\terr = %s\n", err)
+		}
+	}
+}
+
+// alertRuleError responds to a failed change of an alert rule: 400 if the
+// rule is invalid, 404 if it does not exist, and 500 otherwise, such as when
+// it could not be saved.
+func (srv *Server) alertRuleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidAlertRule):
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	case errors.Is(err, ErrUnknownAlertRule):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	default:
+		srv.logError.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// handleAlerts is an HTTP endpoint at path /v1/alerts.
+//
+// GET:
+// Retrieve the alerts fired within the tenant of the request, ordered by when
+// they fired. Alerts may be filtered by the query parameter "imei", and by
+// "from" and "to", RFC 3339 times bounding when the alerts were firing.
+// Endpoint responds with 200 and the alerts. If a filter is invalid, the
+// endpoint responds with a 400.
+func (srv *Server) handleAlerts() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/v1/alerts){1}$`)
+	type Response struct {
+		Alerts []Alert
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.Path)
+		if len(parts) != 2 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			query := r.URL.Query()
+			var imei uint64
+			if v := query.Get("imei"); v != "" {
+				var err error
+				imei, err = strconv.ParseUint(v, 10, 64)
+				if err != nil {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+			}
+			from, to, err := timeRange(query)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+
+			alerts := srv.alertHistory.query(imei, from, to, scopeOf(r).allows)
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(Response{Alerts: alerts}); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// timeRange parses the query parameters "from" and "to" of query, RFC 3339
+// times, failing if from is after to. Bounds that are omitted are zero.
+func timeRange(query url.Values) (from, to time.Time, err error) {
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		v := query.Get(bound.name)
+		if v == "" {
+			continue
+		}
+		if *bound.t, err = time.Parse(time.RFC3339, v); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("failed to server.timeRange\tfrom = %s to = %s", from, to)
+	}
+	return from, to, nil
+}
+
+// handleDeviceList is an HTTP endpoint at path /v1/devices.
+//
+// GET:
+// Retrieve the presence of each device within the tenant of the request that
+// has connected, ordered by IMEI. Devices may be filtered by the query
+// parameter "online", a boolean. Endpoint responds with 200 and the devices.
+// If the filter is invalid, the endpoint responds with a 400.
+func (srv *Server) handleDeviceList() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/v1/devices){1}$`)
+	type Response struct {
+		Devices []Presence
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.Path)
+		if len(parts) != 2 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			var online *bool
+			if v := r.URL.Query().Get("online"); v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+				online = &b
+			}
+
+			scope := scopeOf(r)
+			devices := make([]Presence, 0)
+			for _, presence := range srv.presence.list() {
+				if !scope.allows(presence.Tenant) || online != nil && presence.Online != *online {
+					continue
+				}
+				presence.Place = srv.place(presence.IMEI)
+				devices = append(devices, presence)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(Response{Devices: devices}); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleLive is an HTTP endpoint at path /v1/readings/stream.
+//
+// GET:
+// Stream the readings of the devices within the tenant of the request as they
+// are received, as server-sent events whose data is a JSON LiveReading.
+// Readings may be filtered by the query parameter "imei". Readings are
+// dropped while the client falls behind. The stream ends once the client
+// disconnects or the Server shuts down. If the filter is invalid, the
+// endpoint responds with a 400.
+func (srv *Server) handleLive() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/v1/readings/stream){1}$`)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.Path)
+		if len(parts) != 2 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		var imei uint64
+		if v := r.URL.Query().Get("imei"); v != "" {
+			var err error
+			imei, err = strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+		}
+
+		scope := scopeOf(r)
+		readings, unsubscribe := srv.live.subscribe(func(i uint64) bool {
+			return (imei == 0 || i == imei) && scope.allows(srv.tenantOf(i))
+		})
+		defer unsubscribe()
+
+		rc := http.NewResponseController(w)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			srv.logError.Printf("failed to handleLive/Flush\terr = %s\n", err)
+			return
+		}
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-srv.live.done:
+				return
+			case reading := <-readings:
+				if _, err := io.WriteString(w, "data: "); err != nil {
+					return
+				}
+				// Encode terminates the data with a newline; another ends the
+				// event.
+				if err := enc.Encode(reading); err != nil {
+					return
+				}
+				if _, err := io.WriteString(w, "\n"); err != nil {
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// handleImport is an HTTP endpoint at path /v1/import.
+//
+// POST:
+// Backfill the history of the device of the query parameter "imei" with the
+// timestamped readings of the request body, into the reading history and the
+// Server's store plugins. The body is CSV if its Content-Type is text/csv,
+// with a header naming the columns ReceivedAt, an RFC 3339 time, Temperature,
+// Altitude, Latitude, Longitude, and BatteryLevel, and JSON lines of
+// StoredReadings otherwise. Each row is validated with the range checks of
+// live readings, and must have been received in the past. Endpoint responds
+// with 200 and the number of readings imported on success. If any row is
+// invalid, nothing is imported, and the endpoint responds with a 400 and the
+// invalid rows. If the body exceeds 64 MiB, the endpoint responds with a 413.
+// If the IMEI is invalid, the endpoint responds with a 400, and if it is not
+// within the tenant of the request, with a 404. Requests to Servers with
+// neither a reading history nor store plugins respond with a 404.
+func (srv *Server) handleImport() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/v1/import){1}$`)
+	type Response struct {
+		IMEI     uint64
+		Imported int
+	}
+	type ErrorResponse struct {
+		Errors []ImportError
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.Path)
+		if len(parts) != 2 || !srv.importing() {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query().Get("imei")
+		imei, err := strconv.ParseUint(query, 10, 64)
+		if err != nil || len(query) != 15 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		// Devices that have never connected are owned by no tenant.
+		presence, _ := srv.presence.get(imei)
+		if !scopeOf(r).allows(presence.Tenant) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		readings, invalid, err := srv.parseImport(imei, http.MaxBytesReader(w, r.Body, maxImportSize), mediaType == "text/csv")
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		case err != nil:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		case len(invalid) > 0:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			if err := json.NewEncoder(w).Encode(ErrorResponse{Errors: invalid}); err != nil {
+				srv.logError.Printf("failed to handleImport/Encode\terr = %s\n", err)
+			}
+			return
+		}
+
+		srv.importReadings(imei, readings)
+		srv.logInfo.Printf("[IMEI %d] Imported %d readings\n", imei, len(readings))
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(Response{IMEI: imei, Imported: len(readings)}); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+}
+
+// errConnected is the body of erasure requests of connected devices.
+const errConnected = "Conflict: the device is connected and must be kicked first"
+
+// handleDeviceData is an HTTP endpoint at path /v1/devices/:imei/data.
+//
+// DELETE /v1/devices/:imei/data:
+// Erase the data of the IMEI kept by the Server and its store plugins, to
+// satisfy right-to-erasure requests. Endpoint responds with 200 and an
+// ErasureReceipt of the records erased from each backend, or with a 500 and
+// the receipt if a backend failed to erase them. Exporters are listed as
+// unsupported, as the readings they shipped must be erased from their
+// external systems. If the IMEI is connected, the endpoint responds with a
+// 409, as it would record data anew. Devices that have never connected are
+// owned by no tenant; if the IMEI is not owned by the request's tenant, the
+// endpoint responds with a 404.
+func (srv *Server) handleDeviceData() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/v1/devices/){1}(\d{15})/data$`)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.Path)
+		if len(parts) != 3 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		imei, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		presence, _ := srv.presence.get(imei)
+		if !scopeOf(r).allows(presence.Tenant) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodDelete {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if srv.clientMap.Exists(imei) {
+			http.Error(w, errConnected, http.StatusConflict)
+			return
+		}
+
+		receipt := srv.eraseDevice(imei)
+		status := http.StatusOK
+		if receipt.failed() {
+			status = http.StatusInternalServerError
+			srv.logError.Printf("[IMEI %d] Failed to erase data\treceipt = %+v\n", imei, receipt)
+		} else {
+			srv.logInfo.Printf("[IMEI %d] Erased data\n", imei)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(receipt); err != nil {
+			srv.logError.Printf("failed to handleDeviceData/Encode\terr = %s\n", err)
+		}
+	}
+}
+
+// handleDeviceHistory is an HTTP endpoint at path /v1/devices/:imei/:resource,
+// analyzing the reading history of the specified IMEI. Requests to Servers
+// without a reading history respond with a 404. Requests of the resource
+// "data" are handled by handleDeviceData.
+//
+// GET /v1/devices/:imei/distance:
+// Retrieve the great-circle distance, in meters, along the positions of the
+// IMEI's readings in the reading history, and the distance it traveled each
+// UTC day, kept for 90 days regardless of the reading history. Both may be
+// bounded by the query parameters "from" and "to", RFC 3339 times. Endpoint
+// responds with 200 and the distance on success. If a bound is invalid, the
+// endpoint responds with a 400.
+//
+// GET /v1/devices/:imei/track:
+// Retrieve the positions of the IMEI's readings in the reading history,
+// oldest first, simplified per the Douglas-Peucker algorithm for drawing the
+// IMEI's path. Positions may be bounded by the query parameters "from" and
+// "to", RFC 3339 times, and are simplified to at most the number of the query
+// parameter "maxPoints", 2 through 10000, defaulting to 500. Endpoint
+// responds with 200 and the positions on success. If a bound or maxPoints is
+// invalid, the endpoint responds with a 400.
+//
+// GET /v1/devices/:imei/track.gpx, GET /v1/devices/:imei/track.kml:
+// Retrieve every position of the IMEI's readings in the reading history,
+// oldest first, as a GPX or KML file for mapping tools. Positions may be
+// bounded by the query parameters "from" and "to", RFC 3339 times. Endpoint
+// responds with 200 and the file on success. If a bound is invalid, the
+// endpoint responds with a 400.
+//
+// GET /v1/devices/:imei/trend:
+// Retrieve the mean, minimum, and maximum temperature of the IMEI's readings
+// in the reading history over a window, and the slope and coefficient of
+// determination of a linear fit of temperature over time, so that warming and
+// cooling may be detected. The window is the duration of the query parameter
+// "window", defaulting to 1h, ending at the query parameter "to", an RFC 3339
+// time defaulting to now; "from" is ignored. Endpoint responds with 200 and
+// the trend on success. If the window or to is invalid, the endpoint responds
+// with a 400.
+//
+// If the IMEI has never connected, the endpoints respond with a 404.
+func (srv *Server) handleDeviceHistory() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/v1/devices/){1}(\d{15})/(distance|track|track\.gpx|track\.kml|trend)$`)
+	exports := map[string]struct {
+		contentType string
+		write       func(io.Writer, uint64, []StoredReading) error
+	}{
+		"track.gpx": {contentType: "application/gpx+xml", write: writeGPX},
+		"track.kml": {contentType: "application/vnd.google-earth.kml+xml", write: writeKML},
+	}
+	type DistanceResponse struct {
+		IMEI   uint64
+		Meters float64
+		Daily  []DailyDistance
+	}
+	type TrackResponse struct {
+		IMEI   uint64
+		Points []TrackPoint
+	}
+	type TrendResponse struct {
+		IMEI   uint64
+		Window time.Duration
+		Trend  Trend
+	}
+	data := srv.handleDeviceData()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/data") {
+			data(w, r)
+			return
+		}
+		parts := pathRE.FindStringSubmatch(r.URL.Path)
+		if len(parts) != 4 || srv.history == nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		imei, err := strconv.ParseUint(parts[2], 10, 64)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if presence, ok := srv.presence.get(imei); !ok || !scopeOf(r).allows(presence.Tenant) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		from, to, err := timeRange(query)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if to.IsZero() {
+			to = time.Now()
+		}
+
+		if export, ok := exports[parts[3]]; ok {
+			w.Header().Set("Content-Type", export.contentType)
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%d-%s"`, imei, parts[3]))
+			if err := export.write(w, imei, srv.history.readings(imei, from, to)); err != nil {
+				srv.logError.Printf("failed to handleDeviceHistory/write\terr = %s\n", err)
+			}
+			return
+		}
+
+		var response interface{}
+		switch parts[3] {
+		case "distance":
+			response = DistanceResponse{
+				IMEI:   imei,
+				Meters: distance(srv.history.readings(imei, from, to)),
+				Daily:  srv.odometer.daily(imei, from, to),
+			}
+		case "track":
+			maxPoints := defaultTrackPoints
+			if v := query.Get("maxPoints"); v != "" {
+				maxPoints, err = strconv.Atoi(v)
+				if err != nil || maxPoints < 2 || maxPoints > maxTrackPoints {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+			}
+			response = TrackResponse{
+				IMEI:   imei,
+				Points: track(srv.history.readings(imei, from, to), maxPoints),
+			}
+		case "trend":
+			window := defaultTrendWindow
+			if v := query.Get("window"); v != "" {
+				window, err = time.ParseDuration(v)
+				if err != nil || window <= 0 {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+			}
+			response = TrendResponse{
+				IMEI:   imei,
+				Window: window,
+				Trend:  trend(srv.history.readings(imei, to.Add(-window), to)),
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+}
+
+// handleClusters is an HTTP endpoint at path /v1/devices/clusters.
+//
+// GET:
+// Retrieve the last known positions of the connected devices within the
+// tenant of the request, clustered for rendering on a Web Mercator map at the
+// zoom level of the query parameter "zoom", 0 through 22, defaulting to 0.
+// Devices within 64 pixels of a 256 pixel tile of each other are clustered at
+// their mean position, largest clusters first; clusters of a single device
+// include its IMEI. Positions may be bounded by the query parameter "bbox",
+// formatted "minLon,minLat,maxLon,maxLat" in degrees. Endpoint responds with
+// 200 and the clusters. If zoom or bbox is invalid, the endpoint responds with
+// a 400.
+func (srv *Server) handleClusters() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/v1/devices/clusters){1}$`)
+	type Response struct {
+		Zoom     int
+		Clusters []Cluster
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.Path)
+		if len(parts) != 2 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			query := r.URL.Query()
+			var zoom int
+			if v := query.Get("zoom"); v != "" {
+				var err error
+				zoom, err = strconv.Atoi(v)
+				if err != nil || zoom < 0 || zoom > maxClusterZoom {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+			}
+			bbox := world
+			if v := query.Get("bbox"); v != "" {
+				var err error
+				bbox, err = parseBBox(v)
+				if err != nil {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+			}
+
+			clusters := srv.clusters(zoom, bbox, scopeOf(r).allows)
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(Response{Zoom: zoom, Clusters: clusters}); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleFleet is an HTTP endpoint at path /v1/fleet/aggregate.
+//
+// GET:
+// Retrieve a summary of the statistics of every device within the tenant of
+// the request: counts by presence, and the minimum, maximum, and mean
+// temperature and battery level of the latest readings of online devices.
+// Devices may be filtered by the query parameters "group", "protocol", and
+// "firmware"; filtering by protocol or firmware excludes offline devices, as
+// neither is known once a device disconnects. Endpoint responds with 200 and
+// the summary. If a filter is invalid, the endpoint responds with a 400.
+func (srv *Server) handleFleet() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/v1/fleet/aggregate){1}$`)
+	type Response struct {
+		Aggregate
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.Path)
+		if len(parts) != 2 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			scope := scopeOf(r)
+			query := r.URL.Query()
+
+			var members map[uint64]bool
+			if group := query.Get("group"); group != "" {
+				imeis, _ := srv.groups.members(scope.tenant, group)
+				members = make(map[uint64]bool, len(imeis))
+				for _, imei := range imeis {
+					members[imei] = true
+				}
+			}
+			var protocol client.Protocol
+			if v := query.Get("protocol"); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || client.Protocol(n) != client.ProtocolV1 && client.Protocol(n) != client.ProtocolV2 {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+				protocol = client.Protocol(n)
+			}
+			firmware := query.Get("firmware")
+
+			var a aggregate
+			for _, presence := range srv.presence.list() {
+				if !scope.allows(presence.Tenant) || members != nil && !members[presence.IMEI] {
+					continue
+				}
+				c, _ := srv.clientMap.Load(presence.IMEI)
+				if protocol != 0 || firmware != "" {
+					if c == nil ||
+						protocol != 0 && c.Protocol() != protocol ||
+						firmware != "" && c.Firmware() != firmware {
+						continue
+					}
+				}
+				a.add(presence, c)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(Response{Aggregate: a.summary()}); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleSummary is an HTTP endpoint at path /v1/summary.
+//
+// GET:
+// Retrieve a dashboard-ready overview of the devices within the tenant of the
+// request: online and offline counts, recent connects and disconnects, the
+// online devices with the most decode errors and the lowest battery levels,
+// and the rate readings are received. Endpoint responds with 200 and the
+// summary.
+func (srv *Server) handleSummary() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/v1/summary){1}$`)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 2 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(srv.summary(scopeOf(r))); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleGrafana is an HTTP endpoint at path /v1/grafana/:method, serving
+// the reading history as a Grafana JSON datasource. Each target is named
+// after an IMEI and a reading field, as in "490154203237518.temperature".
+// The endpoint responds with a 404 unless the Server keeps a reading history.
+//
+// GET /v1/grafana/:
+// Test the datasource. Endpoint responds with 200.
+//
+// POST /v1/grafana/search:
+// Retrieve the targets within the tenant of the request containing the
+// request's target. Endpoint responds with 200 and the targets.
+//
+// POST /v1/grafana/query:
+// Retrieve the readings of each requested target received within the
+// requested range, evenly thinned to at most maxDataPoints. Endpoint responds
+// with 200 and the datapoints of each target. If the request is malformed,
+// the endpoint responds with a 400.
+//
+// POST /v1/grafana/annotations:
+// Retrieve the alarms received within the requested range, from the IMEI
+// named by the annotation's query, or every IMEI if the query is empty.
+// Endpoint responds with 200 and the annotations. If the request is
+// malformed, the endpoint responds with a 400.
+func (srv *Server) handleGrafana() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/v1/grafana/){1}(search|query|annotations)?$`)
+	type Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	}
+	type SearchRequest struct {
+		Target string `json:"target"`
+	}
+	type Target struct {
+		Target string `json:"target"`
+	}
+	type QueryRequest struct {
+		Range         Range    `json:"range"`
+		Targets       []Target `json:"targets"`
+		MaxDataPoints int      `json:"maxDataPoints"`
+	}
+	type Series struct {
+		Target     string       `json:"target"`
+		Datapoints [][2]float64 `json:"datapoints"`
+	}
+	type AnnotationsRequest struct {
+		Range      Range           `json:"range"`
+		Annotation json.RawMessage `json:"annotation"`
+	}
+	type Annotation struct {
+		Annotation json.RawMessage `json:"annotation"`
+		Time       int64           `json:"time"`
+		Title      string          `json:"title"`
+		Text       string          `json:"text"`
+		Tags       []string        `json:"tags"`
+	}
+	fields := []struct {
+		Name  string
+		Value func(client.Reading) float64
+	}{
+		{Name: "temperature", Value: func(r client.Reading) float64 { return r.Temperature }},
+		{Name: "altitude", Value: func(r client.Reading) float64 { return r.Altitude }},
+		{Name: "latitude", Value: func(r client.Reading) float64 { return r.Latitude }},
+		{Name: "longitude", Value: func(r client.Reading) float64 { return r.Longitude }},
+		{Name: "battery_level", Value: func(r client.Reading) float64 { return r.BatteryLevel }},
+	}
+
+	// visible retrieves the IMEIs with a reading history within the scope of
+	// r.
+	visible := func(r *http.Request) []uint64 {
+		scope := scopeOf(r)
+		var imeis []uint64
+		for _, imei := range srv.history.imeis() {
+			if presence, ok := srv.presence.get(imei); ok && scope.allows(presence.Tenant) {
+				imeis = append(imeis, imei)
+			}
+		}
+		return imeis
+	}
+	encode := func(w http.ResponseWriter, response interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 3 || srv.history == nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		method := parts[2]
+
+		switch {
+		case r.Method == http.MethodGet && method == "":
+			w.WriteHeader(http.StatusOK)
+			return
+
+		case r.Method == http.MethodPost && method == "search":
+			var request SearchRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			targets := []string{}
+			for _, imei := range visible(r) {
+				for _, field := range fields {
+					target := fmt.Sprintf("%d.%s", imei, field.Name)
+					if strings.Contains(target, request.Target) {
+						targets = append(targets, target)
+					}
+				}
+			}
+			encode(w, targets)
+			return
+
+		case r.Method == http.MethodPost && method == "query":
+			var request QueryRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			imeis := make(map[uint64]bool)
+			for _, imei := range visible(r) {
+				imeis[imei] = true
+			}
+
+			response := make([]Series, 0, len(request.Targets))
+			for _, target := range request.Targets {
+				series := Series{Target: target.Target, Datapoints: [][2]float64{}}
+				name, field, _ := strings.Cut(target.Target, ".")
+				imei, err := strconv.ParseUint(name, 10, 64)
+				if err != nil || !imeis[imei] {
+					response = append(response, series)
+					continue
+				}
+				for _, f := range fields {
+					if f.Name != field {
+						continue
+					}
+					readings := srv.history.readings(imei, request.Range.From, request.Range.To)
+					step := 1
+					if request.MaxDataPoints > 0 && len(readings) > request.MaxDataPoints {
+						step = (len(readings) + request.MaxDataPoints - 1) / request.MaxDataPoints
+					}
+					for i := 0; i < len(readings); i += step {
+						series.Datapoints = append(series.Datapoints, [2]float64{
+							f.Value(readings[i].Reading),
+							float64(readings[i].ReceivedAt.UnixMilli()),
+						})
+					}
+				}
+				response = append(response, series)
+			}
+			encode(w, response)
+			return
+
+		case r.Method == http.MethodPost && method == "annotations":
+			var request AnnotationsRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			var query struct {
+				Query string `json:"query"`
+			}
+			if len(request.Annotation) > 0 {
+				if err := json.Unmarshal(request.Annotation, &query); err != nil {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+			}
+
+			response := []Annotation{}
+			for _, imei := range visible(r) {
+				name := strconv.FormatUint(imei, 10)
+				if query.Query != "" && query.Query != name {
+					continue
+				}
+				for _, stored := range srv.history.readings(imei, request.Range.From, request.Range.To) {
+					if !stored.Alarm {
+						continue
+					}
+					response = append(response, Annotation{
+						Annotation: request.Annotation,
+						Time:       stored.ReceivedAt.UnixMilli(),
+						Title:      "Alarm",
+						Text:       fmt.Sprintf("IMEI %s: %s", name, stored.Reading),
+						Tags:       []string{"alarm", name},
+					})
+				}
+			}
+			encode(w, response)
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleAdminLogLevel is an HTTP endpoint at path /admin/loglevel.
+//
+// GET:
+// Retrieve the current logging level. Endpoint responds with 200 and the
+// level.
+//
+// PUT:
+// Set the logging level to one of "debug", "info", "warn", or "error". Endpoint
+// responds with 200 and the new level on success. If the level is invalid, the
+// endpoint responds with a 400.
+func (srv *Server) handleAdminLogLevel() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/admin/loglevel){1}$`)
+	type Request struct {
+		Level string
+	}
+	type Response struct {
+		Level string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 2 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+
+		case http.MethodPut:
+			var request Request
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			level, err := common.ParseLevel(request.Level)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			srv.SetLogLevel(level)
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		response := Response{
+			Level: srv.LogLevel().String(),
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+}
+
+// handleFlags is an HTTP endpoint at path /admin/flags.
+//
+// GET:
+// Retrieve whether each feature flag is enabled. Endpoint responds with 200
+// and the flags.
+//
+// PUT:
+// Enable or disable a feature flag. Endpoint responds with 200 and the flags
+// on success. If the flag is unknown, the endpoint responds with a 400.
+func (srv *Server) handleFlags() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/admin/flags){1}$`)
+	type Request struct {
+		Flag    Flag
+		Enabled bool
+	}
+	type Response struct {
+		Flags map[Flag]bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 2 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+
+		case http.MethodPut:
+			var request Request
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			if err := srv.SetFeature(request.Flag, request.Enabled); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		response := Response{
+			Flags: srv.flags.list(),
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+}
+
+// handleTunables is an HTTP endpoint at path /admin/tunables.
+//
+// GET:
+// Retrieve the Server's tunables, and the most recent changes to them.
+// Endpoint responds with 200 and the tunables.
+//
+// PATCH:
+// Adjust the Server's tunables, applied to connected and connecting Clients
+// alike. Settings absent from the request are left unchanged. Each change is
+// logged. Endpoint responds with 200 and the tunables on success. If a
+// setting is out of range, or a batch size names an exporter that does not
+// export in batches, no setting is changed and the endpoint responds with a
+// 400.
+func (srv *Server) handleTunables() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/admin/tunables){1}$`)
+	type Response struct {
+		Tunables Tunables
+		Changes  []TunableChange
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 2 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+
+		case http.MethodPatch:
+			var request TunablesPatch
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			if err := srv.SetTunables(request); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		response := Response{
+			Tunables: srv.Tunables(),
+			Changes:  srv.TunableChanges(),
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+}
+
+// handleSilences is an HTTP endpoint at path /admin/silences[/:id].
+//
+// GET /admin/silences:
+// Retrieve the silences. Endpoint responds with 200 and the silences.
+//
+// POST /admin/silences:
+// Create a silence. Its ID is assigned by the server, and its Start defaults
+// to now. Endpoint responds with 201 and the silence on success. If the
+// silence ends before it starts, the endpoint responds with a 400.
+//
+// DELETE /admin/silences/:id:
+// Delete the specified silence. Endpoint responds with 204 on success. If the
+// silence does not exist, the endpoint responds with a 404.
+func (srv *Server) handleSilences() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/admin/silences){1}(?:/(\d+))?$`)
+	type Response struct {
+		Silences []Silence
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 3 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && parts[2] == "":
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(Response{Silences: srv.silences.list()}); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		case r.Method == http.MethodPost && parts[2] == "":
+			var request Silence
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			silence, err := srv.silences.add(request, time.Now())
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			if err := json.NewEncoder(w).Encode(silence); err != nil {
+				srv.logError.Printf("failed to handleSilences/Encode\terr = %s\n", err)
+			}
+			return
+
+		case r.Method == http.MethodDelete && parts[2] != "":
+			id, err := strconv.ParseUint(parts[2], 10, 64)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			if err := srv.silences.remove(id); err != nil {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleQuarantine is an HTTP endpoint at path /admin/quarantine[/:imei].
+//
+// GET /admin/quarantine:
+// Retrieve the IMEIs currently quarantined for repeated decode failures.
+// Endpoint responds with 200 and the quarantined IMEIs.
+//
+// DELETE /admin/quarantine/:imei:
+// Lift the quarantine of the IMEI. Endpoint responds with 204 on success. If
+// the IMEI is not quarantined, the endpoint responds with a 404.
+func (srv *Server) handleQuarantine() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/admin/quarantine){1}(/\d{15})?$`)
+	type Response struct {
+		Quarantined []Quarantined
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 3 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodGet && parts[2] == "":
+			w.Header().Set("Content-Type", "application/json")
+			response := Response{
+				Quarantined: srv.Quarantined(),
+			}
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		case r.Method == http.MethodDelete && parts[2] != "":
+			imei, err := strconv.ParseUint(parts[2][1:], 10, 64)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			if !srv.ClearQuarantine(imei) {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleFirmware is an HTTP endpoint at path /admin/firmware[/:imei].
+//
+// GET /admin/firmware:
+// Retrieve the progress of the most recent firmware transfer to each device.
+// Endpoint responds with 200 and the transfers.
+//
+// GET /admin/firmware/:imei:
+// Retrieve the progress of the most recent firmware transfer to the IMEI.
+// Endpoint responds with 200 and the transfer on success. If no transfer to
+// the IMEI exists, the endpoint responds with a 404.
+//
+// POST /admin/firmware/:imei:
+// Start transferring the firmware image in the request body to the IMEI.
+// Endpoint responds with 202 and the transfer on success. If the IMEI is
+// offline, the endpoint responds with a 404. If the IMEI's protocol does not
+// support transfers, or a transfer is already in progress, the endpoint
+// responds with a 409.
+//
+// DELETE /admin/firmware/:imei:
+// Abort the firmware transfer in progress to the IMEI, such as one the device
+// stopped acknowledging. Endpoint responds with 200 and the aborted transfer
+// on success. If no transfer to the IMEI is in progress, the endpoint
+// responds with a 404.
+func (srv *Server) handleFirmware() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/admin/firmware){1}(/\d{15})?$`)
+	type Response struct {
+		Transfer client.Transfer
+	}
+	type ListResponse struct {
+		Transfers []client.Transfer
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 3 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		var imei uint64
+		if parts[2] != "" {
+			var err error
+			imei, err = strconv.ParseUint(parts[2][1:], 10, 64)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+		}
+
+		switch {
+		case r.Method == http.MethodGet && parts[2] == "":
+			w.Header().Set("Content-Type", "application/json")
+			response := ListResponse{
+				Transfers: srv.transfers.List(),
+			}
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		case r.Method == http.MethodGet:
+			transfer, ok := srv.transfers.Get(imei)
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(Response{Transfer: transfer}); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		case r.Method == http.MethodPost && parts[2] != "":
+			image, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxFirmwareSize))
+			if err != nil || len(image) == 0 {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			c, ok := srv.clientMap.Load(imei)
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+
+			transfer, err := c.StartTransfer(image)
+			switch {
+			case errors.Is(err, client.ErrProtocolUnsupported), errors.Is(err, client.ErrTransferInProgress):
+				http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+				return
+			case err != nil:
+				srv.logError.Printf("failed to handleFirmware/StartTransfer\terr = %s\n", err)
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			if err := json.NewEncoder(w).Encode(Response{Transfer: transfer}); err != nil {
+				srv.logError.Printf("failed to handleFirmware/Encode\terr = %s\n", err)
+			}
+			return
+
+		case r.Method == http.MethodDelete && parts[2] != "":
+			transfer, ok := srv.transfers.Abort(imei)
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			srv.logInfo.Printf("[IMEI %d] Firmware Transfer %d Aborted\n", imei, transfer.ID)
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(Response{Transfer: transfer}); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleDrain is an HTTP endpoint at path /admin/drain.
+//
+// GET:
+// Retrieve whether the Server is draining. Endpoint responds with 200 and the
+// drain state.
+//
+// POST:
+// Drain the Server. New connections are refused, and connected clients are
+// closed once they disconnect or the drain timeout passes. Endpoint responds
+// with 202.
+func (srv *Server) handleDrain() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/admin/drain){1}$`)
+	type Response struct {
+		Draining bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 2 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			response := Response{
+				Draining: srv.Draining(),
+			}
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		case http.MethodPost:
+			srv.Drain()
+			w.WriteHeader(http.StatusAccepted)
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleMetrics is an HTTP endpoint at path /metrics.
+//
+// GET:
+// Retrieve the Server's counters and histograms, including the latency of
+// each stage of the reading pipeline, in the OpenMetrics text format.
+// Endpoint responds with 200 and the metrics. As the metrics span every
+// tenant, requests scoped to a tenant respond with a 403; tenants retrieve
+// their own metrics at /tenants/:tenant.
+func (srv *Server) handleMetrics() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/metrics){1}$`)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 2 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		if !scopeOf(r).admin {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", metrics.OpenMetricsContentType)
+			if err := srv.metrics.WriteOpenMetrics(w); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleRuntime is an HTTP endpoint at path /admin/runtime.
+//
+// GET:
+// Retrieve a snapshot of the Server's runtime resource usage and queue
+// depths. Endpoint responds with 200 and the snapshot.
+func (srv *Server) handleRuntime() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/admin/runtime){1}$`)
+	type Response struct {
+		Runtime RuntimeStats
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 2 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			response := Response{
+				Runtime: srv.RuntimeStats(),
+			}
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+			return
+
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	}
+}
+
+// handleDiagnostics is an HTTP endpoint at path /admin/diagnostics.
+//
+// GET:
+// Retrieve a snapshot of the Server's goroutines, by the subsystem that
+// started them, the Holders not yet garbage collected if tracked, its open
+// connections against its identified Clients, the depths of its queues and
+// those of its exporters, and the health of its exporters, to catch leaks and
+// failing sinks in production. Endpoint responds with 200 and the snapshot.
+func (srv *Server) handleDiagnostics() http.HandlerFunc {
+	pathRE := regexp.MustCompile(`^(/admin/diagnostics){1}$`)
+	type Response struct {
+		Diagnostics Diagnostics
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := pathRE.FindStringSubmatch(r.URL.RequestURI())
+		if len(parts) != 2 {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			response := Response{
+				Diagnostics: srv.Diagnostics(),
+			}
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
 			return
 
 		default:
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+const (
+	// idleSweepInterval is the longest interval between sweeps for idle
+	// Clients.
+	idleSweepInterval = time.Second
+
+	// minIdleSweepInterval is the shortest interval between sweeps for idle
+	// Clients, however short the idle eviction period.
+	minIdleSweepInterval = 10 * time.Millisecond
+)
+
+// WithIdleEviction returns a ServerOption function that closes Clients that
+// logged in but sent no readings for after, freeing their connections, and
+// tenant quota, for active devices. Unlike the reading timeout, which any
+// message resets, only readings keep a Client from being evicted.
+func WithIdleEviction(after time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.idleEviction = after
+	}
+}
+
+// evictIdle closes the Clients idle for the idle eviction period, checking
+// several times per period, until done is closed.
+func (srv *Server) evictIdle(done <-chan struct{}) {
+	interval := srv.idleEviction / 4
+	switch {
+	case interval > idleSweepInterval:
+		interval = idleSweepInterval
+	case interval < minIdleSweepInterval:
+		interval = minIdleSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			srv.evictIdleAt(now)
+		}
+	}
+}
+
+// evictIdleAt closes the logged in Clients that sent no readings for the idle
+// eviction period as of now.
+func (srv *Server) evictIdleAt(now time.Time) {
+	srv.clientMap.Range(func(imei uint64, c *client.Client) bool {
+		if c.Protocol() == 0 || now.Sub(c.LastSeen()) < srv.idleEviction {
+			return true
+		}
+		srv.logWarn.Printf("[IMEI %d] No Readings for %s, Evicting Client\n", imei, srv.idleEviction)
+		c.Close(client.CloseIdle)
+		return true
+	})
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxImportSize is the size of the largest import accepted.
+	maxImportSize = 64 << 20
+
+	// maxImportErrors is the number of invalid rows of an import reported.
+	maxImportErrors = 100
+)
+
+// ImportError is an invalid row of an import.
+type ImportError struct {
+	// Line is the line of the row, counting from 1 and including the header
+	// of CSV imports.
+	Line  int
+	Error string
+}
+
+// importColumns are the columns of CSV imports, named after the fields of
+// StoredReading.
+var importColumns = []string{"ReceivedAt", "Temperature", "Altitude", "Latitude", "Longitude", "BatteryLevel"}
+
+// parseImport parses the rows of an import of imei from r, as CSV with a
+// header naming importColumns if isCSV is set, or as JSON lines of
+// StoredReadings otherwise. Each row is validated by validateImport. The
+// readings are retrieved if every row is valid, and the errors of the first
+// maxImportErrors invalid rows otherwise. An error is returned if r fails to
+// be read.
+func (srv *Server) parseImport(imei uint64, r io.Reader, isCSV bool) ([]StoredReading, []ImportError, error) {
+	var (
+		readings []StoredReading
+		invalid  []ImportError
+	)
+	add := func(line int, stored StoredReading, err error) bool {
+		if err == nil {
+			err = srv.validateImport(imei, stored)
+		}
+		if err != nil {
+			invalid = append(invalid, ImportError{Line: line, Error: err.Error()})
+			return len(invalid) < maxImportErrors
+		}
+		readings = append(readings, stored)
+		return true
+	}
+
+	if isCSV {
+		if err := parseImportCSV(r, add); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if err := parseImportJSON(r, add); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, invalid, nil
+	}
+	return readings, nil, nil
+}
+
+// parseImportJSON calls add with each JSON line of r, until add returns
+// false. Blank lines are skipped.
+func parseImportJSON(r io.Reader, add func(line int, stored StoredReading, err error) bool) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var stored StoredReading
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.DisallowUnknownFields()
+		if !add(line, stored, dec.Decode(&stored)) {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to server.parseImportJSON/Scan\terr = %w", err)
+	}
+	return nil
+}
+
+// parseImportCSV calls add with each record of r, until add returns false.
+// The header of r must name each of importColumns, in any order and case.
+func parseImportCSV(r io.Reader, add func(line int, stored StoredReading, err error) bool) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(importColumns)
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		add(1, StoredReading{}, err)
+		return nil
+	}
+	index := make(map[string]int, len(importColumns))
+	for i, name := range header {
+		for _, column := range importColumns {
+			if strings.EqualFold(strings.TrimSpace(name), column) {
+				index[column] = i
+			}
+		}
+	}
+	if len(index) != len(importColumns) {
+		add(1, StoredReading{}, fmt.Errorf("expected header of columns %s", strings.Join(importColumns, ",")))
+		return nil
+	}
+
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			if !add(parseErr.Line, StoredReading{}, parseErr.Err) {
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to server.parseImportCSV/Read\terr = %w", err)
+		}
+		line, _ := cr.FieldPos(0)
+		stored, err := parseImportRecord(record, index)
+		if !add(line, stored, err) {
+			return nil
+		}
+	}
+}
+
+// parseImportRecord parses the CSV record, whose columns are at index.
+func parseImportRecord(record []string, index map[string]int) (StoredReading, error) {
+	var stored StoredReading
+	receivedAt, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(record[index["ReceivedAt"]]))
+	if err != nil {
+		return stored, fmt.Errorf("invalid ReceivedAt, err = %w", err)
+	}
+	stored.ReceivedAt = receivedAt
+	for _, field := range []struct {
+		column string
+		value  *float64
+	}{
+		{column: "Temperature", value: &stored.Temperature},
+		{column: "Altitude", value: &stored.Altitude},
+		{column: "Latitude", value: &stored.Latitude},
+		{column: "Longitude", value: &stored.Longitude},
+		{column: "BatteryLevel", value: &stored.BatteryLevel},
+	} {
+		v, err := strconv.ParseFloat(strings.TrimSpace(record[index[field.column]]), 64)
+		if err != nil {
+			return stored, fmt.Errorf("invalid %s, err = %w", field.column, err)
+		}
+		*field.value = v
+	}
+	return stored, nil
+}
+
+// validateImport returns an error unless stored, a reading of imei to be
+// imported, was received in the past, and is within the valid ranges of
+// live readings, including those of imei's DeviceOverrides.
+func (srv *Server) validateImport(imei uint64, stored StoredReading) error {
+	switch {
+	case stored.ReceivedAt.IsZero():
+		return errors.New("missing ReceivedAt")
+	case stored.ReceivedAt.After(time.Now()):
+		return fmt.Errorf("future ReceivedAt, value = %s", stored.ReceivedAt.Format(time.RFC3339Nano))
+	}
+	if err := stored.Reading.Validate(); err != nil {
+		return err
+	}
+	return srv.overrides.validate(imei, stored.Reading)
+}
+
+// importing reports whether the Server has a backend to import readings into.
+func (srv *Server) importing() bool {
+	return srv.history != nil || len(srv.backfills) > 0
+}
+
+// importReadings backfills readings of imei into the reading history and the
+// Stores of the Server's plugins, oldest first. Exporters, alerts, and the
+// odometer are not passed them, as they act on readings as they are received.
+func (srv *Server) importReadings(imei uint64, readings []StoredReading) {
+	sort.SliceStable(readings, func(i, j int) bool {
+		return readings[i].ReceivedAt.Before(readings[j].ReceivedAt)
+	})
+	if srv.history != nil {
+		srv.history.backfill(imei, readings)
+	}
+	for _, s := range srv.backfills {
+		for _, stored := range readings {
+			s.StoreReading(imei, stored.ReceivedAt, stored.Reading)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+// Listener names a way devices connect to the Server. Clients are tagged with
+// the Listener they connected through, and may be configured per Listener.
+type Listener string
+
+const (
+	// ListenerTCP is the Server's TCP listener.
+	ListenerTCP Listener = "tcp"
+
+	// ListenerWebSocket is the http server's WebSocket upgrade endpoint.
+	ListenerWebSocket Listener = "websocket"
+
+	// ListenerCoAP is the Server's CoAP socket.
+	ListenerCoAP Listener = "coap"
+
+	// ListenerUDP is the Server's UDP ingest socket.
+	ListenerUDP Listener = "udp"
+
+	// ListenerLwM2M is the LwM2M registration interface of the Server's CoAP
+	// socket.
+	ListenerLwM2M Listener = "lwm2m"
+)
+
+// WithListenerClientOptions returns a ServerOption function that configures
+// the Clients connecting through l with options, in addition to, and after,
+// those of every Client. For example, client.WithTunables sets stricter
+// timeouts for Clients of a public listener alone, and client.WithLogger
+// separates their logs.
+func WithListenerClientOptions(l Listener, options ...client.ClientOption) ServerOption {
+	return func(srv *Server) {
+		srv.listenerOptions[l] = append(srv.listenerOptions[l], options...)
+	}
+}
+
+// clientOptionsOf retrieves the ClientOptions of Clients connecting through
+// l, which tag each Client with l.
+func (srv *Server) clientOptionsOf(l Listener) []client.ClientOption {
+	options := make([]client.ClientOption, 0, len(srv.clientOptions)+1+len(srv.listenerOptions[l]))
+	options = append(options, srv.clientOptions...)
+	options = append(options, client.WithListener(string(l)))
+	return append(options, srv.listenerOptions[l]...)
+}
+
+// listen binds the Server's TCP listeners on port. When reusePort is set,
+// each accept loop is given its own SO_REUSEPORT socket, so that the kernel
+// balances incoming connections across them. Otherwise, the accept loops
+// share a single socket.
+func (srv *Server) listen(port int) error {
+	if !srv.reusePort {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{
+			Port: port,
+		})
+		if err != nil {
+			return err
+		}
+		srv.listeners = []*net.TCPListener{l}
+		return nil
+	}
+
+	lc := net.ListenConfig{Control: reusePortControl}
+	for i := 0; i < srv.acceptors; i++ {
+		l, err := lc.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			srv.closeListeners()
+			return err
+		}
+		srv.listeners = append(srv.listeners, l.(*net.TCPListener))
+	}
+	return nil
+}
+
+// closeListeners closes the Server's TCP listeners, and its CoAP and UDP
+// ingest sockets. WebSocket upgrades are no longer taken.
+func (srv *Server) closeListeners() {
+	for _, l := range srv.listeners {
+		l.Close()
+	}
+	srv.upgrades.close()
+	if srv.coapConn != nil {
+		srv.coapConn.Close()
+	}
+	if srv.udpConn != nil {
+		srv.udpConn.Close()
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+// liveBuffer is the number of readings buffered for each subscriber to live
+// readings. Readings beyond it are dropped until the subscriber catches up.
+const liveBuffer = 64
+
+// LiveReading is a reading of an IMEI, as it is received.
+type LiveReading struct {
+	IMEI       uint64
+	ReceivedAt time.Time
+	Reading    client.Reading
+}
+
+// liveReadings fans the readings of every Client out to subscribers, such as
+// http requests tailing readings. It satisfies the client.ReadingStore
+// interface.
+type liveReadings struct {
+	mu   sync.RWMutex
+	subs map[*liveSubscriber]struct{}
+
+	// done is closed once subscribers should stop, as the Server is shutting
+	// down.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// liveSubscriber receives the readings of the IMEIs accepted by filter.
+type liveSubscriber struct {
+	filter   func(imei uint64) bool
+	readings chan LiveReading
+}
+
+func newLiveReadings() *liveReadings {
+	return &liveReadings{
+		subs: make(map[*liveSubscriber]struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// StoreReading sends reading to each subscriber accepting imei, without
+// blocking.
+func (l *liveReadings) StoreReading(imei uint64, receivedAt time.Time, reading client.Reading) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for sub := range l.subs {
+		if !sub.filter(imei) {
+			continue
+		}
+		select {
+		case sub.readings <- LiveReading{IMEI: imei, ReceivedAt: receivedAt, Reading: reading}:
+		default:
+		}
+	}
+}
+
+// subscribe retrieves a channel of the readings of the IMEIs accepted by
+// filter, and a function ending the subscription.
+func (l *liveReadings) subscribe(filter func(imei uint64) bool) (<-chan LiveReading, func()) {
+	sub := &liveSubscriber{filter: filter, readings: make(chan LiveReading, liveBuffer)}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subs[sub] = struct{}{}
+	return sub.readings, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.subs, sub)
+	}
+}
+
+// close signals subscribers to stop.
+func (l *liveReadings) close() {
+	l.closeOnce.Do(func() { close(l.done) })
+}
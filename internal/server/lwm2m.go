@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/lwm2m"
+)
+
+const (
+	// lwm2mRegistrationPath is the path of the LwM2M registration interface.
+	// Devices register by posting to /rd?ep=<endpoint>, and update or
+	// deregister at the location returned, /rd/<id>.
+	lwm2mRegistrationPath = "rd"
+
+	// lwm2mSendPath is the path devices post their resources to with the
+	// LwM2M Send operation.
+	lwm2mSendPath = "dp"
+)
+
+// lwm2mRegistrations is the set of registered LwM2M devices. The Send
+// operation does not name the device sending it, so devices are identified
+// by the address they last registered or updated their registration from.
+type lwm2mRegistrations struct {
+	mu     sync.Mutex
+	nextID int
+	byID   map[string]lwm2mRegistration
+	byAddr map[string]string
+}
+
+// lwm2mRegistration is the registration of an LwM2M device.
+type lwm2mRegistration struct {
+	imei uint64
+	addr string
+}
+
+func newLwM2MRegistrations() *lwm2mRegistrations {
+	return &lwm2mRegistrations{
+		byID:   make(map[string]lwm2mRegistration),
+		byAddr: make(map[string]string),
+	}
+}
+
+// register registers imei from addr, replacing any previous registration of
+// imei, and retrieves the registration's ID.
+func (r *lwm2mRegistrations) register(imei uint64, addr string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, reg := range r.byID {
+		if reg.imei == imei {
+			r.remove(id)
+		}
+	}
+	r.nextID++
+	id := strconv.Itoa(r.nextID)
+	r.byID[id] = lwm2mRegistration{imei: imei, addr: addr}
+	r.byAddr[addr] = id
+	return id
+}
+
+// update records that the device registered as id is now at addr, and
+// reports whether id is registered.
+func (r *lwm2mRegistrations) update(id, addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.byID[id]
+	if !ok {
+		return false
+	}
+	if r.byAddr[reg.addr] == id {
+		delete(r.byAddr, reg.addr)
+	}
+	reg.addr = addr
+	r.byID[id] = reg
+	r.byAddr[addr] = id
+	return true
+}
+
+// deregister removes the registration id, and retrieves the IMEI it
+// registered. It reports whether id was registered.
+func (r *lwm2mRegistrations) deregister(id string) (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.byID[id]
+	if ok {
+		r.remove(id)
+	}
+	return reg.imei, ok
+}
+
+// remove removes the registration id. The caller must hold r.mu.
+func (r *lwm2mRegistrations) remove(id string) {
+	if addr := r.byID[id].addr; r.byAddr[addr] == id {
+		delete(r.byAddr, addr)
+	}
+	delete(r.byID, id)
+}
+
+// lookup retrieves the IMEI registered from addr, and reports whether one
+// is.
+func (r *lwm2mRegistrations) lookup(addr string) (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, ok := r.byAddr[addr]
+	if !ok {
+		return 0, false
+	}
+	return r.byID[id].imei, true
+}
+
+// lwm2mRegistration handles m, a request to the registration interface from
+// addr. A device registering is admitted as a datagram Client, and one
+// deregistering is disconnected.
+func (srv *Server) lwm2mRegistration(addr *net.UDPAddr, m coapMessage) coapMessage {
+	switch {
+	case len(m.path) == 1 && m.code == coapPost:
+		var endpoint string
+		for _, param := range m.query {
+			if v, ok := strings.CutPrefix(param, "ep="); ok {
+				endpoint = v
+			}
+		}
+		id, err := lwm2m.EndpointIMEI(endpoint)
+		if err != nil {
+			return coapReply(coapBadRequest, "invalid endpoint")
+		}
+		if _, err := srv.datagramSession(id, addr, ListenerLwM2M); err != nil {
+			return coapReply(coapAdmitFailure(err))
+		}
+		reply := coapReply(coapCreated, "")
+		reply.location = []string{lwm2mRegistrationPath, srv.lwm2m.register(id, addr.String())}
+		return reply
+	case len(m.path) == 2 && m.code == coapPost:
+		if !srv.lwm2m.update(m.path[1], addr.String()) {
+			return coapReply(coapNotFound, "")
+		}
+		return coapReply(coapChanged, "")
+	case len(m.path) == 2 && m.code == coapDelete:
+		imei, ok := srv.lwm2m.deregister(m.path[1])
+		if !ok {
+			return coapReply(coapNotFound, "")
+		}
+		srv.closeDatagram(imei, client.ClosePeerReset)
+		return coapReply(coapDeleted, "")
+	case len(m.path) <= 2:
+		return coapReply(coapMethodNotAllowed, "")
+	default:
+		return coapReply(coapNotFound, "")
+	}
+}
+
+// lwm2mSend handles m, an LwM2M Send operation from addr, mapping the
+// resources it reports onto the device's last reading to process a new one.
+// It retrieves the response code, along with a diagnostic message for
+// failures.
+func (srv *Server) lwm2mSend(ctx context.Context, addr *net.UDPAddr, m coapMessage) (byte, string) {
+	if len(m.path) != 1 {
+		return coapNotFound, ""
+	}
+	if m.code != coapPost {
+		return coapMethodNotAllowed, ""
+	}
+	id, ok := srv.lwm2m.lookup(addr.String())
+	if !ok {
+		return coapForbidden, "not registered"
+	}
+	if m.hasContentFormat && m.contentFormat != lwm2m.ContentFormatSenMLJSON {
+		return coapUnsupportedFormat, ""
+	}
+	records, err := lwm2m.ParseSenML(m.payload)
+	if err != nil {
+		return coapBadRequest, "invalid senml"
+	}
+
+	ds, err := srv.datagramSession(id, addr, ListenerLwM2M)
+	if err != nil {
+		return coapAdmitFailure(err)
+	}
+	reading := ds.client.LastReading()
+	if _, err := lwm2m.Apply(&reading, records); errors.Is(err, lwm2m.ErrNoResources) {
+		return coapBadRequest, "no mapped resources"
+	}
+	b, err := reading.Encode()
+	if err != nil {
+		return coapUnavailable, ""
+	}
+	return srv.coapProcess(ctx, ds, b)
+}
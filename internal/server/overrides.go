@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/common"
+)
+
+// ErrInvalidOverrides indicates DeviceOverrides name an unknown AlertRule or
+// reading field, or have an invalid threshold or range.
+var ErrInvalidOverrides = errors.New("invalid device overrides")
+
+// DeviceOverrides are the settings of an IMEI taking precedence over those of
+// the fleet.
+type DeviceOverrides struct {
+	// Thresholds replace the Threshold, and ClearThreshold, of AlertRules
+	// for the IMEI, by rule ID.
+	Thresholds map[uint64]ThresholdOverride `json:",omitempty"`
+
+	// Ranges narrow the valid range of reading fields for the IMEI, by field
+	// name, one of "Temperature", "Altitude", "Latitude", "Longitude", or
+	// "BatteryLevel". Readings outside them are rejected as if they failed to
+	// decode.
+	Ranges map[string]ValidRange `json:",omitempty"`
+}
+
+// ThresholdOverride replaces the thresholds of an AlertRule. A nil
+// ClearThreshold resolves Alerts at Threshold.
+type ThresholdOverride struct {
+	Threshold      float64
+	ClearThreshold *float64 `json:",omitempty"`
+}
+
+// apply retrieves rule with its thresholds replaced by o.
+func (o ThresholdOverride) apply(rule AlertRule) AlertRule {
+	rule.Threshold, rule.ClearThreshold = o.Threshold, o.ClearThreshold
+	return rule
+}
+
+// ValidRange is the valid range of a reading field, inclusive.
+type ValidRange struct {
+	Min float64
+	Max float64
+}
+
+// overrides is a concurrent safe set of DeviceOverrides, by IMEI.
+type overrides struct {
+	mu sync.RWMutex
+	m  map[uint64]DeviceOverrides
+
+	// path is the file overrides are saved to on each change. Empty keeps
+	// overrides in memory only.
+	path string
+}
+
+func newOverrides() *overrides {
+	return &overrides{m: make(map[uint64]DeviceOverrides)}
+}
+
+// get retrieves the overrides of imei, and reports whether it has any.
+func (o *overrides) get(imei uint64) (DeviceOverrides, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	overrides, ok := o.m[imei]
+	return overrides, ok
+}
+
+// set replaces the overrides of imei. Empty overrides delete them.
+func (o *overrides) set(imei uint64, overrides DeviceOverrides) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	prev, ok := o.m[imei]
+	if len(overrides.Thresholds) == 0 && len(overrides.Ranges) == 0 {
+		delete(o.m, imei)
+	} else {
+		o.m[imei] = overrides
+	}
+	if err := o.save(); err != nil {
+		delete(o.m, imei)
+		if ok {
+			o.m[imei] = prev
+		}
+		return err
+	}
+	return nil
+}
+
+// erase deletes the overrides of imei, and reports whether it had any.
+func (o *overrides) erase(imei uint64) (bool, error) {
+	if _, ok := o.get(imei); !ok {
+		return false, nil
+	}
+	if err := o.set(imei, DeviceOverrides{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// threshold retrieves the override of imei for the thresholds of the
+// AlertRule with id, and reports whether there is one.
+func (o *overrides) threshold(imei, id uint64) (ThresholdOverride, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	override, ok := o.m[imei].Thresholds[id]
+	return override, ok
+}
+
+// validate satisfies the client.ReadingValidator interface, returning a
+// client.ErrInvalidRange if a field of reading is outside its range for imei.
+func (o *overrides) validate(imei uint64, reading client.Reading) error {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	for field, r := range o.m[imei].Ranges {
+		if value := alertFields[field](reading); value < r.Min || value > r.Max {
+			return client.ErrInvalidRange{Field: field, Value: value}
+		}
+	}
+	return nil
+}
+
+// save writes the overrides of every IMEI to the Server's device overrides
+// file, replacing it atomically. o.mu must be held.
+func (o *overrides) save() error {
+	if o.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(o.m)
+	if err != nil {
+		return fmt.Errorf("failed to server.overrides.save/Marshal\terr = %w", err)
+	}
+	if err := common.WriteFileAtomic(o.path, b); err != nil {
+		return fmt.Errorf("failed to server.overrides.save\terr = %w", err)
+	}
+	return nil
+}
+
+// load reads the overrides saved to the file at path, and saves subsequent
+// changes to it. A missing file holds no overrides.
+func (o *overrides) load(path string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.path = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to server.overrides.load/ReadFile\terr = %w", err)
+	}
+	if err := json.Unmarshal(b, &o.m); err != nil {
+		return fmt.Errorf("failed to server.overrides.load/Unmarshal\tpath = %s err = %w", path, err)
+	}
+	return nil
+}
+
+// WithDeviceOverridesFile returns a ServerOption function that configures the
+// Server to load the DeviceOverrides of IMEIs from the file at path, and to
+// save them to it whenever they change, so that they survive restarts. A
+// missing file holds no overrides.
+func WithDeviceOverridesFile(path string) ServerOption {
+	return func(srv *Server) {
+		srv.overridesFile = path
+	}
+}
+
+// setOverrides replaces the DeviceOverrides of imei, owned by tenant, after
+// validating them: each threshold must override an AlertRule applying to
+// tenant, consistently with its Op, and each range must be of a reading field
+// and not be inverted. ErrInvalidOverrides is returned otherwise.
+func (srv *Server) setOverrides(imei uint64, tenant string, overrides DeviceOverrides) error {
+	for id, override := range overrides.Thresholds {
+		rule, ok := srv.alerts.rule(id)
+		if !ok || !rule.applies(tenant) {
+			return fmt.Errorf("%w, rule = %d", ErrInvalidOverrides, id)
+		}
+		if err := override.apply(rule).validate(); err != nil {
+			return fmt.Errorf("%w, rule = %d err = %s", ErrInvalidOverrides, id, err)
+		}
+	}
+	for field, r := range overrides.Ranges {
+		if _, ok := alertFields[field]; !ok || r.Min > r.Max {
+			return fmt.Errorf("%w, field = %q", ErrInvalidOverrides, field)
+		}
+	}
+	return srv.overrides.set(imei, overrides)
+}
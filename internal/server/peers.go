@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// headerForwarded marks http requests forwarded by a peer, which are
+	// answered from the node's own devices rather than forwarded again.
+	headerForwarded = "X-Thermomatic-Forwarded"
+
+	// peerTimeout is how long a peer may take to answer a forwarded request.
+	peerTimeout = 2 * time.Second
+
+	// maxPeerResponse is the size of the largest peer response relayed.
+	maxPeerResponse = 1 << 20
+)
+
+// WithPeers returns a ServerOption function that configures the Server with
+// the base URLs of the http servers of the other nodes of a multi-instance
+// deployment, e.g. "http://10.0.0.2:1338". Requests for the reading of a
+// device not connected to the Server are forwarded to its peers, and answered
+// by whichever node the device is connected to. Peers must share the
+// Server's tokens, as requests are forwarded with their Authorization header.
+func WithPeers(peers ...string) ServerOption {
+	return func(srv *Server) {
+		for _, peer := range peers {
+			srv.peers = append(srv.peers, strings.TrimSuffix(peer, "/"))
+		}
+	}
+}
+
+// peerResponse is the response of a peer to a forwarded request.
+type peerResponse struct {
+	peer        string
+	status      int
+	contentType string
+	body        []byte
+	err         error
+}
+
+// forwardToPeers forwards r to each of the Server's peers concurrently, and
+// writes the first response of status ok to w, reporting whether there was
+// one. Requests forwarded by a peer are not forwarded again, so that peers
+// do not forward in circles.
+func (srv *Server) forwardToPeers(w http.ResponseWriter, r *http.Request, ok int) bool {
+	if len(srv.peers) == 0 || r.Header.Get(headerForwarded) != "" {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), peerTimeout)
+	defer cancel()
+	responses := make(chan peerResponse, len(srv.peers))
+	for _, peer := range srv.peers {
+		go func(peer string) {
+			responses <- srv.forward(ctx, r, peer)
+		}(peer)
+	}
+
+	for range srv.peers {
+		response := <-responses
+		if response.err != nil {
+			srv.logWarn.Printf("Failed to Forward Request\tpeer = %s path = %s err = %s\n", response.peer, r.URL.Path, response.err)
+			continue
+		}
+		if response.status != ok {
+			continue
+		}
+		if response.contentType != "" {
+			w.Header().Set("Content-Type", response.contentType)
+		}
+		w.WriteHeader(response.status)
+		w.Write(response.body)
+		return true
+	}
+	return false
+}
+
+// forward sends r to peer, marked as forwarded, and retrieves its response.
+func (srv *Server) forward(ctx context.Context, r *http.Request, peer string) peerResponse {
+	response := peerResponse{peer: peer}
+	req, err := http.NewRequestWithContext(ctx, r.Method, peer+r.URL.RequestURI(), nil)
+	if err != nil {
+		response.err = fmt.Errorf("failed to server.forward/NewRequest\terr = %w", err)
+		return response
+	}
+	req.Header.Set(headerForwarded, "1")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := srv.peerClient.Do(req)
+	if err != nil {
+		response.err = fmt.Errorf("failed to server.forward/Do\terr = %w", err)
+		return response
+	}
+	defer resp.Body.Close()
+	response.status = resp.StatusCode
+	response.contentType = resp.Header.Get("Content-Type")
+	if response.body, err = io.ReadAll(io.LimitReader(resp.Body, maxPeerResponse)); err != nil {
+		response.err = fmt.Errorf("failed to server.forward/ReadAll\terr = %w", err)
+	}
+	return response
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+// pluginConfig names a registered backend, and the configuration it is
+// initialized with.
+type pluginConfig struct {
+	name   string
+	config string
+
+	// dryRun is set for exporters logging what they would send rather than
+	// sending it.
+	dryRun bool
+
+	// anonymize, if non-nil, is how exporters anonymize readings.
+	anonymize *plugin.Anonymization
+
+	// critical, if positive, is how long an exporter may be down before the
+	// Server reports it is not ready.
+	critical time.Duration
+}
+
+// errInvalidAnonymization indicates an anonymized exporter is configured
+// without a key, or with a negative precision.
+var errInvalidAnonymization = errors.New("anonymization requires a key and a non-negative precision")
+
+// WithStore returns a ServerOption function that stores readings in the
+// plugin.Store registered under name, initialized with config. New fails if
+// no Store is registered under name.
+func WithStore(name, config string) ServerOption {
+	return func(srv *Server) {
+		srv.storeConfigs = append(srv.storeConfigs, pluginConfig{name: name, config: config})
+	}
+}
+
+// WithExporter returns a ServerOption function that exports readings with the
+// plugin.Exporter registered under name, initialized with config. New fails
+// if no Exporter is registered under name.
+func WithExporter(name, config string) ServerOption {
+	return func(srv *Server) {
+		srv.exporterConfigs = append(srv.exporterConfigs, pluginConfig{name: name, config: config})
+	}
+}
+
+// WithExporterDryRun returns a ServerOption function that initializes the
+// plugin.Exporter registered under name with config, as WithExporter does,
+// but in dry run mode: readings are serialized as usual, and what would be
+// sent is logged at the info level without contacting the external system,
+// so that new configurations may be validated safely in production.
+func WithExporterDryRun(name, config string) ServerOption {
+	return func(srv *Server) {
+		srv.exporterConfigs = append(srv.exporterConfigs, pluginConfig{name: name, config: config, dryRun: true})
+	}
+}
+
+// WithExporterAnonymized returns a ServerOption function that initializes the
+// plugin.Exporter registered under name with config, as WithExporter does,
+// but anonymizing readings: IMEIs are replaced with pseudonyms derived with
+// key, and latitudes and longitudes are rounded to precision decimal places,
+// so that the exported dataset may be shared with analysts. New fails if key
+// is empty or precision is negative.
+func WithExporterAnonymized(name, config string, key []byte, precision int) ServerOption {
+	return func(srv *Server) {
+		srv.exporterConfigs = append(srv.exporterConfigs, pluginConfig{
+			name:      name,
+			config:    config,
+			anonymize: &plugin.Anonymization{Key: key, Precision: precision},
+		})
+	}
+}
+
+// WithCriticalExporter returns a ServerOption function that initializes the
+// plugin.Exporter registered under name with config, as WithExporter does,
+// but as a critical sink: while the exporter has failed to send readings for
+// longer than downFor, the Server reports it is not ready, so that traffic is
+// routed to nodes able to export. Exporters not reporting their health are
+// never considered down.
+func WithCriticalExporter(name, config string, downFor time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.exporterConfigs = append(srv.exporterConfigs, pluginConfig{name: name, config: config, critical: downFor})
+	}
+}
+
+// WithAuthenticator returns a ServerOption function that authenticates the
+// bearer tokens of http requests with the plugin.Authenticator registered
+// under name, initialized with config, when they are not one of the Server's
+// own tokens. New fails if no Authenticator is registered under name.
+func WithAuthenticator(name, config string) ServerOption {
+	return func(srv *Server) {
+		srv.authenticatorConfigs = append(srv.authenticatorConfigs, pluginConfig{name: name, config: config})
+	}
+}
+
+// loadPlugins initializes the Server's stores, exporters, authenticators, and
+// geocoder, and starts its exporters and geocoder. Plugins initialized before a
+// failure are closed by release.
+func (srv *Server) loadPlugins() error {
+	for _, pc := range srv.storeConfigs {
+		s, err := plugin.NewStore(pc.name, pc.config)
+		if err != nil {
+			return err
+		}
+		srv.stores = append(srv.stores, s)
+		srv.storeNames = append(srv.storeNames, "store:"+pc.name)
+		srv.backfills = append(srv.backfills, s)
+		srv.clientOptions = append(srv.clientOptions, client.WithReadingStore(s))
+	}
+	for _, pc := range srv.exporterConfigs {
+		var options plugin.ExporterOptions
+		if pc.dryRun {
+			options.DryRun = srv.logInfo
+		}
+		if a := pc.anonymize; a != nil {
+			if len(a.Key) == 0 || a.Precision < 0 {
+				return fmt.Errorf("failed to server.loadPlugins\tname = %s err = %w", pc.name, errInvalidAnonymization)
+			}
+			options.Anonymize = a
+		}
+		e, err := plugin.NewExporter(pc.name, pc.config, options)
+		if err != nil {
+			return err
+		}
+		srv.stores = append(srv.stores, e)
+		srv.storeNames = append(srv.storeNames, "exporter:"+pc.name)
+		if pc.critical > 0 {
+			srv.criticalExporters["exporter:"+pc.name] = pc.critical
+		}
+		srv.clientOptions = append(
+			srv.clientOptions,
+			client.WithReadingStore(flaggedStore{Store: e, flags: srv.flags, flag: FlagExporters}))
+		go func() {
+			if err := e.Run(); err != nil {
+				srv.logError.Println(err)
+			}
+		}()
+	}
+	for _, pc := range srv.authenticatorConfigs {
+		a, err := plugin.NewAuthenticator(pc.name, pc.config)
+		if err != nil {
+			return err
+		}
+		srv.tenants.authenticators = append(srv.tenants.authenticators, a)
+	}
+	if pc := srv.geocoderConfig; pc != nil {
+		g, err := plugin.NewGeocoder(pc.name, pc.config)
+		if err != nil {
+			return err
+		}
+		srv.geocoding = newGeocoding(g, srv.logError)
+		srv.clientOptions = append(srv.clientOptions, client.WithReadingStore(srv.geocoding))
+		go srv.geocoding.Run()
+	}
+	return nil
+}
+
+// ExporterHealth retrieves the health of each exporter reporting it, named
+// "exporter:<name>".
+func (srv *Server) ExporterHealth() map[string]plugin.Health {
+	health := make(map[string]plugin.Health)
+	for i, s := range srv.stores {
+		if r, ok := s.(plugin.HealthReporter); ok {
+			health[srv.storeNames[i]] = r.Health()
+		}
+	}
+	return health
+}
+
+// downExporters retrieves the names of the critical exporters of health down
+// for longer than they may be as of now, ordered by name.
+func (srv *Server) downExporters(now time.Time, health map[string]plugin.Health) []string {
+	var down []string
+	for name, downFor := range srv.criticalExporters {
+		if h, ok := health[name]; ok && h.Down(now, downFor) {
+			down = append(down, name)
+		}
+	}
+	sort.Strings(down)
+	return down
+}
+
+// closePlugins closes the Server's stores, exporters, and geocoder.
+func (srv *Server) closePlugins() {
+	if srv.geocoding != nil {
+		srv.geocoding.Close()
+	}
+	for _, s := range srv.stores {
+		if err := s.Close(); err != nil {
+			srv.logError.Println(err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"syscall"
+	"time"
+)
+
+// pollerEvents are the epoll events connections are registered for. Each
+// registration is one-shot, so that a connection is handed to a single
+// worker until it is re-armed.
+const pollerEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// poller waits for reactor connections to become readable using epoll.
+type poller struct {
+	fd int
+}
+
+func newPoller() (*poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &poller{fd: fd}, nil
+}
+
+// add registers rc with the poller.
+func (p *poller) add(rc *reactorConn) error {
+	return p.ctl(rc, syscall.EPOLL_CTL_ADD)
+}
+
+// rearm re-enables rc's one-shot registration.
+func (p *poller) rearm(rc *reactorConn) error {
+	return p.ctl(rc, syscall.EPOLL_CTL_MOD)
+}
+
+// remove deregisters rc. Errors are ignored, as the kernel deregisters closed
+// connections itself.
+func (p *poller) remove(rc *reactorConn) {
+	p.ctl(rc, syscall.EPOLL_CTL_DEL)
+}
+
+// ctl applies op to rc's registration. The file descriptor is only used
+// within Control, so that it cannot be closed and reused by another
+// connection meanwhile. rc is identified by its ID rather than its file
+// descriptor for the same reason.
+func (p *poller) ctl(rc *reactorConn, op int) error {
+	var ctlErr error
+	err := rc.raw.Control(func(fd uintptr) {
+		ctlErr = syscall.EpollCtl(p.fd, op, int(fd), &syscall.EpollEvent{
+			Events: pollerEvents,
+			Fd:     int32(rc.id),
+			Pad:    int32(rc.id >> 32),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return ctlErr
+}
+
+// wait waits up to timeout for registered connections to become readable,
+// calling f with the ID of each.
+func (p *poller) wait(timeout time.Duration, f func(id uint64)) error {
+	var events [128]syscall.EpollEvent
+	n, err := syscall.EpollWait(p.fd, events[:], int(timeout/time.Millisecond))
+	if err == syscall.EINTR {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, event := range events[:n] {
+		f(uint64(uint32(event.Fd)) | uint64(uint32(event.Pad))<<32)
+	}
+	return nil
+}
+
+// close releases the poller.
+func (p *poller) close() error {
+	return syscall.Close(p.fd)
+}
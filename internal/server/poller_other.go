@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// poller is unavailable, as reactors are only supported on Linux.
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, errors.New("reactors are only supported on linux")
+}
+
+func (p *poller) add(rc *reactorConn) error {
+	return errors.New("reactors are only supported on linux")
+}
+
+func (p *poller) rearm(rc *reactorConn) error {
+	return errors.New("reactors are only supported on linux")
+}
+
+func (p *poller) remove(rc *reactorConn) {}
+
+func (p *poller) wait(timeout time.Duration, f func(id uint64)) error {
+	return errors.New("reactors are only supported on linux")
+}
+
+func (p *poller) close() error {
+	return nil
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/common"
+)
+
+// Presence is whether an IMEI is connected, and when it was last seen.
+type Presence struct {
+	IMEI   uint64
+	Online bool
+
+	// Tenant is the tenant owning the IMEI, if any.
+	Tenant string `json:",omitempty"`
+
+	// LastSeen denotes when the IMEI last sent a reading, or connected if it
+	// has not sent one since.
+	LastSeen time.Time
+
+	// OfflineSince denotes when the IMEI disconnected, and is nil while it is
+	// online.
+	OfflineSince *time.Time `json:",omitempty"`
+
+	// CloseReason is why the IMEI last disconnected.
+	CloseReason client.CloseReason `json:",omitempty"`
+
+	// Place is the name of the place at the IMEI's last known position, if
+	// the Server has a geocoder.
+	Place string `json:",omitempty"`
+
+	// Flapping is set while the IMEI is repeatedly going offline and back
+	// online, and changes of its Presence are withheld.
+	Flapping bool `json:",omitempty"`
+}
+
+// presence is a concurrent safe set of Presence records, kept for every IMEI
+// that has connected. Records of online IMEIs are completed from their
+// Clients when retrieved.
+//
+// An IMEI whose connection drops is only recorded offline once the grace
+// period passes without it reconnecting. Each change of an IMEI's Presence is
+// passed to notify, unless the IMEI is flapping: once it has gone offline
+// flapLimit times within flapWindow, changes are withheld until it has not
+// gone offline for flapWindow, at which point its settled Presence is passed
+// to notify if it differs from the last one notified. Changes of IMEIs that
+// are silenced are withheld, and the next change that differs from the last
+// one notified is passed to notify.
+type presence struct {
+	m *common.SyncMap[uint64, Presence]
+
+	grace      time.Duration
+	flapLimit  int
+	flapWindow time.Duration
+	notify     func(Presence)
+	silenced   func(imei uint64, tenant string, t time.Time) bool
+
+	mu     sync.Mutex
+	states map[uint64]*presenceState
+}
+
+// presenceState is the offline detection and flap damping state of an IMEI.
+type presenceState struct {
+	// pending is the timer recording the IMEI offline with pendingRecord once
+	// the grace period passes, and is nil unless its connection dropped
+	// within the period.
+	pending       *time.Timer
+	pendingRecord Presence
+
+	// offlines are the times the IMEI was recorded offline within the flap
+	// window.
+	offlines []time.Time
+
+	// settle is the timer ending the IMEI's damping, and is nil unless it is
+	// flapping.
+	settle *time.Timer
+
+	notified bool
+	online   bool
+}
+
+func newPresence() *presence {
+	return &presence{
+		m:        common.NewSyncMap[uint64, Presence](),
+		notify:   func(Presence) {},
+		silenced: func(uint64, string, time.Time) bool { return false },
+		states:   make(map[uint64]*presenceState),
+	}
+}
+
+// state retrieves the state of imei, creating it if necessary. The caller
+// must hold p.mu.
+func (p *presence) state(imei uint64) *presenceState {
+	st, ok := p.states[imei]
+	if !ok {
+		st = new(presenceState)
+		p.states[imei] = st
+	}
+	return st
+}
+
+// online records that c has connected. If c's IMEI reconnected within the
+// grace period, it is as if it never went offline.
+func (p *presence) online(c *client.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := p.state(c.IMEI())
+	reconnected := st.pending != nil
+	if reconnected {
+		st.pending.Stop()
+		st.pending = nil
+	}
+
+	record, _ := p.m.Load(c.IMEI())
+	record.IMEI = c.IMEI()
+	record.Tenant = c.Tenant()
+	record.Online = true
+	record.LastSeen = c.LastSeen()
+	record.OfflineSince = nil
+	p.m.Store(c.IMEI(), record)
+	if !reconnected {
+		p.changed(st, record)
+	}
+}
+
+// offline records that c has disconnected, and why, once the grace period
+// passes.
+func (p *presence) offline(c *client.Client) {
+	now := time.Now()
+	record := Presence{
+		IMEI:         c.IMEI(),
+		Tenant:       c.Tenant(),
+		LastSeen:     c.LastSeen(),
+		OfflineSince: &now,
+		CloseReason:  c.CloseReason(),
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := p.state(c.IMEI())
+	if p.grace <= 0 {
+		p.commit(st, record)
+		return
+	}
+
+	// The record remains online during the grace period, though the IMEI is
+	// no longer seen.
+	p.m.Update(c.IMEI(), func(pending Presence, _ bool) (Presence, bool) {
+		pending.LastSeen = record.LastSeen
+		return pending, true
+	})
+	var t *time.Timer
+	t = time.AfterFunc(p.grace, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if st.pending == t {
+			st.pending = nil
+			p.commit(st, record)
+		}
+	})
+	st.pending = t
+	st.pendingRecord = record
+}
+
+// flush records every IMEI within its grace period offline immediately.
+func (p *presence) flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, st := range p.states {
+		if st.pending != nil {
+			st.pending.Stop()
+			st.pending = nil
+			p.commit(st, st.pendingRecord)
+		}
+		if st.settle != nil {
+			st.settle.Stop()
+		}
+	}
+}
+
+// commit records the offline record of an IMEI. The caller must hold p.mu.
+func (p *presence) commit(st *presenceState, record Presence) {
+	now := time.Now()
+	offlines := st.offlines[:0]
+	for _, t := range st.offlines {
+		if now.Sub(t) < p.flapWindow {
+			offlines = append(offlines, t)
+		}
+	}
+	st.offlines = append(offlines, now)
+
+	record.Flapping = p.flapLimit > 0 && len(st.offlines) >= p.flapLimit
+	p.m.Store(record.IMEI, record)
+	p.changed(st, record)
+}
+
+// changed passes record, the changed Presence of an IMEI, to notify unless
+// the IMEI is flapping, or record does not differ from the last Presence
+// notified. The caller must hold p.mu.
+func (p *presence) changed(st *presenceState, record Presence) {
+	if !p.flapping(st) {
+		if !st.notified || st.online != record.Online {
+			p.notified(st, record)
+		}
+		return
+	}
+	if st.settle == nil {
+		imei := record.IMEI
+		st.settle = time.AfterFunc(p.flapWindow, func() { p.settle(imei) })
+	}
+}
+
+// flapping reports whether the IMEI of st is flapping. The caller must hold
+// p.mu.
+func (p *presence) flapping(st *presenceState) bool {
+	return p.flapLimit > 0 && len(st.offlines) >= p.flapLimit
+}
+
+// settle ends the damping of imei if it has stopped flapping, notifying its
+// settled Presence. Otherwise, settle is scheduled again once another flap
+// window passes.
+func (p *presence) settle(imei uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	st := p.state(imei)
+	st.settle = nil
+	if n := len(st.offlines); n > 0 && time.Since(st.offlines[n-1]) < p.flapWindow {
+		st.settle = time.AfterFunc(p.flapWindow-time.Since(st.offlines[n-1]), func() { p.settle(imei) })
+		return
+	}
+	st.offlines = st.offlines[:0]
+
+	record, _ := p.m.Load(imei)
+	record.Flapping = false
+	p.m.Store(imei, record)
+	if !st.notified || st.online != record.Online {
+		p.notified(st, record)
+	}
+}
+
+// notified passes record to notify, and remembers it as the last Presence
+// notified, unless its IMEI is silenced. The caller must hold p.mu.
+func (p *presence) notified(st *presenceState, record Presence) {
+	if p.silenced(record.IMEI, record.Tenant, time.Now()) {
+		return
+	}
+	st.notified = true
+	st.online = record.Online
+	p.notify(record)
+}
+
+// get retrieves the Presence of imei, and reports whether imei has a record.
+func (p *presence) get(imei uint64) (Presence, bool) {
+	return p.m.Load(imei)
+}
+
+// erase forgets the Presence record of imei, stopping its pending offline
+// and flap damping timers, and reports whether it had a record.
+func (p *presence) erase(imei uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if st, ok := p.states[imei]; ok {
+		if st.pending != nil {
+			st.pending.Stop()
+		}
+		if st.settle != nil {
+			st.settle.Stop()
+		}
+		delete(p.states, imei)
+	}
+	_, ok := p.m.LoadAndDelete(imei)
+	return ok
+}
+
+// list retrieves every Presence record, ordered by IMEI.
+func (p *presence) list() []Presence {
+	list := make([]Presence, 0, p.m.Len())
+	p.m.Range(func(_ uint64, record Presence) bool {
+		list = append(list, record)
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].IMEI < list[j].IMEI })
+	return list
+}
+
+// save writes every Presence record to the file at path, replacing it
+// atomically.
+func (p *presence) save(path string) error {
+	b, err := json.Marshal(p.list())
+	if err != nil {
+		return fmt.Errorf("failed to server.presence.save/Marshal\terr = %w", err)
+	}
+	if err := common.WriteFileAtomic(path, b); err != nil {
+		return fmt.Errorf("failed to server.presence.save\terr = %w", err)
+	}
+	return nil
+}
+
+// load reads the Presence records saved to the file at path. A missing file
+// holds no records. Records saved while their IMEI was online are loaded as
+// offline since they were last seen, as the IMEI's connection did not survive
+// the Server.
+func (p *presence) load(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to server.presence.load/ReadFile\terr = %w", err)
+	}
+	var list []Presence
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("failed to server.presence.load/Unmarshal\tpath = %s err = %w", path, err)
+	}
+	for _, record := range list {
+		if record.Online {
+			lastSeen := record.LastSeen
+			record.Online = false
+			record.OfflineSince = &lastSeen
+			record.CloseReason = client.CloseServerShutdown
+		}
+		p.m.Store(record.IMEI, record)
+	}
+	return nil
+}
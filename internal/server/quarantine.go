@@ -0,0 +1,62 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/common"
+)
+
+// Quarantined is an IMEI refused connections until a point in time.
+type Quarantined struct {
+	IMEI  uint64
+	Until time.Time
+}
+
+// quarantine is a concurrent safe set of quarantined IMEIs. Entries expire
+// once their Until time has passed.
+type quarantine struct {
+	m *common.SyncMap[uint64, time.Time]
+}
+
+func newQuarantine() *quarantine {
+	return &quarantine{
+		m: common.NewSyncMap[uint64, time.Time](),
+	}
+}
+
+// add quarantines imei until the time specified.
+func (q *quarantine) add(imei uint64, until time.Time) {
+	q.m.Store(imei, until)
+}
+
+// contains reports whether imei is currently quarantined.
+func (q *quarantine) contains(imei uint64) bool {
+	var contains bool
+	q.m.Update(imei, func(until time.Time, ok bool) (time.Time, bool) {
+		contains = ok && time.Now().Before(until)
+		return until, contains
+	})
+	return contains
+}
+
+// remove lifts the quarantine of imei, and reports whether it was
+// quarantined.
+func (q *quarantine) remove(imei uint64) bool {
+	until, ok := q.m.LoadAndDelete(imei)
+	return ok && time.Now().Before(until)
+}
+
+// list retrieves the currently quarantined IMEIs, ordered by IMEI.
+func (q *quarantine) list() []Quarantined {
+	now := time.Now()
+	list := make([]Quarantined, 0, q.m.Len())
+	q.m.Range(func(imei uint64, until time.Time) bool {
+		if now.Before(until) {
+			list = append(list, Quarantined{IMEI: imei, Until: until})
+		}
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].IMEI < list[j].IMEI })
+	return list
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/common"
+)
+
+// errReactorClosed indicates a connection was added to a reactor that is no
+// longer running.
+var errReactorClosed = errors.New("reactor closed")
+
+// errReactorUnsupported indicates a connection the reactor cannot poll was
+// added to it: one without a file descriptor, such as a WebSocket connection,
+// or one whose Client negotiated compression, as decompressors read ahead of
+// the frames returned.
+var errReactorUnsupported = errors.New("connection cannot be polled")
+
+const (
+	// reactorPollTimeout bounds how long the reactor waits for readiness
+	// events before checking whether it has stopped.
+	reactorPollTimeout = 100 * time.Millisecond
+
+	// reactorSweepInterval is how often the reactor looks for connections
+	// whose read deadline has passed.
+	reactorSweepInterval = 250 * time.Millisecond
+)
+
+// reactorConn states. A reactorConn is armed while it waits for its
+// connection to become readable, and busy while a worker processes it.
+const (
+	reactorArmed int32 = iota
+	reactorBusy
+)
+
+// reactorConn is a logged-in connection handled by a reactor.
+type reactorConn struct {
+	*connection
+
+	id      uint64
+	raw     syscall.RawConn
+	session *client.Session
+	state   atomic.Int32
+}
+
+// reactor handles logged-in connections without a goroutine each. Connections
+// are registered with a poller, and handed to a fixed pool of workers once
+// they become readable. A worker processes a single message, or holds the
+// part of one that has arrived in the connection's Session, and then hands
+// the connection back to the poller. Connections that stop sending are
+// closed by a periodic sweep, so that idle connections hold no goroutine or
+// buffer.
+type reactor struct {
+	poller    *poller
+	workers   int
+	finish    func(*connection, error)
+	recovered func(*connection, interface{})
+
+	conns  *common.SyncMap[uint64, *reactorConn]
+	nextID atomic.Uint64
+	ready  chan *reactorConn
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// newReactor initializes a reactor with the number of workers specified.
+// finish is called with each connection the reactor is done with, and the
+// error that ended it. recovered is called instead with connections whose
+// processing panicked, and the value recovered.
+func newReactor(workers int, finish func(*connection, error), recovered func(*connection, interface{})) (*reactor, error) {
+	p, err := newPoller()
+	if err != nil {
+		return nil, fmt.Errorf("failed to server.newReactor/newPoller\terr = %w", err)
+	}
+	return &reactor{
+		poller:    p,
+		workers:   workers,
+		finish:    finish,
+		recovered: recovered,
+		conns:     common.NewSyncMap[uint64, *reactorConn](),
+		ready:     make(chan *reactorConn, workers),
+	}, nil
+}
+
+// add hands cn to the reactor. errReactorClosed is returned once the reactor
+// has stopped running, and errReactorUnsupported if cn cannot be polled.
+func (r *reactor) add(cn *connection) error {
+	if cn.client.Compression() != client.CompressionNone {
+		return errReactorUnsupported
+	}
+	sc, ok := cn.Conn.(syscall.Conn)
+	if !ok {
+		return errReactorUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to server.reactor.add/SyscallConn\terr = %w", err)
+	}
+	rc := &reactorConn{
+		connection: cn,
+		id:         r.nextID.Add(1),
+		raw:        raw,
+		session:    client.NewSession(),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errReactorClosed
+	}
+	r.conns.Store(rc.id, rc)
+	if err := r.poller.add(rc); err != nil {
+		r.conns.Delete(rc.id)
+		return fmt.Errorf("failed to server.reactor.add/add\terr = %w", err)
+	}
+	return nil
+}
+
+// run polls connections and runs the reactor's workers until ctx is done and
+// every connection has been finished. Once ctx is done, each connection is
+// processed once more, which finishes it.
+func (r *reactor) run(ctx context.Context) {
+	var workers sync.WaitGroup
+	for i := 0; i < r.workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for rc := range r.ready {
+				r.process(rc)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		r.poll(stop)
+	}()
+
+	ticker := time.NewTicker(reactorSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.sweep(ctx.Err() != nil)
+		if ctx.Err() != nil && r.stopped() {
+			break
+		}
+	}
+
+	close(stop)
+	<-polled
+	close(r.ready)
+	workers.Wait()
+}
+
+// stopped marks the reactor closed if it has no connections left, and
+// reports whether it did.
+func (r *reactor) stopped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns.Len() > 0 {
+		return false
+	}
+	r.closed = true
+	return true
+}
+
+// poll hands readable connections to the workers until stop is closed.
+func (r *reactor) poll(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		err := r.poller.wait(reactorPollTimeout, func(id uint64) {
+			if rc, ok := r.conns.Load(id); ok {
+				r.dispatch(rc)
+			}
+		})
+		if err != nil {
+			// A poller that cannot wait leaves the connections to the sweep.
+			time.Sleep(reactorPollTimeout)
+		}
+	}
+}
+
+// sweep hands connections whose read deadline has passed to the workers, so
+// that they are closed. Clients closed elsewhere are handed over as well, as
+// closing a connection removes it from the poller without an event. If all is
+// set, every armed connection is handed to the workers.
+func (r *reactor) sweep(all bool) {
+	now := time.Now()
+	r.conns.Range(func(_ uint64, rc *reactorConn) bool {
+		closed := rc.client.CloseReason() != client.CloseNone
+		if all || closed || now.After(rc.session.Deadline()) {
+			r.dispatch(rc)
+		}
+		return true
+	})
+}
+
+// dispatch hands rc to the workers, unless a worker is already processing
+// it.
+func (r *reactor) dispatch(rc *reactorConn) {
+	if rc.state.CompareAndSwap(reactorArmed, reactorBusy) {
+		r.ready <- rc
+	}
+}
+
+// process processes the next message on rc, and then either re-arms or
+// finishes it.
+func (r *reactor) process(rc *reactorConn) {
+	defer func() {
+		if v := recover(); v != nil {
+			r.remove(rc)
+			r.recovered(rc.connection, v)
+		}
+	}()
+
+	finished, err := rc.client.ProcessNext(rc.ctx, rc.session)
+	if !finished {
+		rc.state.Store(reactorArmed)
+		err = r.poller.rearm(rc)
+		if err == nil {
+			return
+		}
+		// The connection can no longer be polled, most likely because it was
+		// closed.
+		if !rc.state.CompareAndSwap(reactorArmed, reactorBusy) {
+			return
+		}
+		err = fmt.Errorf("[IMEI %d] failed to server.reactor.process/rearm\terr = %w", rc.client.IMEI(), err)
+	}
+
+	r.remove(rc)
+	r.finish(rc.connection, err)
+}
+
+// remove stops polling rc.
+func (r *reactor) remove(rc *reactorConn) {
+	r.poller.remove(rc)
+	r.conns.Delete(rc.id)
+}
+
+// close releases the reactor's poller.
+func (r *reactor) close() error {
+	return r.poller.close()
+}
@@ -0,0 +1,23 @@
+//go:build linux
+// +build linux
+
+package server
+
+import "syscall"
+
+// soReusePort is the Linux SO_REUSEPORT socket option, which the syscall
+// package does not define on every architecture.
+const soReusePort = 0xf
+
+// reusePortControl sets SO_REUSEPORT on the socket, allowing multiple
+// sockets to bind the same port.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
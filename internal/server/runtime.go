@@ -0,0 +1,76 @@
+package server
+
+import (
+	"runtime"
+	"time"
+)
+
+// RuntimeStats is a snapshot of the Server's runtime resource usage and
+// queue depths, used to spot leaks during long running soak tests.
+type RuntimeStats struct {
+	Time         time.Time
+	Goroutines   int
+	HeapAlloc    uint64
+	HeapObjects  uint64
+	NumGC        uint32
+	Clients      int
+	Conns        int
+	ReadingLog   int
+	WorkerPool   int
+	ReactorConns int
+	ReactorReady int
+}
+
+// RuntimeStats retrieves a snapshot of the Server's runtime resource usage.
+// Queue depths of subsystems the Server was not configured with are zero.
+func (srv *Server) RuntimeStats() RuntimeStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := RuntimeStats{
+		Time:        time.Now(),
+		Goroutines:  runtime.NumGoroutine(),
+		HeapAlloc:   mem.HeapAlloc,
+		HeapObjects: mem.HeapObjects,
+		NumGC:       mem.NumGC,
+		Clients:     srv.clientMap.Len(),
+		Conns:       srv.conns.m.Len(),
+	}
+	if srv.asyncReadingLogger != nil {
+		stats.ReadingLog = srv.asyncReadingLogger.Len()
+	}
+	if srv.workerPool != nil {
+		stats.WorkerPool = srv.workerPool.Len()
+	}
+	if srv.reactor != nil {
+		stats.ReactorConns = srv.reactor.conns.Len()
+		stats.ReactorReady = len(srv.reactor.ready)
+	}
+	return stats
+}
+
+// soak logs the Server's RuntimeStats every interval until stop is closed.
+func (srv *Server) soak(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			stats := srv.RuntimeStats()
+			srv.logInfo.Printf(
+				"Runtime Stats\tgoroutines = %d heap_alloc = %d heap_objects = %d gc = %d clients = %d conns = %d reading_log = %d worker_pool = %d reactor_conns = %d reactor_ready = %d\n",
+				stats.Goroutines,
+				stats.HeapAlloc,
+				stats.HeapObjects,
+				stats.NumGC,
+				stats.Clients,
+				stats.Conns,
+				stats.ReadingLog,
+				stats.WorkerPool,
+				stats.ReactorConns,
+				stats.ReactorReady)
+		}
+	}
+}
@@ -4,28 +4,203 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"runtime/debug"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/common"
+	"github.com/tjper/thermomatic/internal/export"
+	"github.com/tjper/thermomatic/internal/metrics"
+	"github.com/tjper/thermomatic/internal/plugin"
+	"github.com/tjper/thermomatic/internal/trace"
+)
+
+var (
+	// ErrServerClosed is returned by ListenAndServe after Shutdown.
+	ErrServerClosed = errors.New("thermomatic: Server closed")
+
+	// ErrDuplicateIMEI indicates a client was refused, as a client with the
+	// same IMEI is already connected.
+	ErrDuplicateIMEI = errors.New("imei already connected")
+
+	// ErrBanned indicates a client was refused, as its IMEI is quarantined.
+	ErrBanned = errors.New("imei banned")
+
+	// ErrQuotaExceeded indicates a client was refused, as its tenant has as
+	// many clients connected as its quota permits.
+	ErrQuotaExceeded = errors.New("tenant connection quota exceeded")
+)
+
+const (
+	// expvarName is the name the Server's Metrics are published under by
+	// WithExpvar.
+	expvarName = "thermomatic"
+
+	// statsdPrefix prefixes the name of each metric emitted by WithStatsD.
+	statsdPrefix = "thermomatic."
+
+	// statsdInterval is how often counters are flushed by WithStatsD.
+	statsdInterval = 10 * time.Second
+
+	// traceService is the service name spans are exported under by
+	// WithTracing.
+	traceService = "thermomatic"
+
+	// defaultDrainTimeout is how long a draining Server waits for clients to
+	// disconnect before closing their connections.
+	defaultDrainTimeout = 5 * time.Minute
+
+	// defaultShutdownTimeout is how long Shutdown waits for clients and http
+	// requests to finish before closing their connections.
+	defaultShutdownTimeout = 30 * time.Second
+
+	// minAcceptBackoff and maxAcceptBackoff bound the delay before retrying a
+	// failed Accept.
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
 )
 
 // Server is the thermomatic server.
 type Server struct {
-	listener   *net.TCPListener
-	httpServer http.Server
+	listeners    []*net.TCPListener
+	acceptors    int
+	reusePort    bool
+	httpServer   *http.Server
+	httpListener net.Listener
+	upgrades     *upgrades
+	pprof        bool
+	expvar       bool
+	httpReadOnly bool
 
 	clientMap     *client.ClientMap
 	clientOptions []client.ClientOption
+	conns         *conns
+
+	coapPort      int
+	coapConn      *net.UDPConn
+	coapExchanges *coapExchanges
+	lwm2m         *lwm2mRegistrations
+	udpPort       int
+	udpKey        []byte
+	udpConn       *net.UDPConn
+	datagrams     *datagrams
+	presence      *presence
+	presenceFile  string
+
+	groups               *groups
+	connects             *events
+	disconnects          *events
+	ingest               *ingest
+	history              *history
+	live                 *liveReadings
+	odometer             *odometer
+	tenants              *tenants
+	tenantReadingLoggers map[string]*common.LevelLogger
+
+	alerts           *alerts
+	alertRulesFile   string
+	alertHistory     *alertHistory
+	alertHistoryFile string
+	silences         *silences
+
+	overrides     *overrides
+	overridesFile string
+
+	quarantine         *quarantine
+	quarantineDuration time.Duration
+
+	idleEviction time.Duration
+
+	tlsConfig       *tls.Config
+	tlsCertificate  *tls.Certificate
+	tlsCertificates map[string]*tls.Certificate
+	tlsClientCAs    *x509.CertPool
+
+	transfers *client.Transfers
+
+	metrics    *metrics.Metrics
+	statsdAddr string
+	statsdTags []string
+	statsd     *metrics.StatsD
+
+	traceEndpoint string
+	traceExporter *trace.Exporter
+	tracer        *trace.Tracer
+
+	storeConfigs         []pluginConfig
+	exporterConfigs      []pluginConfig
+	criticalExporters    map[string]time.Duration
+	authenticatorConfigs []pluginConfig
+	stores               []plugin.Store
+	storeNames           []string
+	backfills            []plugin.Store
+	geocoderConfig       *pluginConfig
+	geocoding            *geocoding
+
+	flags         *flags
+	flagsFile     string
+	flagOverrides []flagOverride
+
+	tunables       *client.Tunables
+	tunableChanges *tunableChanges
 
-	logError *log.Logger
-	logInfo  *log.Logger
+	// peers are the base URLs of the http servers of the other nodes,
+	// requests for devices not connected to the Server are forwarded to.
+	peers      []string
+	peerClient *http.Client
+
+	// listenerOptions are the ClientOptions of the Clients connecting
+	// through each Listener, applied after clientOptions.
+	listenerOptions map[Listener][]client.ClientOption
+
+	// resumptions, if non-nil, keeps the session state of disconnected
+	// devices for their reconnection.
+	resumptions *client.Resumptions
+
+	asyncReadingLogOut  io.Writer
+	asyncReadingLogSize int
+	asyncReadingLogger  *client.AsyncReadingLogger
+
+	workerPoolWorkers int
+	workerPoolSize    int
+	workerPool        *client.WorkerPool
+
+	reactorWorkers int
+	reactor        *reactor
+
+	logFilePath     string
+	logFileRotation common.Rotation
+	logFile         *common.RotatingFile
+
+	level    *common.LevelVar
+	logError *common.LevelLogger
+	logWarn  *common.LevelLogger
+	logInfo  *common.LevelLogger
+	logDebug *common.LevelLogger
+
+	// logLimiter, if non-nil, collapses the repeated errors and warnings of
+	// the Server and its Clients.
+	logLimiter *common.RateLimiter
+
+	drain        chan struct{}
+	drainOnce    sync.Once
+	drainTimeout time.Duration
+
+	shutdownTimeout time.Duration
+
+	soakInterval time.Duration
 
 	stop   chan struct{}
 	exited chan struct{}
@@ -36,25 +211,247 @@ type Server struct {
 // nil error. On failure, a nil Server reference is returned, and a non-nil
 // error.
 func New(port int, options ...ServerOption) (*Server, error) {
-	l, err := net.ListenTCP("tcp", &net.TCPAddr{
-		Port: port,
-	})
-	if err != nil {
-		return nil, err
-	}
-
+	level := common.NewLevelVar(common.LevelInfo)
+	m := metrics.New()
+	transfers := client.NewTransfers()
+	tenants := newTenants()
+	tenantReadingLoggers := make(map[string]*common.LevelLogger)
+	tunables := client.NewTunables()
 	srv := &Server{
-		listener:      l,
-		clientMap:     client.NewClientMap(),
-		clientOptions: make([]client.ClientOption, 0),
-		logError:      log.New(os.Stderr, "[Thermomatic ERROR] ", log.LstdFlags),
-		logInfo:       log.New(os.Stdout, "[Thermomatic INFO] ", log.LstdFlags),
-		stop:          make(chan struct{}),
-		exited:        make(chan struct{}),
+		acceptors:            1,
+		clientMap:            client.NewClientMap(),
+		criticalExporters:    make(map[string]time.Duration),
+		tlsCertificates:      make(map[string]*tls.Certificate),
+		conns:                newConns(),
+		upgrades:             newUpgrades(),
+		coapExchanges:        newCoAPExchanges(),
+		lwm2m:                newLwM2MRegistrations(),
+		datagrams:            newDatagrams(),
+		presence:             newPresence(),
+		groups:               newGroups(),
+		connects:             newEvents(recentEvents),
+		disconnects:          newEvents(recentEvents),
+		ingest:               new(ingest),
+		tenants:              tenants,
+		tenantReadingLoggers: tenantReadingLoggers,
+		quarantine:           newQuarantine(),
+		silences:             newSilences(),
+		overrides:            newOverrides(),
+		live:                 newLiveReadings(),
+		alertHistory:         new(alertHistory),
+		flags:                newFlags(),
+		tunables:             tunables,
+		tunableChanges:       new(tunableChanges),
+		peerClient:           new(http.Client),
+		listenerOptions:      make(map[Listener][]client.ClientOption),
+		clientOptions: []client.ClientOption{
+			client.WithLogLevel(level),
+			client.WithTunables(tunables),
+			client.WithMetrics(m),
+			client.WithTransfers(transfers),
+			client.WithTenantResolver(tenants.resolve),
+			client.WithTenantReadingLoggers(tenantReadingLoggers),
+			client.WithTenantRateLimits(tenants.limits),
+		},
+		transfers: transfers,
+		metrics:   m,
+		level:     level,
+		logError: common.NewLevelLogger(
+			common.NewStdLogger(os.Stderr, "[Thermomatic ERROR] ", log.LstdFlags),
+			common.LevelError,
+			level),
+		logWarn: common.NewLevelLogger(
+			common.NewStdLogger(os.Stderr, "[Thermomatic WARN] ", log.LstdFlags),
+			common.LevelWarn,
+			level),
+		logInfo: common.NewLevelLogger(
+			common.NewStdLogger(os.Stdout, "[Thermomatic INFO] ", log.LstdFlags),
+			common.LevelInfo,
+			level),
+		logDebug: common.NewLevelLogger(
+			common.NewStdLogger(os.Stdout, "[Thermomatic DEBUG] ", log.LstdFlags),
+			common.LevelDebug,
+			level),
+		drain:           make(chan struct{}),
+		drainTimeout:    defaultDrainTimeout,
+		shutdownTimeout: defaultShutdownTimeout,
+		stop:            make(chan struct{}),
+		exited:          make(chan struct{}),
 	}
+	srv.alerts = newAlerts(srv.tenantOf, srv.silenced)
+	srv.alerts.placeOf = srv.place
+	srv.alerts.thresholdOf = srv.overrides.threshold
+	srv.alerts.drainOf = func(imei uint64) (float64, bool) {
+		drain, ok := srv.batteryDrain(imei)
+		return drain.PerHour, ok
+	}
+	srv.presence.silenced = srv.silenced
+	srv.clientOptions = append(
+		srv.clientOptions,
+		client.WithProtocols(srv.allowsProtocol),
+		client.WithReadingValidator(srv.overrides.validate))
 	for _, option := range options {
 		option(srv)
 	}
+	srv.tlsConfig = srv.newTLSConfig()
+	if err := srv.loadFlags(); err != nil {
+		return nil, err
+	}
+	if srv.alertRulesFile != "" {
+		if err := srv.alerts.load(srv.alertRulesFile); err != nil {
+			return nil, err
+		}
+	}
+	if srv.overridesFile != "" {
+		if err := srv.overrides.load(srv.overridesFile); err != nil {
+			return nil, err
+		}
+	}
+	srv.alerts.record = func(alert Alert) {
+		if err := srv.alertHistory.add(alert); err != nil {
+			srv.logError.Println(err)
+		}
+	}
+	notify := srv.alerts.notify
+	srv.alerts.notify = func(alert Alert) {
+		if alert.ResolvedAt == nil {
+			srv.logInfo.Printf("[IMEI %d] Alert %q fired\tvalue = %v\n", alert.IMEI, alert.Rule, alert.Value)
+		} else {
+			srv.logInfo.Printf("[IMEI %d] Alert %q resolved\n", alert.IMEI, alert.Rule)
+		}
+		notify(alert)
+	}
+	srv.ingest.record(time.Now(), 0, nil)
+	if srv.history != nil {
+		srv.odometer = newOdometer()
+		srv.clientOptions = append(
+			srv.clientOptions,
+			client.WithReadingStore(srv.history),
+			client.WithReadingStore(srv.odometer))
+	}
+	// Alerts are evaluated once the reading history includes the reading, so
+	// that rules of derived fields, such as BatteryDrain, account for it.
+	srv.clientOptions = append(
+		srv.clientOptions,
+		client.WithReadingStore(srv.alerts),
+		client.WithReadingStore(srv.live))
+	if srv.httpServer != nil {
+		// Requests tailing live readings would otherwise hold up shutdown.
+		srv.httpServer.RegisterOnShutdown(srv.live.close)
+	}
+	if srv.presenceFile != "" {
+		if err := srv.presence.load(srv.presenceFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := srv.listen(port); err != nil {
+		return nil, err
+	}
+	if srv.coapPort != 0 {
+		if err := srv.listenCoAP(srv.coapPort); err != nil {
+			srv.closeListeners()
+			return nil, err
+		}
+	}
+	if srv.udpPort != 0 {
+		if err := srv.listenUDP(srv.udpPort); err != nil {
+			srv.closeListeners()
+			return nil, err
+		}
+	}
+	if srv.reactorWorkers > 0 {
+		r, err := newReactor(srv.reactorWorkers, srv.finishReadings, srv.recovered)
+		if err != nil {
+			srv.closeListeners()
+			return nil, err
+		}
+		srv.reactor = r
+	}
+	if srv.logFilePath != "" {
+		f, err := common.OpenRotatingFile(srv.logFilePath, srv.logFileRotation)
+		if err != nil {
+			srv.closeListeners()
+			srv.closeReactor()
+			return nil, err
+		}
+		srv.logFile = f
+		WithLoggerOutput(f)(srv)
+	}
+	if srv.asyncReadingLogOut != nil {
+		srv.asyncReadingLogger = client.NewAsyncReadingLogger(
+			srv.asyncReadingLogOut,
+			srv.asyncReadingLogSize,
+			&srv.metrics.DroppedReadingLogs)
+		srv.clientOptions = append(
+			srv.clientOptions,
+			client.WithLogReading(srv.asyncReadingLogger.LogReading))
+		go srv.asyncReadingLogger.Run()
+	}
+	if srv.workerPoolWorkers > 0 {
+		srv.workerPool = client.NewWorkerPool(
+			srv.workerPoolWorkers,
+			srv.workerPoolSize,
+			&srv.metrics.DroppedReadings)
+		srv.clientOptions = append(srv.clientOptions, client.WithWorkerPool(srv.workerPool))
+		srv.workerPool.Run()
+	}
+	if srv.expvar {
+		if expvar.Get(expvarName) == nil {
+			expvar.Publish(expvarName, srv.metrics)
+		} else {
+			srv.logWarn.Printf("expvar %q already published, skipping\n", expvarName)
+		}
+	}
+	if srv.statsdAddr != "" {
+		statsd, err := metrics.NewStatsD(
+			srv.statsdAddr,
+			statsdPrefix,
+			statsdInterval,
+			srv.metrics,
+			srv.statsdTags...)
+		if err != nil {
+			srv.closeListeners()
+			srv.release()
+			return nil, err
+		}
+		srv.statsd = statsd
+		go srv.statsd.Run()
+	}
+	if srv.traceEndpoint != "" {
+		srv.traceExporter = trace.NewExporter(srv.traceEndpoint, traceService)
+		srv.tracer = trace.New(srv.traceExporter)
+		srv.clientOptions = append(srv.clientOptions, client.WithTracer(srv.tracer))
+		go func() {
+			if err := srv.traceExporter.Run(); err != nil {
+				srv.logError.Println(err)
+			}
+		}()
+	}
+	if srv.alertHistoryFile != "" {
+		if err := srv.alertHistory.open(srv.alertHistoryFile); err != nil {
+			srv.closeListeners()
+			srv.release()
+			return nil, err
+		}
+	}
+	if err := srv.loadPlugins(); err != nil {
+		srv.closeListeners()
+		srv.release()
+		return nil, err
+	}
+	if srv.httpServer != nil {
+		hl, err := net.Listen("tcp", srv.httpServer.Addr)
+		if err != nil {
+			srv.closeListeners()
+			srv.release()
+			if srv.logFile != nil {
+				srv.logFile.Close()
+			}
+			return nil, err
+		}
+		srv.httpListener = hl
+		srv.httpServer.Handler = srv.router()
+	}
 
 	srv.logInfo.Printf("Initialized Thermomatic Server at localhost:%d\n", port)
 	return srv, nil
@@ -69,7 +466,9 @@ type ServerOption func(*Server)
 func WithLoggerOutput(w io.Writer) ServerOption {
 	return func(srv *Server) {
 		srv.logError.SetOutput(w)
+		srv.logWarn.SetOutput(w)
 		srv.logInfo.SetOutput(w)
+		srv.logDebug.SetOutput(w)
 		srv.clientOptions = append(srv.clientOptions, client.WithLoggerOutput(w))
 	}
 }
@@ -79,7 +478,90 @@ func WithLoggerOutput(w io.Writer) ServerOption {
 func WithLoggerFlags(flags int) ServerOption {
 	return func(srv *Server) {
 		srv.logError.SetFlags(flags)
+		srv.logWarn.SetFlags(flags)
 		srv.logInfo.SetFlags(flags)
+		srv.logDebug.SetFlags(flags)
+	}
+}
+
+// WithLogger returns a ServerOption function that configures the Server and
+// its Clients to write their messages to l, e.g. a common.SlogLogger or a
+// common.LoggerFunc wrapping zap or zerolog. Once set, WithLoggerOutput and
+// WithLoggerFlags have no effect.
+func WithLogger(l common.Logger) ServerOption {
+	return func(srv *Server) {
+		srv.logError.SetLogger(l)
+		srv.logWarn.SetLogger(l)
+		srv.logInfo.SetLogger(l)
+		srv.logDebug.SetLogger(l)
+		srv.clientOptions = append(srv.clientOptions, client.WithLogger(l))
+	}
+}
+
+// WithLogRateLimit returns a ServerOption function that collapses repeated
+// errors and warnings of the Server and its Clients, such as the decode
+// failures of a device sending garbage, into a "repeated N times" message per
+// interval, so that one misbehaving device cannot flood the log. Messages
+// are identical if they share the text preceding their first tab, which
+// names the failure and IMEI but not its details.
+func WithLogRateLimit(interval time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.logLimiter = common.NewRateLimiter(interval)
+		srv.logError.SetRateLimiter(srv.logLimiter)
+		srv.logWarn.SetRateLimiter(srv.logLimiter)
+		srv.clientOptions = append(srv.clientOptions, client.WithLogRateLimiter(srv.logLimiter))
+	}
+}
+
+// WithSessionResumption returns a ServerOption function that keeps the
+// session state of a disconnected device for grace: its last reading, its
+// command ID sequence, and the commands it has not acknowledged. A device
+// reconnecting within grace resumes its session, recorded as a resumed
+// rather than a fresh connect.
+func WithSessionResumption(grace time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.resumptions = client.NewResumptions(grace)
+		srv.clientOptions = append(srv.clientOptions, client.WithResumptions(srv.resumptions))
+	}
+}
+
+// WithLogFile returns a ServerOption function that configures the Server's
+// and its Clients' loggers to write to the file at path, which is rotated
+// according to rotation.
+func WithLogFile(path string, rotation common.Rotation) ServerOption {
+	return func(srv *Server) {
+		srv.logFilePath = path
+		srv.logFileRotation = rotation
+	}
+}
+
+// WithAsyncReadingLog returns a ServerOption function that configures Clients
+// to log readings to w asynchronously in batches, via a buffer of size
+// readings. Readings received while the buffer is full are dropped and
+// counted in the Server's Metrics.
+func WithAsyncReadingLog(w io.Writer, size int) ServerOption {
+	return func(srv *Server) {
+		srv.asyncReadingLogOut = w
+		srv.asyncReadingLogSize = size
+	}
+}
+
+// WithWorkerPool returns a ServerOption function that configures Clients to
+// hand post-decode work, such as reading logging, to a pool of workers
+// goroutines, each with a queue of size readings. Readings received while a
+// queue is full are dropped and counted in the Server's Metrics.
+func WithWorkerPool(workers, size int) ServerOption {
+	return func(srv *Server) {
+		srv.workerPoolWorkers = workers
+		srv.workerPoolSize = size
+	}
+}
+
+// WithLogLevel returns a ServerOption function that configures the initial
+// logging level of the Server and its Clients.
+func WithLogLevel(level common.Level) ServerOption {
+	return func(srv *Server) {
+		srv.level.Set(level)
 	}
 }
 
@@ -91,95 +573,946 @@ func WithClientOptions(options ...client.ClientOption) ServerOption {
 	}
 }
 
-// WithHttpServer returns a ServerOption function that initializes and starts
-// an http server.
+// WithQuarantine returns a ServerOption function that quarantines a client
+// once limit consecutive readings fail to decode. A quarantined client is
+// disconnected, and its IMEI is refused connections for duration.
+func WithQuarantine(limit int, duration time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.quarantineDuration = duration
+		srv.clientOptions = append(srv.clientOptions, client.WithDecodeFailureLimit(limit))
+	}
+}
+
+// WithAcknowledgements returns a ServerOption function that runs protocol v2
+// clients in acknowledged mode, answering each reading and alarm frame with a
+// FrameReadingAck frame, or a FrameNack frame carrying the NackCode of the
+// error rejecting it.
+func WithAcknowledgements() ServerOption {
+	return func(srv *Server) {
+		srv.clientOptions = append(srv.clientOptions, client.WithAcknowledgements())
+	}
+}
+
+// WithPresenceFile returns a ServerOption function that configures the
+// Server to load Presence records from the file at path when initialized, and
+// to save them there once its clients have exited, so that they survive
+// restarts.
+func WithPresenceFile(path string) ServerOption {
+	return func(srv *Server) {
+		srv.presenceFile = path
+	}
+}
+
+// WithOfflineGrace returns a ServerOption function that configures the
+// Server to only record an IMEI offline once grace has passed since its
+// connection dropped, so that devices reconnecting within grace remain online.
+func WithOfflineGrace(grace time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.presence.grace = grace
+	}
+}
+
+// WithFlapDamping returns a ServerOption function that configures the Server
+// to withhold changes of an IMEI's Presence from its presence hook once the
+// IMEI has gone offline limit times within window, until it has not gone
+// offline for window.
+func WithFlapDamping(limit int, window time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.presence.flapLimit = limit
+		srv.presence.flapWindow = window
+	}
+}
+
+// WithPresenceHook returns a ServerOption function that configures the Server
+// to call f with each change of an IMEI's Presence, such as to notify a
+// webhook. f is called while presence changes are serialized, and must not
+// block.
+func WithPresenceHook(f func(Presence)) ServerOption {
+	return func(srv *Server) {
+		srv.presence.notify = f
+	}
+}
+
+// WithReadingHistory returns a ServerOption function that keeps the most
+// recent size readings of each IMEI in memory, to be queried through the
+// Grafana datasource and device history endpoints, along with the distance
+// each IMEI travels per day.
+func WithReadingHistory(size int) ServerOption {
+	return func(srv *Server) {
+		srv.history = nil
+		if size > 0 {
+			srv.history = newHistory(size)
+		}
+	}
+}
+
+// WithTenantPrefix returns a ServerOption function that assigns devices whose
+// IMEI begins with prefix to tenant, unless they presented a verified TLS
+// certificate naming their organization, or connected to a tenant's TLS
+// hostname. Where prefixes overlap, the longest matching prefix wins.
+func WithTenantPrefix(prefix, tenant string) ServerOption {
+	return func(srv *Server) {
+		srv.tenants.prefixes[prefix] = tenant
+	}
+}
+
+// WithTenantToken returns a ServerOption function that scopes http requests
+// bearing token to tenant's devices and metrics. Once any token is configured,
+// requests without a known token are refused.
+func WithTenantToken(token, tenant string) ServerOption {
+	return func(srv *Server) {
+		srv.tenants.tokens[tokenHash(token)] = tenant
+	}
+}
+
+// WithAdminToken returns a ServerOption function that grants http requests
+// bearing token access to every tenant, and to the administrative endpoints.
+// Once any token is configured, requests without a known token are refused.
+func WithAdminToken(token string) ServerOption {
+	return func(srv *Server) {
+		srv.tenants.adminToken = token
+	}
+}
+
+// WithTenantQuota returns a ServerOption function that imposes quota on
+// tenant. Devices connecting while their tenant has quota.Connections devices
+// connected are refused, and readings exceeding quota.ReadingsPerSecond are
+// rejected, with a NackQuotaExceeded in acknowledged mode.
+func WithTenantQuota(tenant string, quota Quota) ServerOption {
+	return func(srv *Server) {
+		srv.tenants.quotas[tenant] = quota
+		delete(srv.tenants.limits, tenant)
+		if quota.ReadingsPerSecond > 0 {
+			srv.tenants.limits[tenant] = client.NewRateLimit(quota.ReadingsPerSecond)
+		}
+	}
+}
+
+// WithTenantReadingLog returns a ServerOption function that exports the
+// readings of tenant's devices to w, rather than to the Server's debug log,
+// irrespective of the log level. WithAsyncReadingLog takes precedence.
+func WithTenantReadingLog(tenant string, w io.Writer) ServerOption {
+	return func(srv *Server) {
+		srv.tenantReadingLoggers[tenant] = common.NewLevelLogger(
+			common.NewStdLogger(w, "", 0),
+			common.LevelDebug,
+			common.NewLevelVar(common.LevelDebug))
+	}
+}
+
+// WithCoAP returns a ServerOption function that configures the Server to
+// receive readings from constrained devices as CoAP requests on the UDP port
+// specified. Devices post the binary encoding of a reading to
+// /readings/<imei>, and remain connected until idle for the datagram idle
+// timeout. LwM2M devices may instead register at /rd, and report their
+// temperature, location, and battery objects with the Send operation.
+func WithCoAP(port int) ServerOption {
+	return func(srv *Server) {
+		srv.coapPort = port
+	}
+}
+
+// WithUDPIngest returns a ServerOption function that configures the Server to
+// receive readings as UDP datagrams on the port specified, for devices that
+// favor battery life over delivery guarantees. Each datagram holds a device's
+// IMEI followed by a reading. If key is non-nil, each datagram must also be
+// followed by the HMAC-SHA256 of its IMEI and reading under key. Devices
+// remain connected until idle for the datagram idle timeout.
+func WithUDPIngest(port int, key []byte) ServerOption {
+	return func(srv *Server) {
+		srv.udpPort = port
+		srv.udpKey = key
+	}
+}
+
+// WithDatagramIdleTimeout returns a ServerOption function that configures how
+// long a device sending datagrams, such as CoAP requests, may go without
+// sending a reading before it is disconnected.
+func WithDatagramIdleTimeout(timeout time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.datagrams.idle = timeout
+	}
+}
+
+// WithAcceptors returns a ServerOption function that runs n accept loops,
+// improving connection establishment throughput when many devices reconnect
+// at once. If reusePort is true, each accept loop listens on its own
+// SO_REUSEPORT socket; otherwise, the accept loops share a single socket.
+func WithAcceptors(n int, reusePort bool) ServerOption {
+	return func(srv *Server) {
+		if n < 1 {
+			n = 1
+		}
+		srv.acceptors = n
+		srv.reusePort = reusePort
+	}
+}
+
+// WithReactor returns a ServerOption function that handles logged-in clients
+// with an event-driven reactor of workers goroutines, rather than a goroutine
+// blocked reading each client's connection. Clients only occupy a worker
+// while they have a message to process, reducing the memory held by fleets of
+// mostly-idle devices. Reactors are only supported on Linux; elsewhere, New
+// fails.
+func WithReactor(workers int) ServerOption {
+	return func(srv *Server) {
+		if workers < 1 {
+			workers = 1
+		}
+		srv.reactorWorkers = workers
+	}
+}
+
+// WithSoak returns a ServerOption function that logs the Server's
+// RuntimeStats every interval while it serves, so that leaks surface during
+// long running soak tests.
+func WithSoak(interval time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.soakInterval = interval
+	}
+}
+
+// WithDrainTimeout returns a ServerOption function that sets how long a
+// draining Server waits for clients to disconnect before closing their
+// connections.
+func WithDrainTimeout(timeout time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.drainTimeout = timeout
+	}
+}
+
+// WithShutdownTimeout returns a ServerOption function that sets how long
+// Shutdown waits for clients and http requests to finish before closing their
+// connections.
+func WithShutdownTimeout(timeout time.Duration) ServerOption {
+	return func(srv *Server) {
+		srv.shutdownTimeout = timeout
+	}
+}
+
+// WithHttpServer returns a ServerOption function that initializes an http
+// server listening on port. The port is bound by New, and the http server is
+// started by ListenAndServe.
 func WithHttpServer(port int) ServerOption {
 	return func(srv *Server) {
-		go func() {
-			srv.httpServer = http.Server{
-				Addr:    fmt.Sprintf(":%d", port),
-				Handler: srv.router(),
-			}
-			srv.logError.Println(srv.httpServer.ListenAndServe())
-		}()
+		srv.httpServer = &http.Server{
+			Addr: fmt.Sprintf(":%d", port),
+		}
+	}
+}
+
+// WithHolderTracking returns a ServerOption function that counts the
+// common.Holders of the Server and its Clients, reported by Diagnostics, to
+// detect leaked Holders. Counting sets a finalizer on each Holder, so it is
+// disabled by default.
+func WithHolderTracking() ServerOption {
+	return func(srv *Server) {
+		common.TrackHolders()
+	}
+}
+
+// WithHttpReadOnly returns a ServerOption function that makes the http server
+// read-only, for instances exposed to less-trusted networks: requests to
+// administrative endpoints, and requests that would change the Server's
+// state, such as disconnecting devices, ingesting readings, or writing alert
+// rules, respond with a 403. It has no effect unless WithHttpServer is also
+// passed.
+func WithHttpReadOnly() ServerOption {
+	return func(srv *Server) {
+		srv.httpReadOnly = true
+	}
+}
+
+// WithPprof returns a ServerOption function that mounts the net/http/pprof
+// handlers under /debug/pprof/ on the http server. It has no effect unless
+// WithHttpServer is also passed.
+func WithPprof() ServerOption {
+	return func(srv *Server) {
+		srv.pprof = true
+	}
+}
+
+// LogLevel retrieves the current logging level of the Server and its Clients.
+func (srv *Server) LogLevel() common.Level {
+	return srv.level.Level()
+}
+
+// SetLogLevel sets the logging level of the Server and its Clients. The change
+// applies immediately to established client connections.
+func (srv *Server) SetLogLevel(level common.Level) {
+	srv.level.Set(level)
+	srv.logInfo.Printf("Log level set to %s\n", level)
+}
+
+// WithExpvar returns a ServerOption function that publishes the Server's
+// Metrics via expvar under the name "thermomatic", and mounts the expvar
+// handler at /debug/vars on the http server. Only the first Server in a
+// process may publish its Metrics.
+func WithExpvar() ServerOption {
+	return func(srv *Server) {
+		srv.expvar = true
+	}
+}
+
+// WithStatsD returns a ServerOption function that emits the Server's Metrics
+// to the StatsD agent listening on the UDP address addr. If tags are
+// specified, metrics are emitted in the DogStatsD format with each tag
+// attached, e.g. "env:production".
+func WithStatsD(addr string, tags ...string) ServerOption {
+	return func(srv *Server) {
+		srv.statsdAddr = addr
+		srv.statsdTags = tags
+	}
+}
+
+// WithTracing returns a ServerOption function that records spans covering
+// connection lifetimes, logins, the reading pipeline, and http requests, and
+// exports them to the OTLP/HTTP traces endpoint specified, e.g.
+// "http://localhost:4318/v1/traces".
+func WithTracing(endpoint string) ServerOption {
+	return func(srv *Server) {
+		srv.traceEndpoint = endpoint
+	}
+}
+
+// WithRemoteWrite returns a ServerOption function that exports readings to
+// the Prometheus remote-write endpoint specified, e.g.
+// "http://localhost:9009/api/v1/push", as a series per reading field labeled
+// with the device's IMEI.
+func WithRemoteWrite(endpoint string) ServerOption {
+	return WithExporter("remote_write", endpoint)
+}
+
+// WithGraphite returns a ServerOption function that emits readings to the
+// Graphite carbon receiver at addr over network, "tcp" or "udp", every
+// interval. Each reading field is a metric named <prefix>.<imei>.<field>.
+func WithGraphite(network, addr, prefix string, interval time.Duration) ServerOption {
+	return WithExporter("graphite", export.GraphiteURL(network, addr, prefix, interval))
+}
+
+// Metrics retrieves the Metrics recorded by the Server and its Clients.
+func (srv *Server) Metrics() *metrics.Metrics {
+	return srv.metrics
+}
+
+// Clients retrieves the Clients currently connected, ordered by IMEI.
+func (srv *Server) Clients() []*client.Client {
+	clients := make([]*client.Client, 0, srv.clientMap.Len())
+	srv.clientMap.Range(func(_ uint64, c *client.Client) bool {
+		clients = append(clients, c)
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool { return clients[i].IMEI() < clients[j].IMEI() })
+	return clients
+}
+
+// ForEachClient calls f for each Client currently connected, in no particular
+// order. If f returns false, the iteration stops. f must not block, as
+// Clients cannot connect or disconnect until ForEachClient returns.
+func (srv *Server) ForEachClient(f func(*client.Client) bool) {
+	srv.clientMap.Range(func(_ uint64, c *client.Client) bool {
+		return f(c)
+	})
+}
+
+// CloseClient closes the Client connected with imei, recording reason as its
+// CloseReason, and reports whether imei was connected.
+func (srv *Server) CloseClient(imei uint64, reason client.CloseReason) bool {
+	c, ok := srv.clientMap.Load(imei)
+	if !ok {
+		return false
+	}
+	if err := c.Close(reason); err != nil {
+		srv.logWarn.Printf("[IMEI %d] failed to server.CloseClient/Close\terr = %s\n", imei, err)
+	}
+	srv.logInfo.Printf("Client %d closed\treason = %s\n", imei, reason)
+	return true
+}
+
+// Presence retrieves the Presence of imei, and reports whether imei has
+// connected since the Server started, or since the presence file was saved.
+func (srv *Server) Presence(imei uint64) (Presence, bool) {
+	record, ok := srv.presence.get(imei)
+	if !ok {
+		return record, false
+	}
+	record.Place = srv.place(imei)
+	if !record.Online {
+		return record, true
+	}
+	if c, ok := srv.clientMap.Load(imei); ok {
+		record.LastSeen = c.LastSeen()
+	}
+	return record, true
+}
+
+// Quarantined retrieves the IMEIs currently refused connections due to
+// repeated decode failures.
+func (srv *Server) Quarantined() []Quarantined {
+	return srv.quarantine.list()
+}
+
+// ClearQuarantine lifts the quarantine of imei, allowing it to reconnect, and
+// reports whether it was quarantined.
+func (srv *Server) ClearQuarantine(imei uint64) bool {
+	ok := srv.quarantine.remove(imei)
+	if ok {
+		srv.logInfo.Printf("Client %d quarantine cleared\n", imei)
+	}
+	return ok
+}
+
+// Drain stops the Server from accepting new connections, while letting
+// connected clients continue until they disconnect or the drain timeout
+// passes. Once the timeout passes, remaining client connections are closed.
+// Shutdown must still be called to release the Server's resources.
+func (srv *Server) Drain() {
+	srv.drainOnce.Do(func() {
+		srv.logInfo.Printf(
+			"Draining Thermomatic server listening at %s\n",
+			srv.listeners[0].Addr())
+		close(srv.drain)
+	})
+}
+
+// Draining reports whether Drain has been called.
+func (srv *Server) Draining() bool {
+	select {
+	case <-srv.drain:
+		return true
+	default:
+		return false
 	}
 }
 
 // Shutdown communicates to all thermomatic server processes that shutdown has
 // begun. Shutdown logs that shutdown has completed when server has been
-// completely shutdown.
+// completely shutdown. Connections still open once the shutdown timeout has
+// passed are closed.
 func (srv *Server) Shutdown() {
 	srv.logInfo.Printf(
 		"Shutting down Thermomatic server listening at %s\n",
-		srv.listener.Addr())
+		srv.listeners[0].Addr())
 
-	if err := srv.httpServer.Shutdown(context.Background()); err != nil {
-		srv.logError.Println(err)
+	ctx, cancel := context.WithTimeout(context.Background(), srv.shutdownTimeout)
+	defer cancel()
+
+	if srv.httpServer != nil {
+		if err := srv.httpServer.Shutdown(ctx); err != nil {
+			srv.logError.Println(err)
+			if err := srv.httpServer.Close(); err != nil {
+				srv.logError.Println(err)
+			}
+			srv.logWarn.Println("Force closed http server.")
+		}
+		// The listener is only closed by the http server once serving.
+		srv.httpListener.Close()
 	}
 
+	srv.goodbye()
 	close(srv.stop)
-	<-srv.exited
+	select {
+	case <-srv.exited:
+	case <-ctx.Done():
+		imeis, unidentified := srv.conns.closeAll()
+		srv.logWarn.Printf(
+			"Shutdown timeout of %s passed, force closed %d client connections %v and %d unidentified connections\n",
+			srv.shutdownTimeout,
+			len(imeis),
+			imeis,
+			unidentified)
+		<-srv.exited
+	}
+
+	srv.release()
+	if srv.logLimiter != nil {
+		srv.logLimiter.Flush()
+	}
 	srv.logInfo.Println("Finished shutting down Thermomatic server.")
+
+	if srv.logFile != nil {
+		if err := srv.logFile.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// release stops the Server's exporters and reading logger.
+func (srv *Server) release() {
+	// The worker pool is closed first, as its workers may log readings
+	// asynchronously.
+	if srv.workerPool != nil {
+		srv.workerPool.Close()
+	}
+	if srv.asyncReadingLogger != nil {
+		srv.asyncReadingLogger.Close()
+	}
+	if srv.statsd != nil {
+		if err := srv.statsd.Close(); err != nil {
+			srv.logError.Println(err)
+		}
+	}
+	if srv.traceExporter != nil {
+		srv.traceExporter.Close()
+	}
+	srv.closePlugins()
+	srv.closeReactor()
+	if err := srv.alertHistory.close(); err != nil {
+		srv.logError.Println(err)
+	}
+}
+
+// savePresence saves the Server's Presence records, if it has a presence
+// file.
+func (srv *Server) savePresence() {
+	if srv.presenceFile == "" {
+		return
+	}
+	if err := srv.presence.save(srv.presenceFile); err != nil {
+		srv.logError.Println(err)
+	}
+}
+
+// closeReactor releases the Server's reactor, if it has one.
+func (srv *Server) closeReactor() {
+	if srv.reactor == nil {
+		return
+	}
+	if err := srv.reactor.close(); err != nil {
+		srv.logError.Println(err)
+	}
+}
+
+// goodbye sends a goodbye frame to each connected protocol v2 Client, so
+// that devices back off and reconnect elsewhere rather than to this server.
+func (srv *Server) goodbye() {
+	var clients []*client.Client
+	srv.ForEachClient(func(c *client.Client) bool {
+		if c.Protocol() == client.ProtocolV2 {
+			clients = append(clients, c)
+		}
+		return true
+	})
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *client.Client) {
+			defer wg.Done()
+			if err := c.Goodbye(); err != nil {
+				srv.logWarn.Printf("failed to Goodbye\terr = %s\n", err)
+			}
+		}(c)
+	}
+	wg.Wait()
+	if len(clients) > 0 {
+		srv.logInfo.Printf("Sent goodbye to %d clients\n", len(clients))
+	}
 }
 
 // ListenAndServe accepts incoming TCP connections, creates and manages
 // Clients, and processes the clients connection contents in a seperate
-// goroutine.
-func (srv *Server) ListenAndServe() {
-	srv.logInfo.Println("accepting TCP connections...")
-	ctx, cancel := context.WithCancel(context.Background())
+// goroutine. The http server, if configured, is served alongside.
+//
+// ListenAndServe always returns a non-nil error. After Shutdown, the returned
+// error is ErrServerClosed. If ctx is done, ctx.Err() is returned. Otherwise,
+// the fatal accept or http server error is returned. In each case, clients
+// have exited once ListenAndServe returns.
+func (srv *Server) ListenAndServe(ctx context.Context) error {
+	clientCtx, cancelClients := context.WithCancel(ctx)
+	var (
+		acceptors    sync.WaitGroup
+		subProcesses sync.WaitGroup
+		reactor      sync.WaitGroup
+	)
+	defer func() {
+		srv.closeListeners()
+		acceptors.Wait()
+		cancelClients()
+		subProcesses.Wait()
+		reactor.Wait()
+		srv.closeDatagrams()
+		srv.presence.flush()
+		srv.savePresence()
+		close(srv.exited)
+	}()
 
-	var subProcesses sync.WaitGroup
-	for {
+	if srv.soakInterval > 0 {
+		go srv.soak(srv.soakInterval, srv.exited)
+	}
+	go srv.sampleIngest(srv.exited)
+	if srv.idleEviction > 0 {
+		go srv.evictIdle(srv.exited)
+	}
+	if srv.httpServer != nil {
+		acceptors.Add(1)
+		go func() {
+			defer acceptors.Done()
+			srv.serveUpgrades(clientCtx, &subProcesses)
+		}()
+	}
+	if srv.coapConn != nil || srv.udpConn != nil {
+		go srv.sweepDatagrams(srv.exited)
+	}
+	if srv.coapConn != nil {
+		acceptors.Add(1)
+		go func() {
+			defer acceptors.Done()
+			srv.logInfo.Printf("receiving CoAP requests at %s...\n", srv.coapConn.LocalAddr())
+			srv.serveCoAP(clientCtx)
+		}()
+	}
+	if srv.udpConn != nil {
+		acceptors.Add(1)
+		go func() {
+			defer acceptors.Done()
+			srv.logInfo.Printf("receiving UDP readings at %s...\n", srv.udpConn.LocalAddr())
+			srv.serveUDP(clientCtx)
+		}()
+	}
+	if srv.reactor != nil {
+		reactor.Add(1)
+		go func() {
+			defer reactor.Done()
+			srv.reactor.run(clientCtx)
+		}()
+	}
+
+	fatal := make(chan error, 1)
+	if srv.httpServer != nil {
+		go func() {
+			err := srv.httpServer.Serve(srv.httpListener)
+			if !errors.Is(err, http.ErrServerClosed) {
+				fatal <- fmt.Errorf("failed to server.ListenAndServe/Serve\terr = %w", err)
+			}
+		}()
+	}
+
+	// Accept blocks until a connection arrives, so the listeners are closed
+	// to interrupt it once the Server stops or drains, ctx is done, or the
+	// http server fails.
+	interrupt := make(chan error, 1)
+	go func() {
 		select {
 		case <-srv.stop:
-			srv.listener.Close()
-			cancel()
-			subProcesses.Wait()
-			close(srv.exited)
-			return
+		case <-srv.drain:
+		case <-clientCtx.Done():
+		case err := <-fatal:
+			interrupt <- err
+		}
+		srv.closeListeners()
+	}()
 
-		default:
-			if err := srv.listener.SetDeadline(time.Now().Add(time.Second)); err != nil {
-				srv.logError.Println(err)
-				continue
-			}
-			conn, err := srv.listener.Accept()
-			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
-				continue
-			}
-			if err != nil {
-				srv.logError.Println(err)
-				continue
-			}
+	if srv.acceptors > 1 {
+		srv.logInfo.Printf("accepting TCP connections on %d accept loops...\n", srv.acceptors)
+	} else {
+		srv.logInfo.Println("accepting TCP connections...")
+	}
+	exited := make(chan error, srv.acceptors)
+	for i := 0; i < srv.acceptors; i++ {
+		l := srv.listeners[i%len(srv.listeners)]
+		acceptors.Add(1)
+		go func() {
+			defer acceptors.Done()
+			exited <- srv.accept(clientCtx, l, &subProcesses)
+		}()
+	}
+
+	// Accept loops only exit once their listener is closed.
+	err := <-exited
+	select {
+	case <-srv.stop:
+		return ErrServerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-interrupt:
+		return err
+	case <-srv.drain:
+		srv.awaitClients(ctx, cancelClients, &subProcesses)
+		select {
+		case <-srv.stop:
+			return ErrServerClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	default:
+		srv.metrics.Errors.Inc()
+		srv.metrics.AcceptErrors.Inc()
+		return fmt.Errorf("failed to server.ListenAndServe/Accept\terr = %w", err)
+	}
+}
+
+// accept accepts connections from l, handling each on its own goroutine
+// tracked by subProcesses, until l is closed. Connections handed to the
+// reactor remain tracked by subProcesses until the reactor finishes them. The
+// error closing l is returned.
+func (srv *Server) accept(ctx context.Context, l net.Listener, subProcesses *sync.WaitGroup) error {
+	srv.metrics.Accepting.Inc()
+	defer srv.metrics.Accepting.Add(-1)
+
+	var backoff time.Duration
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			srv.metrics.Errors.Inc()
+			srv.metrics.AcceptErrors.Inc()
+
+			// Accept errors such as running out of file descriptors are
+			// retried with an exponential backoff.
+			backoff = acceptBackoff(backoff)
+			srv.logError.Printf("failed to Accept, retrying in %s\terr = %s\n", backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		srv.metrics.Connections.Inc()
+		if srv.tlsConfig != nil {
+			conn = tls.Server(conn, srv.tlsConfig)
+		}
+		subProcesses.Add(1)
+		go srv.handleConn(ctx, conn, ListenerTCP, subProcesses.Done)
+	}
+}
+
+// serveUpgrades handles the connections upgraded by the http server, each on
+// its own goroutine tracked by subProcesses, until the upgrades are closed.
+func (srv *Server) serveUpgrades(ctx context.Context, subProcesses *sync.WaitGroup) {
+	for {
+		select {
+		case conn := <-srv.upgrades.conns:
+			srv.metrics.Connections.Inc()
 			subProcesses.Add(1)
-			go func(ctx context.Context, c net.Conn) {
-				defer subProcesses.Done()
-				defer c.Close()
-
-				client, err := client.New(ctx, conn, srv.clientOptions...)
-				if err != nil {
-					srv.logError.Println(err)
-					return
-				}
-
-				if srv.clientMap.Exists(client.IMEI()) {
-					srv.logError.Printf("Client %d is already connected\n", client.IMEI())
-					return
-				}
-				srv.clientMap.Store(client.IMEI(), *client)
-				defer srv.clientMap.Delete(client.IMEI())
-
-				if err := client.ProcessLogin(ctx); err != nil {
-					srv.logError.Printf("failed to ProcessLogin\terr = %s\n", err)
-					return
-				}
-
-				if err := client.ProcessReadings(ctx); err != nil {
-					srv.logError.Printf("failed to ProcessReadings\terr = %s\n", err)
-					return
-				}
-			}(ctx, conn)
+			go srv.handleConn(ctx, conn, ListenerWebSocket, subProcesses.Done)
+		case <-srv.upgrades.closed:
+			return
 		}
 	}
 }
+
+// acceptBackoff retrieves the delay before retrying a failed Accept, given the
+// previous delay.
+func acceptBackoff(previous time.Duration) time.Duration {
+	if previous == 0 {
+		return minAcceptBackoff
+	}
+	if next := previous * 2; next < maxAcceptBackoff {
+		return next
+	}
+	return maxAcceptBackoff
+}
+
+// awaitClients waits for the clients' sub-processes to exit, the drain
+// timeout to pass, ctx to be done, or the Server to stop. If the
+// sub-processes have not exited, cancel is called to close the clients'
+// connections.
+func (srv *Server) awaitClients(ctx context.Context, cancel context.CancelFunc, subProcesses *sync.WaitGroup) {
+	exited := make(chan struct{})
+	go func() {
+		subProcesses.Wait()
+		close(exited)
+	}()
+
+	timer := time.NewTimer(srv.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-exited:
+		srv.logInfo.Println("Finished draining Thermomatic server.")
+	case <-timer.C:
+		srv.logWarn.Printf("Drain timeout of %s passed, closing client connections\n", srv.drainTimeout)
+	case <-ctx.Done():
+	case <-srv.stop:
+	}
+	cancel()
+}
+
+// connection is a connection handled by the Server, along with the state
+// released once it closes.
+type connection struct {
+	net.Conn
+
+	ctx      context.Context
+	span     *trace.Span
+	client   *client.Client
+	accepted time.Time
+	stored   bool
+	done     func()
+
+	closeOnce sync.Once
+}
+
+// handleConn manages the lifetime of the client connected via conn, through
+// the listener l. Once conn is closed, done is called. conn is closed before
+// handleConn returns, unless the client is handed to the Server's reactor.
+func (srv *Server) handleConn(ctx context.Context, conn net.Conn, l Listener, done func()) {
+	srv.conns.add(conn)
+	cn := &connection{Conn: conn, accepted: time.Now(), done: done}
+	defer func() {
+		if v := recover(); v != nil {
+			srv.recovered(cn, v)
+		}
+	}()
+	cn.ctx, cn.span = srv.tracer.Start(
+		ctx,
+		"connection",
+		trace.KindServer,
+		trace.String("net.peer.addr", conn.RemoteAddr().String()))
+
+	c, err := client.New(cn.ctx, conn, srv.clientOptionsOf(l)...)
+	if err != nil {
+		cn.span.RecordError(err)
+		srv.metrics.Errors.Inc()
+		srv.logError.Println(err)
+		srv.closeConn(cn)
+		return
+	}
+	cn.client = c
+	cn.span.SetAttributes(trace.Int("imei", int64(c.IMEI())))
+	srv.conns.identify(conn, c.IMEI())
+
+	if err := srv.admit(c); err != nil {
+		cn.span.RecordError(err)
+		srv.logWarn.Println(err)
+		c.Close(closeReasonOfAdmit(err))
+		srv.closeConn(cn)
+		return
+	}
+	cn.stored = true
+	srv.connected(c)
+
+	if err := c.ProcessLogin(cn.ctx); err != nil {
+		cn.span.RecordError(err)
+		srv.metrics.Errors.Inc()
+		srv.logError.Printf("failed to ProcessLogin\terr = %s\n", err)
+		srv.closeConn(cn)
+		return
+	}
+	srv.metrics.Timing("login", time.Since(cn.accepted))
+
+	if srv.reactor != nil && srv.flags.enabled(FlagReactor) {
+		err := srv.reactor.add(cn)
+		if err == nil {
+			return
+		}
+		// Clients the reactor cannot handle fall back to this goroutine.
+		if err != errReactorClosed && err != errReactorUnsupported {
+			srv.logWarn.Println(err)
+		}
+	}
+	srv.finishReadings(cn, c.ProcessReadings(cn.ctx))
+}
+
+// admit stores c in the Server's ClientMap. If c's IMEI is quarantined,
+// ErrBanned is returned. If c's tenant has as many clients connected as its
+// quota permits, ErrQuotaExceeded is returned. If a client with c's IMEI is
+// already connected, ErrDuplicateIMEI is returned.
+func (srv *Server) admit(c *client.Client) error {
+	if srv.quarantine.contains(c.IMEI()) {
+		return fmt.Errorf("[IMEI %d] failed to server.admit\terr = %w", c.IMEI(), ErrBanned)
+	}
+	if !srv.tenants.connect(c.Tenant()) {
+		srv.metrics.TenantQuotaExceeded.Counter(c.Tenant() + ".connections").Inc()
+		return fmt.Errorf("[IMEI %d] failed to server.admit\ttenant = %s err = %w", c.IMEI(), c.Tenant(), ErrQuotaExceeded)
+	}
+	if _, loaded := srv.clientMap.LoadOrStore(c.IMEI(), c); loaded {
+		srv.tenants.disconnect(c.Tenant())
+		return fmt.Errorf("[IMEI %d] failed to server.admit\terr = %w", c.IMEI(), ErrDuplicateIMEI)
+	}
+	return nil
+}
+
+// closeReasonOfAdmit retrieves the CloseReason of a client that failed to be
+// admitted with err.
+func closeReasonOfAdmit(err error) client.CloseReason {
+	switch {
+	case errors.Is(err, ErrBanned):
+		return client.CloseQuarantined
+	case errors.Is(err, ErrQuotaExceeded):
+		return client.CloseQuotaExceeded
+	default:
+		return client.CloseDuplicate
+	}
+}
+
+// connected records the connection of c, once admitted, resuming the session
+// of its device if it reconnected within the Server's resumption grace.
+func (srv *Server) connected(c *client.Client) {
+	resumed := c.Resume()
+	srv.presence.online(c)
+	srv.connects.add(Event{IMEI: c.IMEI(), Tenant: c.Tenant(), Time: time.Now(), Resumed: resumed})
+	srv.metrics.Clients.Inc()
+	if tenant := c.Tenant(); tenant != "" {
+		srv.metrics.TenantConnections.Counter(tenant).Inc()
+	}
+	if l := c.Listener(); l != "" {
+		srv.metrics.ListenerConnections.Counter(l).Inc()
+	}
+}
+
+// finishReadings handles err, the error ending cn's readings, and closes cn.
+func (srv *Server) finishReadings(cn *connection, err error) {
+	switch {
+	case errors.Is(err, client.ErrClientQuarantined):
+		srv.metrics.Quarantines.Inc()
+		srv.quarantine.add(cn.client.IMEI(), time.Now().Add(srv.quarantineDuration))
+		srv.logWarn.Printf("Client %d quarantined for %s\n", cn.client.IMEI(), srv.quarantineDuration)
+	case err != nil:
+		cn.span.RecordError(err)
+		srv.metrics.Errors.Inc()
+		srv.logError.Printf("failed to ProcessReadings\terr = %s\n", err)
+	}
+	srv.closeConn(cn)
+}
+
+// recovered handles v, a panic recovered while handling cn, and closes cn so
+// that only cn is affected by the panic.
+func (srv *Server) recovered(cn *connection, v interface{}) {
+	srv.metrics.Panics.Inc()
+	srv.metrics.Errors.Inc()
+	srv.logError.Printf("recovered from panic handling %s\tpanic = %v\n%s", cn.RemoteAddr(), v, debug.Stack())
+	if cn.span != nil {
+		cn.span.RecordError(fmt.Errorf("panic = %v", v))
+	}
+	srv.closeConn(cn)
+}
+
+// closeConn releases the state held for cn, and closes it. It is safe to call
+// closeConn more than once.
+func (srv *Server) closeConn(cn *connection) {
+	cn.closeOnce.Do(func() {
+		srv.releaseConn(cn)
+	})
+}
+
+func (srv *Server) releaseConn(cn *connection) {
+	// Clients still open, such as those whose handling panicked, are closed
+	// with client.CloseError.
+	if cn.client != nil {
+		cn.client.Close(client.CloseError)
+	}
+	if cn.stored {
+		srv.metrics.Clients.Add(-1)
+		srv.clientMap.Delete(cn.client.IMEI())
+		srv.tenants.disconnect(cn.client.Tenant())
+		srv.disconnected(cn.client)
+	}
+	cn.span.End()
+	srv.metrics.Timing("connection", time.Since(cn.accepted))
+	srv.conns.remove(cn.Conn)
+	cn.Conn.Close()
+	cn.done()
+}
+
+// disconnected records the disconnection of c, suspending the session of its
+// device for resumption.
+func (srv *Server) disconnected(c *client.Client) {
+	c.Suspend()
+	reason := c.CloseReason()
+	srv.metrics.Disconnects.Counter(string(reason)).Inc()
+	srv.presence.offline(c)
+	srv.disconnects.add(Event{IMEI: c.IMEI(), Tenant: c.Tenant(), Time: time.Now(), CloseReason: reason})
+	srv.logDebug.Printf("[IMEI %d] Disconnected\treason = %s\n", c.IMEI(), reason)
+}
@@ -1,27 +1,52 @@
+//go:build integration
 // +build integration
 
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/json"
-	"flag"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/common"
+	"github.com/tjper/thermomatic/internal/export"
+	"github.com/tjper/thermomatic/internal/plugin"
+	"github.com/tjper/thermomatic/internal/store"
+	"github.com/tjper/thermomatic/internal/testutil"
 )
 
-var golden = flag.Bool("golden", false, "overwrite *.golden files for golden file tests")
-
 func TestLogin(t *testing.T) {
 	tests := []struct {
 		Name     string
@@ -40,7 +65,7 @@ func TestLogin(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
-			w := newSafeWriter()
+			w := testutil.NewSafeWriter()
 			svr, err := New(
 				test.Port,
 				WithLoggerOutput(w),
@@ -51,7 +76,7 @@ func TestLogin(t *testing.T) {
 				t.Errorf("unexpected error = %s\n", err)
 			}
 			defer svr.Shutdown()
-			go svr.ListenAndServe()
+			go svr.ListenAndServe(context.Background())
 
 			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
 			if err != nil {
@@ -67,7 +92,7 @@ func TestLogin(t *testing.T) {
 			}
 			time.Sleep(time.Second)
 
-			isGolden(t, w.Bytes())
+			testutil.Golden(t, w.Bytes())
 		})
 	}
 }
@@ -95,7 +120,7 @@ func TestMultiConnections(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
-			w := newSafeWriter()
+			w := testutil.NewSafeWriter()
 			svr, err := New(
 				test.Port,
 				WithLoggerOutput(w),
@@ -106,7 +131,7 @@ func TestMultiConnections(t *testing.T) {
 				t.Errorf("unexpected error = %s\n", err)
 			}
 			defer svr.Shutdown()
-			go svr.ListenAndServe()
+			go svr.ListenAndServe(context.Background())
 
 			go func() {
 				conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
@@ -140,7 +165,7 @@ func TestMultiConnections(t *testing.T) {
 			}()
 			time.Sleep(1500 * time.Millisecond)
 
-			isGolden(t, w.Bytes())
+			testutil.Golden(t, w.Bytes())
 		})
 	}
 
@@ -171,7 +196,7 @@ func TestLoginWindowExpired(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
-			w := newSafeWriter()
+			w := testutil.NewSafeWriter()
 			svr, err := New(
 				test.Port,
 				WithLoggerOutput(w),
@@ -182,7 +207,7 @@ func TestLoginWindowExpired(t *testing.T) {
 				t.Errorf("unexpected error = %s\n", err)
 			}
 			defer svr.Shutdown()
-			go svr.ListenAndServe()
+			go svr.ListenAndServe(context.Background())
 
 			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
 			if err != nil {
@@ -197,7 +222,7 @@ func TestLoginWindowExpired(t *testing.T) {
 				time.Sleep(1500 * time.Millisecond)
 			}
 
-			isGolden(t, w.Bytes())
+			testutil.Golden(t, w.Bytes())
 		})
 	}
 }
@@ -217,19 +242,20 @@ func TestNoMessageForTwoSeconds(t *testing.T) {
 				[]byte("login"),
 			},
 			Messages: [][]byte{
-				reading(t),
-				reading(t),
+				testutil.Reading(t),
+				testutil.Reading(t),
 			},
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
-			w := newSafeWriter()
+			w := testutil.NewSafeWriter()
 			svr, err := New(
 				test.Port,
 				WithLoggerOutput(w),
 				WithLoggerFlags(0),
+				WithLogLevel(common.LevelDebug),
 				WithClientOptions(
 					client.WithLogReading(client.LogReading),
 					client.WithLoggerFlags(0),
@@ -239,7 +265,7 @@ func TestNoMessageForTwoSeconds(t *testing.T) {
 				t.Errorf("unexpected error = %s\n", err)
 			}
 			defer svr.Shutdown()
-			go svr.ListenAndServe()
+			go svr.ListenAndServe(context.Background())
 
 			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
 			if err != nil {
@@ -259,7 +285,7 @@ func TestNoMessageForTwoSeconds(t *testing.T) {
 				time.Sleep(2500 * time.Millisecond)
 			}
 
-			isGolden(t, w.Bytes())
+			testutil.Golden(t, w.Bytes())
 		})
 	}
 }
@@ -273,22 +299,23 @@ func TestProcessReadings(t *testing.T) {
 		{
 			Name:     "10 Messages",
 			Port:     1337,
-			Messages: messagesTen(t),
+			Messages: testutil.MessagesFile(t, "testdata/TestProcessReadings/messagesTen.json"),
 		},
 		{
 			Name:     "100 Messages",
 			Port:     1337,
-			Messages: messagesOneHundred(t),
+			Messages: testutil.MessagesFile(t, "testdata/TestProcessReadings/messagesOneHundred.json"),
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
-			w := newSafeWriter()
+			w := testutil.NewSafeWriter()
 			svr, err := New(
 				test.Port,
 				WithLoggerOutput(w),
 				WithLoggerFlags(0),
+				WithLogLevel(common.LevelDebug),
 				WithClientOptions(
 					client.WithLogReading(client.LogReading),
 					client.WithLoggerFlags(0),
@@ -298,7 +325,7 @@ func TestProcessReadings(t *testing.T) {
 				t.Errorf("unexpected error = %s\n", err)
 			}
 			defer svr.Shutdown()
-			go svr.ListenAndServe()
+			go svr.ListenAndServe(context.Background())
 
 			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
 			if err != nil {
@@ -314,7 +341,7 @@ func TestProcessReadings(t *testing.T) {
 			}
 			time.Sleep(5 * time.Second)
 
-			isGolden(t, w.Bytes())
+			testutil.Golden(t, w.Bytes())
 		})
 	}
 }
@@ -331,14 +358,14 @@ func TestLastReading(t *testing.T) {
 			Name:     "10 Messages, check last message",
 			Port:     1337,
 			HttpPort: 1338,
-			Messages: messagesTen(t),
+			Messages: testutil.MessagesFile(t, "testdata/TestProcessReadings/messagesTen.json"),
 			Imei:     490154203237518,
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
-			w := newSafeWriter()
+			w := testutil.NewSafeWriter()
 			svr, err := New(
 				test.Port,
 				WithLoggerOutput(w),
@@ -348,7 +375,7 @@ func TestLastReading(t *testing.T) {
 			if err != nil {
 				t.Errorf("unexpected error = %s\n", err)
 			}
-			go svr.ListenAndServe()
+			go svr.ListenAndServe(context.Background())
 
 			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
 			if err != nil {
@@ -380,7 +407,18 @@ func TestLastReading(t *testing.T) {
 			conn.Close()
 			svr.Shutdown()
 
-			isGolden(t, b)
+			// The receive time varies between runs, so is checked apart from
+			// the golden response.
+			receivedAtRE := regexp.MustCompile(`,"ReceivedAt":"([^"]+)"`)
+			match := receivedAtRE.FindSubmatch(b)
+			if match == nil {
+				t.Fatalf("expected receive time, actual = %s", b)
+			}
+			receivedAt, err := time.Parse(time.RFC3339Nano, string(match[1]))
+			if err != nil || time.Since(receivedAt) > 5*time.Second {
+				t.Errorf("unexpected receive time = %s, err = %v", match[1], err)
+			}
+			testutil.Golden(t, receivedAtRE.ReplaceAll(b, nil))
 		})
 	}
 }
@@ -398,7 +436,7 @@ func TestImeiStatus(t *testing.T) {
 			Name:     "10 Messages, ensure IMEI status is online",
 			Port:     1337,
 			HttpPort: 1338,
-			Messages: messagesTen(t),
+			Messages: testutil.MessagesFile(t, "testdata/TestProcessReadings/messagesTen.json"),
 			Imei:     490154203237518,
 			Expected: http.StatusOK,
 		},
@@ -406,7 +444,7 @@ func TestImeiStatus(t *testing.T) {
 			Name:     "10 Messages, ensure IMEI status is offline",
 			Port:     1337,
 			HttpPort: 1338,
-			Messages: messagesTen(t),
+			Messages: testutil.MessagesFile(t, "testdata/TestProcessReadings/messagesTen.json"),
 			Imei:     490224203237518,
 			Expected: http.StatusNoContent,
 		},
@@ -414,7 +452,7 @@ func TestImeiStatus(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
-			w := newSafeWriter()
+			w := testutil.NewSafeWriter()
 			svr, err := New(
 				test.Port,
 				WithLoggerOutput(w),
@@ -425,7 +463,7 @@ func TestImeiStatus(t *testing.T) {
 				t.Errorf("unexpected error = %s\n", err)
 			}
 			defer svr.Shutdown()
-			go svr.ListenAndServe()
+			go svr.ListenAndServe(context.Background())
 
 			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
 			if err != nil {
@@ -457,95 +495,5098 @@ func TestImeiStatus(t *testing.T) {
 	}
 }
 
-func messagesTen(t *testing.T) [][]byte {
-	f, err := os.Open("testdata/TestProcessReadings/messagesTen.json")
-	if err != nil {
-		t.Errorf("unexpected error = %s\n", err)
+func TestQuarantine(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Port     int
+		HttpPort int
+		Limit    int
+		Messages [][]byte
+		Expected int
+	}{
+		{
+			Name:     "quarantined after consecutive decode failures",
+			Port:     1337,
+			HttpPort: 1338,
+			Limit:    3,
+			Messages: [][]byte{
+				[]byte("490154203237518"),
+				[]byte("login"),
+				testutil.InvalidReading(t),
+				testutil.InvalidReading(t),
+				testutil.InvalidReading(t),
+			},
+			Expected: 1,
+		},
+		{
+			Name:     "decode failures interrupted by valid reading",
+			Port:     1337,
+			HttpPort: 1338,
+			Limit:    3,
+			Messages: [][]byte{
+				[]byte("490154203237518"),
+				[]byte("login"),
+				testutil.InvalidReading(t),
+				testutil.InvalidReading(t),
+				testutil.Reading(t),
+				testutil.InvalidReading(t),
+			},
+			Expected: 0,
+		},
 	}
-	defer f.Close()
-	return messages(t, f)
-}
 
-func messagesOneHundred(t *testing.T) [][]byte {
-	f, err := os.Open("testdata/TestProcessReadings/messagesOneHundred.json")
-	if err != nil {
-		t.Errorf("unexpected error = %s\n", err)
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(
+				test.Port,
+				WithLoggerOutput(w),
+				WithLoggerFlags(0),
+				WithHttpServer(test.HttpPort),
+				WithQuarantine(test.Limit, time.Minute),
+			)
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
+
+			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer conn.Close()
+
+			for _, message := range test.Messages {
+				if _, err := conn.Write(message); err != nil {
+					t.Errorf("unexpected error = %s\n", err)
+				}
+			}
+			time.Sleep(time.Second)
+
+			resp, err := http.Get(fmt.Sprintf("http://localhost:%d/admin/quarantine", test.HttpPort))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer resp.Body.Close()
+
+			var actual struct {
+				Quarantined []Quarantined
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			if len(actual.Quarantined) != test.Expected {
+				t.Errorf("expected %d quarantined, actual = %v", test.Expected, actual.Quarantined)
+			}
+		})
 	}
-	defer f.Close()
-	return messages(t, f)
 }
 
-func messages(t *testing.T, r io.Reader) [][]byte {
-	var readings []client.Reading
-	if err := json.NewDecoder(r).Decode(&readings); err != nil {
-		t.Errorf("unexpected error = %s\n", err)
+func TestDeviceStats(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Port      int
+		HttpPort  int
+		Messages  [][]byte
+		Imei      int
+		Readings  int64
+		BytesRead int64
+	}{
+		{
+			Name:      "10 Messages",
+			Port:      1337,
+			HttpPort:  1338,
+			Messages:  testutil.MessagesFile(t, "testdata/TestProcessReadings/messagesTen.json"),
+			Imei:      490154203237518,
+			Readings:  10,
+			BytesRead: 15 + 5 + 10*40,
+		},
 	}
 
-	msgs := [][]byte{
-		[]byte("490154203237518"),
-		[]byte("login"),
-	}
-	for _, reading := range readings {
-		b, err := reading.Encode()
-		if err != nil {
-			t.Errorf("unexpected error = %s\n", err)
-		}
-		msgs = append(msgs, b)
-	}
-	return msgs
-}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(
+				test.Port,
+				WithLoggerOutput(w),
+				WithLoggerFlags(0),
+				WithHttpServer(test.HttpPort),
+			)
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
 
-type safeWriter struct {
-	sync.RWMutex
-	*bytes.Buffer
-}
+			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer conn.Close()
+
+			for _, message := range test.Messages {
+				if _, err := conn.Write(message); err != nil {
+					t.Errorf("unexpected error = %s\n", err)
+				}
+			}
+			time.Sleep(time.Second)
+
+			resp, err := http.Get(
+				fmt.Sprintf(
+					"http://localhost:%d/devices/%d/stats",
+					test.HttpPort,
+					test.Imei))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer resp.Body.Close()
 
-func newSafeWriter() *safeWriter {
-	return &safeWriter{
-		Buffer: new(bytes.Buffer),
+			var actual struct {
+				Stats client.Stats
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			if actual.Stats.Readings != test.Readings {
+				t.Errorf("expected %d readings, actual = %d", test.Readings, actual.Stats.Readings)
+			}
+			if actual.Stats.BytesRead != test.BytesRead {
+				t.Errorf("expected %d bytes read, actual = %d", test.BytesRead, actual.Stats.BytesRead)
+			}
+		})
 	}
 }
 
-func (w *safeWriter) Write(b []byte) (int, error) {
-	w.Lock()
-	defer w.Unlock()
-	return w.Buffer.Write(b)
-}
+func TestAlarmFrames(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Port     int
+		HttpPort int
+		Frames   []client.FrameType
+		Imei     int
+		Alarms   int64
+		Readings int64
+	}{
+		{
+			Name:     "alarms and readings",
+			Port:     1337,
+			HttpPort: 1338,
+			Frames: []client.FrameType{
+				client.FrameReading,
+				client.FrameAlarm,
+				client.FrameReading,
+				client.FrameAlarm,
+			},
+			Imei:     490154203237518,
+			Alarms:   2,
+			Readings: 4,
+		},
+	}
 
-func (w *safeWriter) Bytes() []byte {
-	w.RLock()
-	defer w.RUnlock()
-	return w.Buffer.Bytes()
-}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(
+				test.Port,
+				WithLoggerOutput(w),
+				WithLoggerFlags(0),
+				WithHttpServer(test.HttpPort),
+			)
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
 
-func reading(t *testing.T) []byte {
-	b, err := client.Reading{
-		Temperature:  67.77,
-		Altitude:     2.63555,
-		Latitude:     33.41,
-		Longitude:    44.4,
-		BatteryLevel: 0.25666,
-	}.Encode()
-	if err != nil {
-		t.Errorf("unexpected error = %s\n", err)
+			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer conn.Close()
+
+			b := append([]byte("490154203237518"), "logv2"...)
+			for _, frame := range test.Frames {
+				b = client.AppendFrame(b, frame, testutil.Reading(t))
+			}
+			if _, err := conn.Write(b); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			time.Sleep(time.Second)
+
+			resp, err := http.Get(
+				fmt.Sprintf(
+					"http://localhost:%d/devices/%d/stats",
+					test.HttpPort,
+					test.Imei))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer resp.Body.Close()
+
+			var actual struct {
+				Stats client.Stats
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			if actual.Stats.Alarms != test.Alarms {
+				t.Errorf("expected %d alarms, actual = %d", test.Alarms, actual.Stats.Alarms)
+			}
+			if actual.Stats.Readings != test.Readings {
+				t.Errorf("expected %d readings, actual = %d", test.Readings, actual.Stats.Readings)
+			}
+		})
 	}
-	return b
 }
 
-func isGolden(t *testing.T, actual []byte) {
-	file := "testdata/" + t.Name() + ".golden"
-	if *golden {
-		if err := ioutil.WriteFile(file, actual, 0644); err != nil {
-			t.Errorf("unexpected error = %s\n", err)
-		}
+func TestDeviceCommands(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Port     int
+		HttpPort int
+		Imei     int
+		Payload  []byte
+		Expected client.CommandStatus
+	}{
+		{
+			Name:     "command acked",
+			Port:     1337,
+			HttpPort: 1338,
+			Imei:     490154203237518,
+			Payload:  []byte("reboot"),
+			Expected: client.CommandAcked,
+		},
 	}
 
-	expected, err := ioutil.ReadFile(file)
-	if err != nil {
-		t.Errorf("unexpected error = %s\n", err)
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(
+				test.Port,
+				WithLoggerOutput(w),
+				WithLoggerFlags(0),
+				WithHttpServer(test.HttpPort),
+			)
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
+
+			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write(append([]byte("490154203237518"), "logv2"...)); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			body, err := json.Marshal(struct{ Payload []byte }{test.Payload})
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			resp, err := http.Post(
+				fmt.Sprintf(
+					"http://localhost:%d/devices/%d/commands",
+					test.HttpPort,
+					test.Imei),
+				"application/json",
+				bytes.NewReader(body))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusAccepted {
+				t.Errorf("expected status %d, actual = %d", http.StatusAccepted, resp.StatusCode)
+			}
+
+			// The device reads the command frame and acks its ID.
+			frame := make([]byte, 3+4+len(test.Payload))
+			if _, err := io.ReadFull(conn, frame); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			if client.FrameType(frame[0]) != client.FrameCommand {
+				t.Errorf("expected frame type %#x, actual = %#x", client.FrameCommand, frame[0])
+			}
+			if !bytes.Equal(frame[7:], test.Payload) {
+				t.Errorf("expected payload %q, actual = %q", test.Payload, frame[7:])
+			}
+			if _, err := conn.Write(client.AppendFrame(nil, client.FrameAck, frame[3:7])); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			resp, err = http.Get(
+				fmt.Sprintf(
+					"http://localhost:%d/devices/%d/commands",
+					test.HttpPort,
+					test.Imei))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer resp.Body.Close()
+
+			var actual struct {
+				Commands []client.Command
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			if len(actual.Commands) != 1 {
+				t.Fatalf("expected 1 command, actual = %d", len(actual.Commands))
+			}
+			if actual.Commands[0].Status != test.Expected {
+				t.Errorf("expected status %s, actual = %s", test.Expected, actual.Commands[0].Status)
+			}
+		})
+	}
+}
+
+func TestFirmware(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Port     int
+		HttpPort int
+		Imei     int
+		Firmware string
+	}{
+		{
+			Name:     "firmware reported",
+			Port:     1337,
+			HttpPort: 1338,
+			Imei:     490154203237518,
+			Firmware: "1.4.2-rc1",
+		},
 	}
 
-	if !bytes.Equal(expected, actual) {
-		t.Errorf("actual != expected\nexpected = %s\nactual = %s\n", expected, actual)
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(
+				test.Port,
+				WithLoggerOutput(w),
+				WithLoggerFlags(0),
+				WithHttpServer(test.HttpPort),
+			)
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
+
+			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer conn.Close()
+
+			b := append([]byte("490154203237518"), "logfw"...)
+			b = append(b, byte(len(test.Firmware)))
+			b = append(b, test.Firmware...)
+			if _, err := conn.Write(b); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			resp, err := http.Get(
+				fmt.Sprintf(
+					"http://localhost:%d/devices/%d",
+					test.HttpPort,
+					test.Imei))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer resp.Body.Close()
+
+			var actual struct {
+				Device struct {
+					Protocol client.Protocol
+					Firmware string
+				}
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			if actual.Device.Protocol != client.ProtocolV2 {
+				t.Errorf("expected protocol %d, actual = %d", client.ProtocolV2, actual.Device.Protocol)
+			}
+			if actual.Device.Firmware != test.Firmware {
+				t.Errorf("expected firmware %q, actual = %q", test.Firmware, actual.Device.Firmware)
+			}
+		})
+	}
+}
+
+func TestGoodbye(t *testing.T) {
+	tests := []struct {
+		Name string
+		Port int
+	}{
+		{
+			Name: "goodbye on shutdown",
+			Port: 1337,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(
+				test.Port,
+				WithLoggerOutput(w),
+				WithLoggerFlags(0),
+			)
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			go svr.ListenAndServe(context.Background())
+
+			device := testutil.Dial(t, test.Port)
+			device.Send(testutil.LoginV2(testutil.IMEI))
+			time.Sleep(100 * time.Millisecond)
+
+			shutdown := make(chan struct{})
+			go func() {
+				svr.Shutdown()
+				close(shutdown)
+			}()
+
+			if ft, _ := device.ReadFrame(time.Second); ft != client.FrameGoodbye {
+				t.Errorf("expected frame type %#x, actual = %#x", client.FrameGoodbye, ft)
+			}
+			<-shutdown
+		})
+	}
+}
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Port     int
+		HttpPort int
+	}{
+		{
+			Name:     "drain until clients disconnect",
+			Port:     1337,
+			HttpPort: 1338,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(
+				test.Port,
+				WithLoggerOutput(w),
+				WithLoggerFlags(0),
+				WithHttpServer(test.HttpPort),
+				WithDrainTimeout(10*time.Second),
+			)
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
+
+			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write(append([]byte("490154203237518"), "login"...)); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+
+			resp, err := http.Post(
+				fmt.Sprintf("http://localhost:%d/admin/drain", test.HttpPort),
+				"application/json",
+				nil)
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusAccepted {
+				t.Errorf("expected status %d, actual = %d", http.StatusAccepted, resp.StatusCode)
+			}
+			time.Sleep(1100 * time.Millisecond)
+
+			resp, err = http.Get(fmt.Sprintf("http://localhost:%d/health", test.HttpPort))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("expected status %d, actual = %d", http.StatusServiceUnavailable, resp.StatusCode)
+			}
+			if _, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port)); err == nil {
+				t.Errorf("expected draining server to refuse connections")
+			}
+
+			// The connected client continues until it disconnects.
+			if _, err := conn.Write(testutil.Reading(t)); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if !svr.clientMap.Exists(490154203237518) {
+				t.Errorf("expected client to remain connected while draining")
+			}
+			conn.Close()
+			time.Sleep(2100 * time.Millisecond)
+
+			if !bytes.Contains(w.Bytes(), []byte("Finished draining Thermomatic server.")) {
+				t.Errorf("expected drain to finish, logs = %s", w.Bytes())
+			}
+		})
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Port     int
+		Timeout  time.Duration
+		Expected string
+	}{
+		{
+			Name:     "force close unidentified connection",
+			Port:     1337,
+			Timeout:  100 * time.Millisecond,
+			Expected: "force closed 0 client connections [] and 1 unidentified connections",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(
+				test.Port,
+				WithLoggerOutput(w),
+				WithLoggerFlags(0),
+				WithShutdownTimeout(test.Timeout),
+			)
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			go svr.ListenAndServe(context.Background())
+
+			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
+			if err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			defer conn.Close()
+			// Logged-in clients' reads are interrupted by shutdown, while a
+			// connection yet to send its IMEI holds shutdown until it is closed.
+			time.Sleep(100 * time.Millisecond)
+
+			svr.Shutdown()
+			if !bytes.Contains(w.Bytes(), []byte(test.Expected)) {
+				t.Errorf("expected log %q, logs = %s", test.Expected, w.Bytes())
+			}
+		})
+	}
+}
+
+func TestHttpBindError(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Port     int
+		HttpPort int
+	}{
+		{
+			Name:     "http port in use",
+			Port:     1337,
+			HttpPort: 1338,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			l, err := net.Listen("tcp", ":"+strconv.Itoa(test.HttpPort))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer l.Close()
+
+			w := testutil.NewSafeWriter()
+			if _, err := New(
+				test.Port,
+				WithLoggerOutput(w),
+				WithLoggerFlags(0),
+				WithHttpServer(test.HttpPort),
+			); err == nil {
+				t.Fatalf("expected bind error")
+			}
+
+			// The TCP port is released when New fails.
+			svr, err := New(test.Port, WithLoggerOutput(w), WithLoggerFlags(0))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			go svr.ListenAndServe(context.Background())
+			svr.Shutdown()
+		})
+	}
+}
+
+func TestListenAndServeErrors(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Port     int
+		Cancel   bool
+		Expected error
+	}{
+		{
+			Name:     "context canceled",
+			Port:     1337,
+			Cancel:   true,
+			Expected: context.Canceled,
+		},
+		{
+			Name:     "shutdown",
+			Port:     1337,
+			Expected: ErrServerClosed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(test.Port, WithLoggerOutput(w), WithLoggerFlags(0))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errs := make(chan error, 1)
+			go func() {
+				errs <- svr.ListenAndServe(ctx)
+			}()
+
+			if test.Cancel {
+				cancel()
+				if err := <-errs; err != test.Expected {
+					t.Errorf("expected error = %v, actual = %v", test.Expected, err)
+				}
+				svr.Shutdown()
+				return
+			}
+			svr.Shutdown()
+			if err := <-errs; err != test.Expected {
+				t.Errorf("expected error = %v, actual = %v", test.Expected, err)
+			}
+		})
+	}
+}
+
+func TestAcceptMetrics(t *testing.T) {
+	tests := []struct {
+		Name        string
+		Port        int
+		Connections int
+	}{
+		{
+			Name:        "accepting and connections",
+			Port:        1337,
+			Connections: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(test.Port, WithLoggerOutput(w), WithLoggerFlags(0))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			errs := make(chan error, 1)
+			go func() {
+				errs <- svr.ListenAndServe(context.Background())
+			}()
+
+			for i := 0; i < test.Connections; i++ {
+				conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
+				if err != nil {
+					t.Fatalf("unexpected error = %s\n", err)
+				}
+				conn.Close()
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			m := svr.Metrics()
+			if accepting := m.Accepting.Value(); accepting != 1 {
+				t.Errorf("expected accepting = 1, actual = %d", accepting)
+			}
+			if connections := m.Connections.Value(); connections != int64(test.Connections) {
+				t.Errorf("expected %d connections, actual = %d", test.Connections, connections)
+			}
+
+			// Shutdown interrupts Accept without waiting on a deadline.
+			start := time.Now()
+			svr.Shutdown()
+			if err := <-errs; err != ErrServerClosed {
+				t.Errorf("expected error = %v, actual = %v", ErrServerClosed, err)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("expected prompt shutdown, elapsed = %s", elapsed)
+			}
+			if accepting := m.Accepting.Value(); accepting != 0 {
+				t.Errorf("expected accepting = 0, actual = %d", accepting)
+			}
+		})
+	}
+}
+
+func TestClients(t *testing.T) {
+	tests := []struct {
+		Name string
+		Port int
+		Imei uint64
+	}{
+		{
+			Name: "client state is current",
+			Port: 1337,
+			Imei: 490154203237518,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(test.Port, WithLoggerOutput(w), WithLoggerFlags(0))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
+
+			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write(append([]byte("490154203237518"), "login"...)); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			clients := svr.Clients()
+			if len(clients) != 1 || clients[0].IMEI() != test.Imei {
+				t.Fatalf("expected client %d, actual = %v", test.Imei, clients)
+			}
+
+			// Readings processed after the Client was stored are observed.
+			if _, err := conn.Write(testutil.Reading(t)); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if readings := clients[0].Stats().Readings; readings != 1 {
+				t.Errorf("expected 1 reading, actual = %d", readings)
+			}
+
+			var visited int
+			svr.ForEachClient(func(c *client.Client) bool {
+				visited++
+				return true
+			})
+			if visited != 1 {
+				t.Errorf("expected 1 client visited, actual = %d", visited)
+			}
+		})
+	}
+}
+
+func TestAcceptors(t *testing.T) {
+	tests := []struct {
+		Name        string
+		Port        int
+		Acceptors   int
+		ReusePort   bool
+		Connections int
+	}{
+		{
+			Name:        "shared socket",
+			Port:        1337,
+			Acceptors:   4,
+			Connections: 20,
+		},
+		{
+			Name:        "reuse port",
+			Port:        1337,
+			Acceptors:   4,
+			ReusePort:   true,
+			Connections: 20,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(
+				test.Port,
+				WithLoggerOutput(w),
+				WithLoggerFlags(0),
+				WithAcceptors(test.Acceptors, test.ReusePort),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			errs := make(chan error, 1)
+			go func() {
+				errs <- svr.ListenAndServe(context.Background())
+			}()
+			time.Sleep(100 * time.Millisecond)
+
+			if accepting := svr.Metrics().Accepting.Value(); accepting != int64(test.Acceptors) {
+				t.Errorf("expected %d accept loops, actual = %d", test.Acceptors, accepting)
+			}
+			for i := 0; i < test.Connections; i++ {
+				conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
+				if err != nil {
+					t.Fatalf("unexpected error = %s\n", err)
+				}
+				conn.Close()
+			}
+			time.Sleep(100 * time.Millisecond)
+			if connections := svr.Metrics().Connections.Value(); connections != int64(test.Connections) {
+				t.Errorf("expected %d connections, actual = %d", test.Connections, connections)
+			}
+
+			svr.Shutdown()
+			if err := <-errs; err != ErrServerClosed {
+				t.Errorf("expected error = %v, actual = %v", ErrServerClosed, err)
+			}
+			if accepting := svr.Metrics().Accepting.Value(); accepting != 0 {
+				t.Errorf("expected no accept loops, actual = %d", accepting)
+			}
+		})
+	}
+}
+
+func TestReactor(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Port     int
+		Workers  int
+		Login    []byte
+		Frame    bool
+		Compress bool
+		Readings int
+		Hangup   bool
+		Expected string
+	}{
+		{
+			Name:     "protocol v1 device hangs up",
+			Port:     1337,
+			Workers:  2,
+			Login:    append([]byte("490154203237518"), "login"...),
+			Readings: 3,
+			Hangup:   true,
+			Expected: "[IMEI 490154203237518] Connection Closed by Device\n",
+		},
+		{
+			Name:     "protocol v2 device goes idle",
+			Port:     1337,
+			Workers:  2,
+			Login:    append([]byte("356938035643809"), "logv2"...),
+			Frame:    true,
+			Readings: 3,
+			Expected: "[IMEI 356938035643809] No Readings for 2 seconds, Closing Client\n",
+		},
+		{
+			Name:     "compressed device falls back to goroutine",
+			Port:     1337,
+			Workers:  2,
+			Login:    append([]byte("356938035643809"), "logcz\x01"...),
+			Frame:    true,
+			Compress: true,
+			Readings: 3,
+			Expected: "[IMEI 356938035643809] No Readings for 2 seconds, Closing Client\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(
+				test.Port,
+				WithLoggerOutput(w),
+				WithLoggerFlags(0),
+				WithReactor(test.Workers),
+				WithClientOptions(client.WithLoggerOutput(w), client.WithLoggerFlags(0)),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			errs := make(chan error, 1)
+			go func() {
+				errs <- svr.ListenAndServe(context.Background())
+			}()
+
+			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write(test.Login); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			zw := zlib.NewWriter(conn)
+			for i := 0; i < test.Readings; i++ {
+				b := testutil.Reading(t)
+				if test.Frame {
+					b = client.AppendFrame(nil, client.FrameReading, b)
+				}
+				if test.Compress {
+					if _, err := zw.Write(b); err != nil {
+						t.Fatalf("unexpected error = %s\n", err)
+					}
+					if err := zw.Flush(); err != nil {
+						t.Fatalf("unexpected error = %s\n", err)
+					}
+				} else if _, err := conn.Write(b); err != nil {
+					t.Fatalf("unexpected error = %s\n", err)
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			if readings := svr.Metrics().Readings.Value(); readings != int64(test.Readings) {
+				t.Errorf("expected %d readings, actual = %d", test.Readings, readings)
+			}
+			if test.Hangup {
+				conn.Close()
+			}
+
+			deadline := time.Now().Add(3 * time.Second)
+			for svr.Metrics().Clients.Value() != 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if clients := svr.Metrics().Clients.Value(); clients != 0 {
+				t.Errorf("expected no clients, actual = %d", clients)
+			}
+			if !bytes.Contains(w.Bytes(), []byte(test.Expected)) {
+				t.Errorf("expected log %q, actual = %s", test.Expected, w.Bytes())
+			}
+
+			svr.Shutdown()
+			if err := <-errs; err != ErrServerClosed {
+				t.Errorf("expected error = %v, actual = %v", ErrServerClosed, err)
+			}
+		})
+	}
+}
+
+func TestReactorShutdown(t *testing.T) {
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithReactor(1),
+		WithClientOptions(client.WithLoggerOutput(io.Discard)),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- svr.ListenAndServe(context.Background())
+	}()
+
+	conn, err := net.Dial("tcp", ":1337")
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(append([]byte("490154203237518"), "logv2"...)); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if clients := svr.Metrics().Clients.Value(); clients != 1 {
+		t.Fatalf("expected 1 client, actual = %d", clients)
+	}
+
+	// Connected clients are finished by the reactor, without waiting for
+	// their read deadline.
+	start := time.Now()
+	svr.Shutdown()
+	if err := <-errs; err != ErrServerClosed {
+		t.Errorf("expected error = %v, actual = %v", ErrServerClosed, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected prompt shutdown, actual = %s", elapsed)
+	}
+	if clients := svr.Metrics().Clients.Value(); clients != 0 {
+		t.Errorf("expected no clients, actual = %d", clients)
+	}
+}
+
+func BenchmarkThroughput(b *testing.B) {
+	for _, clients := range []int{1, 100, 10000} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			benchmarkThroughput(b, clients)
+		})
+	}
+}
+
+// benchmarkThroughput measures the rate readings sent by the number of
+// clients specified are processed by a Server. Each op is a reading sent by
+// every client. Clients read at a negligible reading interval, so that the
+// pipeline rather than the reading rate limit is measured.
+func benchmarkThroughput(b *testing.B, clients int) {
+	tunables := client.NewTunables()
+	if err := tunables.SetReadingInterval(time.Nanosecond); err != nil {
+		b.Fatalf("unexpected error = %s\n", err)
+	}
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithClientOptions(client.WithLoggerOutput(io.Discard), client.WithTunables(tunables)),
+	)
+	if err != nil {
+		b.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	conns := make([]net.Conn, 0, clients)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < clients; i++ {
+		conn, err := net.Dial("tcp", ":1337")
+		if err != nil {
+			// Large client counts may exceed the file descriptor limit.
+			b.Skipf("failed to connect client %d of %d\terr = %s", i+1, clients, err)
+		}
+		conns = append(conns, conn)
+		if _, err := conn.Write(testutil.Login(testutil.GenerateIMEI(i))); err != nil {
+			b.Fatalf("unexpected error = %s\n", err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for svr.Metrics().Clients.Value() < int64(clients) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if connected := svr.Metrics().Clients.Value(); connected != int64(clients) {
+		b.Fatalf("expected %d clients, actual = %d", clients, connected)
+	}
+
+	message := testutil.Reading(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, conn := range conns {
+		go func(conn net.Conn) {
+			for i := 0; i < b.N; i++ {
+				if _, err := conn.Write(message); err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+
+	expected := int64(clients) * int64(b.N)
+	for svr.Metrics().Readings.Value() < expected {
+		if svr.Metrics().Clients.Value() < int64(clients) {
+			b.Fatalf("expected %d clients, actual = %d", clients, svr.Metrics().Clients.Value())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(expected)/b.Elapsed().Seconds(), "readings/s")
+}
+
+func TestRuntimeStats(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Port     int
+		HttpPort int
+		Interval time.Duration
+	}{
+		{
+			Name:     "soak logs runtime stats",
+			Port:     1337,
+			HttpPort: 1338,
+			Interval: 50 * time.Millisecond,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			svr, err := New(
+				test.Port,
+				WithLoggerOutput(w),
+				WithLoggerFlags(0),
+				WithHttpServer(test.HttpPort),
+				WithWorkerPool(2, 16),
+				WithSoak(test.Interval),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
+
+			conn, err := net.Dial("tcp", ":"+strconv.Itoa(test.Port))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write(append([]byte("490154203237518"), "login"...)); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+			}
+			time.Sleep(3 * test.Interval)
+
+			if !bytes.Contains(w.Bytes(), []byte("Runtime Stats\tgoroutines = ")) {
+				t.Errorf("expected runtime stats to be logged, logs = %s", w.Bytes())
+			}
+
+			resp, err := http.Get(fmt.Sprintf("http://localhost:%d/admin/runtime", test.HttpPort))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected status %d, actual = %d", http.StatusOK, resp.StatusCode)
+			}
+			var response struct {
+				Runtime RuntimeStats
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if response.Runtime.Goroutines == 0 || response.Runtime.HeapAlloc == 0 {
+				t.Errorf("expected runtime usage, actual = %+v", response.Runtime)
+			}
+			if response.Runtime.Clients != 1 || response.Runtime.Conns != 1 {
+				t.Errorf("expected 1 client and connection, actual = %+v", response.Runtime)
+			}
+		})
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Port    int
+		Options []ServerOption
+	}{
+		{
+			Name: "connection goroutine",
+			Port: 1337,
+		},
+		{
+			Name:    "reactor worker",
+			Port:    1337,
+			Options: []ServerOption{WithReactor(1)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			w := testutil.NewSafeWriter()
+			panicking := func(*common.LevelLogger, uint64, time.Time, client.Reading) {
+				panic("reading log failed")
+			}
+			options := append([]ServerOption{
+				WithLoggerOutput(w),
+				WithLoggerFlags(0),
+				WithClientOptions(
+					client.WithLoggerOutput(io.Discard),
+					client.WithLogReading(panicking)),
+			}, test.Options...)
+			svr, err := New(test.Port, options...)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
+
+			device := testutil.Dial(t, test.Port)
+			device.Send(testutil.Login(testutil.IMEI), testutil.Reading(t))
+			time.Sleep(100 * time.Millisecond)
+
+			if panics := svr.Metrics().Panics.Value(); panics != 1 {
+				t.Errorf("expected 1 panic, actual = %d", panics)
+			}
+			if clients := svr.Metrics().Clients.Value(); clients != 0 {
+				t.Errorf("expected panicking client to be closed, clients = %d", clients)
+			}
+			if !bytes.Contains(w.Bytes(), []byte("recovered from panic handling")) {
+				t.Errorf("expected recovered panic to be logged, logs = %s", w.Bytes())
+			}
+
+			// The server continues to serve other devices.
+			device = testutil.Dial(t, test.Port)
+			device.Send(testutil.Login(testutil.IMEI))
+			time.Sleep(100 * time.Millisecond)
+			if clients := svr.Metrics().Clients.Value(); clients != 1 {
+				t.Errorf("expected 1 client, actual = %d", clients)
+			}
+		})
+	}
+}
+
+func TestHttpPanicRecovery(t *testing.T) {
+	w := testutil.NewSafeWriter()
+	svr, err := New(1337, WithLoggerOutput(w), WithLoggerFlags(0))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	h := svr.recoverer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("handler failed")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected status %d, actual = %d", http.StatusInternalServerError, rec.Code)
+	}
+	if panics := svr.Metrics().Panics.Value(); panics != 1 {
+		t.Errorf("expected 1 panic, actual = %d", panics)
+	}
+	if !bytes.Contains(w.Bytes(), []byte("recovered from panic handling GET /health")) {
+		t.Errorf("expected recovered panic to be logged, logs = %s", w.Bytes())
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	svr, err := New(1337, WithLoggerOutput(io.Discard))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	newClient := func(imei string) *client.Client {
+		server, device := net.Pipe()
+		t.Cleanup(func() {
+			server.Close()
+			device.Close()
+		})
+		go device.Write([]byte(imei))
+		c, err := client.New(context.Background(), server, client.WithLoggerOutput(io.Discard))
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		return c
+	}
+
+	if err := svr.admit(newClient(testutil.IMEI)); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if err := svr.admit(newClient(testutil.IMEI)); !errors.Is(err, ErrDuplicateIMEI) {
+		t.Errorf("expected error wrapping %v, actual = %v", ErrDuplicateIMEI, err)
+	}
+
+	banned := newClient(testutil.GenerateIMEI(1))
+	svr.quarantine.add(banned.IMEI(), time.Now().Add(time.Minute))
+	if err := svr.admit(banned); !errors.Is(err, ErrBanned) {
+		t.Errorf("expected error wrapping %v, actual = %v", ErrBanned, err)
+	}
+}
+
+func TestAcknowledgements(t *testing.T) {
+	tests := []struct {
+		Name            string
+		Port            int
+		Reading         func(testing.TB) []byte
+		ExpectedType    client.FrameType
+		ExpectedPayload []byte
+	}{
+		{
+			Name:            "reading acknowledged",
+			Port:            1337,
+			Reading:         testutil.Reading,
+			ExpectedType:    client.FrameReadingAck,
+			ExpectedPayload: []byte{},
+		},
+		{
+			Name:            "invalid reading rejected",
+			Port:            1337,
+			Reading:         testutil.InvalidReading,
+			ExpectedType:    client.FrameNack,
+			ExpectedPayload: []byte{byte(client.NackInvalidTemperature)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			svr, err := New(
+				test.Port,
+				WithLoggerOutput(io.Discard),
+				WithAcknowledgements(),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
+
+			device := testutil.Dial(t, test.Port)
+			device.Send(testutil.LoginV2(testutil.IMEI))
+			device.SendFrame(client.FrameReading, test.Reading(t))
+
+			ft, payload := device.ReadFrame(time.Second)
+			if ft != test.ExpectedType {
+				t.Errorf("expected frame type %#x, actual = %#x", test.ExpectedType, ft)
+			}
+			if !bytes.Equal(test.ExpectedPayload, payload) {
+				t.Errorf("expected payload % x, actual = % x", test.ExpectedPayload, payload)
+			}
+		})
+	}
+}
+
+func TestDisconnectReasons(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Port     int
+		HttpPort int
+		Messages [][]byte
+		Wait     time.Duration
+		Expected client.CloseReason
+	}{
+		{
+			Name:     "inactive",
+			Port:     1337,
+			HttpPort: 1338,
+			Messages: [][]byte{testutil.Login(testutil.IMEI)},
+			Wait:     2500 * time.Millisecond,
+			Expected: client.CloseInactive,
+		},
+		{
+			Name:     "login expired",
+			Port:     1337,
+			HttpPort: 1338,
+			Messages: [][]byte{[]byte(testutil.IMEI)},
+			Wait:     1500 * time.Millisecond,
+			Expected: client.CloseLoginExpired,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			svr, err := New(
+				test.Port,
+				WithLoggerOutput(io.Discard),
+				WithHttpServer(test.HttpPort),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
+
+			device := testutil.Dial(t, test.Port)
+			device.Send(test.Messages...)
+			time.Sleep(test.Wait)
+
+			resp, err := http.Get(fmt.Sprintf("http://localhost:%d/status/%s", test.HttpPort, testutil.IMEI))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected status code %d, actual = %d", http.StatusOK, resp.StatusCode)
+			}
+			var actual Presence
+			if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if actual.Online || actual.OfflineSince == nil || actual.CloseReason != test.Expected {
+				t.Errorf("expected offline with close reason %s, actual = %+v", test.Expected, actual)
+			}
+			if n := svr.metrics.Disconnects.Counter(string(test.Expected)).Value(); n != 1 {
+				t.Errorf("expected 1 disconnect, actual = %d", n)
+			}
+		})
+	}
+}
+
+func TestKick(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Options []ServerOption
+	}{
+		{
+			Name: "goroutine per connection",
+		},
+		{
+			Name:    "reactor",
+			Options: []ServerOption{WithReactor(2)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			svr, err := New(
+				1337,
+				append([]ServerOption{WithLoggerOutput(io.Discard), WithHttpServer(1338)}, test.Options...)...,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
+
+			device := testutil.Dial(t, 1337)
+			device.Send(testutil.LoginV2(testutil.IMEI))
+			time.Sleep(100 * time.Millisecond)
+
+			kick := func() int {
+				req, err := http.NewRequest(http.MethodDelete, "http://localhost:1338/devices/"+testutil.IMEI, nil)
+				if err != nil {
+					t.Fatalf("unexpected error = %s\n", err)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("unexpected error = %s\n", err)
+				}
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+
+			if code := kick(); code != http.StatusNoContent {
+				t.Errorf("expected status code %d, actual = %d", http.StatusNoContent, code)
+			}
+			if err := device.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if _, err := device.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("expected error %v, actual = %v", io.EOF, err)
+			}
+			// Reactor connections are released by the reactor's next sweep.
+			time.Sleep(2 * reactorSweepInterval)
+
+			if p, ok := svr.Presence(490154203237518); !ok || p.CloseReason != client.CloseKicked {
+				t.Errorf("expected close reason %s, actual = %+v", client.CloseKicked, p)
+			}
+			if code := kick(); code != http.StatusNotFound {
+				t.Errorf("expected status code %d, actual = %d", http.StatusNotFound, code)
+			}
+		})
+	}
+}
+
+func TestConnectionMetadata(t *testing.T) {
+	tests := []struct {
+		Name string
+		Path string
+	}{
+		{
+			Name: "devices",
+			Path: "/devices/" + testutil.IMEI,
+		},
+		{
+			Name: "status",
+			Path: "/status/" + testutil.IMEI,
+		},
+	}
+
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	time.Sleep(100 * time.Millisecond)
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			resp, err := http.Get("http://localhost:1338" + test.Path)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer resp.Body.Close()
+
+			var actual struct {
+				client.Metadata
+				Device *client.Metadata
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			m := actual.Metadata
+			if actual.Device != nil {
+				m = *actual.Device
+			}
+			if m.RemoteAddr != device.LocalAddr().String() {
+				t.Errorf("expected remote address %s, actual = %s", device.LocalAddr(), m.RemoteAddr)
+			}
+			if m.Protocol != client.ProtocolV2 || m.ConnectedAt.IsZero() || m.TLS != nil {
+				t.Errorf("unexpected metadata = %+v", m)
+			}
+		})
+	}
+}
+
+func TestPresence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "presence.json")
+
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithPresenceFile(path))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	served := make(chan struct{})
+	go func() {
+		svr.ListenAndServe(context.Background())
+		close(served)
+	}()
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.Login(testutil.IMEI), testutil.Reading(t))
+	time.Sleep(100 * time.Millisecond)
+
+	p, ok := svr.Presence(490154203237518)
+	if !ok || !p.Online || p.OfflineSince != nil || p.LastSeen.IsZero() {
+		t.Errorf("expected online presence, actual = %+v", p)
+	}
+	lastSeen := p.LastSeen
+
+	svr.Shutdown()
+	<-served
+
+	// The presence of the device survives the restart.
+	svr, err = New(1337, WithLoggerOutput(io.Discard), WithPresenceFile(path), WithHttpServer(1338))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	resp, err := http.Get("http://localhost:1338/status/" + testutil.IMEI)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, actual = %d", http.StatusOK, resp.StatusCode)
+	}
+	var actual Presence
+	if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if actual.Online || actual.OfflineSince == nil || actual.CloseReason != client.CloseServerShutdown {
+		t.Errorf("expected offline presence, actual = %+v", actual)
+	}
+	if !actual.LastSeen.Equal(lastSeen) {
+		t.Errorf("expected last seen %s, actual = %s", lastSeen, actual.LastSeen)
+	}
+}
+
+func TestPresenceDamping(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Options  []ServerOption
+		Steps    []string
+		Wait     time.Duration
+		Expected []bool
+	}{
+		{
+			Name:     "reconnect within grace",
+			Options:  []ServerOption{WithOfflineGrace(500 * time.Millisecond)},
+			Steps:    []string{"connect", "kick", "connect"},
+			Wait:     700 * time.Millisecond,
+			Expected: []bool{true},
+		},
+		{
+			Name:     "offline after grace",
+			Options:  []ServerOption{WithOfflineGrace(200 * time.Millisecond)},
+			Steps:    []string{"connect", "kick"},
+			Wait:     400 * time.Millisecond,
+			Expected: []bool{true, false},
+		},
+		{
+			Name:     "flapping settles offline",
+			Options:  []ServerOption{WithFlapDamping(2, time.Second)},
+			Steps:    []string{"connect", "kick", "connect", "kick", "connect", "kick"},
+			Wait:     1200 * time.Millisecond,
+			Expected: []bool{true, false, true, false},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var (
+				mu     sync.Mutex
+				events []bool
+			)
+			hook := WithPresenceHook(func(p Presence) {
+				mu.Lock()
+				events = append(events, p.Online)
+				mu.Unlock()
+			})
+			svr, err := New(1337, append([]ServerOption{WithLoggerOutput(io.Discard), hook}, test.Options...)...)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
+
+			for _, step := range test.Steps {
+				switch step {
+				case "connect":
+					device := testutil.Dial(t, 1337)
+					device.Send(testutil.LoginV2(testutil.IMEI))
+				case "kick":
+					if !svr.CloseClient(490154203237518, client.CloseKicked) {
+						t.Fatal("expected client to be connected")
+					}
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+			time.Sleep(test.Wait)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if fmt.Sprint(events) != fmt.Sprint(test.Expected) {
+				t.Errorf("expected presence events %v, actual = %v", test.Expected, events)
+			}
+			if p, _ := svr.Presence(490154203237518); p.Flapping {
+				t.Errorf("expected settled presence, actual = %+v", p)
+			}
+		})
+	}
+}
+
+func TestTenants(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "acme.log"))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer f.Close()
+
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+		WithTenantPrefix("4901", "acme"),
+		WithTenantToken("acme-token", "acme"),
+		WithTenantToken("globex-token", "globex"),
+		WithAdminToken("admin-token"),
+		WithTenantReadingLog("acme", f),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.Login(testutil.IMEI), testutil.Reading(t))
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		Name     string
+		Token    string
+		Path     string
+		Expected int
+	}{
+		{
+			Name:     "health without token",
+			Path:     "/health",
+			Expected: http.StatusOK,
+		},
+		{
+			Name:     "device without token",
+			Path:     "/devices/" + testutil.IMEI,
+			Expected: http.StatusUnauthorized,
+		},
+		{
+			Name:     "device with unknown token",
+			Token:    "unknown-token",
+			Path:     "/devices/" + testutil.IMEI,
+			Expected: http.StatusUnauthorized,
+		},
+		{
+			Name:     "device of tenant",
+			Token:    "acme-token",
+			Path:     "/devices/" + testutil.IMEI,
+			Expected: http.StatusOK,
+		},
+		{
+			Name:     "device of other tenant",
+			Token:    "globex-token",
+			Path:     "/devices/" + testutil.IMEI,
+			Expected: http.StatusNoContent,
+		},
+		{
+			Name:     "reading of other tenant",
+			Token:    "globex-token",
+			Path:     "/readings/" + testutil.IMEI,
+			Expected: http.StatusNoContent,
+		},
+		{
+			Name:     "status of other tenant",
+			Token:    "globex-token",
+			Path:     "/status/" + testutil.IMEI,
+			Expected: http.StatusNoContent,
+		},
+		{
+			Name:     "device as admin",
+			Token:    "admin-token",
+			Path:     "/devices/" + testutil.IMEI,
+			Expected: http.StatusOK,
+		},
+		{
+			Name:     "admin endpoint as tenant",
+			Token:    "acme-token",
+			Path:     "/admin/loglevel",
+			Expected: http.StatusForbidden,
+		},
+		{
+			Name:     "admin endpoint as admin",
+			Token:    "admin-token",
+			Path:     "/admin/loglevel",
+			Expected: http.StatusOK,
+		},
+		{
+			Name:     "other tenant's metrics",
+			Token:    "globex-token",
+			Path:     "/tenants/acme",
+			Expected: http.StatusNotFound,
+		},
+		{
+			Name:     "fleet metrics as tenant",
+			Token:    "acme-token",
+			Path:     "/metrics",
+			Expected: http.StatusForbidden,
+		},
+		{
+			Name:     "fleet metrics as admin",
+			Token:    "admin-token",
+			Path:     "/metrics",
+			Expected: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://localhost:1338"+test.Path, nil)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if test.Token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.Token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.Expected {
+				t.Errorf("expected status %d, actual = %d", test.Expected, resp.StatusCode)
+			}
+		})
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:1338/tenants/acme", nil)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	req.Header.Set("Authorization", "Bearer acme-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer resp.Body.Close()
+	var actual struct {
+		Clients     int
+		Connections int64
+		Readings    int64
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if actual.Clients != 1 || actual.Connections != 1 || actual.Readings != 1 {
+		t.Errorf("unexpected tenant metrics = %+v", actual)
+	}
+
+	// The fleet metrics label the series of every tenant, so only the admin
+	// sees acme's labels.
+	label := []byte(`tenant="acme"`)
+	for token, visible := range map[string]bool{"globex-token": false, "admin-token": true} {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:1338/metrics", nil)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		if bytes.Contains(b, label) != visible {
+			t.Errorf("%s: expected acme labels visible = %t, actual = %s", token, visible, b)
+		}
+	}
+
+	p, ok := svr.Presence(490154203237518)
+	if !ok || p.Tenant != "acme" {
+		t.Errorf("expected acme presence, actual = %+v", p)
+	}
+
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if !bytes.Contains(b, []byte(","+testutil.IMEI+",")) {
+		t.Errorf("expected reading exported to tenant log, actual = %q", b)
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithTenantPrefix("4901", "acme"),
+		WithTenantQuota("acme", Quota{Connections: 1, ReadingsPerSecond: 1}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.Login(testutil.IMEI), testutil.Reading(t), testutil.Reading(t), testutil.Reading(t))
+	time.Sleep(200 * time.Millisecond)
+
+	refused := testutil.Dial(t, 1337)
+	refused.Send(testutil.Login(testutil.GenerateIMEI(1)))
+	if err := refused.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	// The refused connection is closed with its login unread, and may be
+	// reset rather than closed gracefully.
+	_, err = refused.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Errorf("expected refused connection closed, actual = %v", err)
+	}
+
+	m := svr.Metrics()
+	if n := m.Readings.Value(); n != 1 {
+		t.Errorf("expected 1 reading, actual = %d", n)
+	}
+	exceeded := m.TenantQuotaExceeded.Snapshot()
+	if exceeded["acme.readings"] != 2 || exceeded["acme.connections"] != 1 {
+		t.Errorf("unexpected quota exceeded = %v", exceeded)
+	}
+	if n := m.Clients.Value(); n != 1 {
+		t.Errorf("expected 1 client, actual = %d", n)
+	}
+}
+
+func TestGroups(t *testing.T) {
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	imeis := []string{testutil.IMEI, testutil.GenerateIMEI(1)}
+	for _, imei := range imeis {
+		device := testutil.Dial(t, 1337)
+		device.Send(testutil.Login(imei), testutil.Reading(t))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	do := func(method, path string) *http.Response {
+		req, err := http.NewRequest(method, "http://localhost:1338"+path, nil)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		Name     string
+		Method   string
+		Path     string
+		Expected int
+	}{
+		{
+			Name:     "assign device",
+			Method:   http.MethodPut,
+			Path:     "/groups/north/devices/" + imeis[0],
+			Expected: http.StatusNoContent,
+		},
+		{
+			Name:     "assign second device",
+			Method:   http.MethodPut,
+			Path:     "/groups/north/devices/" + imeis[1],
+			Expected: http.StatusNoContent,
+		},
+		{
+			Name:     "assign unknown device",
+			Method:   http.MethodPut,
+			Path:     "/groups/north/devices/" + testutil.GenerateIMEI(2),
+			Expected: http.StatusNotFound,
+		},
+		{
+			Name:     "unknown group",
+			Method:   http.MethodGet,
+			Path:     "/groups/south",
+			Expected: http.StatusNotFound,
+		},
+		{
+			Name:     "unassign unassigned device",
+			Method:   http.MethodDelete,
+			Path:     "/groups/south/devices/" + imeis[0],
+			Expected: http.StatusNotFound,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			resp := do(test.Method, test.Path)
+			resp.Body.Close()
+			if resp.StatusCode != test.Expected {
+				t.Errorf("expected status %d, actual = %d", test.Expected, resp.StatusCode)
+			}
+		})
+	}
+
+	resp := do(http.MethodGet, "/groups/north")
+	defer resp.Body.Close()
+	var actual struct {
+		Devices   []Presence
+		Aggregate Aggregate
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if len(actual.Devices) != 2 || !actual.Devices[0].Online || !actual.Devices[1].Online {
+		t.Errorf("unexpected devices = %+v", actual.Devices)
+	}
+	a := actual.Aggregate
+	if a.Devices != 2 || a.Online != 2 || a.Readings != 2 || a.Temperature == nil || a.Temperature.Mean != 67.77 {
+		t.Errorf("unexpected aggregate = %+v", a)
+	}
+
+	unassign := do(http.MethodDelete, "/groups/north/devices/"+imeis[0])
+	unassign.Body.Close()
+	if unassign.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status %d, actual = %d", http.StatusNoContent, unassign.StatusCode)
+	}
+	if imeis, ok := svr.groups.members("", "north"); !ok || len(imeis) != 1 {
+		t.Errorf("expected 1 member, actual = %v", imeis)
+	}
+}
+
+func TestFleetAggregate(t *testing.T) {
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	cold, err := client.Reading{Temperature: 20, BatteryLevel: 0.5}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	devices := []struct {
+		IMEI    string
+		Reading []byte
+	}{
+		{IMEI: testutil.IMEI, Reading: testutil.Reading(t)},
+		{IMEI: testutil.GenerateIMEI(1), Reading: cold},
+		{IMEI: testutil.GenerateIMEI(2), Reading: cold},
+	}
+	for _, d := range devices {
+		device := testutil.Dial(t, 1337)
+		device.Send(testutil.Login(d.IMEI), d.Reading)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The last device is kicked, and is offline.
+	kicked, err := strconv.ParseUint(devices[2].IMEI, 10, 64)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if !svr.CloseClient(kicked, client.CloseKicked) {
+		t.Fatalf("expected %d to be connected", kicked)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		Name     string
+		Query    string
+		Status   int
+		Expected Aggregate
+	}{
+		{
+			Name:   "fleet",
+			Status: http.StatusOK,
+			Expected: Aggregate{
+				Devices:      3,
+				Online:       2,
+				Offline:      1,
+				Readings:     2,
+				Temperature:  &Range{Min: 20, Max: 67.77, Mean: (20 + 67.77) / 2},
+				BatteryLevel: &Range{Min: 0.25666, Max: 0.5, Mean: (0.25666 + 0.5) / 2},
+			},
+		},
+		{
+			Name:   "protocol filter",
+			Query:  "?protocol=1",
+			Status: http.StatusOK,
+			Expected: Aggregate{
+				Devices:      2,
+				Online:       2,
+				Readings:     2,
+				Temperature:  &Range{Min: 20, Max: 67.77, Mean: (20 + 67.77) / 2},
+				BatteryLevel: &Range{Min: 0.25666, Max: 0.5, Mean: (0.25666 + 0.5) / 2},
+			},
+		},
+		{
+			Name:     "unmatched protocol filter",
+			Query:    "?protocol=2",
+			Status:   http.StatusOK,
+			Expected: Aggregate{},
+		},
+		{
+			Name:     "unknown group filter",
+			Query:    "?group=north",
+			Status:   http.StatusOK,
+			Expected: Aggregate{},
+		},
+		{
+			Name:   "invalid protocol filter",
+			Query:  "?protocol=v1",
+			Status: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			resp, err := http.Get("http://localhost:1338/v1/fleet/aggregate" + test.Query)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.Status {
+				t.Fatalf("expected status %d, actual = %d", test.Status, resp.StatusCode)
+			}
+			if test.Status != http.StatusOK {
+				return
+			}
+
+			var actual Aggregate
+			if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			expected, _ := json.Marshal(test.Expected)
+			b, _ := json.Marshal(actual)
+			if !bytes.Equal(expected, b) {
+				t.Errorf("expected != actual\nexpected = %s\nactual = %s\n", expected, b)
+			}
+		})
+	}
+}
+
+func TestSummary(t *testing.T) {
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	cold, err := client.Reading{Temperature: 20, BatteryLevel: 0.5}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	devices := []struct {
+		IMEI     string
+		Messages [][]byte
+	}{
+		{IMEI: testutil.IMEI, Messages: [][]byte{testutil.Reading(t)}},
+		{IMEI: testutil.GenerateIMEI(1), Messages: [][]byte{testutil.InvalidReading(t), cold}},
+		{IMEI: testutil.GenerateIMEI(2)},
+	}
+	for _, d := range devices {
+		device := testutil.Dial(t, 1337)
+		device.Send(append([][]byte{testutil.Login(d.IMEI)}, d.Messages...)...)
+		time.Sleep(50 * time.Millisecond)
+	}
+	kicked, err := strconv.ParseUint(devices[2].IMEI, 10, 64)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	svr.CloseClient(kicked, client.CloseKicked)
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get("http://localhost:1338/v1/summary")
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer resp.Body.Close()
+	var actual Summary
+	if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	if actual.Online != 2 || actual.Offline != 1 {
+		t.Errorf("expected 2 online and 1 offline, actual = %d and %d", actual.Online, actual.Offline)
+	}
+	if actual.IngestRate <= 0 {
+		t.Errorf("expected positive ingest rate, actual = %f", actual.IngestRate)
+	}
+	if n := len(actual.RecentConnects); n != 3 || actual.RecentConnects[0].IMEI != kicked {
+		t.Errorf("unexpected recent connects = %+v", actual.RecentConnects)
+	}
+	if n := len(actual.RecentDisconnects); n != 1 || actual.RecentDisconnects[0].CloseReason != client.CloseKicked {
+		t.Errorf("unexpected recent disconnects = %+v", actual.RecentDisconnects)
+	}
+	if n := len(actual.TopDecodeErrors); n != 1 || actual.TopDecodeErrors[0].DecodeErrors != 1 {
+		t.Errorf("unexpected top decode errors = %+v", actual.TopDecodeErrors)
+	}
+	if n := len(actual.LowestBattery); n != 2 || actual.LowestBattery[0].BatteryLevel != 0.25666 {
+		t.Errorf("unexpected lowest battery = %+v", actual.LowestBattery)
+	}
+}
+
+func TestGrafana(t *testing.T) {
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338), WithReadingHistory(10))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	reading := testutil.Reading(t)
+	device := testutil.Dial(t, 1337)
+	device.Send(
+		testutil.LoginV2(testutil.IMEI),
+		client.AppendFrame(nil, client.FrameReading, reading),
+		client.AppendFrame(nil, client.FrameAlarm, reading))
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Get("http://localhost:1338/v1/grafana/")
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, actual = %d", http.StatusOK, resp.StatusCode)
+	}
+
+	from := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	to := time.Now().Add(time.Minute).UTC().Format(time.RFC3339)
+	tests := []struct {
+		Name     string
+		Method   string
+		Body     string
+		Expected string
+	}{
+		{
+			Name:     "search",
+			Method:   "search",
+			Body:     `{"target":"temp"}`,
+			Expected: `["490154203237518.temperature"]`,
+		},
+		{
+			Name:     "query",
+			Method:   "query",
+			Body:     `{"range":{"from":"` + from + `","to":"` + to + `"},"targets":[{"target":"490154203237518.temperature"},{"target":"490154203237518.humidity"}]}`,
+			Expected: `[{"datapoints":[[67.77,0],[67.77,0]],"target":"490154203237518.temperature"},{"datapoints":[],"target":"490154203237518.humidity"}]`,
+		},
+		{
+			Name:     "query max data points",
+			Method:   "query",
+			Body:     `{"range":{"from":"` + from + `","to":"` + to + `"},"targets":[{"target":"490154203237518.battery_level"}],"maxDataPoints":1}`,
+			Expected: `[{"datapoints":[[0.25666,0]],"target":"490154203237518.battery_level"}]`,
+		},
+		{
+			Name:     "annotations",
+			Method:   "annotations",
+			Body:     `{"range":{"from":"` + from + `","to":"` + to + `"},"annotation":{"query":"490154203237518"}}`,
+			Expected: `[{"annotation":{"query":"490154203237518"},"tags":["alarm","490154203237518"],"text":"","time":0,"title":"Alarm"}]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			resp, err := http.Post("http://localhost:1338/v1/grafana/"+test.Method, "application/json", bytes.NewBufferString(test.Body))
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status %d, actual = %d", http.StatusOK, resp.StatusCode)
+			}
+
+			// Times and texts vary between runs, and are zeroed before
+			// comparison. Keys are compared in sorted order.
+			var actual interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&actual); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			switch v := actual.(type) {
+			case []interface{}:
+				for _, e := range v {
+					switch e := e.(type) {
+					case map[string]interface{}:
+						if _, ok := e["time"]; ok {
+							e["time"], e["text"] = 0, ""
+						}
+						if points, ok := e["datapoints"].([]interface{}); ok {
+							for _, p := range points {
+								p.([]interface{})[1] = 0
+							}
+						}
+					}
+				}
+			}
+			b, err := json.Marshal(actual)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if string(b) != test.Expected {
+				t.Errorf("expected != actual\nexpected = %s\nactual = %s\n", test.Expected, b)
+			}
+		})
+	}
+}
+
+// coapRequest builds a CoAP request of type typ and code, posted to the
+// segments of path.
+func coapRequest(typ, code byte, messageID uint16, token []byte, path []string, payload []byte) []byte {
+	return coapMessage{
+		typ:       typ,
+		code:      code,
+		messageID: messageID,
+		token:     token,
+		path:      path,
+		payload:   payload,
+	}.append(nil)
+}
+
+func TestCoAP(t *testing.T) {
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithCoAP(1337),
+		WithDatagramIdleTimeout(time.Second),
+		WithClientOptions(client.WithLogReading(func(*common.LevelLogger, uint64, time.Time, client.Reading) {})),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	device, err := net.Dial("udp", "localhost:1337")
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer device.Close()
+	exchange := func(request []byte) coapMessage {
+		if _, err := device.Write(request); err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		if err := device.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		b := make([]byte, maxCoAPMessage)
+		n, err := device.Read(b)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		response, err := parseCoAP(b[:n])
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		return response
+	}
+
+	path := []string{coapReadingsPath, testutil.IMEI}
+	token := []byte{0xca, 0xfe}
+	tests := []struct {
+		Name    string
+		Request []byte
+		Type    byte
+		Code    byte
+	}{
+		{
+			Name:    "reading",
+			Request: coapRequest(coapConfirmable, coapPost, 1, token, path, testutil.Reading(t)),
+			Type:    coapAcknowledgment,
+			Code:    coapChanged,
+		},
+		{
+			Name:    "retransmitted reading",
+			Request: coapRequest(coapConfirmable, coapPost, 1, token, path, testutil.Reading(t)),
+			Type:    coapAcknowledgment,
+			Code:    coapChanged,
+		},
+		{
+			Name:    "invalid reading",
+			Request: coapRequest(coapConfirmable, coapPost, 2, token, path, testutil.InvalidReading(t)),
+			Type:    coapAcknowledgment,
+			Code:    coapBadRequest,
+		},
+		{
+			Name:    "short reading",
+			Request: coapRequest(coapConfirmable, coapPost, 3, token, path, []byte{1, 2, 3}),
+			Type:    coapAcknowledgment,
+			Code:    coapBadRequest,
+		},
+		{
+			Name:    "invalid imei",
+			Request: coapRequest(coapConfirmable, coapPost, 4, token, []string{coapReadingsPath, "49015420323751"}, testutil.Reading(t)),
+			Type:    coapAcknowledgment,
+			Code:    coapBadRequest,
+		},
+		{
+			Name:    "unknown path",
+			Request: coapRequest(coapConfirmable, coapPost, 5, token, []string{"status"}, testutil.Reading(t)),
+			Type:    coapAcknowledgment,
+			Code:    coapNotFound,
+		},
+		{
+			Name:    "get",
+			Request: coapRequest(coapConfirmable, 0x01, 6, token, path, nil),
+			Type:    coapAcknowledgment,
+			Code:    coapMethodNotAllowed,
+		},
+		{
+			Name:    "ping",
+			Request: coapRequest(coapConfirmable, coapEmpty, 7, nil, nil, nil),
+			Type:    coapReset,
+			Code:    coapEmpty,
+		},
+	}
+	for _, test := range tests {
+		response := exchange(test.Request)
+		if response.typ != test.Type || response.code != test.Code {
+			t.Errorf("%s: expected type %d code %#x, actual = type %d code %#x", test.Name, test.Type, test.Code, response.typ, response.code)
+		}
+		if test.Type == coapAcknowledgment && !bytes.Equal(response.token, token) {
+			t.Errorf("%s: expected token %x, actual = %x", test.Name, token, response.token)
+		}
+	}
+
+	// Non-confirmable readings are stored without being answered.
+	if _, err := device.Write(coapRequest(coapNonConfirmable, coapPost, 8, nil, path, testutil.Reading(t))); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	clients := svr.Clients()
+	if len(clients) != 1 || clients[0].IMEI() != 490154203237518 {
+		t.Fatalf("expected client %s, actual = %v", testutil.IMEI, clients)
+	}
+	if stats := clients[0].Stats(); stats.Readings != 2 || stats.DecodeErrors != 2 {
+		t.Errorf("expected 2 readings and 2 decode errors, actual = %+v", stats)
+	}
+	if p, ok := svr.Presence(490154203237518); !ok || !p.Online {
+		t.Errorf("expected online presence, actual = %+v", p)
+	}
+
+	time.Sleep(time.Second + 2*datagramSweepInterval)
+	if p, ok := svr.Presence(490154203237518); !ok || p.Online || p.CloseReason != client.CloseInactive {
+		t.Errorf("expected close reason %s, actual = %+v", client.CloseInactive, p)
+	}
+	if clients := svr.Clients(); len(clients) != 0 {
+		t.Errorf("expected no clients, actual = %d", len(clients))
+	}
+}
+
+func TestLwM2M(t *testing.T) {
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithCoAP(1337),
+		WithClientOptions(client.WithLogReading(func(*common.LevelLogger, uint64, time.Time, client.Reading) {})),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	var messageID uint16
+	exchange := func(device net.Conn, request coapMessage) coapMessage {
+		messageID++
+		request.typ = coapConfirmable
+		request.messageID = messageID
+		if _, err := device.Write(request.append(nil)); err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		if err := device.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		b := make([]byte, maxCoAPMessage)
+		n, err := device.Read(b)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		response, err := parseCoAP(b[:n])
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		if response.messageID != messageID {
+			t.Fatalf("expected message ID %d, actual = %d", messageID, response.messageID)
+		}
+		return response
+	}
+	dial := func() net.Conn {
+		device, err := net.Dial("udp", "localhost:1337")
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		t.Cleanup(func() { device.Close() })
+		return device
+	}
+	send := func(device net.Conn, senml string) coapMessage {
+		return exchange(device, coapMessage{
+			code:             coapPost,
+			path:             []string{lwm2mSendPath},
+			contentFormat:    110,
+			hasContentFormat: true,
+			payload:          []byte(senml),
+		})
+	}
+	device := dial()
+
+	if response := send(device, `[{"n":"/3303/0/5700","v":21.5}]`); response.code != coapForbidden {
+		t.Errorf("expected unregistered send code %#x, actual = %#x", coapForbidden, response.code)
+	}
+
+	register := exchange(device, coapMessage{
+		code:    coapPost,
+		path:    []string{lwm2mRegistrationPath},
+		query:   []string{"ep=urn:imei:" + testutil.IMEI, "lt=300", "lwm2m=1.1"},
+		payload: []byte("</3303/0>,</6/0>,</3/0>"),
+	})
+	if register.code != coapCreated || len(register.location) != 2 || register.location[0] != lwm2mRegistrationPath {
+		t.Fatalf("unexpected registration response = %+v", register)
+	}
+	location := register.location
+
+	tests := []struct {
+		Name     string
+		SenML    string
+		Code     byte
+		Expected client.Reading
+	}{
+		{
+			Name:     "temperature and battery",
+			SenML:    `[{"bn":"/3303/0/","n":"5700","v":21.5},{"bn":"/3/0/","n":"9","v":87}]`,
+			Code:     coapChanged,
+			Expected: client.Reading{Temperature: 21.5, BatteryLevel: 87},
+		},
+		{
+			Name:     "location",
+			SenML:    `[{"bn":"/6/0/","n":"0","v":33.41},{"n":"1","v":44.4},{"n":"2","v":120}]`,
+			Code:     coapChanged,
+			Expected: client.Reading{Temperature: 21.5, BatteryLevel: 87, Latitude: 33.41, Longitude: 44.4, Altitude: 120},
+		},
+		{
+			Name:     "unmapped resources",
+			SenML:    `[{"n":"/3/0/0","vs":"thermomatic"}]`,
+			Code:     coapBadRequest,
+			Expected: client.Reading{Temperature: 21.5, BatteryLevel: 87, Latitude: 33.41, Longitude: 44.4, Altitude: 120},
+		},
+		{
+			Name:     "out of range",
+			SenML:    `[{"n":"/3/0/9","v":101}]`,
+			Code:     coapBadRequest,
+			Expected: client.Reading{Temperature: 21.5, BatteryLevel: 87, Latitude: 33.41, Longitude: 44.4, Altitude: 120},
+		},
+	}
+	for _, test := range tests {
+		if response := send(device, test.SenML); response.code != test.Code {
+			t.Errorf("%s: expected code %#x, actual = %#x", test.Name, test.Code, response.code)
+		}
+		clients := svr.Clients()
+		if len(clients) != 1 {
+			t.Fatalf("%s: expected 1 client, actual = %d", test.Name, len(clients))
+		}
+		if reading := clients[0].LastReading(); reading != test.Expected {
+			t.Errorf("%s: expected reading %+v, actual = %+v", test.Name, test.Expected, reading)
+		}
+	}
+
+	// Updating the registration from a new address rebinds the device.
+	moved := dial()
+	if response := exchange(moved, coapMessage{code: coapPost, path: location}); response.code != coapChanged {
+		t.Errorf("expected update code %#x, actual = %#x", coapChanged, response.code)
+	}
+	if response := send(moved, `[{"n":"/3303/0/5700","v":22}]`); response.code != coapChanged {
+		t.Errorf("expected send code %#x, actual = %#x", coapChanged, response.code)
+	}
+	if response := send(device, `[{"n":"/3303/0/5700","v":22}]`); response.code != coapForbidden {
+		t.Errorf("expected stale send code %#x, actual = %#x", coapForbidden, response.code)
+	}
+
+	if response := exchange(moved, coapMessage{code: coapDelete, path: location}); response.code != coapDeleted {
+		t.Errorf("expected deregistration code %#x, actual = %#x", coapDeleted, response.code)
+	}
+	if p, ok := svr.Presence(490154203237518); !ok || p.Online || p.CloseReason != client.ClosePeerReset {
+		t.Errorf("expected close reason %s, actual = %+v", client.ClosePeerReset, p)
+	}
+	if response := exchange(moved, coapMessage{code: coapDelete, path: location}); response.code != coapNotFound {
+		t.Errorf("expected repeated deregistration code %#x, actual = %#x", coapNotFound, response.code)
+	}
+}
+
+func TestUDPIngest(t *testing.T) {
+	key := []byte("secret")
+	sign := func(b []byte) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(b)
+		return mac.Sum(b)
+	}
+	datagram := func(reading []byte) []byte {
+		return append([]byte(testutil.IMEI), reading...)
+	}
+
+	tests := []struct {
+		Name         string
+		Key          []byte
+		Datagrams    [][]byte
+		Readings     int64
+		DecodeErrors int64
+	}{
+		{
+			Name: "unauthenticated",
+			Datagrams: [][]byte{
+				datagram(testutil.Reading(t)),
+				datagram(testutil.InvalidReading(t)),
+				datagram(testutil.Reading(t))[:30],
+				append([]byte("490154203237519"), testutil.Reading(t)...),
+				datagram(testutil.Reading(t)),
+			},
+			Readings:     2,
+			DecodeErrors: 1,
+		},
+		{
+			Name: "hmac",
+			Key:  key,
+			Datagrams: [][]byte{
+				sign(datagram(testutil.Reading(t))),
+				datagram(testutil.Reading(t)),
+				append(datagram(testutil.Reading(t)), make([]byte, sha256.Size)...),
+				sign(datagram(testutil.InvalidReading(t))),
+			},
+			Readings:     1,
+			DecodeErrors: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			svr, err := New(
+				1337,
+				WithLoggerOutput(io.Discard),
+				WithUDPIngest(1337, test.Key),
+				WithClientOptions(client.WithLogReading(func(*common.LevelLogger, uint64, time.Time, client.Reading) {})),
+			)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
+
+			device, err := net.Dial("udp", "localhost:1337")
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer device.Close()
+			for _, b := range test.Datagrams {
+				if _, err := device.Write(b); err != nil {
+					t.Fatalf("unexpected error = %s\n", err)
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			clients := svr.Clients()
+			if len(clients) != 1 || clients[0].IMEI() != 490154203237518 {
+				t.Fatalf("expected client %s, actual = %v", testutil.IMEI, clients)
+			}
+			if stats := clients[0].Stats(); stats.Readings != test.Readings || stats.DecodeErrors != test.DecodeErrors {
+				t.Errorf("expected %d readings and %d decode errors, actual = %+v", test.Readings, test.DecodeErrors, stats)
+			}
+		})
+	}
+}
+
+// wsFrame builds a final, masked WebSocket frame of opcode with payload, as
+// sent by a device.
+func wsFrame(opcode byte, payload []byte) []byte {
+	mask := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	b := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		b = append(b, 0x80|byte(len(payload)))
+	default:
+		b = append(b, 0x80|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	}
+	b = append(b, mask[:]...)
+	for i, v := range payload {
+		b = append(b, v^mask[i%len(mask)])
+	}
+	return b
+}
+
+// readWSFrame reads an unmasked WebSocket frame, as sent by the Server.
+func readWSFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatalf("expected unmasked frame")
+	}
+	payload := make([]byte, header[1]&0x7f)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+func TestWebSocketIngest(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Options []ServerOption
+	}{
+		{
+			Name: "goroutine per connection",
+		},
+		{
+			Name:    "reactor",
+			Options: []ServerOption{WithReactor(2)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			svr, err := New(
+				1337,
+				append([]ServerOption{
+					WithLoggerOutput(io.Discard),
+					WithHttpServer(1338),
+					WithAdminToken("admin"),
+					WithAcknowledgements(),
+					WithClientOptions(client.WithLogReading(func(*common.LevelLogger, uint64, time.Time, client.Reading) {})),
+				}, test.Options...)...,
+			)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer svr.Shutdown()
+			go svr.ListenAndServe(context.Background())
+			time.Sleep(100 * time.Millisecond)
+
+			// Requests that are not handshakes are refused.
+			resp, err := http.Get("http://localhost:1338/v1/ingest")
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("expected status code %d, actual = %d", http.StatusBadRequest, resp.StatusCode)
+			}
+
+			conn, err := net.Dial("tcp", "localhost:1338")
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			defer conn.Close()
+			if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			fmt.Fprint(conn, "GET /v1/ingest HTTP/1.1\r\n"+
+				"Host: localhost:1338\r\n"+
+				"Upgrade: websocket\r\n"+
+				"Connection: Upgrade\r\n"+
+				"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+				"Sec-WebSocket-Version: 13\r\n\r\n")
+			r := bufio.NewReader(conn)
+			resp, err = http.ReadResponse(r, nil)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("expected status code %d, actual = %d", http.StatusSwitchingProtocols, resp.StatusCode)
+			}
+			if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+				t.Errorf("unexpected Sec-WebSocket-Accept = %s", accept)
+			}
+
+			// Message boundaries need not align with frames.
+			login := testutil.LoginV2(testutil.IMEI)
+			reading := client.AppendFrame(nil, client.FrameReading, testutil.Reading(t))
+			for _, frame := range [][]byte{
+				wsFrame(wsBinary, login[:10]),
+				wsFrame(wsBinary, append(login[10:], reading[:5]...)),
+				wsFrame(wsPing, []byte("ping")),
+				wsFrame(wsBinary, reading[5:]),
+			} {
+				if _, err := conn.Write(frame); err != nil {
+					t.Fatalf("unexpected error = %s\n", err)
+				}
+			}
+
+			if opcode, payload := readWSFrame(t, r); opcode != wsPong || string(payload) != "ping" {
+				t.Errorf("expected pong, actual = opcode %#x payload %q", opcode, payload)
+			}
+			opcode, payload := readWSFrame(t, r)
+			if opcode != wsBinary || !bytes.Equal(payload, client.AppendFrame(nil, client.FrameReadingAck, nil)) {
+				t.Errorf("expected reading ack, actual = opcode %#x payload %x", opcode, payload)
+			}
+			clients := svr.Clients()
+			if len(clients) != 1 || clients[0].Stats().Readings != 1 {
+				t.Fatalf("expected 1 client with 1 reading, actual = %v", clients)
+			}
+
+			if _, err := conn.Write(wsFrame(wsClose, binary.BigEndian.AppendUint16(nil, 1000))); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if opcode, payload := readWSFrame(t, r); opcode != wsClose || !bytes.Equal(payload, binary.BigEndian.AppendUint16(nil, 1000)) {
+				t.Errorf("expected close, actual = opcode %#x payload %x", opcode, payload)
+			}
+		})
+	}
+}
+
+// testStore is a plugin.Exporter recording the readings it is passed, and
+// whether it was run and closed.
+type testStore struct {
+	mu       sync.Mutex
+	readings []client.Reading
+	ran      bool
+	closed   bool
+}
+
+func (s *testStore) StoreReading(_ uint64, _ time.Time, reading client.Reading) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readings = append(s.readings, reading)
+}
+
+func (s *testStore) Run() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ran = true
+	return nil
+}
+
+func (s *testStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *testStore) state() (int, bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.readings), s.ran, s.closed
+}
+
+// testAuthenticator authenticates its token as the tenant "acme".
+type testAuthenticator string
+
+func (a testAuthenticator) Authenticate(token string) (plugin.Identity, bool) {
+	return plugin.Identity{Tenant: "acme"}, token == string(a)
+}
+
+// countingGeocoder names places by their coordinates, and counts the
+// positions it geocodes.
+type countingGeocoder struct {
+	calls atomic.Int32
+}
+
+func (g *countingGeocoder) ReverseGeocode(_ context.Context, latitude, longitude float64) (string, error) {
+	g.calls.Add(1)
+	return fmt.Sprintf("%.3f,%.3f", latitude, longitude), nil
+}
+
+var testGeocoder = new(countingGeocoder)
+
+var testPlugins = struct {
+	store    *testStore
+	exporter *testStore
+}{store: new(testStore), exporter: new(testStore)}
+
+func init() {
+	plugin.RegisterStore("test", func(string) (plugin.Store, error) { return testPlugins.store, nil })
+	plugin.RegisterExporter("test", func(string, plugin.ExporterOptions) (plugin.Exporter, error) { return testPlugins.exporter, nil })
+	plugin.RegisterAuthenticator("test", func(config string) (plugin.Authenticator, error) {
+		return testAuthenticator(config), nil
+	})
+	plugin.RegisterGeocoder("test", func(string) (plugin.Geocoder, error) { return testGeocoder, nil })
+}
+
+func TestPlugins(t *testing.T) {
+	if _, err := New(1337, WithLoggerOutput(io.Discard), WithExporter("missing", "")); !errors.Is(err, plugin.ErrUnknownPlugin) {
+		t.Fatalf("expected error wrapping %v, actual = %v", plugin.ErrUnknownPlugin, err)
+	}
+
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+		WithStore("test", ""),
+		WithExporter("test", ""),
+		WithAuthenticator("test", "secret"),
+		WithClientOptions(client.WithLogReading(func(*common.LevelLogger, uint64, time.Time, client.Reading) {})),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	device.SendFrame(client.FrameReading, testutil.Reading(t))
+	time.Sleep(100 * time.Millisecond)
+
+	for name, s := range map[string]*testStore{"store": testPlugins.store, "exporter": testPlugins.exporter} {
+		if readings, _, _ := s.state(); readings != 1 {
+			t.Errorf("expected %s to be passed 1 reading, actual = %d", name, readings)
+		}
+	}
+	if _, ran, _ := testPlugins.exporter.state(); !ran {
+		t.Error("expected exporter to run")
+	}
+
+	tests := []struct {
+		Name     string
+		Token    string
+		Path     string
+		Expected int
+	}{
+		{Name: "authenticated", Token: "secret", Path: "/readings/" + testutil.IMEI, Expected: http.StatusNoContent},
+		{Name: "unknown token", Token: "wrong", Path: "/readings/" + testutil.IMEI, Expected: http.StatusUnauthorized},
+		{Name: "tenant scoped", Token: "secret", Path: pathAdminLogLevel, Expected: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://localhost:1338"+test.Path, nil)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			req.Header.Set("Authorization", "Bearer "+test.Token)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.Expected {
+				t.Errorf("expected status %d, actual = %d", test.Expected, resp.StatusCode)
+			}
+		})
+	}
+
+	svr.Shutdown()
+	for name, s := range map[string]*testStore{"store": testPlugins.store, "exporter": testPlugins.exporter} {
+		if _, _, closed := s.state(); !closed {
+			t.Errorf("expected %s to be closed", name)
+		}
+	}
+}
+
+func TestExporterDryRun(t *testing.T) {
+	w := testutil.NewSafeWriter()
+	// Nothing listens at the receiver's address; a dry run never dials it.
+	svr, err := New(1337, WithLoggerOutput(w), WithExporterDryRun("graphite", export.GraphiteURL("tcp", "127.0.0.1:1", "fleet", 50*time.Millisecond)))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	device.SendFrame(client.FrameReading, testutil.Reading(t))
+	time.Sleep(200 * time.Millisecond)
+
+	for _, expected := range []string{
+		"dry run: graphite would send 1 readings to tcp://127.0.0.1:1",
+		"dry run: fleet." + testutil.IMEI + ".temperature ",
+	} {
+		if !bytes.Contains(w.Bytes(), []byte(expected)) {
+			t.Errorf("expected log to contain %q, actual = %s", expected, w.Bytes())
+		}
+	}
+}
+
+func TestExporterAnonymized(t *testing.T) {
+	config := export.GraphiteURL("udp", "127.0.0.1:1", "fleet", 50*time.Millisecond)
+	if _, err := New(1337, WithLoggerOutput(io.Discard), WithExporterAnonymized("graphite", config, nil, 2)); !errors.Is(err, errInvalidAnonymization) {
+		t.Fatalf("expected error wrapping %v, actual = %v", errInvalidAnonymization, err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer conn.Close()
+	config = export.GraphiteURL("udp", conn.LocalAddr().String(), "fleet", 50*time.Millisecond)
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithExporterAnonymized("graphite", config, []byte("secret"), 1))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	device.SendFrame(client.FrameReading, testutil.Reading(t))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var received []byte
+	for !bytes.Contains(received, []byte(".longitude ")) {
+		b := make([]byte, 64<<10)
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("unexpected error = %s, received = %s\n", err, received)
+		}
+		received = append(received, b[:n]...)
+	}
+	if bytes.Contains(received, []byte(testutil.IMEI)) {
+		t.Errorf("expected IMEI to be anonymized, received = %s", received)
+	}
+	for _, line := range strings.Split(string(received), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || !(strings.HasSuffix(fields[0], ".latitude") || strings.HasSuffix(fields[0], ".longitude")) {
+			continue
+		}
+		if _, frac, ok := strings.Cut(fields[1], "."); ok && len(frac) > 1 {
+			t.Errorf("expected position rounded to 1 decimal place, actual = %s", line)
+		}
+	}
+}
+
+// httpDoClient does not reuse connections, as Servers are restarted between
+// requests.
+var httpDoClient = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+// httpDo sends an http request with body to path of the Server listening on
+// port 1338, fails t unless it responds with status expected, and retrieves
+// the response body.
+func httpDo(t *testing.T, method, path, body string, expected int) []byte {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://localhost:1338"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	resp, err := httpDoClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if resp.StatusCode != expected {
+		t.Fatalf("%s %s: expected status %d, actual = %d", method, path, expected, resp.StatusCode)
+	}
+	return b
+}
+
+func TestFirmwareAbort(t *testing.T) {
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	time.Sleep(100 * time.Millisecond)
+
+	path := "/admin/firmware/" + testutil.IMEI
+	httpDo(t, http.MethodDelete, path, "", http.StatusNotFound)
+
+	// The device never acks the first chunk, so the transfer stalls.
+	httpDo(t, http.MethodPost, path, "image", http.StatusAccepted)
+	if ft, _ := device.ReadFrame(time.Second); ft != client.FrameFirmwareChunk {
+		t.Fatalf("expected frame %v, actual = %v", client.FrameFirmwareChunk, ft)
+	}
+	httpDo(t, http.MethodPost, path, "image", http.StatusConflict)
+
+	var actual struct {
+		Transfer client.Transfer
+	}
+	if err := json.Unmarshal(httpDo(t, http.MethodDelete, path, "", http.StatusOK), &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if actual.Transfer.Status != client.TransferAborted {
+		t.Errorf("expected status %s, actual = %s", client.TransferAborted, actual.Transfer.Status)
+	}
+	httpDo(t, http.MethodPost, path, "image", http.StatusAccepted)
+}
+
+func TestFeatureFlags(t *testing.T) {
+	if _, err := New(1337, WithLoggerOutput(io.Discard), WithFeatureFlag("missing", true)); !errors.Is(err, ErrUnknownFlag) {
+		t.Fatalf("expected error wrapping %v, actual = %v", ErrUnknownFlag, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "flags.json")
+	if err := os.WriteFile(path, []byte(`{"protocol_v2": false, "reactor": false}`), 0o600); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+		WithFeatureFlags(path),
+		WithFeatureFlag(FlagReactor, true),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	flags := func(t *testing.T, method, body string, expected int) map[Flag]bool {
+		var actual struct {
+			Flags map[Flag]bool
+		}
+		if b := httpDo(t, method, pathFlags, body, expected); expected == http.StatusOK {
+			if err := json.Unmarshal(b, &actual); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+		}
+		return actual.Flags
+	}
+
+	expected := map[Flag]bool{FlagProtocolV2: false, FlagReactor: true, FlagExporters: true}
+	if actual := flags(t, http.MethodGet, "", http.StatusOK); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected flags = %v, actual = %v", expected, actual)
+	}
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	time.Sleep(100 * time.Millisecond)
+	if n := svr.metrics.Disconnects.Counter(string(client.CloseUnauthorized)).Value(); n != 1 {
+		t.Errorf("expected 1 unauthorized disconnect, actual = %d", n)
+	}
+
+	expected[FlagProtocolV2] = true
+	if actual := flags(t, http.MethodPut, `{"Flag": "protocol_v2", "Enabled": true}`, http.StatusOK); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected flags = %v, actual = %v", expected, actual)
+	}
+	flags(t, http.MethodPut, `{"Flag": "missing", "Enabled": true}`, http.StatusBadRequest)
+
+	device = testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	time.Sleep(100 * time.Millisecond)
+	if !svr.clientMap.Exists(490154203237518) {
+		t.Error("expected protocol v2 client to be connected")
+	}
+}
+
+func TestAlertRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	alerts := make(chan Alert, 1)
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+		WithAlertRulesFile(path),
+		WithAlertHook(func(alert Alert) { alerts <- alert }),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	go svr.ListenAndServe(context.Background())
+
+	rule := func(b []byte) AlertRule {
+		var rule AlertRule
+		if err := json.Unmarshal(b, &rule); err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		return rule
+	}
+
+	httpDo(t, http.MethodPost, pathAlertRules, `{"Name": "hot", "Field": "Pressure", "Op": ">", "Threshold": 60}`, http.StatusBadRequest)
+	httpDo(t, http.MethodPost, pathAlertRules, `{"Name": "hot", "Field": "Temperature", "Op": "!=", "Threshold": 60}`, http.StatusBadRequest)
+	created := rule(httpDo(t, http.MethodPost, pathAlertRules, `{"Name": "hot", "Field": "Temperature", "Op": ">", "Threshold": 80}`, http.StatusCreated))
+	expected := AlertRule{ID: 1, Name: "hot", Field: "Temperature", Op: ">", Threshold: 80}
+	if created != expected {
+		t.Errorf("expected rule = %+v, actual = %+v", expected, created)
+	}
+	expected.Threshold = 60
+	if updated := rule(httpDo(t, http.MethodPut, pathAlertRules+"/1", `{"Name": "hot", "Field": "Temperature", "Op": ">", "Threshold": 60}`, http.StatusOK)); updated != expected {
+		t.Errorf("expected rule = %+v, actual = %+v", expected, updated)
+	}
+	httpDo(t, http.MethodPut, pathAlertRules+"/2", `{"Name": "hot", "Field": "Temperature", "Op": ">", "Threshold": 60}`, http.StatusNotFound)
+	httpDo(t, http.MethodDelete, pathAlertRules+"/2", "", http.StatusNotFound)
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	device.SendFrame(client.FrameReading, testutil.Reading(t))
+	select {
+	case alert := <-alerts:
+		if alert.RuleID != 1 || alert.IMEI != 490154203237518 || alert.Value != 67.77 || alert.ResolvedAt != nil {
+			t.Errorf("unexpected alert = %+v", alert)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected alert to fire")
+	}
+	svr.Shutdown()
+
+	// Rules survive restarts.
+	svr, err = New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338), WithAlertRulesFile(path))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	var actual struct {
+		Rules []AlertRule
+	}
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, pathAlertRules, "", http.StatusOK), &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if len(actual.Rules) != 1 || actual.Rules[0] != expected {
+		t.Errorf("expected rules = [%+v], actual = %+v", expected, actual.Rules)
+	}
+	httpDo(t, http.MethodDelete, pathAlertRules+"/1", "", http.StatusNoContent)
+	httpDo(t, http.MethodGet, pathAlertRules+"/1", "", http.StatusNotFound)
+	if created := rule(httpDo(t, http.MethodPost, pathAlertRules, `{"Name": "cold", "Field": "Temperature", "Op": "<", "Threshold": 0}`, http.StatusCreated)); created.ID != 2 {
+		t.Errorf("expected rule ID 2, actual = %d", created.ID)
+	}
+}
+
+func TestAlertThrottle(t *testing.T) {
+	a := newAlerts(
+		func(uint64) string { return "" },
+		func(uint64, string, time.Time) bool { return false })
+	var notified []Alert
+	a.notify = func(alert Alert) { notified = append(notified, alert) }
+	if _, err := a.create("", AlertRule{Name: "hot", Field: "Temperature", Op: ">", Threshold: 60, Throttle: -time.Minute}); !errors.Is(err, ErrInvalidAlertRule) {
+		t.Fatalf("expected error wrapping %v, actual = %v", ErrInvalidAlertRule, err)
+	}
+	if _, err := a.create("", AlertRule{Name: "hot", Field: "Temperature", Op: ">", Threshold: 60, Throttle: 10 * time.Minute}); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+
+	start := time.Now()
+	for i, temperature := range []float64{
+		70, // fires, and is notified
+		50, // resolves, throttled
+		70, // fires again, matching the state last notified
+		50, // resolves, throttled
+		50, // throttle elapsed, resolution notified
+		70, // fires, throttled
+		50, // resolves, matching the state last notified
+	} {
+		a.StoreReading(490154203237518, start.Add(time.Duration(i)*3*time.Minute), client.Reading{Temperature: temperature})
+	}
+
+	if len(notified) != 2 {
+		t.Fatalf("expected 2 notifications, actual = %+v", notified)
+	}
+	if notified[0].ResolvedAt != nil || !notified[0].FiredAt.Equal(start) {
+		t.Errorf("expected firing alert, actual = %+v", notified[0])
+	}
+	if notified[1].ResolvedAt == nil || !notified[1].ResolvedAt.Equal(start.Add(9*time.Minute)) {
+		t.Errorf("expected alert resolved at 9m, actual = %+v", notified[1])
+	}
+}
+
+func TestAlertHysteresis(t *testing.T) {
+	alerts := make(chan Alert, 4)
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+		WithAlertHook(func(alert Alert) { alerts <- alert }),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	for _, rule := range []string{
+		`{"Name": "hot", "Field": "Temperature", "Op": ">", "Threshold": 80, "ClearThreshold": 85}`,
+		`{"Name": "cold", "Field": "Temperature", "Op": "<", "Threshold": 0, "ClearThreshold": -5}`,
+		`{"Name": "hot", "Field": "Temperature", "Op": ">", "Threshold": 80, "FireAfter": -1}`,
+		`{"Name": "hot", "Field": "Temperature", "Op": ">", "Threshold": 80, "ResolveAfter": -1}`,
+	} {
+		httpDo(t, http.MethodPost, pathAlertRules, rule, http.StatusBadRequest)
+	}
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	send := func(temperature float64) {
+		b, err := client.Reading{Temperature: temperature, BatteryLevel: 0.5}.Encode()
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		device.SendFrame(client.FrameReading, b)
+	}
+	expect := func(resolved bool) {
+		t.Helper()
+		select {
+		case alert := <-alerts:
+			if (alert.ResolvedAt != nil) != resolved {
+				t.Errorf("expected resolved = %t, actual = %+v", resolved, alert)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected alert, resolved = %t", resolved)
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		time.Sleep(100 * time.Millisecond)
+		if len(alerts) != 0 {
+			t.Fatalf("unexpected alert = %+v", <-alerts)
+		}
+	}
+
+	// Alerts resolve at the clear threshold, not at the threshold.
+	httpDo(t, http.MethodPost, pathAlertRules, `{"Name": "hot", "Field": "Temperature", "Op": ">", "Threshold": 80, "ClearThreshold": 75}`, http.StatusCreated)
+	send(85)
+	expect(false)
+	send(78)
+	send(81)
+	send(78)
+	expectNone()
+	send(75)
+	expect(true)
+	httpDo(t, http.MethodDelete, pathAlertRules+"/1", "", http.StatusNoContent)
+
+	// Alerts fire, and resolve, once readings satisfy, or clear, the rule for
+	// long enough.
+	httpDo(t, http.MethodPost, pathAlertRules, `{"Name": "hot", "Field": "Temperature", "Op": ">", "Threshold": 80, "FireAfter": 300000000, "ResolveAfter": 300000000}`, http.StatusCreated)
+	send(85)
+	expectNone()
+	send(70)
+	time.Sleep(250 * time.Millisecond)
+	send(85)
+	expectNone()
+	time.Sleep(250 * time.Millisecond)
+	send(85)
+	expect(false)
+	send(70)
+	expectNone()
+	send(85)
+	time.Sleep(250 * time.Millisecond)
+	send(70)
+	expectNone()
+	time.Sleep(250 * time.Millisecond)
+	send(70)
+	expect(true)
+}
+
+func TestDeviceOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	alerts := make(chan Alert, 1)
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+		WithDeviceOverridesFile(path),
+		WithAlertHook(func(alert Alert) { alerts <- alert }),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	go svr.ListenAndServe(context.Background())
+
+	overrides := "/devices/" + testutil.IMEI + "/overrides"
+	httpDo(t, http.MethodGet, overrides, "", http.StatusNotFound)
+	httpDo(t, http.MethodPost, pathAlertRules, `{"Name": "hot", "Field": "Temperature", "Op": ">", "Threshold": 80}`, http.StatusCreated)
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	send := func(temperature float64) {
+		b, err := client.Reading{Temperature: temperature, BatteryLevel: 0.5}.Encode()
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		device.SendFrame(client.FrameReading, b)
+		time.Sleep(50 * time.Millisecond)
+	}
+	send(70)
+	if len(alerts) != 0 {
+		t.Fatalf("unexpected alert = %+v", <-alerts)
+	}
+
+	for _, body := range []string{
+		`{"Thresholds": {"2": {"Threshold": 60}}}`,
+		`{"Thresholds": {"1": {"Threshold": 60, "ClearThreshold": 65}}}`,
+		`{"Ranges": {"Pressure": {"Min": 0, "Max": 1}}}`,
+		`{"Ranges": {"Temperature": {"Min": 50, "Max": -20}}}`,
+	} {
+		httpDo(t, http.MethodPut, overrides, body, http.StatusBadRequest)
+	}
+
+	// Thresholds take precedence over those of the rule.
+	httpDo(t, http.MethodPut, overrides, `{"Thresholds": {"1": {"Threshold": 60}}}`, http.StatusOK)
+	send(70)
+	select {
+	case alert := <-alerts:
+		if alert.RuleID != 1 || alert.Value != 70 || alert.ResolvedAt != nil {
+			t.Errorf("unexpected alert = %+v", alert)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected alert to fire")
+	}
+
+	// Readings outside the IMEI's ranges are rejected.
+	expected := DeviceOverrides{
+		Thresholds: map[uint64]ThresholdOverride{1: {Threshold: 60}},
+		Ranges:     map[string]ValidRange{"Temperature": {Min: -20, Max: 50}},
+	}
+	httpDo(t, http.MethodPut, overrides, `{"Thresholds": {"1": {"Threshold": 60}}, "Ranges": {"Temperature": {"Min": -20, "Max": 50}}}`, http.StatusOK)
+	send(55)
+	var stats struct {
+		Stats client.Stats
+	}
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, "/devices/"+testutil.IMEI+"/stats", "", http.StatusOK), &stats); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if stats.Stats.Readings != 2 || stats.Stats.DecodeErrors != 1 {
+		t.Errorf("expected 2 readings and 1 rejected, actual = %+v", stats.Stats)
+	}
+	svr.Shutdown()
+
+	// Overrides survive restarts.
+	svr, err = New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338), WithDeviceOverridesFile(path))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+	device = testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	time.Sleep(50 * time.Millisecond)
+
+	var actual struct {
+		Overrides DeviceOverrides
+	}
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, overrides, "", http.StatusOK), &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if !reflect.DeepEqual(actual.Overrides, expected) {
+		t.Errorf("expected overrides = %+v, actual = %+v", expected, actual.Overrides)
+	}
+	httpDo(t, http.MethodPut, overrides, `{}`, http.StatusOK)
+	actual.Overrides = DeviceOverrides{}
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, overrides, "", http.StatusOK), &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if actual.Overrides.Thresholds != nil || actual.Overrides.Ranges != nil {
+		t.Errorf("expected no overrides, actual = %+v", actual.Overrides)
+	}
+}
+
+func TestSilences(t *testing.T) {
+	alerts := make(chan Alert, 1)
+	presences := make(chan Presence, 1)
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+		WithAlertHook(func(alert Alert) { alerts <- alert }),
+		WithPresenceHook(func(presence Presence) { presences <- presence }),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	httpDo(t, http.MethodPost, pathAlertRules, `{"Name": "hot", "Field": "Temperature", "Op": ">", "Threshold": 60}`, http.StatusCreated)
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	if presence := <-presences; !presence.Online {
+		t.Fatalf("expected online presence, actual = %+v", presence)
+	}
+	httpDo(t, http.MethodPut, "/groups/maintenance/devices/"+testutil.IMEI, "", http.StatusNoContent)
+
+	httpDo(t, http.MethodPost, pathSilences, `{"Group": "maintenance", "Start": "2030-01-02T00:00:00Z", "End": "2030-01-01T00:00:00Z"}`, http.StatusBadRequest)
+	body := fmt.Sprintf(`{"Group": "maintenance", "End": %q, "Comment": "firmware rollout"}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+	var silence Silence
+	if err := json.Unmarshal(httpDo(t, http.MethodPost, pathSilences, body, http.StatusCreated), &silence); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if silence.ID != 1 || silence.Start.IsZero() {
+		t.Errorf("unexpected silence = %+v", silence)
+	}
+
+	// Alerts and presence changes of silenced IMEIs are suppressed.
+	device.SendFrame(client.FrameReading, testutil.Reading(t))
+	time.Sleep(100 * time.Millisecond)
+	httpDo(t, http.MethodDelete, "/devices/"+testutil.IMEI, "", http.StatusNoContent)
+	select {
+	case alert := <-alerts:
+		t.Errorf("unexpected alert = %+v", alert)
+	case presence := <-presences:
+		t.Errorf("unexpected presence = %+v", presence)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	httpDo(t, http.MethodDelete, pathSilences+"/1", "", http.StatusNoContent)
+	httpDo(t, http.MethodDelete, pathSilences+"/1", "", http.StatusNotFound)
+
+	// Reconnecting matches the presence last notified, and is not notified.
+	device = testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	device.SendFrame(client.FrameReading, testutil.Reading(t))
+	select {
+	case alert := <-alerts:
+		if alert.RuleID != 1 || alert.ResolvedAt != nil {
+			t.Errorf("unexpected alert = %+v", alert)
+		}
+	case presence := <-presences:
+		t.Errorf("unexpected presence = %+v", presence)
+	case <-time.After(time.Second):
+		t.Error("expected alert to fire")
+	}
+}
+
+func TestAlertHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts.jsonl")
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338), WithAlertHistoryFile(path))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	go svr.ListenAndServe(context.Background())
+
+	cool, err := client.Reading{Temperature: 20, Altitude: 2.63555, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.25666}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	httpDo(t, http.MethodPost, pathAlertRules, `{"Name": "hot", "Field": "Temperature", "Op": ">", "Threshold": 60}`, http.StatusCreated)
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	device.SendFrame(client.FrameReading, testutil.Reading(t))
+	device.SendFrame(client.FrameReading, cool)
+	time.Sleep(100 * time.Millisecond)
+
+	alerts := func(t *testing.T, query string) []Alert {
+		var actual struct {
+			Alerts []Alert
+		}
+		if err := json.Unmarshal(httpDo(t, http.MethodGet, pathAlerts+query, "", http.StatusOK), &actual); err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		return actual.Alerts
+	}
+
+	actual := alerts(t, "?imei="+testutil.IMEI)
+	if len(actual) != 1 || actual[0].Rule != "hot" || actual[0].Value != 67.77 || actual[0].ResolvedAt == nil {
+		t.Fatalf("expected 1 resolved alert, actual = %+v", actual)
+	}
+	after := actual[0].ResolvedAt.Add(time.Hour).Format(time.RFC3339)
+	before := actual[0].FiredAt.Add(-time.Hour).Format(time.RFC3339)
+	if actual := alerts(t, "?from="+after); len(actual) != 0 {
+		t.Errorf("expected no alerts after %s, actual = %+v", after, actual)
+	}
+	if actual := alerts(t, "?to="+before); len(actual) != 0 {
+		t.Errorf("expected no alerts before %s, actual = %+v", before, actual)
+	}
+	if actual := alerts(t, "?imei=490154203237519"); len(actual) != 0 {
+		t.Errorf("expected no alerts of another IMEI, actual = %+v", actual)
+	}
+	httpDo(t, http.MethodGet, pathAlerts+"?from=yesterday", "", http.StatusBadRequest)
+	svr.Shutdown()
+
+	// The history survives restarts.
+	svr, err = New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338), WithAlertHistoryFile(path))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+	if restored := alerts(t, "?from="+before+"&to="+after); !reflect.DeepEqual(restored, actual) {
+		t.Errorf("expected alerts = %+v, actual = %+v", actual, restored)
+	}
+}
+
+func TestGreatCircle(t *testing.T) {
+	tests := []struct {
+		Name     string
+		A, B     client.Reading
+		Expected float64
+	}{
+		{Name: "same position", A: client.Reading{Latitude: 33.41, Longitude: 44.4}, B: client.Reading{Latitude: 33.41, Longitude: 44.4}},
+		{Name: "one degree of latitude", A: client.Reading{}, B: client.Reading{Latitude: 1}, Expected: 111195},
+		{Name: "antimeridian", A: client.Reading{Longitude: 179.5}, B: client.Reading{Longitude: -179.5}, Expected: 111195},
+		{Name: "antipodes", A: client.Reading{Latitude: 90}, B: client.Reading{Latitude: -90}, Expected: 20015115},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			if actual := greatCircle(test.A, test.B); math.Abs(actual-test.Expected) > 1 {
+				t.Errorf("expected %f meters, actual = %f", test.Expected, actual)
+			}
+		})
+	}
+}
+
+func TestDistance(t *testing.T) {
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338), WithReadingHistory(10))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/distance", "", http.StatusNotFound)
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	for _, latitude := range []float64{0, 1, 2} {
+		b, err := client.Reading{Temperature: 20, Latitude: latitude, BatteryLevel: 0.5}.Encode()
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		device.SendFrame(client.FrameReading, b)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	var actual struct {
+		IMEI   uint64
+		Meters float64
+		Daily  []DailyDistance
+	}
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/distance", "", http.StatusOK), &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if math.Abs(actual.Meters-222390) > 1 {
+		t.Errorf("expected 222390 meters, actual = %f", actual.Meters)
+	}
+	if len(actual.Daily) != 1 || actual.Daily[0].Meters != actual.Meters || !actual.Daily[0].Day.Equal(time.Now().UTC().Truncate(24*time.Hour)) {
+		t.Errorf("expected today's distance, actual = %+v", actual.Daily)
+	}
+
+	yesterday := time.Now().UTC().Truncate(24 * time.Hour).Add(-time.Hour).Format(time.RFC3339)
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/distance?to="+yesterday, "", http.StatusOK), &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if actual.Meters != 0 || len(actual.Daily) != 0 {
+		t.Errorf("expected no distance until %s, actual = %+v", yesterday, actual)
+	}
+	httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/distance?to=tomorrow", "", http.StatusBadRequest)
+	httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/distance?from="+time.Now().Format(time.RFC3339)+"&to="+yesterday, "", http.StatusBadRequest)
+}
+
+func TestClusters(t *testing.T) {
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	// Two devices in Baghdad, and one in Sydney.
+	positions := [][2]float64{{33.41, 44.4}, {33.42, 44.41}, {-33.87, 151.21}}
+	imeis := make([]uint64, len(positions))
+	for i, position := range positions {
+		imeis[i], _ = strconv.ParseUint(testutil.GenerateIMEI(i), 10, 64)
+		b, err := client.Reading{Temperature: 20, Latitude: position[0], Longitude: position[1], BatteryLevel: 0.5}.Encode()
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		device := testutil.Dial(t, 1337)
+		device.Send(testutil.LoginV2(testutil.GenerateIMEI(i)))
+		device.SendFrame(client.FrameReading, b)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	tests := map[string]struct {
+		query    string
+		expected []Cluster
+	}{
+		"world": {
+			query: "",
+			expected: []Cluster{
+				{Latitude: 33.415, Longitude: 44.405, Count: 2},
+				{Latitude: -33.87, Longitude: 151.21, Count: 1, IMEI: imeis[2]},
+			},
+		},
+		"street": {
+			query: "?zoom=16",
+			expected: []Cluster{
+				{Latitude: 33.42, Longitude: 44.41, Count: 1, IMEI: imeis[1]},
+				{Latitude: 33.41, Longitude: 44.4, Count: 1, IMEI: imeis[0]},
+				{Latitude: -33.87, Longitude: 151.21, Count: 1, IMEI: imeis[2]},
+			},
+		},
+		"bbox": {
+			query: "?zoom=16&bbox=100,-90,180,0",
+			expected: []Cluster{
+				{Latitude: -33.87, Longitude: 151.21, Count: 1, IMEI: imeis[2]},
+			},
+		},
+		"antimeridian": {
+			query:    "?bbox=170,-90,-170,90",
+			expected: []Cluster{},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var actual struct {
+				Zoom     int
+				Clusters []Cluster
+			}
+			if err := json.Unmarshal(httpDo(t, http.MethodGet, pathClusters+test.query, "", http.StatusOK), &actual); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if len(actual.Clusters) != len(test.expected) {
+				t.Fatalf("expected %d clusters, actual = %+v", len(test.expected), actual.Clusters)
+			}
+			for i, expected := range test.expected {
+				cluster := actual.Clusters[i]
+				if cluster.Count != expected.Count || cluster.IMEI != expected.IMEI ||
+					math.Abs(cluster.Latitude-expected.Latitude) > 1e-9 ||
+					math.Abs(cluster.Longitude-expected.Longitude) > 1e-9 {
+					t.Errorf("cluster %d: expected %+v, actual = %+v", i, expected, cluster)
+				}
+			}
+		})
+	}
+
+	for _, query := range []string{"?zoom=23", "?zoom=-1", "?zoom=near", "?bbox=0,0,1", "?bbox=0,10,1,0", "?bbox=0,0,181,1"} {
+		httpDo(t, http.MethodGet, pathClusters+query, "", http.StatusBadRequest)
+	}
+}
+
+func TestTrack(t *testing.T) {
+	at := func(lat, lon float64) StoredReading {
+		return StoredReading{Reading: client.Reading{Latitude: lat, Longitude: lon}}
+	}
+	// A path north, with a small wiggle, then a turn east.
+	readings := []StoredReading{at(0, 0), at(0.5, 0.0001), at(1, 0), at(1, 0.5), at(1, 1)}
+	tests := map[string]struct {
+		readings  []StoredReading
+		maxPoints int
+		expected  [][2]float64
+	}{
+		"empty": {
+			readings:  nil,
+			maxPoints: 2,
+			expected:  [][2]float64{},
+		},
+		"single": {
+			readings:  readings[:1],
+			maxPoints: 2,
+			expected:  [][2]float64{{0, 0}},
+		},
+		"ends": {
+			readings:  readings,
+			maxPoints: 2,
+			expected:  [][2]float64{{0, 0}, {1, 1}},
+		},
+		"turn": {
+			readings:  readings,
+			maxPoints: 3,
+			expected:  [][2]float64{{0, 0}, {1, 0}, {1, 1}},
+		},
+		"wiggle": {
+			readings:  readings,
+			maxPoints: 4,
+			expected:  [][2]float64{{0, 0}, {0.5, 0.0001}, {1, 0}, {1, 1}},
+		},
+		"collinear": {
+			readings:  readings,
+			maxPoints: 10,
+			expected:  [][2]float64{{0, 0}, {0.5, 0.0001}, {1, 0}, {1, 1}},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual := track(test.readings, test.maxPoints)
+			if len(actual) != len(test.expected) {
+				t.Fatalf("expected %d points, actual = %+v", len(test.expected), actual)
+			}
+			for i, expected := range test.expected {
+				if actual[i].Latitude != expected[0] || actual[i].Longitude != expected[1] {
+					t.Errorf("point %d: expected %v, actual = %+v", i, expected, actual[i])
+				}
+			}
+		})
+	}
+
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338), WithReadingHistory(10))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	for _, reading := range readings {
+		b, err := client.Reading{Temperature: 20, Latitude: reading.Latitude, Longitude: reading.Longitude, BatteryLevel: 0.5}.Encode()
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		device.SendFrame(client.FrameReading, b)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	var actual struct {
+		IMEI   uint64
+		Points []TrackPoint
+	}
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/track?maxPoints=3", "", http.StatusOK), &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if len(actual.Points) != 3 || actual.Points[1].Latitude != 1 || actual.Points[1].Longitude != 0 || actual.Points[0].ReceivedAt.IsZero() {
+		t.Errorf("expected the turn to be kept, actual = %+v", actual.Points)
+	}
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/track", "", http.StatusOK), &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if len(actual.Points) != 4 {
+		t.Errorf("expected 4 points, actual = %+v", actual.Points)
+	}
+	for _, query := range []string{"?maxPoints=1", "?maxPoints=10001", "?maxPoints=many", "?from=yesterday"} {
+		httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/track"+query, "", http.StatusBadRequest)
+	}
+}
+
+func TestTrackExport(t *testing.T) {
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338), WithReadingHistory(10))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	for _, latitude := range []float64{33.41, 33.42} {
+		b, err := client.Reading{Temperature: 20, Latitude: latitude, Longitude: 44.4, BatteryLevel: 0.5}.Encode()
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		device.SendFrame(client.FrameReading, b)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	var gpx struct {
+		Track struct {
+			Name   string `xml:"name"`
+			Points []struct {
+				Latitude  float64   `xml:"lat,attr"`
+				Longitude float64   `xml:"lon,attr"`
+				Time      time.Time `xml:"time"`
+			} `xml:"trkseg>trkpt"`
+		} `xml:"trk"`
+	}
+	if err := xml.Unmarshal(httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/track.gpx", "", http.StatusOK), &gpx); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	points := gpx.Track.Points
+	if gpx.Track.Name != testutil.IMEI || len(points) != 2 ||
+		points[0].Latitude != 33.41 || points[1].Latitude != 33.42 || points[1].Longitude != 44.4 || points[0].Time.IsZero() {
+		t.Errorf("expected a GPX track of 2 points, actual = %+v", gpx)
+	}
+
+	var kml struct {
+		Coordinates string `xml:"Document>Placemark>LineString>coordinates"`
+	}
+	if err := xml.Unmarshal(httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/track.kml", "", http.StatusOK), &kml); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if kml.Coordinates != "44.4,33.41 44.4,33.42" {
+		t.Errorf("expected a KML path of 2 points, actual = %q", kml.Coordinates)
+	}
+
+	yesterday := time.Now().Add(-24 * time.Hour).Format(time.RFC3339)
+	gpx.Track.Points = nil
+	if err := xml.Unmarshal(httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/track.gpx?to="+yesterday, "", http.StatusOK), &gpx); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if len(gpx.Track.Points) != 0 {
+		t.Errorf("expected no points until %s, actual = %+v", yesterday, gpx.Track.Points)
+	}
+	httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/track.kml?from=yesterday", "", http.StatusBadRequest)
+	httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/track.csv", "", http.StatusNotFound)
+}
+
+func TestBatteryDrain(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours, level float64) StoredReading {
+		return StoredReading{
+			ReceivedAt: start.Add(time.Duration(hours * float64(time.Hour))),
+			Reading:    client.Reading{BatteryLevel: level},
+		}
+	}
+	tests := map[string]struct {
+		readings []StoredReading
+		ok       bool
+		perHour  float64
+		empty    time.Duration
+	}{
+		"draining": {
+			readings: []StoredReading{at(0, 90), at(1, 80), at(2, 70)},
+			ok:       true,
+			perHour:  10,
+			empty:    7 * time.Hour,
+		},
+		"charged": {
+			readings: []StoredReading{at(0, 20), at(1, 10), at(2, 95), at(3, 90), at(4, 85), at(5, 80)},
+			ok:       true,
+			perHour:  5,
+			empty:    16 * time.Hour,
+		},
+		"noise": {
+			readings: []StoredReading{at(0, 50), at(1, 50.5), at(2, 50), at(3, 50)},
+			ok:       true,
+			perHour:  0.05,
+			empty:    1000 * time.Hour,
+		},
+		"steady": {
+			readings: []StoredReading{at(0, 50), at(1, 50), at(2, 50)},
+			ok:       true,
+		},
+		"too few since charge": {
+			readings: []StoredReading{at(0, 90), at(1, 80), at(2, 70), at(3, 95), at(4, 90)},
+		},
+		"simultaneous": {
+			readings: []StoredReading{at(0, 90), at(0, 80), at(0, 70)},
+		},
+		"empty": {
+			readings: nil,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			drain, ok := batteryDrain(test.readings)
+			if ok != test.ok {
+				t.Fatalf("expected ok = %t, actual = %t", test.ok, ok)
+			}
+			if math.Abs(drain.PerHour-test.perHour) > 1e-9 {
+				t.Errorf("expected %f per hour, actual = %f", test.perHour, drain.PerHour)
+			}
+			if (drain.TimeToEmpty - test.empty).Abs() > time.Millisecond {
+				t.Errorf("expected %s to empty, actual = %s", test.empty, drain.TimeToEmpty)
+			}
+			if test.empty == 0 && drain.EmptyAt != nil {
+				t.Errorf("expected no projection, actual = %s", drain.EmptyAt)
+			}
+		})
+	}
+
+	alerts := make(chan Alert, 1)
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+		WithReadingHistory(10),
+		WithAlertHook(func(alert Alert) { alerts <- alert }),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	httpDo(t, http.MethodPost, pathAlertRules, `{"Name": "draining", "Field": "BatteryDrain", "Op": ">", "Threshold": 100}`, http.StatusCreated)
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	for i, level := range []float64{90, 80, 70} {
+		b, err := client.Reading{Temperature: 20, BatteryLevel: level}.Encode()
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		device.SendFrame(client.FrameReading, b)
+		time.Sleep(50 * time.Millisecond)
+		if i < minDrainReadings-1 && len(alerts) != 0 {
+			t.Fatalf("expected no alert before the drain rate is known, actual = %+v", <-alerts)
+		}
+	}
+	select {
+	case alert := <-alerts:
+		if alert.Rule != "draining" || alert.Value <= 100 {
+			t.Errorf("unexpected alert = %+v", alert)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected alert to fire")
+	}
+
+	var actual struct {
+		Battery *BatteryDrain
+	}
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, "/devices/"+testutil.IMEI+"/stats", "", http.StatusOK), &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if actual.Battery == nil || actual.Battery.Readings != 3 || actual.Battery.PerHour <= 0 || actual.Battery.TimeToEmpty <= 0 || actual.Battery.EmptyAt == nil {
+		t.Errorf("expected a battery drain estimate, actual = %+v", actual.Battery)
+	}
+}
+
+func TestTrend(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hours, temperature float64) StoredReading {
+		return StoredReading{
+			ReceivedAt: start.Add(time.Duration(hours * float64(time.Hour))),
+			Reading:    client.Reading{Temperature: temperature},
+		}
+	}
+	tests := map[string]struct {
+		readings []StoredReading
+		expected Trend
+	}{
+		"empty": {
+			readings: nil,
+			expected: Trend{},
+		},
+		"single": {
+			readings: []StoredReading{at(0, 20)},
+			expected: Trend{From: start, To: start, Readings: 1, Mean: 20, Min: 20, Max: 20},
+		},
+		"warming": {
+			readings: []StoredReading{at(0, 20), at(0.5, 21), at(1, 22)},
+			expected: Trend{From: start, To: start.Add(time.Hour), Readings: 3, Mean: 21, Min: 20, Max: 22, SlopePerHour: 2, R2: 1},
+		},
+		"cooling": {
+			readings: []StoredReading{at(0, 22), at(1, 21), at(2, 21), at(3, 20)},
+			expected: Trend{From: start, To: start.Add(3 * time.Hour), Readings: 4, Mean: 21, Min: 20, Max: 22, SlopePerHour: -0.6, R2: 0.9},
+		},
+		"steady": {
+			readings: []StoredReading{at(0, 20), at(1, 20)},
+			expected: Trend{From: start, To: start.Add(time.Hour), Readings: 2, Mean: 20, Min: 20, Max: 20, SlopePerHour: 0, R2: 1},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual := trend(test.readings)
+			if !actual.From.Equal(test.expected.From) || !actual.To.Equal(test.expected.To) ||
+				actual.Readings != test.expected.Readings ||
+				math.Abs(actual.Mean-test.expected.Mean) > 1e-9 ||
+				actual.Min != test.expected.Min || actual.Max != test.expected.Max ||
+				math.Abs(actual.SlopePerHour-test.expected.SlopePerHour) > 1e-9 ||
+				math.Abs(actual.R2-test.expected.R2) > 1e-9 {
+				t.Errorf("expected trend = %+v, actual = %+v", test.expected, actual)
+			}
+		})
+	}
+
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338), WithReadingHistory(10))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	for _, temperature := range []float64{20, 21, 22} {
+		b, err := client.Reading{Temperature: temperature, BatteryLevel: 0.5}.Encode()
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		device.SendFrame(client.FrameReading, b)
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	var actual struct {
+		IMEI   uint64
+		Window time.Duration
+		Trend  Trend
+	}
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/trend", "", http.StatusOK), &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if actual.Window != time.Hour || actual.Trend.Readings != 3 || actual.Trend.Mean != 21 || actual.Trend.SlopePerHour <= 0 {
+		t.Errorf("expected a warming trend over 1h, actual = %+v", actual)
+	}
+	yesterday := time.Now().Add(-24 * time.Hour).Format(time.RFC3339)
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/trend?window=30m&to="+yesterday, "", http.StatusOK), &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if actual.Window != 30*time.Minute || actual.Trend.Readings != 0 {
+		t.Errorf("expected no readings in the window, actual = %+v", actual)
+	}
+	for _, query := range []string{"?window=0s", "?window=-1h", "?window=hour", "?to=now"} {
+		httpDo(t, http.MethodGet, "/v1/devices/"+testutil.IMEI+"/trend"+query, "", http.StatusBadRequest)
+	}
+}
+
+func TestGeocoder(t *testing.T) {
+	alerts := make(chan Alert, 1)
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+		WithGeocoder("test", ""),
+		WithAlertHook(func(alert Alert) { alerts <- alert }),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	cool, err := client.Reading{Temperature: 20, Latitude: 33.41, Longitude: 44.4, BatteryLevel: 0.5}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	httpDo(t, http.MethodPost, pathAlertRules, `{"Name": "hot", "Field": "Temperature", "Op": ">", "Threshold": 60}`, http.StatusCreated)
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	device.SendFrame(client.FrameReading, cool)
+	device.SendFrame(client.FrameReading, cool)
+	time.Sleep(100 * time.Millisecond)
+
+	// Readings at the same position are geocoded once.
+	if calls := testGeocoder.calls.Load(); calls != 1 {
+		t.Errorf("expected 1 position geocoded, actual = %d", calls)
+	}
+	var presence Presence
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, "/status/"+testutil.IMEI, "", http.StatusOK), &presence); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if presence.Place != "33.410,44.400" {
+		t.Errorf("expected place = 33.410,44.400, actual = %q", presence.Place)
+	}
+
+	device.SendFrame(client.FrameReading, testutil.Reading(t))
+	select {
+	case alert := <-alerts:
+		if alert.Place != "33.410,44.400" {
+			t.Errorf("expected alert place = 33.410,44.400, actual = %q", alert.Place)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected alert to fire")
+	}
+}
+
+func TestDeviceList(t *testing.T) {
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	online := testutil.Dial(t, 1337)
+	online.Send(testutil.LoginV2(testutil.GenerateIMEI(2)))
+	offline := testutil.Dial(t, 1337)
+	offline.Send(testutil.LoginV2(testutil.GenerateIMEI(1)))
+	time.Sleep(50 * time.Millisecond)
+	imei, _ := strconv.ParseUint(testutil.GenerateIMEI(1), 10, 64)
+	if !svr.CloseClient(imei, client.CloseKicked) {
+		t.Fatal("expected client to be connected")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	tests := map[string]struct {
+		query    string
+		expected []string
+	}{
+		"all":     {query: "", expected: []string{testutil.GenerateIMEI(1), testutil.GenerateIMEI(2)}},
+		"online":  {query: "?online=true", expected: []string{testutil.GenerateIMEI(2)}},
+		"offline": {query: "?online=false", expected: []string{testutil.GenerateIMEI(1)}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var actual struct {
+				Devices []Presence
+			}
+			if err := json.Unmarshal(httpDo(t, http.MethodGet, pathDeviceList+test.query, "", http.StatusOK), &actual); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			imeis := make([]string, 0, len(actual.Devices))
+			for _, device := range actual.Devices {
+				imeis = append(imeis, strconv.FormatUint(device.IMEI, 10))
+			}
+			if !reflect.DeepEqual(test.expected, imeis) {
+				t.Errorf("expected devices = %v, actual = %v", test.expected, imeis)
+			}
+		})
+	}
+
+	httpDo(t, http.MethodGet, pathDeviceList+"?online=maybe", "", http.StatusBadRequest)
+}
+
+func TestLiveReadings(t *testing.T) {
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	go svr.ListenAndServe(context.Background())
+	time.Sleep(50 * time.Millisecond)
+
+	httpDo(t, http.MethodGet, pathLive+"?imei=x", "", http.StatusBadRequest)
+
+	resp, err := http.Get("http://localhost:1338" + pathLive + "?imei=" + testutil.IMEI)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected content type = text/event-stream, actual = %q", ct)
+	}
+	events := make(chan LiveReading, 8)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var reading LiveReading
+			if err := json.Unmarshal([]byte(data), &reading); err != nil {
+				t.Errorf("unexpected error = %s\n", err)
+				return
+			}
+			events <- reading
+		}
+	}()
+
+	// Readings of other IMEIs are filtered out.
+	other := testutil.Dial(t, 1337)
+	other.Send(testutil.LoginV2(testutil.GenerateIMEI(1)))
+	other.SendFrame(client.FrameReading, testutil.Reading(t))
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	b, err := client.Reading{Temperature: 21.5, BatteryLevel: 0.5}.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	device.SendFrame(client.FrameReading, b)
+
+	select {
+	case reading := <-events:
+		if strconv.FormatUint(reading.IMEI, 10) != testutil.IMEI || reading.Reading.Temperature != 21.5 || reading.ReceivedAt.IsZero() {
+			t.Errorf("unexpected reading = %+v", reading)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected reading to be streamed")
+	}
+
+	// The stream ends once the Server shuts down.
+	svr.Shutdown()
+	select {
+	case reading, ok := <-events:
+		if ok {
+			t.Errorf("unexpected reading = %+v", reading)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected stream to end")
+	}
+}
+
+func TestHttpReadOnly(t *testing.T) {
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338), WithHttpReadOnly(), WithReadingHistory(10))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	time.Sleep(50 * time.Millisecond)
+
+	tests := map[string]struct {
+		method   string
+		path     string
+		body     string
+		expected int
+	}{
+		"health":           {method: http.MethodGet, path: pathHealth, expected: http.StatusOK},
+		"list rules":       {method: http.MethodGet, path: pathAlertRules, expected: http.StatusOK},
+		"device list":      {method: http.MethodGet, path: pathDeviceList, expected: http.StatusOK},
+		"grafana query":    {method: http.MethodPost, path: pathGrafana + "search", body: `{"target": ""}`, expected: http.StatusOK},
+		"create rule":      {method: http.MethodPost, path: pathAlertRules, body: `{"Name": "hot", "Field": "Temperature", "Op": ">", "Threshold": 80}`, expected: http.StatusForbidden},
+		"disconnect":       {method: http.MethodDelete, path: pathDevices + testutil.IMEI, expected: http.StatusForbidden},
+		"drain":            {method: http.MethodPost, path: pathDrain, expected: http.StatusForbidden},
+		"admin read":       {method: http.MethodGet, path: pathQuarantine, expected: http.StatusForbidden},
+		"write overrides":  {method: http.MethodPut, path: pathDevices + testutil.IMEI + "/overrides", body: `{}`, expected: http.StatusForbidden},
+		"unknown mutation": {method: http.MethodPatch, path: pathHealth, expected: http.StatusForbidden},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			body := httpDo(t, test.method, test.path, test.body, test.expected)
+			if test.expected == http.StatusForbidden && strings.TrimSpace(string(body)) != errReadOnly {
+				t.Errorf("expected body = %q, actual = %q", errReadOnly, body)
+			}
+		})
+	}
+
+	// WebSocket ingest is rejected, though its handshake is a GET.
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:1338"+pathIngest, nil)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	resp, err := httpDoClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if resp.StatusCode != http.StatusForbidden || strings.TrimSpace(string(body)) != errReadOnly {
+		t.Errorf("expected ingest status = %d, actual = %d, body = %q", http.StatusForbidden, resp.StatusCode, body)
+	}
+
+	// Rejected requests have no effect.
+	if _, ok := svr.clientMap.Load(490154203237518); !ok {
+		t.Error("expected client to remain connected")
+	}
+}
+
+func TestImport(t *testing.T) {
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338), WithReadingHistory(5))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	device.SendFrame(client.FrameReading, testutil.Reading(t))
+	time.Sleep(50 * time.Millisecond)
+
+	imei, _ := strconv.ParseUint(testutil.IMEI, 10, 64)
+	temperatures := func() []float64 {
+		temperatures := make([]float64, 0)
+		for _, stored := range svr.history.readings(imei, time.Time{}, time.Now().Add(time.Hour)) {
+			temperatures = append(temperatures, stored.Temperature)
+		}
+		return temperatures
+	}
+	post := func(contentType, body string, expected int) []byte {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:1338"+pathImport+"?imei="+testutil.IMEI, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		resp, err := httpDoClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		if resp.StatusCode != expected {
+			t.Fatalf("expected status %d, actual = %d: %s", expected, resp.StatusCode, b)
+		}
+		return b
+	}
+
+	// Readings imported out of order are merged into the history in order.
+	var response struct {
+		IMEI     uint64
+		Imported int
+	}
+	body := post("application/x-ndjson", `{"ReceivedAt": "2024-01-01T00:02:00Z", "Temperature": 3, "BatteryLevel": 50}
+
+{"ReceivedAt": "2024-01-01T00:00:00Z", "Temperature": 1, "BatteryLevel": 50}
+`, http.StatusOK)
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if response.IMEI != imei || response.Imported != 2 {
+		t.Errorf("unexpected response = %+v", response)
+	}
+	post("text/csv", "batterylevel,ReceivedAt,Temperature,Altitude,Latitude,Longitude\n50,2024-01-01T00:01:00Z,2,0,0,0\n", http.StatusOK)
+	if actual, expected := temperatures(), []float64{1, 2, 3, 67.77}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected temperatures = %v, actual = %v", expected, actual)
+	}
+
+	// Imports are validated as live readings are, and rejected entirely if
+	// any row is invalid.
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	body = post("application/x-ndjson", `{"ReceivedAt": "2024-01-01T00:03:00Z", "Temperature": 4}
+{"ReceivedAt": "2024-01-01T00:04:00Z", "Temperature": 1000}
+{"ReceivedAt": "`+future+`", "Temperature": 5}
+{"Temperature": 6}
+{"ReceivedAt": "2024-01-01T00:05:00Z", "Pressure": 7}
+`, http.StatusBadRequest)
+	var invalid struct {
+		Errors []ImportError
+	}
+	if err := json.Unmarshal(body, &invalid); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	lines := make([]int, 0, len(invalid.Errors))
+	for _, e := range invalid.Errors {
+		lines = append(lines, e.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{2, 3, 4, 5}) {
+		t.Errorf("expected invalid lines = [2 3 4 5], actual = %+v", invalid.Errors)
+	}
+	body = post("text/csv", "ReceivedAt,Temperature,Altitude,Latitude,Longitude,BatteryLevel\n2024-01-01T00:03:00Z,4,0,0,0,101\nyesterday,4,0,0,0,1\n", http.StatusBadRequest)
+	if err := json.Unmarshal(body, &invalid); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if len(invalid.Errors) != 2 || invalid.Errors[0].Line != 2 || invalid.Errors[1].Line != 3 {
+		t.Errorf("unexpected errors = %+v", invalid.Errors)
+	}
+	post("text/csv", "ReceivedAt,Temperature\n2024-01-01T00:03:00Z,4\n", http.StatusBadRequest)
+	if actual, expected := temperatures(), []float64{1, 2, 3, 67.77}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected temperatures = %v, actual = %v", expected, actual)
+	}
+
+	// The history keeps the most recent readings.
+	post("application/x-ndjson", `{"ReceivedAt": "2024-01-01T00:03:00Z", "Temperature": 4}
+{"ReceivedAt": "2024-01-01T00:04:00Z", "Temperature": 5}`, http.StatusOK)
+	if actual, expected := temperatures(), []float64{2, 3, 4, 5, 67.77}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected temperatures = %v, actual = %v", expected, actual)
+	}
+
+	httpDo(t, http.MethodPost, pathImport+"?imei=123", "", http.StatusBadRequest)
+	httpDo(t, http.MethodGet, pathImport+"?imei="+testutil.IMEI, "", http.StatusMethodNotAllowed)
+}
+
+func TestEraseDevice(t *testing.T) {
+	dir := t.TempDir()
+	readingsPath := filepath.Join(dir, "readings.jsonl")
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+		WithReadingHistory(5),
+		WithPresenceFile(filepath.Join(dir, "presence.json")),
+		WithAlertHistoryFile(filepath.Join(dir, "alerts.jsonl")),
+		WithStore("file", readingsPath),
+		WithExporter("test", ""),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	imei, _ := strconv.ParseUint(testutil.IMEI, 10, 64)
+	other := testutil.GenerateIMEI(1)
+	for _, imei := range []string{testutil.IMEI, other} {
+		device := testutil.Dial(t, 1337)
+		device.Send(testutil.LoginV2(imei))
+		device.SendFrame(client.FrameReading, testutil.Reading(t))
+	}
+	time.Sleep(50 * time.Millisecond)
+	svr.groups.add("", "fleet", imei)
+
+	path := "/v1/devices/" + testutil.IMEI + "/data"
+	httpDo(t, http.MethodDelete, path, "", http.StatusConflict)
+	httpDo(t, http.MethodGet, path, "", http.StatusMethodNotAllowed)
+	svr.CloseClient(imei, client.CloseKicked)
+	time.Sleep(50 * time.Millisecond)
+
+	var receipt ErasureReceipt
+	if err := json.Unmarshal(httpDo(t, http.MethodDelete, path, "", http.StatusOK), &receipt); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if receipt.IMEI != imei || receipt.ErasedAt.IsZero() {
+		t.Errorf("unexpected receipt = %+v", receipt)
+	}
+	erased := make(map[string]ErasedBackend)
+	for _, backend := range receipt.Backends {
+		erased[backend.Name] = backend
+	}
+	for name, records := range map[string]int{"history": 1, "presence": 1, "groups": 1, "store:file": 1} {
+		if erased[name].Records != records {
+			t.Errorf("expected %d records erased from %s, actual = %+v", records, name, erased[name])
+		}
+	}
+	if !erased["exporter:test"].Unsupported {
+		t.Errorf("expected exporter erasure to be unsupported, actual = %+v", erased["exporter:test"])
+	}
+
+	if _, ok := svr.Presence(imei); ok {
+		t.Error("expected presence to be erased")
+	}
+	if readings := svr.history.readings(imei, time.Time{}, time.Now()); len(readings) != 0 {
+		t.Errorf("expected history to be erased, actual = %+v", readings)
+	}
+	records, err := store.ReadFile(readingsPath)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if len(records) != 1 || strconv.FormatUint(records[0].IMEI, 10) != other {
+		t.Errorf("expected only the readings of %s to remain, actual = %+v", other, records)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "presence.json"))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if bytes.Contains(b, []byte(testutil.IMEI)) {
+		t.Errorf("expected presence file to be erased, actual = %s", b)
+	}
+}
+
+func TestLogRateLimit(t *testing.T) {
+	w := testutil.NewSafeWriter()
+	svr, err := New(1337, WithLoggerOutput(w), WithLogRateLimit(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	for i := 0; i < 5; i++ {
+		device.SendFrame(client.FrameReading, testutil.InvalidReading(t))
+	}
+	device.SendFrame(client.FrameReading, testutil.Reading(t))
+	time.Sleep(250 * time.Millisecond)
+
+	const failure = "Failed to Client.ProcessReadings/decode"
+	if n := bytes.Count(w.Bytes(), []byte(failure)); n != 1 {
+		t.Errorf("expected 1 decode failure logged, actual = %d\n%s", n, w.Bytes())
+	}
+
+	// Repetitions are summarized on shutdown, rather than lost.
+	svr.Shutdown()
+	expected := "[IMEI " + testutil.IMEI + "] " + failure + "\trepeated 4 times in 1h0m0s"
+	if !bytes.Contains(w.Bytes(), []byte(expected)) {
+		t.Errorf("expected log to contain %q, actual = %s", expected, w.Bytes())
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	stacks := []struct {
+		Stack    string
+		Expected string
+	}{
+		{
+			Stack:    "goroutine 1 [running]:\nmain.main()\n\t/app/main.go:10 +0x1d",
+			Expected: "main",
+		},
+		{
+			Stack: "goroutine 7 [select]:\n" +
+				"github.com/tjper/thermomatic/internal/export.(*RemoteWrite).Run(0xc000010000)\n\t/app/remotewrite.go:80 +0x1d\n" +
+				"created by github.com/tjper/thermomatic/internal/server.(*Server).loadPlugins in goroutine 1\n\t/app/plugins.go:90 +0x1d",
+			Expected: "internal/export",
+		},
+		{
+			Stack: "goroutine 9 [IO wait]:\n" +
+				"internal/poll.runtime_pollWait(0x7f, 0x72)\n\t/go/netpoll.go:343 +0x85\n" +
+				"net/http.(*conn).serve(0xc000100000, {0x9, 0xc0})\n\t/go/server.go:3086 +0x5cb\n" +
+				"created by net/http.(*Server).Serve in goroutine 8\n\t/go/server.go:3086 +0x5cb",
+			Expected: "net/http",
+		},
+	}
+	for _, test := range stacks {
+		if actual := subsystemOf(test.Stack); actual != test.Expected {
+			t.Errorf("expected subsystem %q, actual = %q\n%s", test.Expected, actual, test.Stack)
+		}
+	}
+
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338), WithWorkerPool(2, 16), WithHolderTracking())
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	// A connection that never logs in is unidentified.
+	testutil.Dial(t, 1337)
+	time.Sleep(50 * time.Millisecond)
+
+	var response struct {
+		Diagnostics Diagnostics
+	}
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, pathDiagnostics, "", http.StatusOK), &response); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	d := response.Diagnostics
+	if d.Conns != 2 || d.Clients != 1 || d.Unidentified != 1 {
+		t.Errorf("unexpected connections = %+v", d)
+	}
+	if d.Subsystems["internal/client"] == 0 || d.Subsystems["internal/server"] == 0 {
+		t.Errorf("expected goroutines of the client and server subsystems, actual = %v", d.Subsystems)
+	}
+	var goroutines int
+	for _, n := range d.Subsystems {
+		goroutines += n
+	}
+	if goroutines != d.Goroutines {
+		t.Errorf("expected subsystems to total %d goroutines, actual = %d", d.Goroutines, goroutines)
+	}
+	if d.Holders == 0 {
+		t.Error("expected holders of the client")
+	}
+	if _, ok := d.Queues["worker_pool"]; !ok {
+		t.Errorf("expected the worker pool queue, actual = %v", d.Queues)
+	}
+	httpDo(t, http.MethodPost, pathDiagnostics, "", http.StatusMethodNotAllowed)
+}
+
+func TestTunables(t *testing.T) {
+	out := testutil.NewSafeWriter()
+	svr, err := New(
+		1337,
+		WithLoggerOutput(out),
+		WithHttpServer(1338),
+		WithExporter("remote_write", "http://127.0.0.1:1/api/v1/push"),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	type Response struct {
+		Tunables Tunables
+		Changes  []TunableChange
+	}
+	tunables := func(t *testing.T, method, body string, expected int) Response {
+		t.Helper()
+		var actual Response
+		if b := httpDo(t, method, pathTunables, body, expected); expected == http.StatusOK {
+			if err := json.Unmarshal(b, &actual); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+		}
+		return actual
+	}
+
+	expected := Tunables{
+		ReadingInterval: 25 * time.Millisecond,
+		ReadingTimeout:  2 * time.Second,
+		BatchSizes:      map[string]int{"exporter:remote_write": 512},
+	}
+	if actual := tunables(t, http.MethodGet, "", http.StatusOK); !reflect.DeepEqual(actual.Tunables, expected) || len(actual.Changes) != 0 {
+		t.Errorf("expected tunables = %+v, actual = %+v", expected, actual)
+	}
+
+	// A device logged in before the adjustment is closed per the new reading
+	// timeout.
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.Login(testutil.IMEI))
+	time.Sleep(100 * time.Millisecond)
+
+	tunables(t, http.MethodPatch, `{"ReadingTimeout": -1}`, http.StatusBadRequest)
+	tunables(t, http.MethodPatch, `{"ReadingTimeout": 300000000, "BatchSizes": {"exporter:missing": 1}}`, http.StatusBadRequest)
+	tunables(t, http.MethodPatch, `{"BatchSizes": {"exporter:remote_write": 0}}`, http.StatusBadRequest)
+	tunables(t, http.MethodPut, "", http.StatusMethodNotAllowed)
+
+	expected.ReadingTimeout = 300 * time.Millisecond
+	expected.BatchSizes["exporter:remote_write"] = 64
+	actual := tunables(t, http.MethodPatch, `{"ReadingTimeout": 300000000, "BatchSizes": {"exporter:remote_write": 64}}`, http.StatusOK)
+	if !reflect.DeepEqual(actual.Tunables, expected) {
+		t.Errorf("expected tunables = %+v, actual = %+v", expected, actual.Tunables)
+	}
+	if len(actual.Changes) != 2 ||
+		actual.Changes[0].Setting != "ReadingTimeout" || actual.Changes[0].From != "2s" || actual.Changes[0].To != "300ms" ||
+		actual.Changes[1].Setting != "BatchSizes.exporter:remote_write" || actual.Changes[1].To != "64" {
+		t.Errorf("unexpected changes = %+v", actual.Changes)
+	}
+
+	device.Send(testutil.Reading(t))
+	device.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := device.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected device to be closed, actual err = %v", err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte("No Readings for 0.3 seconds")) {
+		t.Errorf("expected inactivity warning, actual = %s", out.Bytes())
+	}
+	if !bytes.Contains(out.Bytes(), []byte("Tunable ReadingTimeout changed from 2s to 300ms")) {
+		t.Errorf("expected audit log, actual = %s", out.Bytes())
+	}
+}
+
+func TestSessionResumption(t *testing.T) {
+	const grace = 500 * time.Millisecond
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+		WithSessionResumption(grace),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	imei, err := strconv.ParseUint(testutil.IMEI, 10, 64)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	commandsPath := "/devices/" + testutil.IMEI + "/commands"
+	readFrame := func(device *testutil.Device, expected client.FrameType) uint32 {
+		t.Helper()
+		ft, payload := device.ReadFrame(time.Second)
+		if ft != expected || len(payload) < 4 {
+			t.Fatalf("unexpected frame type = %#x, payload = % x", ft, payload)
+		}
+		return binary.BigEndian.Uint32(payload)
+	}
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	device.SendFrame(client.FrameReading, testutil.Reading(t))
+	time.Sleep(100 * time.Millisecond)
+	httpDo(t, http.MethodPost, commandsPath, `{"Payload": "Y21k"}`, http.StatusAccepted)
+	if id := readFrame(device, client.FrameCommand); id != 1 {
+		t.Errorf("unexpected command ID = %d", id)
+	}
+	svr.CloseClient(imei, client.CloseKicked)
+	device.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// The unacknowledged command is redelivered to the reconnected device,
+	// whose delta frames apply to the reading of its previous connection.
+	device = testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	if id := readFrame(device, client.FrameCommand); id != 1 {
+		t.Errorf("unexpected redelivered command ID = %d", id)
+	}
+	device.SendFrame(client.FrameDelta, []byte{0})
+	time.Sleep(100 * time.Millisecond)
+	c, ok := svr.clientMap.Load(imei)
+	if !ok {
+		t.Fatal("expected client to be connected")
+	}
+	if stats := c.Stats(); stats.Readings != 1 || stats.DecodeErrors != 0 {
+		t.Errorf("unexpected stats = %+v", stats)
+	}
+	httpDo(t, http.MethodPost, commandsPath, `{"Payload": "Y21k"}`, http.StatusAccepted)
+	if id := readFrame(device, client.FrameCommand); id != 2 {
+		t.Errorf("unexpected command ID = %d", id)
+	}
+	svr.CloseClient(imei, client.CloseKicked)
+	device.Close()
+
+	// Once the grace window passes, the device starts fresh.
+	time.Sleep(grace + 100*time.Millisecond)
+	device = testutil.Dial(t, 1337)
+	device.Send(testutil.LoginV2(testutil.IMEI))
+	device.SendFrame(client.FrameDelta, []byte{0})
+	time.Sleep(100 * time.Millisecond)
+	if c, ok := svr.clientMap.Load(imei); !ok || c.Stats().DecodeErrors != 1 || len(c.Commands()) != 0 {
+		t.Errorf("expected fresh session, actual ok = %t", ok)
+	}
+
+	connects := svr.connects.list(func(Event) bool { return true })
+	if len(connects) != 3 || connects[2].Resumed || !connects[1].Resumed || connects[0].Resumed {
+		t.Errorf("unexpected connects = %+v", connects)
+	}
+}
+
+func TestPeers(t *testing.T) {
+	local, err := New(1337, WithLoggerOutput(io.Discard), WithHttpServer(1338), WithPeers("http://localhost:1340/", "http://localhost:1"))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer local.Shutdown()
+	go local.ListenAndServe(context.Background())
+
+	remote, err := New(1339, WithLoggerOutput(io.Discard), WithHttpServer(1340), WithPeers("http://localhost:1338"))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer remote.Shutdown()
+	go remote.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1339)
+	device.Send(testutil.Login(testutil.IMEI), testutil.Reading(t))
+	time.Sleep(100 * time.Millisecond)
+
+	// The reading of a device connected to the remote node is fetched from
+	// it, despite the unreachable peer.
+	var actual struct {
+		Reading client.Reading
+	}
+	if err := json.Unmarshal(httpDo(t, http.MethodGet, "/readings/"+testutil.IMEI, "", http.StatusOK), &actual); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if actual.Reading.Temperature != 67.77 {
+		t.Errorf("unexpected reading = %+v", actual.Reading)
+	}
+
+	// Devices connected to no node are not forwarded in circles.
+	httpDo(t, http.MethodGet, "/readings/"+testutil.GenerateIMEI(1), "", http.StatusNoContent)
+}
+
+func TestListenerClientOptions(t *testing.T) {
+	strict := client.NewTunables()
+	if err := strict.SetReadingTimeout(200 * time.Millisecond); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithUDPIngest(1337, nil),
+		WithListenerClientOptions(ListenerTCP, client.WithTunables(strict)),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	udpIMEI := testutil.GenerateIMEI(1)
+	datagrams, err := net.Dial("udp", "localhost:1337")
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer datagrams.Close()
+	if _, err := datagrams.Write(append([]byte(udpIMEI), testutil.Reading(t)...)); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.Login(testutil.IMEI), testutil.Reading(t))
+	time.Sleep(100 * time.Millisecond)
+
+	listeners := make(map[string]string)
+	for _, c := range svr.Clients() {
+		listeners[strconv.FormatUint(c.IMEI(), 10)] = c.Metadata().Listener
+	}
+	expected := map[string]string{testutil.IMEI: "tcp", udpIMEI: "udp"}
+	if !reflect.DeepEqual(listeners, expected) {
+		t.Errorf("expected listeners = %v, actual = %v", expected, listeners)
+	}
+	if actual := svr.metrics.ListenerConnections.Snapshot(); actual["tcp"] != 1 || actual["udp"] != 1 {
+		t.Errorf("unexpected listener connections = %v", actual)
+	}
+
+	// Only the TCP Client is held to the TCP listener's stricter timeout.
+	time.Sleep(300 * time.Millisecond)
+	clients := svr.Clients()
+	if len(clients) != 1 || strconv.FormatUint(clients[0].IMEI(), 10) != udpIMEI {
+		t.Errorf("expected only the UDP client, actual = %v", clients)
+	}
+}
+
+func TestIdleEviction(t *testing.T) {
+	lax := client.NewTunables()
+	if err := lax.SetReadingTimeout(5 * time.Second); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithIdleEviction(400*time.Millisecond),
+		WithListenerClientOptions(ListenerTCP, client.WithTunables(lax)),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	idle := testutil.Dial(t, 1337)
+	idle.Send(testutil.Login(testutil.IMEI))
+	activeIMEI := testutil.GenerateIMEI(1)
+	active := testutil.Dial(t, 1337)
+	active.Send(testutil.Login(activeIMEI))
+
+	for i := 0; i < 10; i++ {
+		active.Send(testutil.Reading(t))
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	clients := svr.Clients()
+	if len(clients) != 1 || strconv.FormatUint(clients[0].IMEI(), 10) != activeIMEI {
+		t.Errorf("expected only the active client, actual = %v", clients)
+	}
+	if n := svr.metrics.Disconnects.Counter(string(client.CloseIdle)).Value(); n != 1 {
+		t.Errorf("expected idle disconnects = 1, actual = %d", n)
+	}
+}
+
+func TestIdleEvictionShortPeriod(t *testing.T) {
+	// A period too short to divide into sweeps must not stop the Server.
+	svr, err := New(1337, WithLoggerOutput(io.Discard), WithIdleEviction(time.Nanosecond))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.Login(testutil.IMEI))
+	time.Sleep(200 * time.Millisecond)
+
+	if n := svr.metrics.Disconnects.Counter(string(client.CloseIdle)).Value(); n != 1 {
+		t.Errorf("expected idle disconnects = 1, actual = %d", n)
+	}
+}
+
+func TestIngestLatencyMetrics(t *testing.T) {
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.Login(testutil.IMEI), testutil.Reading(t), testutil.Reading(t))
+	time.Sleep(100 * time.Millisecond)
+
+	stages := svr.metrics.IngestLatency.Snapshot()
+	for _, stage := range []string{"decode", "store", "export", "total"} {
+		if n := stages[stage].Count; n != 2 {
+			t.Errorf("expected %s latency count = 2, actual = %d", stage, n)
+		}
+	}
+
+	b := httpDo(t, http.MethodGet, pathMetrics, "", http.StatusOK)
+	for _, expected := range []string{
+		"thermomatic_readings_total 2\n",
+		`thermomatic_ingest_latency_seconds_count{stage="total"} 2` + "\n",
+		`thermomatic_ingest_latency_seconds_bucket{stage="export",le="+Inf"} 2` + "\n",
+	} {
+		if !strings.Contains(string(b), expected) {
+			t.Errorf("expected metrics to contain %q\nactual = %s", expected, b)
+		}
+	}
+	httpDo(t, http.MethodPost, pathMetrics, "", http.StatusMethodNotAllowed)
+}
+
+func TestCriticalExporterReadiness(t *testing.T) {
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithHttpServer(1338),
+		WithCriticalExporter("remote_write", "http://127.0.0.1:1/api/v1/push", 50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	type Response struct {
+		Exporters map[string]plugin.Health
+		Down      []string
+	}
+	health := func(t *testing.T, expected int) Response {
+		t.Helper()
+		var actual Response
+		if err := json.Unmarshal(httpDo(t, http.MethodGet, pathHealth, "", expected), &actual); err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		return actual
+	}
+
+	if actual := health(t, http.StatusOK); len(actual.Exporters) != 1 || len(actual.Down) != 0 {
+		t.Errorf("unexpected health = %+v", actual)
+	}
+
+	// Export each reading as it is received, so that the unreachable endpoint
+	// is contacted at once.
+	if err := svr.SetTunables(TunablesPatch{BatchSizes: map[string]int{"exporter:remote_write": 1}}); err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	device := testutil.Dial(t, 1337)
+	device.Send(testutil.Login(testutil.IMEI), testutil.Reading(t))
+	time.Sleep(200 * time.Millisecond)
+
+	actual := health(t, http.StatusServiceUnavailable)
+	if !reflect.DeepEqual(actual.Down, []string{"exporter:remote_write"}) {
+		t.Errorf("unexpected down exporters = %v", actual.Down)
+	}
+	exporter := svr.Diagnostics().Exporters["exporter:remote_write"]
+	if exporter.DownSince == nil || exporter.LastSuccess != nil || exporter.LastError == "" {
+		t.Errorf("unexpected exporter health = %+v", exporter)
+	}
+}
+
+func TestTenantHostnames(t *testing.T) {
+	acme, acmeRoot := selfSignedCertificate(t, "acme.thermomatic.test", "")
+	globex, globexRoot := selfSignedCertificate(t, "globex.thermomatic.test", "")
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithTenantHostname("acme.thermomatic.test", "acme", acme),
+		WithTenantHostname("Globex.Thermomatic.test", "globex", globex),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	// Each device verifies that it is presented its tenant's certificate.
+	dial := func(t *testing.T, config *tls.Config) (*tls.Conn, error) {
+		t.Helper()
+		conn, err := tls.Dial("tcp", "localhost:1337", config)
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	acmeIMEI, globexIMEI := testutil.GenerateIMEI(1), testutil.GenerateIMEI(2)
+	for _, device := range []struct {
+		imei     string
+		hostname string
+		root     *x509.CertPool
+	}{
+		{imei: acmeIMEI, hostname: "acme.thermomatic.test", root: acmeRoot},
+		{imei: globexIMEI, hostname: "globex.thermomatic.test", root: globexRoot},
+	} {
+		conn, err := dial(t, &tls.Config{ServerName: device.hostname, RootCAs: device.root})
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		defer conn.Close()
+		if _, err := conn.Write(append(testutil.Login(device.imei), testutil.Reading(t)...)); err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+	}
+
+	// Hostnames without a certificate fail the handshake, as the Server has
+	// no default certificate.
+	if conn, err := dial(t, &tls.Config{ServerName: "initech.thermomatic.test", InsecureSkipVerify: true}); err == nil {
+		conn.Close()
+		t.Errorf("expected handshake error")
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	tenants := make(map[string]string)
+	for _, c := range svr.Clients() {
+		tenants[strconv.FormatUint(c.IMEI(), 10)] = c.Tenant()
+	}
+	expected := map[string]string{acmeIMEI: "acme", globexIMEI: "globex"}
+	if !reflect.DeepEqual(tenants, expected) {
+		t.Errorf("expected tenants = %v, actual = %v", expected, tenants)
+	}
+	if actual := svr.metrics.TenantReadings.Snapshot(); actual["acme"] != 1 || actual["globex"] != 1 {
+		t.Errorf("unexpected tenant readings = %v", actual)
+	}
+}
+
+func TestTLSClientCAs(t *testing.T) {
+	acme, acmeRoot := selfSignedCertificate(t, "acme.thermomatic.test", "")
+	device, deviceRoot := selfSignedCertificate(t, "device.thermomatic.test", "initech")
+	untrusted, _ := selfSignedCertificate(t, "device.thermomatic.test", "initech")
+	svr, err := New(
+		1337,
+		WithLoggerOutput(io.Discard),
+		WithTenantHostname("acme.thermomatic.test", "acme", acme),
+		WithTLSClientCAs(deviceRoot),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer svr.Shutdown()
+	go svr.ListenAndServe(context.Background())
+
+	// dial connects as imei, presenting certificates, and reports whether the
+	// Server accepted the connection.
+	dial := func(t *testing.T, imei string, certificates []tls.Certificate) bool {
+		t.Helper()
+		conn, err := tls.Dial("tcp", "localhost:1337", &tls.Config{
+			ServerName:   "acme.thermomatic.test",
+			RootCAs:      acmeRoot,
+			Certificates: certificates,
+		})
+		if err != nil {
+			return false
+		}
+		t.Cleanup(func() { conn.Close() })
+		if _, err := conn.Write(append(testutil.Login(imei), testutil.Reading(t)...)); err != nil {
+			return false
+		}
+		// TLS 1.3 servers verify client certificates after the client
+		// finishes its handshake, so rejections surface on read.
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1))
+		return errors.Is(err, os.ErrDeadlineExceeded)
+	}
+
+	verifiedIMEI := testutil.GenerateIMEI(1)
+	if !dial(t, verifiedIMEI, []tls.Certificate{device}) {
+		t.Error("expected verified device to connect")
+	}
+	if dial(t, testutil.GenerateIMEI(2), []tls.Certificate{untrusted}) {
+		t.Error("expected device with untrusted certificate to be refused")
+	}
+	if dial(t, testutil.GenerateIMEI(3), nil) {
+		t.Error("expected device without certificate to be refused")
+	}
+
+	// The verified certificate's organization outranks the hostname.
+	tenants := make(map[string]string)
+	for _, c := range svr.Clients() {
+		tenants[strconv.FormatUint(c.IMEI(), 10)] = c.Tenant()
+	}
+	expected := map[string]string{verifiedIMEI: "initech"}
+	if !reflect.DeepEqual(tenants, expected) {
+		t.Errorf("expected tenants = %v, actual = %v", expected, tenants)
+	}
+}
+
+// selfSignedCertificate generates a certificate for hostname, naming
+// organization unless it is empty, along with a pool trusting it.
+func selfSignedCertificate(t *testing.T, hostname, organization string) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if organization != "" {
+		template.Subject.Organization = []string{organization}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
 	}
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
 }
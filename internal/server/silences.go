@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidSilence indicates a Silence ends before it starts.
+	ErrInvalidSilence = errors.New("invalid silence")
+
+	// ErrUnknownSilence indicates no Silence has the ID specified.
+	ErrUnknownSilence = errors.New("unknown silence")
+)
+
+// Silence suppresses the alert notifications, and presence changes passed to
+// the presence hook, of the IMEIs it matches from Start until End, such as
+// during planned maintenance. A Silence matches the IMEIs satisfying each of
+// IMEI, Tenant, and Group that are set, so that a Silence setting none
+// matches every IMEI.
+type Silence struct {
+	// ID is assigned by the Server.
+	ID uint64
+
+	IMEI   uint64 `json:",omitempty"`
+	Tenant string `json:",omitempty"`
+
+	// Group names a group of Tenant, or a group shared by requests scoped to
+	// every tenant if Tenant is empty.
+	Group string `json:",omitempty"`
+
+	// Start defaults to when the Silence is created.
+	Start time.Time
+	End   time.Time
+
+	Comment string `json:",omitempty"`
+}
+
+// active reports whether the Silence is in effect at t.
+func (s Silence) active(t time.Time) bool {
+	return !t.Before(s.Start) && t.Before(s.End)
+}
+
+// silences is a concurrent safe set of Silences.
+type silences struct {
+	mu     sync.RWMutex
+	m      map[uint64]Silence
+	nextID uint64
+}
+
+func newSilences() *silences {
+	return &silences{m: make(map[uint64]Silence), nextID: 1}
+}
+
+// add assigns s an ID, and adds it to the set. Silences that have ended are
+// forgotten.
+func (ss *silences) add(s Silence, now time.Time) (Silence, error) {
+	if s.Start.IsZero() {
+		s.Start = now
+	}
+	if !s.End.After(s.Start) {
+		return Silence{}, fmt.Errorf("%w, start = %s end = %s", ErrInvalidSilence, s.Start, s.End)
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for id, silence := range ss.m {
+		if !now.Before(silence.End) {
+			delete(ss.m, id)
+		}
+	}
+	s.ID = ss.nextID
+	ss.nextID++
+	ss.m[s.ID] = s
+	return s, nil
+}
+
+// remove deletes the Silence with id.
+func (ss *silences) remove(id uint64) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, ok := ss.m[id]; !ok {
+		return fmt.Errorf("%w, id = %d", ErrUnknownSilence, id)
+	}
+	delete(ss.m, id)
+	return nil
+}
+
+// list retrieves every Silence, ordered by ID.
+func (ss *silences) list() []Silence {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	list := make([]Silence, 0, len(ss.m))
+	for _, s := range ss.m {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// silenced reports whether imei, owned by tenant, is matched by a Silence in
+// effect at t.
+func (srv *Server) silenced(imei uint64, tenant string, t time.Time) bool {
+	srv.silences.mu.RLock()
+	defer srv.silences.mu.RUnlock()
+	for _, s := range srv.silences.m {
+		if !s.active(t) ||
+			s.IMEI != 0 && s.IMEI != imei ||
+			s.Tenant != "" && s.Tenant != tenant ||
+			s.Group != "" && !srv.groups.contains(s.Tenant, s.Group, imei) {
+			continue
+		}
+		return true
+	}
+	return false
+}
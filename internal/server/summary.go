@@ -0,0 +1,238 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+const (
+	// recentEvents is the number of recent connects, and disconnects, kept for
+	// the summary.
+	recentEvents = 10
+
+	// summaryDevices is the number of devices listed in each ranking of the
+	// summary.
+	summaryDevices = 5
+
+	// ingestWindow is the trailing window the ingest rate is measured over,
+	// and ingestInterval how often the readings counted are sampled.
+	ingestWindow   = time.Minute
+	ingestInterval = time.Second
+)
+
+// Summary is a dashboard-ready overview of a fleet of devices.
+type Summary struct {
+	Online  int
+	Offline int
+
+	// IngestRate is the number of readings received per second, over the
+	// trailing minute.
+	IngestRate float64
+
+	// RecentConnects and RecentDisconnects are the most recent connection
+	// events, newest first.
+	RecentConnects    []Event
+	RecentDisconnects []Event
+
+	// TopDecodeErrors are the online devices with the most decode errors,
+	// and LowestBattery those with the lowest battery level, in order.
+	TopDecodeErrors []DeviceDecodeErrors
+	LowestBattery   []DeviceBatteryLevel
+}
+
+// Event is a device connecting or disconnecting.
+type Event struct {
+	IMEI   uint64
+	Tenant string `json:",omitempty"`
+	Time   time.Time
+
+	// CloseReason is why the device disconnected, and is empty for connects.
+	CloseReason client.CloseReason `json:",omitempty"`
+
+	// Resumed is set for connects resuming the session of a previous
+	// connection of the device.
+	Resumed bool `json:",omitempty"`
+}
+
+// DeviceDecodeErrors is the number of readings of a device that failed to
+// decode.
+type DeviceDecodeErrors struct {
+	IMEI         uint64
+	DecodeErrors int64
+}
+
+// DeviceBatteryLevel is the battery level of a device's latest reading.
+type DeviceBatteryLevel struct {
+	IMEI         uint64
+	BatteryLevel float64
+}
+
+// events is a concurrent safe ring of the most recent Events.
+type events struct {
+	mu   sync.Mutex
+	ring []Event
+	next int
+}
+
+func newEvents(size int) *events {
+	return &events{ring: make([]Event, 0, size)}
+}
+
+// add records event, forgetting the oldest Event if the ring is full.
+func (e *events) add(event Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.ring) < cap(e.ring) {
+		e.ring = append(e.ring, event)
+		return
+	}
+	e.ring[e.next] = event
+	e.next = (e.next + 1) % len(e.ring)
+}
+
+// erase forgets the Events of imei, and retrieves how many were forgotten.
+func (e *events) erase(imei uint64) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	kept := make([]Event, 0, cap(e.ring))
+	for i := range e.ring {
+		if event := e.ring[(e.next+i)%len(e.ring)]; event.IMEI != imei {
+			kept = append(kept, event)
+		}
+	}
+	n := len(e.ring) - len(kept)
+	e.ring = kept
+	e.next = 0
+	return n
+}
+
+// list retrieves the Events for which include returns true, newest first.
+func (e *events) list(include func(Event) bool) []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	list := make([]Event, 0, len(e.ring))
+	for i := len(e.ring) - 1; i >= 0; i-- {
+		event := e.ring[(e.next+i)%len(e.ring)]
+		if include(event) {
+			list = append(list, event)
+		}
+	}
+	return list
+}
+
+// ingest samples the readings counted, overall and by tenant, to measure the
+// rate readings are received over the ingest window.
+type ingest struct {
+	mu      sync.Mutex
+	samples []ingestSample
+}
+
+// ingestSample is the number of readings counted at a point in time.
+type ingestSample struct {
+	time     time.Time
+	readings int64
+	tenants  map[string]int64
+}
+
+// record adds a sample of the readings counted at now, forgetting samples no
+// longer needed to measure the rate over the ingest window.
+func (in *ingest) record(now time.Time, readings int64, tenants map[string]int64) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.samples = append(in.samples, ingestSample{time: now, readings: readings, tenants: tenants})
+	start := now.Add(-ingestWindow)
+	for len(in.samples) > 1 && !in.samples[1].time.After(start) {
+		in.samples = in.samples[1:]
+	}
+}
+
+// rate retrieves the rate readings were received over the ingest window,
+// where readings is the number counted at now. If tenant is not empty, only
+// the readings of tenant, counted in tenants, are measured.
+func (in *ingest) rate(now time.Time, readings int64, tenants map[string]int64, tenant string) float64 {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(in.samples) == 0 {
+		return 0
+	}
+	oldest := in.samples[0]
+	elapsed := now.Sub(oldest.time).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	if tenant != "" {
+		return float64(tenants[tenant]-oldest.tenants[tenant]) / elapsed
+	}
+	return float64(readings-oldest.readings) / elapsed
+}
+
+// sampleIngest samples the readings counted every ingestInterval until stop is
+// closed.
+func (srv *Server) sampleIngest(stop <-chan struct{}) {
+	ticker := time.NewTicker(ingestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			srv.ingest.record(now, srv.metrics.Readings.Value(), srv.metrics.TenantReadings.Snapshot())
+		}
+	}
+}
+
+// summary retrieves the Summary of the devices within s.
+func (srv *Server) summary(s scope) Summary {
+	var summary Summary
+	for _, presence := range srv.presence.list() {
+		if !s.allows(presence.Tenant) {
+			continue
+		}
+		if presence.Online {
+			summary.Online++
+		} else {
+			summary.Offline++
+		}
+	}
+
+	readings, tenants := srv.metrics.Readings.Value(), srv.metrics.TenantReadings.Snapshot()
+	summary.IngestRate = srv.ingest.rate(time.Now(), readings, tenants, s.tenant)
+
+	include := func(e Event) bool { return s.allows(e.Tenant) }
+	summary.RecentConnects = srv.connects.list(include)
+	summary.RecentDisconnects = srv.disconnects.list(include)
+
+	summary.TopDecodeErrors = []DeviceDecodeErrors{}
+	summary.LowestBattery = []DeviceBatteryLevel{}
+	srv.ForEachClient(func(c *client.Client) bool {
+		if !s.allows(c.Tenant()) {
+			return true
+		}
+		stats := c.Stats()
+		if stats.DecodeErrors > 0 {
+			summary.TopDecodeErrors = append(summary.TopDecodeErrors, DeviceDecodeErrors{IMEI: c.IMEI(), DecodeErrors: stats.DecodeErrors})
+		}
+		if stats.Readings > 0 {
+			summary.LowestBattery = append(summary.LowestBattery, DeviceBatteryLevel{IMEI: c.IMEI(), BatteryLevel: c.LastReading().BatteryLevel})
+		}
+		return true
+	})
+	sort.Slice(summary.TopDecodeErrors, func(i, j int) bool {
+		a, b := summary.TopDecodeErrors[i], summary.TopDecodeErrors[j]
+		return a.DecodeErrors > b.DecodeErrors || a.DecodeErrors == b.DecodeErrors && a.IMEI < b.IMEI
+	})
+	sort.Slice(summary.LowestBattery, func(i, j int) bool {
+		a, b := summary.LowestBattery[i], summary.LowestBattery[j]
+		return a.BatteryLevel < b.BatteryLevel || a.BatteryLevel == b.BatteryLevel && a.IMEI < b.IMEI
+	})
+	if len(summary.TopDecodeErrors) > summaryDevices {
+		summary.TopDecodeErrors = summary.TopDecodeErrors[:summaryDevices]
+	}
+	if len(summary.LowestBattery) > summaryDevices {
+		summary.LowestBattery = summary.LowestBattery[:summaryDevices]
+	}
+	return summary
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+// tenants maps devices and http bearer tokens to the tenants owning them.
+type tenants struct {
+	// prefixes maps IMEI prefixes to tenants.
+	prefixes map[string]string
+
+	// hostnames maps lowercase TLS SNI hostnames to tenants.
+	hostnames map[string]string
+
+	// tokens maps the tokenHash of bearer tokens to the tenants they are
+	// scoped to. Tokens are looked up by hash, so that the time a lookup takes
+	// reveals nothing of how much of a presented token matches a known one.
+	tokens map[[sha256.Size]byte]string
+
+	// adminToken is the bearer token scoped to every tenant, and the
+	// administrative endpoints.
+	adminToken string
+
+	// authenticators authenticate the bearer tokens that are neither in
+	// tokens nor adminToken.
+	authenticators []plugin.Authenticator
+
+	// quotas maps tenants to their quotas, and limits to the RateLimits
+	// enforcing their reading rate quotas.
+	quotas map[string]Quota
+	limits map[string]*client.RateLimit
+
+	mu        sync.Mutex
+	connected map[string]int
+}
+
+// Quota is the set of limits imposed on a tenant. Zero limits are not
+// enforced.
+type Quota struct {
+	// Connections is the number of the tenant's devices that may be connected
+	// at once.
+	Connections int `json:",omitempty"`
+
+	// ReadingsPerSecond is the combined rate at which the tenant's devices may
+	// send readings.
+	ReadingsPerSecond int `json:",omitempty"`
+}
+
+func newTenants() *tenants {
+	return &tenants{
+		prefixes:  make(map[string]string),
+		hostnames: make(map[string]string),
+		tokens:    make(map[[sha256.Size]byte]string),
+		quotas:    make(map[string]Quota),
+		limits:    make(map[string]*client.RateLimit),
+		connected: make(map[string]int),
+	}
+}
+
+// connect takes one of tenant's connection slots, and reports whether its
+// connection quota permitted it.
+func (t *tenants) connect(tenant string) bool {
+	if tenant == "" {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if limit := t.quotas[tenant].Connections; limit > 0 && t.connected[tenant] >= limit {
+		return false
+	}
+	t.connected[tenant]++
+	return true
+}
+
+// disconnect returns one of tenant's connection slots.
+func (t *tenants) disconnect(tenant string) {
+	if tenant == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.connected[tenant]--
+	if t.connected[tenant] <= 0 {
+		delete(t.connected, tenant)
+	}
+}
+
+// resolve retrieves the tenant owning the device with imei. Devices that
+// presented a verified TLS certificate belong to the tenant named by its
+// organization, and those that connected to a tenant's TLS hostname belong to
+// that tenant; otherwise, the tenant of the longest matching IMEI prefix owns
+// the device.
+// It satisfies the client.TenantResolver signature.
+func (t *tenants) resolve(imei uint64, tls *client.TLSState) string {
+	if tls != nil && tls.Organization != "" {
+		return tls.Organization
+	}
+	if tls != nil {
+		if tenant, ok := t.hostnames[strings.ToLower(tls.ServerName)]; ok {
+			return tenant
+		}
+	}
+	digits := fmt.Sprintf("%015d", imei)
+	var tenant, longest string
+	for prefix, owner := range t.prefixes {
+		if strings.HasPrefix(digits, prefix) && len(prefix) > len(longest) {
+			tenant, longest = owner, prefix
+		}
+	}
+	return tenant
+}
+
+// authenticating reports whether http requests must carry a bearer token.
+func (t *tenants) authenticating() bool {
+	return t.adminToken != "" || len(t.tokens) > 0 || len(t.authenticators) > 0
+}
+
+// authenticate retrieves the scope of token from the tenants' authenticators,
+// and reports whether any of them know it.
+func (t *tenants) authenticate(token string) (scope, bool) {
+	for _, a := range t.authenticators {
+		if identity, ok := a.Authenticate(token); ok {
+			return scope{tenant: identity.Tenant, admin: identity.Admin}, true
+		}
+	}
+	return scope{}, false
+}
+
+// scope is the set of tenants, and endpoints, an http request may access.
+type scope struct {
+	// tenant is the tenant the request is restricted to, unless admin is set.
+	tenant string
+	admin  bool
+}
+
+// allows reports whether the scope may access resources owned by tenant.
+func (s scope) allows(tenant string) bool {
+	return s.admin || s.tenant == tenant
+}
+
+type scopeKey struct{}
+
+// scopeOf retrieves the scope of r. Requests to a Server without bearer
+// tokens are unrestricted.
+func scopeOf(r *http.Request) scope {
+	s, ok := r.Context().Value(scopeKey{}).(scope)
+	if !ok {
+		return scope{admin: true}
+	}
+	return s
+}
+
+// authenticated wraps h, scoping each http request to the tenant of its
+// bearer token. Requests without a known token respond with a 401, and
+// tenant scoped requests to administrative endpoints respond with a 403. The
+// health endpoint is open to every request, as is the ingest endpoint, whose
+// devices authenticate by logging in.
+func (srv *Server) authenticated(h http.Handler) http.Handler {
+	if !srv.tenants.authenticating() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == pathHealth || r.URL.Path == pathIngest {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		var s scope
+		hash := tokenHash(token)
+		switch tenant, known := srv.tenants.tokens[hash]; {
+		case ok && srv.tenants.isAdmin(hash):
+			s = scope{admin: true}
+		case ok && known:
+			s = scope{tenant: tenant}
+		default:
+			var authenticated bool
+			if ok && token != "" {
+				s, authenticated = srv.tenants.authenticate(token)
+			}
+			if !authenticated {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		if !s.admin && (strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/debug/")) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), scopeKey{}, s)))
+	})
+}
+
+// tokenHash hashes the bearer token, to look up and compare tokens in time
+// independent of their contents.
+func tokenHash(token string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(token))
+}
+
+// isAdmin reports whether hash is the tokenHash of the admin token, comparing
+// them in constant time.
+func (t *tenants) isAdmin(hash [sha256.Size]byte) bool {
+	if t.adminToken == "" {
+		return false
+	}
+	admin := tokenHash(t.adminToken)
+	return subtle.ConstantTimeCompare(hash[:], admin[:]) == 1
+}
+
+// loadClient retrieves the Client connected with imei, and reports whether it
+// is connected and owned by a tenant within the scope of r. Devices of other
+// tenants are indistinguishable from offline devices.
+func (srv *Server) loadClient(r *http.Request, imei uint64) (*client.Client, bool) {
+	c, ok := srv.clientMap.Load(imei)
+	if !ok || !scopeOf(r).allows(c.Tenant()) {
+		return nil, false
+	}
+	return c, true
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownHostname indicates a device connected over TLS with an SNI
+// hostname the Server has no certificate for.
+var ErrUnknownHostname = errors.New("unknown tls server name")
+
+// WithTLS returns a ServerOption function that terminates TLS on the
+// Server's TCP listener, presenting certificate to devices whose SNI hostname
+// has no certificate of its own.
+func WithTLS(certificate tls.Certificate) ServerOption {
+	return func(srv *Server) {
+		srv.tlsCertificate = &certificate
+	}
+}
+
+// WithTLSClientCAs returns a ServerOption function that requires devices
+// connecting over TLS to present a certificate verified against pool. Devices
+// whose certificate names an organization belong to the tenant of that name.
+// It has no effect unless TLS is enabled with WithTLS or WithTenantHostname.
+func WithTLSClientCAs(pool *x509.CertPool) ServerOption {
+	return func(srv *Server) {
+		srv.tlsClientCAs = pool
+	}
+}
+
+// WithTenantHostname returns a ServerOption function that assigns devices
+// connecting over TLS to hostname, per their SNI hostname, to tenant,
+// presenting them certificate, so that each tenant's devices may connect to
+// a tenant-specific hostname on the same listener. TLS is terminated on the
+// Server's TCP listener, as with WithTLS. Hostnames are matched
+// case-insensitively. Devices presenting a certificate verified per
+// WithTLSClientCAs that names their organization belong to it instead.
+//
+// The SNI hostname is chosen by the device, so it does not authenticate the
+// device: any device may connect to any tenant's hostname, and hostname
+// tenancy is only as strong as the device's login. Use WithTLSClientCAs
+// where tenants must be authenticated.
+func WithTenantHostname(hostname, tenant string, certificate tls.Certificate) ServerOption {
+	return func(srv *Server) {
+		hostname = strings.ToLower(hostname)
+		srv.tenants.hostnames[hostname] = tenant
+		srv.tlsCertificates[hostname] = &certificate
+	}
+}
+
+// newTLSConfig initializes the TLS configuration of the Server's TCP
+// listener, or retrieves nil if TLS is not enabled.
+func (srv *Server) newTLSConfig() *tls.Config {
+	if srv.tlsCertificate == nil && len(srv.tlsCertificates) == 0 {
+		return nil
+	}
+	config := &tls.Config{GetCertificate: srv.certificateOf}
+	if srv.tlsClientCAs != nil {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = srv.tlsClientCAs
+	}
+	return config
+}
+
+// certificateOf retrieves the certificate presented to a device per the SNI
+// hostname of hello. If the hostname has no certificate, the Server's
+// default certificate is presented; without one, ErrUnknownHostname is
+// returned, and the handshake fails.
+func (srv *Server) certificateOf(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if certificate, ok := srv.tlsCertificates[strings.ToLower(hello.ServerName)]; ok {
+		return certificate, nil
+	}
+	if srv.tlsCertificate != nil {
+		return srv.tlsCertificate, nil
+	}
+	return nil, fmt.Errorf("failed to server.certificateOf\tserver name = %s err = %w", hello.ServerName, ErrUnknownHostname)
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// defaultTrackPoints is the number of points a track is simplified to,
+	// unless otherwise specified.
+	defaultTrackPoints = 500
+
+	// maxTrackPoints is the largest number of points a track may be
+	// simplified to.
+	maxTrackPoints = 10000
+)
+
+// TrackPoint is a position of an IMEI along its track.
+type TrackPoint struct {
+	ReceivedAt time.Time
+	Latitude   float64
+	Longitude  float64
+}
+
+// track retrieves the positions of readings, simplified per the
+// Douglas-Peucker algorithm to at most maxPoints points, which must be at
+// least 2. Rather than by a tolerance, segments are split at the position
+// farthest from them, farthest first, until maxPoints positions are kept or
+// every position lies on the track. The first and last positions are always
+// kept.
+func track(readings []StoredReading, maxPoints int) []TrackPoint {
+	points := make([]TrackPoint, 0)
+	if len(readings) == 0 {
+		return points
+	}
+	keep := make([]bool, len(readings))
+	keep[0], keep[len(readings)-1] = true, true
+
+	// segment is a span of readings whose positions between its ends are not
+	// yet kept, and the position among them farthest from the span.
+	type segment struct {
+		first, last int
+		farthest    int
+		deviation   float64
+	}
+	split := func(first, last int) segment {
+		s := segment{first: first, last: last}
+		for i := first + 1; i < last; i++ {
+			if d := deviation(readings[i], readings[first], readings[last]); d > s.deviation {
+				s.farthest, s.deviation = i, d
+			}
+		}
+		return s
+	}
+
+	kept := 2
+	if len(readings) == 1 {
+		kept = 1
+	}
+	var segments []segment
+	if len(readings) > 2 {
+		segments = append(segments, split(0, len(readings)-1))
+	}
+	for kept < maxPoints && len(segments) > 0 {
+		next := 0
+		for i, s := range segments {
+			if s.deviation > segments[next].deviation {
+				next = i
+			}
+		}
+		s := segments[next]
+		if s.deviation == 0 {
+			break
+		}
+		segments = append(segments[:next], segments[next+1:]...)
+		keep[s.farthest] = true
+		kept++
+		segments = append(segments, split(s.first, s.farthest), split(s.farthest, s.last))
+	}
+
+	for i, reading := range readings {
+		if keep[i] {
+			points = append(points, TrackPoint{
+				ReceivedAt: reading.ReceivedAt,
+				Latitude:   reading.Latitude,
+				Longitude:  reading.Longitude,
+			})
+		}
+	}
+	return points
+}
+
+// deviation retrieves the distance, in meters, of the position of reading from
+// the segment between the positions of first and last, on an equirectangular
+// projection centered on first.
+func deviation(reading, first, last StoredReading) float64 {
+	project := func(r StoredReading) (x, y float64) {
+		lat := first.Latitude * math.Pi / 180
+		x = (r.Longitude - first.Longitude) * math.Pi / 180 * math.Cos(lat) * earthRadius
+		y = (r.Latitude - first.Latitude) * math.Pi / 180 * earthRadius
+		return x, y
+	}
+	px, py := project(reading)
+	lx, ly := project(last)
+
+	length := lx*lx + ly*ly
+	if length == 0 {
+		return math.Hypot(px, py)
+	}
+	t := math.Max(0, math.Min(1, (px*lx+py*ly)/length))
+	return math.Hypot(px-t*lx, py-t*ly)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"math"
+	"time"
+)
+
+// defaultTrendWindow is the window of readings a Trend is computed over,
+// unless otherwise specified.
+const defaultTrendWindow = time.Hour
+
+// Trend summarizes the temperatures of an IMEI's readings over a window, with
+// a linear fit of temperature over time.
+type Trend struct {
+	// From and To are when the first and last readings of the window were
+	// received.
+	From     time.Time `json:",omitempty"`
+	To       time.Time `json:",omitempty"`
+	Readings int
+
+	Mean float64
+	Min  float64
+	Max  float64
+
+	// SlopePerHour is the change in temperature per hour, positive while
+	// warming and negative while cooling, and R2 the coefficient of
+	// determination of the fit, from 0 to 1. Both are zero unless there are
+	// readings received at different times.
+	SlopePerHour float64
+	R2           float64
+}
+
+// trend computes the Trend of the temperatures of readings, oldest first.
+func trend(readings []StoredReading) Trend {
+	var t Trend
+	if len(readings) == 0 {
+		return t
+	}
+	t.From, t.To = readings[0].ReceivedAt, readings[len(readings)-1].ReceivedAt
+	t.Readings = len(readings)
+	t.Min, t.Max = math.Inf(1), math.Inf(-1)
+	for _, reading := range readings {
+		t.Mean += reading.Temperature
+		t.Min = math.Min(t.Min, reading.Temperature)
+		t.Max = math.Max(t.Max, reading.Temperature)
+	}
+	t.Mean /= float64(len(readings))
+	t.SlopePerHour, t.R2, _ = fitLine(readings, func(r StoredReading) float64 { return r.Temperature })
+	return t
+}
+
+// fitLine fits field of readings, oldest first, to a line over the hours
+// since the first reading by least squares. It retrieves the slope of the
+// line, per hour, and its coefficient of determination, and reports whether
+// readings were received at different times, without which there is no fit.
+func fitLine(readings []StoredReading, field func(StoredReading) float64) (slope, r2 float64, ok bool) {
+	if len(readings) < 2 {
+		return 0, 0, false
+	}
+	since := readings[0].ReceivedAt
+	var n, sumX, sumY float64
+	for _, reading := range readings {
+		n++
+		sumX += reading.ReceivedAt.Sub(since).Hours()
+		sumY += field(reading)
+	}
+	meanX, meanY := sumX/n, sumY/n
+	var sxx, sxy, syy float64
+	for _, reading := range readings {
+		dx := reading.ReceivedAt.Sub(since).Hours() - meanX
+		dy := field(reading) - meanY
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+	if sxx == 0 {
+		return 0, 0, false
+	}
+	slope = sxy / sxx
+	r2 = 1
+	if syy != 0 {
+		r2 = sxy * sxy / (sxx * syy)
+	}
+	return slope, r2, true
+}
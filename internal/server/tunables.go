@@ -0,0 +1,162 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+// ErrUnknownExporter indicates a batch size was set for an exporter the
+// Server does not run, or that does not export in batches.
+var ErrUnknownExporter = errors.New("unknown batching exporter")
+
+// recentTunableChanges is the number of recent Tunables changes kept for
+// auditing.
+const recentTunableChanges = 64
+
+// Tunables are the settings of the Server that may be adjusted while it
+// runs. Adjustments apply to connected Clients, as well as those connecting
+// afterwards.
+type Tunables struct {
+	// ReadingInterval is the interval each Client's read ticker ticks at; a
+	// Client reads at most one message per interval.
+	ReadingInterval time.Duration
+
+	// ReadingTimeout is how long a logged-in Client may go without sending a
+	// message before it is closed.
+	ReadingTimeout time.Duration
+
+	// BatchSizes is the maximum number of readings per export request of
+	// each exporter plugin exporting in batches, named "exporter:<name>".
+	BatchSizes map[string]int
+}
+
+// TunablesPatch adjusts the Tunables of the Server. Nil settings are left
+// unchanged, as are exporters absent from BatchSizes.
+type TunablesPatch struct {
+	ReadingInterval *time.Duration
+	ReadingTimeout  *time.Duration
+	BatchSizes      map[string]int
+}
+
+// TunableChange records the adjustment of a Tunables setting.
+type TunableChange struct {
+	Time    time.Time
+	Setting string
+	From    string
+	To      string
+}
+
+// tunableChanges is a concurrent safe log of the most recent TunableChanges.
+type tunableChanges struct {
+	mu      sync.Mutex
+	changes []TunableChange
+}
+
+// add records change, discarding the oldest change once the log is full.
+func (c *tunableChanges) add(change TunableChange) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.changes) == recentTunableChanges {
+		c.changes = c.changes[1:]
+	}
+	c.changes = append(c.changes, change)
+}
+
+// list retrieves the TunableChanges logged, oldest first.
+func (c *tunableChanges) list() []TunableChange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]TunableChange(nil), c.changes...)
+}
+
+// Tunables retrieves the current Tunables of the Server.
+func (srv *Server) Tunables() Tunables {
+	tunables := Tunables{
+		ReadingInterval: srv.tunables.ReadingInterval(),
+		ReadingTimeout:  srv.tunables.ReadingTimeout(),
+		BatchSizes:      make(map[string]int),
+	}
+	for name, b := range srv.batchers() {
+		tunables.BatchSizes[name] = b.BatchSize()
+	}
+	return tunables
+}
+
+// TunableChanges retrieves the most recent adjustments of the Server's
+// Tunables, oldest first.
+func (srv *Server) TunableChanges() []TunableChange {
+	return srv.tunableChanges.list()
+}
+
+// SetTunables adjusts the Tunables of the Server per patch, logging each
+// setting changed. Patches are validated before any setting is adjusted: if
+// a batch size names an unknown exporter, ErrUnknownExporter is returned,
+// and if a setting is out of range, client.ErrInvalidTunable is returned.
+func (srv *Server) SetTunables(patch TunablesPatch) error {
+	batchers := srv.batchers()
+	if patch.ReadingInterval != nil && *patch.ReadingInterval <= 0 {
+		return fmt.Errorf("failed to server.SetTunables\tReadingInterval = %s err = %w", *patch.ReadingInterval, client.ErrInvalidTunable)
+	}
+	if patch.ReadingTimeout != nil && *patch.ReadingTimeout <= 0 {
+		return fmt.Errorf("failed to server.SetTunables\tReadingTimeout = %s err = %w", *patch.ReadingTimeout, client.ErrInvalidTunable)
+	}
+	names := make([]string, 0, len(patch.BatchSizes))
+	for name, size := range patch.BatchSizes {
+		if _, ok := batchers[name]; !ok {
+			return fmt.Errorf("failed to server.SetTunables\texporter = %s err = %w", name, ErrUnknownExporter)
+		}
+		if size < 1 {
+			return fmt.Errorf("failed to server.SetTunables\texporter = %s BatchSize = %d err = %w", name, size, client.ErrInvalidTunable)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if patch.ReadingInterval != nil {
+		from := srv.tunables.ReadingInterval()
+		if err := srv.tunables.SetReadingInterval(*patch.ReadingInterval); err != nil {
+			return fmt.Errorf("failed to server.SetTunables/SetReadingInterval\terr = %w", err)
+		}
+		srv.auditTunable("ReadingInterval", from.String(), patch.ReadingInterval.String())
+	}
+	if patch.ReadingTimeout != nil {
+		from := srv.tunables.ReadingTimeout()
+		if err := srv.tunables.SetReadingTimeout(*patch.ReadingTimeout); err != nil {
+			return fmt.Errorf("failed to server.SetTunables/SetReadingTimeout\terr = %w", err)
+		}
+		srv.auditTunable("ReadingTimeout", from.String(), patch.ReadingTimeout.String())
+	}
+	for _, name := range names {
+		b, size := batchers[name], patch.BatchSizes[name]
+		from := b.BatchSize()
+		if err := b.SetBatchSize(size); err != nil {
+			return fmt.Errorf("failed to server.SetTunables/SetBatchSize\texporter = %s err = %w", name, err)
+		}
+		srv.auditTunable("BatchSizes."+name, fmt.Sprint(from), fmt.Sprint(size))
+	}
+	return nil
+}
+
+// auditTunable logs, and records, the change of setting from from to to.
+func (srv *Server) auditTunable(setting, from, to string) {
+	srv.tunableChanges.add(TunableChange{Time: time.Now(), Setting: setting, From: from, To: to})
+	srv.logInfo.Printf("Tunable %s changed from %s to %s\n", setting, from, to)
+}
+
+// batchers retrieves the exporter plugins of the Server exporting in
+// batches, by name.
+func (srv *Server) batchers() map[string]plugin.Batcher {
+	batchers := make(map[string]plugin.Batcher)
+	for i, s := range srv.stores {
+		if b, ok := s.(plugin.Batcher); ok {
+			batchers[srv.storeNames[i]] = b
+		}
+	}
+	return batchers
+}
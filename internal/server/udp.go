@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/imei"
+)
+
+const (
+	// udpReadingSize is the size of an encoded Reading.
+	udpReadingSize = 40
+
+	// udpDatagramSize is the size of an unauthenticated UDP datagram: an IMEI
+	// followed by a reading.
+	udpDatagramSize = imeiLength + udpReadingSize
+
+	// udpAuthenticatedSize is the size of an authenticated UDP datagram: an
+	// IMEI and reading followed by their HMAC-SHA256.
+	udpAuthenticatedSize = udpDatagramSize + sha256.Size
+
+	// maxUDPDatagram is the largest UDP datagram read.
+	maxUDPDatagram = 512
+)
+
+// errUDPAuthentication indicates a UDP datagram's HMAC was missing or did not
+// match.
+var errUDPAuthentication = errors.New("udp datagram failed authentication")
+
+// listenUDP binds the Server's UDP ingest socket on port.
+func (srv *Server) listenUDP(port int) error {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return fmt.Errorf("failed to server.listenUDP/ListenUDP\tport = %d err = %w", port, err)
+	}
+	srv.udpConn = conn
+	return nil
+}
+
+// serveUDP receives readings on the Server's UDP ingest socket until it is
+// closed. Each datagram holds a device's 15 byte IMEI followed by a reading.
+// If the Server has a UDP key, the reading must be followed by the
+// HMAC-SHA256 of the IMEI and reading under the key. Datagrams are never
+// answered, so those that are rejected are only logged.
+func (srv *Server) serveUDP(ctx context.Context) {
+	b := make([]byte, maxUDPDatagram)
+	for {
+		n, addr, err := srv.udpConn.ReadFromUDP(b)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			srv.metrics.Errors.Inc()
+			srv.logError.Printf("failed to server.serveUDP/ReadFromUDP\terr = %s\n", err)
+			continue
+		}
+		if err := srv.handleUDP(ctx, addr, b[:n]); err != nil {
+			srv.logDebug.Println(err)
+		}
+	}
+}
+
+// handleUDP processes b, a datagram received from addr, and retrieves the
+// error rejecting it, if any. A panic handling b is recovered.
+func (srv *Server) handleUDP(ctx context.Context, addr *net.UDPAddr, b []byte) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			srv.metrics.Panics.Inc()
+			srv.metrics.Errors.Inc()
+			srv.logError.Printf("recovered from panic handling udp datagram from %s\tpanic = %v\n%s", addr, v, debug.Stack())
+			err = nil
+		}
+	}()
+
+	if err := srv.authenticateUDP(b); err != nil {
+		srv.metrics.Errors.Inc()
+		return fmt.Errorf("failed to server.handleUDP\taddr = %s len = %d err = %w", addr, len(b), err)
+	}
+	id, err := imei.Decode(b[:imeiLength])
+	if err != nil {
+		srv.metrics.Errors.Inc()
+		return fmt.Errorf("failed to server.handleUDP/Decode\taddr = %s err = %w", addr, err)
+	}
+
+	ds, err := srv.datagramSession(id, addr, ListenerUDP)
+	if err != nil {
+		return err
+	}
+	err = ds.client.ProcessDatagram(ctx, ds.session, b[imeiLength:udpDatagramSize])
+	if errors.Is(err, client.ErrClientQuarantined) {
+		srv.quarantineDatagram(ds)
+	}
+	return err
+}
+
+// authenticateUDP verifies the length of b, a UDP datagram, and its HMAC if
+// the Server has a UDP key.
+func (srv *Server) authenticateUDP(b []byte) error {
+	if srv.udpKey == nil {
+		if len(b) != udpDatagramSize {
+			return client.ErrInvalidDatagram
+		}
+		return nil
+	}
+	if len(b) != udpAuthenticatedSize {
+		return errUDPAuthentication
+	}
+	mac := hmac.New(sha256.New, srv.udpKey)
+	mac.Write(b[:udpDatagramSize])
+	if !hmac.Equal(mac.Sum(nil), b[udpDatagramSize:]) {
+		return errUDPAuthentication
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// WebSocket opcodes, per RFC 6455.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+const (
+	// wsAcceptGUID is appended to a handshake's key to compute its accept
+	// value.
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// maxWSControlPayload is the largest payload of a control frame.
+	maxWSControlPayload = 125
+
+	// wsCloseUnsupported is the close status of a connection closed for
+	// receiving a text frame.
+	wsCloseUnsupported = 1003
+)
+
+// errWSProtocol indicates a WebSocket peer violated the protocol.
+var errWSProtocol = errors.New("websocket protocol violation")
+
+// wsConn is a net.Conn carrying a byte stream over a WebSocket connection.
+// Reads return the payloads of the binary frames received, so that message
+// boundaries are disregarded, and writes send a binary frame each. Ping
+// frames are answered, and a close frame ends the stream with io.EOF.
+type wsConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// remaining is the number of payload bytes left to read of the current
+	// frame, unmasked with mask from maskPos.
+	remaining uint64
+	mask      [4]byte
+	maskPos   int
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// Read satisfies the io.Reader interface, reading from the payloads of the
+// binary frames received.
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.r.Read(b)
+	for i := range b[:n] {
+		b[i] ^= c.mask[c.maskPos]
+		c.maskPos = (c.maskPos + 1) % len(c.mask)
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads the header of the next frame, handling control frames.
+func (c *wsConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		// Frames sent by clients must be masked.
+		return c.fail(1002, fmt.Errorf("failed to server.wsConn.nextFrame\terr = unmasked frame: %w", errWSProtocol))
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if _, err := io.ReadFull(c.r, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case wsBinary, wsContinuation:
+		c.remaining = length
+		return nil
+	case wsText:
+		return c.fail(wsCloseUnsupported, fmt.Errorf("failed to server.wsConn.nextFrame\terr = text frame: %w", errWSProtocol))
+	case wsClose, wsPing, wsPong:
+		if length > maxWSControlPayload {
+			return c.fail(1002, fmt.Errorf("failed to server.wsConn.nextFrame\terr = control frame length %d: %w", length, errWSProtocol))
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= c.mask[i%len(c.mask)]
+		}
+		switch opcode {
+		case wsClose:
+			c.writeClose(payload)
+			return io.EOF
+		case wsPing:
+			return c.writeFrame(wsPong, payload)
+		}
+		return nil
+	default:
+		return c.fail(1002, fmt.Errorf("failed to server.wsConn.nextFrame\terr = opcode %#x: %w", opcode, errWSProtocol))
+	}
+}
+
+// fail sends a close frame with status, and returns err.
+func (c *wsConn) fail(status uint16, err error) error {
+	c.writeClose(binary.BigEndian.AppendUint16(nil, status))
+	return err
+}
+
+// Write satisfies the io.Writer interface, sending b as a binary frame.
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame sends a final, unmasked frame of opcode with payload.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	return c.write(opcode, payload)
+}
+
+// writeClose sends a close frame with payload, unless one was sent already.
+func (c *wsConn) writeClose(payload []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.write(wsClose, payload)
+}
+
+// write sends a frame. The caller must hold c.writeMu.
+func (c *wsConn) write(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close satisfies the io.Closer interface, sending a normal closure frame
+// before closing the connection.
+func (c *wsConn) Close() error {
+	c.writeClose(binary.BigEndian.AppendUint16(nil, 1000))
+	return c.Conn.Close()
+}
+
+// upgrades hands connections upgraded by the http server to ListenAndServe,
+// to be handled as device connections.
+type upgrades struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newUpgrades() *upgrades {
+	return &upgrades{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// handoff hands conn to ListenAndServe, and reports whether it was taken.
+// Once the upgrades are closed, no connection is taken.
+func (u *upgrades) handoff(conn net.Conn) bool {
+	select {
+	case u.conns <- conn:
+		return true
+	case <-u.closed:
+		return false
+	}
+}
+
+// accepting reports whether the upgrades have not been closed.
+func (u *upgrades) accepting() bool {
+	select {
+	case <-u.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// close stops the upgrades from taking connections.
+func (u *upgrades) close() {
+	u.closeOnce.Do(func() { close(u.closed) })
+}
+
+// handleIngest is an HTTP endpoint at path /v1/ingest.
+//
+// GET:
+// Upgrade the request to a WebSocket connection carrying a device connection,
+// for devices and gateways restricted to http ports. The device sends the
+// messages it would send over TCP, starting with its IMEI and login, as the
+// payloads of binary frames; message boundaries need not align with frames.
+// Downlink messages are sent as a binary frame each. The endpoint responds
+// with a 400 to requests that are not WebSocket handshakes, and a 503 while
+// the Server is draining.
+func (srv *Server) handleIngest() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != pathIngest {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if !headerContains(r.Header, "Connection", "upgrade") ||
+			!headerContains(r.Header, "Upgrade", "websocket") ||
+			key == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Sec-WebSocket-Version") != "13" {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+			http.Error(w, http.StatusText(http.StatusUpgradeRequired), http.StatusUpgradeRequired)
+			return
+		}
+		if !srv.upgrades.accepting() {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			srv.logError.Printf("failed to server.handleIngest/Hijack\terr = %s\n", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		sum := sha1.Sum([]byte(key + wsAcceptGUID))
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+		if err := rw.Flush(); err != nil {
+			srv.logWarn.Printf("failed to server.handleIngest/Flush\terr = %s\n", err)
+			conn.Close()
+			return
+		}
+
+		ws := &wsConn{Conn: conn, r: rw.Reader}
+		if !srv.upgrades.handoff(ws) {
+			ws.Close()
+		}
+	}
+}
+
+// headerContains reports whether the comma separated values of the header
+// key in h contain token, case insensitively.
+func headerContains(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// ErrNoKey indicates an encrypted record was read without a key.
+	ErrNoKey = errors.New("encrypted record without key")
+
+	// ErrDecrypt indicates an encrypted record failed to decrypt, as it was
+	// encrypted under another key or was tampered with.
+	ErrDecrypt = errors.New("failed to decrypt record")
+)
+
+// KeySource supplies the AES key records are encrypted with, 16, 24, or 32
+// bytes long selecting AES-128, AES-192, or AES-256. Implementations may
+// fetch the key from the environment, or unwrap it with a key management
+// service.
+type KeySource interface {
+	Key() ([]byte, error)
+}
+
+// EnvKey is a KeySource of the base64 encoded key in the environment variable
+// it names.
+type EnvKey string
+
+// Key satisfies the KeySource interface.
+func (e EnvKey) Key() ([]byte, error) {
+	v, ok := os.LookupEnv(string(e))
+	if !ok || v == "" {
+		return nil, fmt.Errorf("failed to store.EnvKey.Key\tenv = %s err = %w", e, ErrNoKey)
+	}
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store.EnvKey.Key/DecodeString\tenv = %s err = %w", e, err)
+	}
+	return key, nil
+}
+
+// newAEAD initializes the AES-GCM cipher of the key supplied by keys.
+func newAEAD(keys KeySource) (cipher.AEAD, error) {
+	key, err := keys.Key()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store.newAEAD/NewCipher\terr = %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store.newAEAD/NewGCM\terr = %w", err)
+	}
+	return aead, nil
+}
+
+// seal encrypts plaintext under a random nonce, and retrieves the base64
+// encoding of the nonce followed by the ciphertext.
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to store.seal/Read\terr = %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, nil)
+	b := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(b, sealed)
+	return b, nil
+}
+
+// open decrypts b, sealed by seal.
+func open(aead cipher.AEAD, b []byte) ([]byte, error) {
+	sealed := make([]byte, base64.StdEncoding.DecodedLen(len(b)))
+	n, err := base64.StdEncoding.Decode(sealed, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store.open/Decode\terr = %w", err)
+	}
+	sealed = sealed[:n]
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,33 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+func init() {
+	plugin.RegisterStore("file", newFileStore)
+}
+
+// newFileStore initializes a File, configured with its path, optionally
+// followed by the query "?key_env=NAME" to encrypt readings under the key in
+// the environment variable NAME, e.g.
+// "/var/lib/thermomatic/readings.jsonl?key_env=THERMOMATIC_STORE_KEY".
+func newFileStore(config string) (plugin.Store, error) {
+	path, rawQuery, _ := strings.Cut(config, "?")
+	if path == "" {
+		return nil, fmt.Errorf("failed to store.newFileStore\tconfig = %q", config)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store.newFileStore/ParseQuery\terr = %w", err)
+	}
+	var opts []Option
+	if name := query.Get("key_env"); name != "" {
+		opts = append(opts, WithEncryption(EnvKey(name)))
+	}
+	return NewFile(path, opts...)
+}
@@ -0,0 +1,346 @@
+// Package store implements stores keeping the readings of devices at rest.
+// Stores satisfy the client.ReadingStore interface, and may encrypt the
+// readings they keep for deployments with data-at-rest requirements.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+// ErrUndecodable indicates records of a file failed to be decoded, such as
+// records encrypted under a key the File does not have.
+var ErrUndecodable = errors.New("undecodable records")
+
+// Record is a reading kept by a store, with the IMEI it was received from
+// and when.
+type Record struct {
+	IMEI       uint64
+	ReceivedAt time.Time
+	Reading    client.Reading
+}
+
+// options are the settings of a store.
+type options struct {
+	// keys, if non-nil, supplies the key records are encrypted with.
+	keys KeySource
+}
+
+// Option configures a store.
+type Option func(*options)
+
+// WithEncryption returns an Option function that configures a store to
+// encrypt each record with AES-GCM, under the key supplied by keys.
+func WithEncryption(keys KeySource) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// newOptions applies each Option to the default options.
+func newOptions(opts []Option) options {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// File appends readings to a file, a line per Record: the Record as JSON, or
+// if encrypted, the base64 encoding of a random nonce followed by the
+// AES-GCM encryption of the Record as JSON.
+type File struct {
+	path string
+	aead cipher.AEAD
+
+	mu     sync.Mutex
+	file   *os.File
+	failed int64
+
+	// erasing serializes erasures, which rewrite the file without holding mu.
+	erasing sync.Mutex
+}
+
+var (
+	_ client.ReadingStore = (*File)(nil)
+	_ plugin.Eraser       = (*File)(nil)
+)
+
+// NewFile opens the file at path to append readings to, creating it if
+// missing.
+func NewFile(path string, opts ...Option) (*File, error) {
+	o := newOptions(opts)
+	f := &File{path: path}
+	if o.keys != nil {
+		aead, err := newAEAD(o.keys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store.NewFile\terr = %w", err)
+		}
+		f.aead = aead
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store.NewFile/OpenFile\terr = %w", err)
+	}
+	f.file = file
+	return f, nil
+}
+
+// StoreReading appends reading, received from imei at receivedAt, to the
+// file. Readings failing to be written are counted by Failed.
+func (f *File) StoreReading(imei uint64, receivedAt time.Time, reading client.Reading) {
+	line, err := json.Marshal(Record{IMEI: imei, ReceivedAt: receivedAt, Reading: reading})
+	if err == nil && f.aead != nil {
+		line, err = seal(f.aead, line)
+	}
+	if err != nil {
+		atomic.AddInt64(&f.failed, 1)
+		return
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		atomic.AddInt64(&f.failed, 1)
+		return
+	}
+	if _, err := f.file.Write(line); err != nil {
+		atomic.AddInt64(&f.failed, 1)
+	}
+}
+
+// Failed retrieves the number of readings that failed to be written.
+func (f *File) Failed() int64 {
+	return atomic.LoadInt64(&f.failed)
+}
+
+// EraseDevice satisfies the plugin.Eraser interface, rewriting the file
+// without the records of imei. Encrypted records are kept as they were
+// written, and require the File to have the key they were encrypted under.
+// Records that fail to be decoded are kept, and reported by an error wrapping
+// ErrUndecodable once the other records of imei are erased.
+//
+// The file is rewritten while readings continue to be stored; only the
+// readings stored meanwhile are filtered while storing is blocked, before
+// the rewritten file replaces the file.
+func (f *File) EraseDevice(imei uint64) (int, error) {
+	f.erasing.Lock()
+	defer f.erasing.Unlock()
+
+	f.mu.Lock()
+	closed := f.file == nil
+	f.mu.Unlock()
+	if closed {
+		return 0, fmt.Errorf("failed to store.File.EraseDevice\terr = %w", os.ErrClosed)
+	}
+
+	src, err := os.Open(f.path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store.File.EraseDevice/Open\terr = %w", err)
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to store.File.EraseDevice/CreateTemp\terr = %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	e := eraser{imei: imei, aead: f.aead, r: bufio.NewReader(src), w: bufio.NewWriter(tmp)}
+	if err := e.filter(); err != nil {
+		return 0, fmt.Errorf("failed to store.File.EraseDevice\terr = %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, fmt.Errorf("failed to store.File.EraseDevice\terr = %w", os.ErrClosed)
+	}
+	// Readings stored while the file was filtered are filtered now that
+	// storing is blocked, so that the last of them is whole.
+	e.final = true
+	if err := e.filter(); err != nil {
+		return 0, fmt.Errorf("failed to store.File.EraseDevice\terr = %w", err)
+	}
+	if e.erased > 0 {
+		if err := f.replace(tmp, e.w); err != nil {
+			return 0, err
+		}
+	}
+	if len(e.undecodable) > 0 {
+		return e.erased, fmt.Errorf("failed to store.File.EraseDevice\tpath = %s lines = %d first = %d err = %w", f.path, len(e.undecodable), e.undecodable[0], ErrUndecodable)
+	}
+	return e.erased, nil
+}
+
+// replace replaces the file with tmp, once w has flushed the records kept to
+// it, and reopens the file. The caller must hold f.mu.
+func (f *File) replace(tmp *os.File, w *bufio.Writer) error {
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to store.File.replace/Flush\terr = %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to store.File.replace/Close\terr = %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to store.File.replace/Rename\terr = %w", err)
+	}
+
+	// The file appended to was replaced.
+	f.file.Close()
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		f.file = nil
+		return fmt.Errorf("failed to store.File.replace/OpenFile\terr = %w", err)
+	}
+	f.file = file
+	return nil
+}
+
+// eraser copies the lines of a File from r to w, without the records of
+// imei.
+type eraser struct {
+	imei uint64
+	aead cipher.AEAD
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	// final is set once the File is no longer appended to, and a line missing
+	// its newline is whole.
+	final bool
+
+	// partial is a line missing its newline, which may still be being
+	// appended to.
+	partial []byte
+
+	line        int
+	erased      int
+	undecodable []int
+}
+
+// filter copies the lines of r to w until r is exhausted, counting the
+// records erased and the lines that failed to be decoded.
+func (e *eraser) filter() error {
+	for {
+		b, err := e.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to store.eraser.filter/ReadBytes\terr = %w", err)
+		}
+		line := append(e.partial, b...)
+		e.partial = nil
+		if err == io.EOF && !e.final {
+			e.partial = line
+			return nil
+		}
+		if len(line) > 0 {
+			if err := e.copy(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// copy copies line to w, unless it is a record of imei.
+func (e *eraser) copy(line []byte) error {
+	e.line++
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil
+	}
+	record, err := decode(e.aead, bytes.TrimSuffix(line, []byte("\n")))
+	switch {
+	case err != nil:
+		e.undecodable = append(e.undecodable, e.line)
+	case record.IMEI == e.imei:
+		e.erased++
+		return nil
+	}
+	if _, err := e.w.Write(line); err != nil {
+		return fmt.Errorf("failed to store.eraser.copy/Write\terr = %w", err)
+	}
+	return nil
+}
+
+// Close closes the file. Readings stored afterwards fail.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to store.File.Close\terr = %w", err)
+	}
+	return nil
+}
+
+// ReadFile reads the Records of the file at path, written by a File, oldest
+// first. Encrypted records require WithEncryption, with the key they were
+// encrypted under; files may mix encrypted and unencrypted records, as when
+// encryption is enabled for an existing file.
+func ReadFile(path string, opts ...Option) ([]Record, error) {
+	o := newOptions(opts)
+	var aead cipher.AEAD
+	if o.keys != nil {
+		var err error
+		if aead, err = newAEAD(o.keys); err != nil {
+			return nil, fmt.Errorf("failed to store.ReadFile\terr = %w", err)
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store.ReadFile/Open\terr = %w", err)
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		record, err := decode(aead, scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("failed to store.ReadFile\tpath = %s line = %d err = %w", path, line, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to store.ReadFile/Scan\terr = %w", err)
+	}
+	return records, nil
+}
+
+// decode decodes the Record of line, decrypting it with aead if it is
+// encrypted.
+func decode(aead cipher.AEAD, line []byte) (Record, error) {
+	if !bytes.HasPrefix(line, []byte("{")) {
+		if aead == nil {
+			return Record{}, ErrNoKey
+		}
+		var err error
+		if line, err = open(aead, line); err != nil {
+			return Record{}, err
+		}
+	}
+	var record Record
+	if err := json.Unmarshal(line, &record); err != nil {
+		return Record{}, fmt.Errorf("failed to store.decode/Unmarshal\terr = %w", err)
+	}
+	return record, nil
+}
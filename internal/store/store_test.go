@@ -0,0 +1,265 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+	"github.com/tjper/thermomatic/internal/plugin"
+)
+
+// staticKey is a KeySource of a fixed key.
+type staticKey []byte
+
+func (k staticKey) Key() ([]byte, error) { return k, nil }
+
+var reading = client.Reading{
+	Temperature:  21.5,
+	Altitude:     120,
+	Latitude:     45.5,
+	Longitude:    -122.6,
+	BatteryLevel: 80,
+}
+
+func TestFile(t *testing.T) {
+	key := staticKey(bytes.Repeat([]byte{1}, 32))
+	tests := map[string]struct {
+		opts      []Option
+		plaintext bool
+	}{
+		"plaintext": {plaintext: true},
+		"encrypted": {opts: []Option{WithEncryption(key)}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "readings.jsonl")
+			f, err := NewFile(path, test.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			receivedAt := time.Now().UTC().Truncate(time.Millisecond)
+			f.StoreReading(1, receivedAt, reading)
+			f.StoreReading(2, receivedAt.Add(time.Second), reading)
+			if err := f.Close(); err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			f.StoreReading(3, receivedAt, reading)
+			if f.Failed() != 1 {
+				t.Errorf("unexpected failed = %d", f.Failed())
+			}
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if plaintext := strings.Contains(string(b), "Temperature"); plaintext != test.plaintext {
+				t.Errorf("unexpected file = %s", b)
+			}
+
+			records, err := ReadFile(path, test.opts...)
+			if err != nil {
+				t.Fatalf("unexpected error = %s\n", err)
+			}
+			if len(records) != 2 {
+				t.Fatalf("unexpected records = %+v", records)
+			}
+			if records[0].IMEI != 1 || !records[0].ReceivedAt.Equal(receivedAt) || records[0].Reading != reading {
+				t.Errorf("unexpected record = %+v", records[0])
+			}
+			if records[1].IMEI != 2 {
+				t.Errorf("unexpected record = %+v", records[1])
+			}
+		})
+	}
+}
+
+func TestReadFileEncrypted(t *testing.T) {
+	key := staticKey(bytes.Repeat([]byte{1}, 32))
+	path := filepath.Join(t.TempDir(), "readings.jsonl")
+
+	// Encryption enabled for an existing file of plaintext records.
+	for _, opts := range [][]Option{nil, {WithEncryption(key)}} {
+		f, err := NewFile(path, opts...)
+		if err != nil {
+			t.Fatalf("unexpected error = %s\n", err)
+		}
+		f.StoreReading(1, time.Now(), reading)
+		f.Close()
+	}
+
+	if records, err := ReadFile(path, WithEncryption(key)); err != nil || len(records) != 2 {
+		t.Errorf("unexpected records = %+v, err = %v", records, err)
+	}
+	if _, err := ReadFile(path); !errors.Is(err, ErrNoKey) {
+		t.Errorf("unexpected error = %v", err)
+	}
+	other := staticKey(bytes.Repeat([]byte{2}, 32))
+	if _, err := ReadFile(path, WithEncryption(other)); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("unexpected error = %v", err)
+	}
+	if _, err := NewFile(path, WithEncryption(staticKey("short"))); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestEnvKey(t *testing.T) {
+	const env = "THERMOMATIC_TEST_STORE_KEY"
+	key := bytes.Repeat([]byte{1}, 16)
+
+	t.Setenv(env, "")
+	if _, err := EnvKey(env).Key(); !errors.Is(err, ErrNoKey) {
+		t.Errorf("unexpected error = %v", err)
+	}
+	t.Setenv(env, "not base64!")
+	if _, err := EnvKey(env).Key(); err == nil {
+		t.Error("expected error")
+	}
+	t.Setenv(env, base64.StdEncoding.EncodeToString(key))
+	actual, err := EnvKey(env).Key()
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	if !bytes.Equal(actual, key) {
+		t.Errorf("unexpected key = %x", actual)
+	}
+}
+
+func TestFilePlugin(t *testing.T) {
+	const env = "THERMOMATIC_TEST_STORE_KEY"
+	dir := t.TempDir()
+
+	if _, err := plugin.NewStore("file", ""); err == nil {
+		t.Error("expected error")
+	}
+	if _, err := plugin.NewStore("file", filepath.Join(dir, "missing.jsonl")+"?key_env="+env); !errors.Is(err, ErrNoKey) {
+		t.Errorf("unexpected error = %v", err)
+	}
+
+	t.Setenv(env, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	s, err := plugin.NewStore("file", filepath.Join(dir, "readings.jsonl")+"?key_env="+env)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer s.Close()
+	f, ok := s.(*File)
+	if !ok {
+		t.Fatalf("unexpected store = %T", s)
+	}
+	if f.aead == nil {
+		t.Error("expected encryption")
+	}
+}
+
+func TestFileEraseDevice(t *testing.T) {
+	key := staticKey(bytes.Repeat([]byte{1}, 32))
+	path := filepath.Join(t.TempDir(), "readings.jsonl")
+	f, err := NewFile(path, WithEncryption(key))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer f.Close()
+	for _, imei := range []uint64{1, 2, 1, 3} {
+		f.StoreReading(imei, time.Now(), reading)
+	}
+
+	if erased, err := f.EraseDevice(1); err != nil || erased != 2 {
+		t.Fatalf("unexpected erased = %d, err = %v", erased, err)
+	}
+	if erased, err := f.EraseDevice(4); err != nil || erased != 0 {
+		t.Fatalf("unexpected erased = %d, err = %v", erased, err)
+	}
+	// Readings stored after an erasure are appended to the rewritten file.
+	f.StoreReading(4, time.Now(), reading)
+
+	records, err := ReadFile(path, WithEncryption(key))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	var imeis []uint64
+	for _, record := range records {
+		imeis = append(imeis, record.IMEI)
+	}
+	if len(imeis) != 3 || imeis[0] != 2 || imeis[1] != 3 || imeis[2] != 4 {
+		t.Errorf("unexpected IMEIs = %v", imeis)
+	}
+	if f.Failed() != 0 {
+		t.Errorf("unexpected failed = %d", f.Failed())
+	}
+}
+
+func TestFileEraseDeviceUndecodable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readings.jsonl")
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer f.Close()
+	f.StoreReading(1, time.Now(), reading)
+	f.mu.Lock()
+	f.file.Write([]byte("c2VhbGVk\n"))
+	f.mu.Unlock()
+	f.StoreReading(2, time.Now(), reading)
+	f.StoreReading(1, time.Now(), reading)
+
+	// The undecodable line is kept and reported, while the records of the
+	// device are erased regardless.
+	erased, err := f.EraseDevice(1)
+	if !errors.Is(err, ErrUndecodable) || erased != 2 {
+		t.Fatalf("unexpected erased = %d, err = %v", erased, err)
+	}
+	if !strings.Contains(err.Error(), "first = 2") {
+		t.Errorf("expected error to report line 2, actual = %s", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 || lines[0] != "c2VhbGVk" || !strings.Contains(lines[1], `"IMEI":2`) {
+		t.Errorf("unexpected lines = %q", lines)
+	}
+}
+
+func TestFileEraseDeviceConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readings.jsonl")
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	defer f.Close()
+	for i := 0; i < 1000; i++ {
+		f.StoreReading(uint64(i%2+1), time.Now(), reading)
+	}
+
+	// Readings stored while the file is rewritten are kept.
+	stored := make(chan struct{})
+	go func() {
+		defer close(stored)
+		for i := 0; i < 200; i++ {
+			f.StoreReading(3, time.Now(), reading)
+		}
+	}()
+	if erased, err := f.EraseDevice(1); err != nil || erased != 500 {
+		t.Fatalf("unexpected erased = %d, err = %v", erased, err)
+	}
+	<-stored
+
+	records, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	counts := make(map[uint64]int)
+	for _, record := range records {
+		counts[record.IMEI]++
+	}
+	if len(counts) != 2 || counts[2] != 500 || counts[3] != 200 {
+		t.Errorf("unexpected counts = %v", counts)
+	}
+}
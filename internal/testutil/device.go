@@ -0,0 +1,66 @@
+package testutil
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+// Device is a fake device connected to a server under test. Failures are
+// reported to the test the Device was dialed with.
+type Device struct {
+	net.Conn
+	t testing.TB
+}
+
+// Dial connects a Device to the server listening on port. The Device is
+// closed once the test completes.
+func Dial(t testing.TB, port int) *Device {
+	t.Helper()
+	conn, err := net.Dial("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatalf("unexpected error = %s\n", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &Device{Conn: conn, t: t}
+}
+
+// Send writes each message to the server.
+func (d *Device) Send(messages ...[]byte) {
+	d.t.Helper()
+	for _, message := range messages {
+		if _, err := d.Write(message); err != nil {
+			d.t.Errorf("unexpected error = %s\n", err)
+		}
+	}
+}
+
+// SendFrame writes a protocol v2 frame of type ft carrying payload to the
+// server.
+func (d *Device) SendFrame(ft client.FrameType, payload []byte) {
+	d.t.Helper()
+	d.Send(client.AppendFrame(nil, ft, payload))
+}
+
+// ReadFrame reads a protocol v2 frame sent by the server, waiting up to
+// timeout.
+func (d *Device) ReadFrame(timeout time.Duration) (client.FrameType, []byte) {
+	d.t.Helper()
+	if err := d.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		d.t.Fatalf("unexpected error = %s\n", err)
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(d, header); err != nil {
+		d.t.Fatalf("unexpected error = %s\n", err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(d, payload); err != nil {
+		d.t.Fatalf("unexpected error = %s\n", err)
+	}
+	return client.FrameType(header[0]), payload
+}
@@ -0,0 +1,172 @@
+// Package testutil provides helpers for writing integration tests against a
+// Thermomatic server: a concurrent safe log writer, golden file comparison,
+// device message builders, and a fake device.
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/tjper/thermomatic/internal/client"
+)
+
+// IMEI is the IMEI messages are built for, unless otherwise specified.
+const IMEI = "490154203237518"
+
+var golden = flag.Bool("golden", false, "overwrite *.golden files for golden file tests")
+
+// SafeWriter is a concurrent safe buffer, typically used to capture the logs
+// of a server under test.
+type SafeWriter struct {
+	sync.RWMutex
+	*bytes.Buffer
+}
+
+// NewSafeWriter initializes an empty SafeWriter.
+func NewSafeWriter() *SafeWriter {
+	return &SafeWriter{
+		Buffer: new(bytes.Buffer),
+	}
+}
+
+// Write satisfies the io.Writer interface.
+func (w *SafeWriter) Write(b []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.Buffer.Write(b)
+}
+
+// Bytes retrieves the bytes written.
+func (w *SafeWriter) Bytes() []byte {
+	w.RLock()
+	defer w.RUnlock()
+	return w.Buffer.Bytes()
+}
+
+// Golden compares actual to the golden file of the running test, located at
+// testdata/<test name>.golden. When tests are run with the -golden flag, the
+// golden file is overwritten with actual first.
+func Golden(t testing.TB, actual []byte) {
+	t.Helper()
+	file := "testdata/" + t.Name() + ".golden"
+	if *golden {
+		if err := ioutil.WriteFile(file, actual, 0644); err != nil {
+			t.Errorf("unexpected error = %s\n", err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Errorf("unexpected error = %s\n", err)
+	}
+
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("actual != expected\nexpected = %s\nactual = %s\n", expected, actual)
+	}
+}
+
+// Reading retrieves an encoded, valid reading message.
+func Reading(t testing.TB) []byte {
+	return encode(t, client.Reading{
+		Temperature:  67.77,
+		Altitude:     2.63555,
+		Latitude:     33.41,
+		Longitude:    44.4,
+		BatteryLevel: 0.25666,
+	})
+}
+
+// InvalidReading retrieves an encoded reading message that fails to decode,
+// as its temperature is out of range.
+func InvalidReading(t testing.TB) []byte {
+	return encode(t, client.Reading{
+		Temperature:  1000,
+		Altitude:     2.63555,
+		Latitude:     33.41,
+		Longitude:    44.4,
+		BatteryLevel: 0.25666,
+	})
+}
+
+func encode(t testing.TB, reading client.Reading) []byte {
+	t.Helper()
+	b, err := reading.Encode()
+	if err != nil {
+		t.Errorf("unexpected error = %s\n", err)
+	}
+	return b
+}
+
+// Login builds the login messages of a protocol v1 device.
+func Login(imei string) []byte {
+	return append([]byte(imei), "login"...)
+}
+
+// LoginV2 builds the login messages of a protocol v2 device.
+func LoginV2(imei string) []byte {
+	return append([]byte(imei), "logv2"...)
+}
+
+// LoginFirmware builds the login messages of a protocol v2 device reporting
+// its firmware version.
+func LoginFirmware(imei, firmware string) []byte {
+	b := append([]byte(imei), "logfw"...)
+	b = append(b, byte(len(firmware)))
+	return append(b, firmware...)
+}
+
+// GenerateIMEI generates the i-th of a series of valid IMEIs.
+func GenerateIMEI(i int) string {
+	b := []byte(fmt.Sprintf("%014d0", int64(49015420000000)+int64(i)))
+	var sum int
+	for j, c := range b[:14] {
+		digit := int(c - '0')
+		if j&1 == 1 {
+			if digit *= 2; digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+	b[14] = byte('0' + (10-sum%10)%10)
+	return string(b)
+}
+
+// Messages builds the messages of a protocol v1 device that logs in as IMEI,
+// and then sends the JSON encoded readings read from r.
+func Messages(t testing.TB, r io.Reader) [][]byte {
+	t.Helper()
+	var readings []client.Reading
+	if err := json.NewDecoder(r).Decode(&readings); err != nil {
+		t.Errorf("unexpected error = %s\n", err)
+	}
+
+	msgs := [][]byte{
+		[]byte(IMEI),
+		[]byte("login"),
+	}
+	for _, reading := range readings {
+		msgs = append(msgs, encode(t, reading))
+	}
+	return msgs
+}
+
+// MessagesFile builds the messages of Messages from the JSON encoded readings
+// in the file at path.
+func MessagesFile(t testing.TB, path string) [][]byte {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Errorf("unexpected error = %s\n", err)
+		return nil
+	}
+	defer f.Close()
+	return Messages(t, f)
+}
@@ -0,0 +1,29 @@
+package testutil
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tjper/thermomatic/internal/imei"
+)
+
+func TestGenerateIMEI(t *testing.T) {
+	seen := make(map[uint64]bool)
+	for i := 0; i < 1000; i++ {
+		code, err := imei.Decode([]byte(GenerateIMEI(i)))
+		if err != nil {
+			t.Fatalf("IMEI %d: unexpected error = %s\n", i, err)
+		}
+		if seen[code] {
+			t.Fatalf("IMEI %d: duplicate IMEI %d", i, code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestLoginFirmware(t *testing.T) {
+	expected := []byte("490154203237518logfw\x051.2.3")
+	if actual := LoginFirmware(IMEI, "1.2.3"); !bytes.Equal(expected, actual) {
+		t.Errorf("expected %q, actual = %q", expected, actual)
+	}
+}
@@ -0,0 +1,238 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// exporterQueueSize bounds the number of ended Spans awaiting export.
+	// Spans ended while the queue is full are dropped.
+	exporterQueueSize = 4096
+
+	// exporterBatchSize is the maximum number of Spans per export request.
+	exporterBatchSize = 512
+
+	// exporterInterval is the longest a Span waits in the queue.
+	exporterInterval = 5 * time.Second
+)
+
+// Exporter batches ended Spans and posts them to an OpenTelemetry collector's
+// OTLP/HTTP traces endpoint, e.g. "http://localhost:4318/v1/traces".
+type Exporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+
+	queue   chan *Span
+	dropped int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewExporter initializes an Exporter posting to endpoint, identifying spans
+// as originating from service. Run must be called to begin exporting.
+func NewExporter(endpoint, service string) *Exporter {
+	return &Exporter{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *Span, exporterQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Dropped retrieves the number of Spans dropped because the queue was full.
+func (e *Exporter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+// Run exports queued Spans in batches until Close is called.
+func (e *Exporter) Run() error {
+	defer close(e.done)
+
+	ticker := time.NewTicker(exporterInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, exporterBatchSize)
+	var lastErr error
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.post(batch); err != nil {
+			lastErr = err
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-e.stop:
+			for {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+					if len(batch) == exporterBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return lastErr
+				}
+			}
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) == exporterBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close stops Run after exporting all queued Spans.
+func (e *Exporter) Close() {
+	close(e.stop)
+	<-e.done
+}
+
+// export queues span for export, dropping it if the queue is full.
+func (e *Exporter) export(span *Span) {
+	if e == nil {
+		return
+	}
+	select {
+	case e.queue <- span:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+// post sends spans to the collector as an OTLP ExportTraceServiceRequest.
+func (e *Exporter) post(spans []*Span) error {
+	b, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return fmt.Errorf("failed to trace.post/Marshal\terr = %w", err)
+	}
+
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to trace.post/Post\terr = %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to trace.post\tstatus = %s", resp.Status)
+	}
+	return nil
+}
+
+// The following types mirror the OTLP/JSON encoding of an
+// ExportTraceServiceRequest.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              Kind            `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// OTLP status codes.
+const (
+	statusOK    = 1
+	statusError = 2
+)
+
+func (e *Exporter) request(spans []*Span) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        attributes(s.attrs),
+			Status:            otlpStatus{Code: statusOK},
+		}
+		if s.err != nil {
+			span.Status = otlpStatus{Code: statusError, Message: s.err.Error()}
+		}
+		s.mu.Unlock()
+		out = append(out, span)
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: attributes([]Attribute{String("service.name", e.service)}),
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: e.service},
+				Spans: out,
+			}},
+		}},
+	}
+}
+
+// attributes converts attrs to their OTLP/JSON AnyValue representation.
+func attributes(attrs []Attribute) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]interface{}
+		switch v := a.Value.(type) {
+		case string:
+			value = map[string]interface{}{"stringValue": v}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, otlpAttribute{Key: a.Key, Value: value})
+	}
+	return out
+}
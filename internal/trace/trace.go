@@ -0,0 +1,145 @@
+// Package trace implements a minimal tracer recording spans of the thermomatic
+// server's work, and exporting them to an OpenTelemetry collector using the
+// OTLP/HTTP JSON protocol.
+//
+// A nil *Tracer is valid and records nothing, so tracing may be left
+// unconfigured without guarding each call site.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Attribute is a key-value pair describing a Span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string Attribute.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int returns an integer Attribute.
+func Int(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Bool returns a boolean Attribute.
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Kind describes the relationship between a Span and its callers.
+type Kind int
+
+const (
+	// KindInternal denotes an internal operation.
+	KindInternal Kind = 1
+	// KindServer denotes the handling of a remote request.
+	KindServer Kind = 2
+)
+
+// Tracer starts Spans and hands them to its Exporter once they end.
+type Tracer struct {
+	exporter *Exporter
+}
+
+// New initializes a Tracer exporting ended Spans to exporter.
+func New(exporter *Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+type spanKey struct{}
+
+// Start starts a Span named name. If ctx carries a Span, the new Span is its
+// child. The returned context carries the new Span.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind, attrs ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		attrs:  attrs,
+		spanID: newID(8),
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok && parent != nil {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		span.traceID = newID(16)
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Span is a timed operation. All Span methods are safe to call on a nil Span.
+type Span struct {
+	tracer *Tracer
+
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	kind     Kind
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []Attribute
+	err   error
+	ended bool
+}
+
+// SetAttributes adds attrs to the Span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// RecordError marks the Span as failed with err. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// End ends the Span and hands it to the Tracer's Exporter. Calls after the
+// first have no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.exporter.export(s)
+}
+
+// newID returns a random, hex encoded identifier of n bytes.
+func newID(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
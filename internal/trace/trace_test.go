@@ -0,0 +1,63 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExporter(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("unexpected error = %s\n", err)
+		}
+		requests <- request
+	}))
+	defer collector.Close()
+
+	exporter := NewExporter(collector.URL, "thermomatic")
+	go exporter.Run()
+	tracer := New(exporter)
+
+	ctx, parent := tracer.Start(context.Background(), "connection", KindServer, Int("imei", 490154203237518))
+	_, child := tracer.Start(ctx, "login", KindInternal)
+	child.RecordError(errors.New("client unauthorized"))
+	child.End()
+	parent.End()
+	exporter.Close()
+
+	request := <-requests
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, actual = %d", len(spans))
+	}
+	login, connection := spans[0], spans[1]
+	if login.TraceID != connection.TraceID {
+		t.Errorf("expected child to share trace ID, %s != %s", login.TraceID, connection.TraceID)
+	}
+	if login.ParentSpanID != connection.SpanID {
+		t.Errorf("expected child parent = %s, actual = %s", connection.SpanID, login.ParentSpanID)
+	}
+	if login.Status.Code != statusError {
+		t.Errorf("expected child status = %d, actual = %d", statusError, login.Status.Code)
+	}
+	if connection.Attributes[0].Value["intValue"] != "490154203237518" {
+		t.Errorf("unexpected attributes = %v", connection.Attributes)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "reading", KindInternal)
+	if ctx != context.Background() {
+		t.Errorf("expected context to be unchanged")
+	}
+	span.SetAttributes(String("key", "value"))
+	span.RecordError(errors.New("failure"))
+	span.End()
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/tjper/thermomatic/internal/server"
+
+	// Register the store plugins.
+	_ "github.com/tjper/thermomatic/internal/store"
 )
 
 // addr is the default TCP listening port
@@ -15,19 +23,199 @@ const addr = 1337
 // httpAddr is the default HTTP listening port
 const httpAddr = 1338
 
+// soak is the interval runtime stats are logged at, for soak tests. Zero
+// disables them.
+var soak = flag.Duration("soak", 0, "interval to log runtime stats at during soak tests")
+
+// presence is the file device presence is kept in across restarts. Empty
+// keeps presence in memory only.
+var presence = flag.String("presence", "", "file to keep device presence in across restarts")
+
+// alertRules is the file alert rules are kept in across restarts. Empty keeps
+// alert rules in memory only.
+var alertRules = flag.String("alert-rules", "", "file to keep alert rules in across restarts")
+
+// alertHistory is the file fired and resolved alerts are appended to. Empty
+// keeps the alert history in memory only.
+var alertHistory = flag.String("alert-history", "", "file to append fired and resolved alerts to")
+
+// deviceOverrides is the file per-device overrides are kept in across
+// restarts. Empty keeps overrides in memory only.
+var deviceOverrides = flag.String("device-overrides", "", "file to keep per-device overrides in across restarts")
+
+// featureFlags is a JSON file of the feature flags to enable or disable. Empty
+// enables every feature flag.
+var featureFlags = flag.String("feature-flags", "", "JSON file of feature flags to enable or disable")
+
+// adminToken is the bearer token required of http requests. Empty leaves the
+// http server open.
+var adminToken = flag.String("admin-token", "", "bearer token required of http requests")
+
+// logRateLimit is the interval repeated errors and warnings are collapsed
+// over. Zero writes every message.
+var logRateLimit = flag.Duration("log-rate-limit", 0, "interval to collapse repeated errors and warnings over, e.g. 10s; 0 writes every message")
+
+// sessionGrace is how long the session of a disconnected device is kept for
+// it to resume. Zero starts every connection fresh.
+var sessionGrace = flag.Duration("session-grace", 0, "how long the session of a disconnected device is kept for it to resume by reconnecting, e.g. 30s; 0 starts every connection fresh")
+
+// idleEviction is how long a logged in device may go without sending a
+// reading before it is disconnected. Zero disables eviction.
+var idleEviction = flag.Duration("idle-eviction", 0, "how long a logged in device may go without sending a reading before it is disconnected, e.g. 10m; 0 disables eviction")
+
+// peers are the comma separated base URLs of the http servers of the other
+// nodes of a multi-instance deployment.
+var peers = flag.String("peers", "", "comma separated base URLs of the http servers of the other nodes, e.g. http://10.0.0.2:1338, to look up devices connected to them")
+
+// trackHolders enables counting Holders, reported by the diagnostics
+// endpoint.
+var trackHolders = flag.Bool("track-holders", false, "count holders, reported by /admin/diagnostics, to detect leaks; slows garbage collection")
+
+// httpReadOnly disables the administrative and state changing http endpoints.
+var httpReadOnly = flag.Bool("http-read-only", false, "reject administrative and state changing http requests with a 403")
+
+// pluginFlag is a repeatable flag naming a registered plugin and its
+// configuration, as name=config.
+type pluginFlag [][2]string
+
+// String satisfies the flag.Value interface.
+func (f *pluginFlag) String() string {
+	names := make([]string, 0, len(*f))
+	for _, p := range *f {
+		names = append(names, p[0]+"="+p[1])
+	}
+	return strings.Join(names, ",")
+}
+
+// Set satisfies the flag.Value interface.
+func (f *pluginFlag) Set(s string) error {
+	name, config, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=config, actual = %q", s)
+	}
+	*f = append(*f, [2]string{name, config})
+	return nil
+}
+
+// stores, exporters, and authenticators are the plugins the server is
+// configured with. dryRunExporters are exporters logging what they would
+// send rather than sending it. anonymizedExporters are exporters replacing
+// IMEIs with pseudonyms and rounding positions. criticalExporters are
+// exporters the server is not ready without.
+var stores, exporters, dryRunExporters, anonymizedExporters, criticalExporters, authenticators pluginFlag
+
+// criticalDownFor is how long a critical exporter may fail to send readings
+// before the server reports it is not ready.
+var criticalDownFor = flag.Duration("critical-down-for", time.Minute, "how long a critical exporter may fail to send readings before the server reports it is not ready")
+
+// anonymizeKey is the secret anonymized exporters derive IMEI pseudonyms
+// with. It defaults to the THERMOMATIC_ANONYMIZE_KEY environment variable.
+var anonymizeKey = flag.String("anonymize-key", os.Getenv("THERMOMATIC_ANONYMIZE_KEY"), "secret anonymized exporters derive IMEI pseudonyms with (env THERMOMATIC_ANONYMIZE_KEY)")
+
+// anonymizePrecision is the number of decimal places anonymized exporters
+// round latitudes and longitudes to.
+var anonymizePrecision = flag.Int("anonymize-precision", 2, "decimal places anonymized exporters round latitudes and longitudes to")
+
+// geocoder is the plugin the server resolves device positions to places
+// with. Empty disables geocoding.
+var geocoder = flag.String("geocoder", "", "reverse geocoder plugin, as name=config")
+
+func init() {
+	flag.Var(&stores, "store", "reading store plugin, as name=config; repeatable")
+	flag.Var(&exporters, "exporter", "reading exporter plugin, as name=config; repeatable")
+	flag.Var(&dryRunExporters, "exporter-dry-run", "reading exporter plugin logging what it would send instead of sending it, as name=config; repeatable")
+	flag.Var(&anonymizedExporters, "exporter-anonymized", "reading exporter plugin replacing IMEIs with pseudonyms and rounding positions, as name=config; repeatable")
+	flag.Var(&criticalExporters, "exporter-critical", "reading exporter plugin the server is not ready without once down for -critical-down-for, as name=config; repeatable")
+	flag.Var(&authenticators, "authenticator", "http bearer token authenticator plugin, as name=config; repeatable")
+}
+
 func main() {
-	svr, err := server.New(
-		addr,
+	flag.Parse()
+
+	options := []server.ServerOption{
 		server.WithHttpServer(httpAddr),
-	)
+	}
+	if *soak > 0 {
+		options = append(options, server.WithSoak(*soak))
+	}
+	if *presence != "" {
+		options = append(options, server.WithPresenceFile(*presence))
+	}
+	if *alertRules != "" {
+		options = append(options, server.WithAlertRulesFile(*alertRules))
+	}
+	if *alertHistory != "" {
+		options = append(options, server.WithAlertHistoryFile(*alertHistory))
+	}
+	if *deviceOverrides != "" {
+		options = append(options, server.WithDeviceOverridesFile(*deviceOverrides))
+	}
+	if *featureFlags != "" {
+		options = append(options, server.WithFeatureFlags(*featureFlags))
+	}
+	if *adminToken != "" {
+		options = append(options, server.WithAdminToken(*adminToken))
+	}
+	if *logRateLimit > 0 {
+		options = append(options, server.WithLogRateLimit(*logRateLimit))
+	}
+	if *peers != "" {
+		options = append(options, server.WithPeers(strings.Split(*peers, ",")...))
+	}
+	if *sessionGrace > 0 {
+		options = append(options, server.WithSessionResumption(*sessionGrace))
+	}
+	if *idleEviction > 0 {
+		options = append(options, server.WithIdleEviction(*idleEviction))
+	}
+	if *httpReadOnly {
+		options = append(options, server.WithHttpReadOnly())
+	}
+	if *trackHolders {
+		options = append(options, server.WithHolderTracking())
+	}
+	for _, p := range stores {
+		options = append(options, server.WithStore(p[0], p[1]))
+	}
+	for _, p := range exporters {
+		options = append(options, server.WithExporter(p[0], p[1]))
+	}
+	for _, p := range dryRunExporters {
+		options = append(options, server.WithExporterDryRun(p[0], p[1]))
+	}
+	for _, p := range anonymizedExporters {
+		options = append(options, server.WithExporterAnonymized(p[0], p[1], []byte(*anonymizeKey), *anonymizePrecision))
+	}
+	for _, p := range criticalExporters {
+		options = append(options, server.WithCriticalExporter(p[0], p[1], *criticalDownFor))
+	}
+	for _, p := range authenticators {
+		options = append(options, server.WithAuthenticator(p[0], p[1]))
+	}
+	if *geocoder != "" {
+		var p pluginFlag
+		if err := p.Set(*geocoder); err != nil {
+			log.Fatal(err)
+		}
+		options = append(options, server.WithGeocoder(p[0][0], p[0][1]))
+	}
+	svr, err := server.New(addr, options...)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer svr.Shutdown()
 
-	go svr.ListenAndServe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- svr.ListenAndServe(context.Background())
+	}()
 
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	log.Println(<-ch)
+	select {
+	case sig := <-ch:
+		log.Println(sig)
+	case err := <-errs:
+		log.Println(err)
+	}
 }